@@ -0,0 +1,937 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxBatchItems       = 1000     // Most generations one batch may hold
+	maxBatchConcurrency = 16       // Most items of a batch queued or running at once
+	maxBatchBodyBytes   = 10 << 20 // Largest manifest upload
+	maxSitemapBytes     = 10 << 20 // Largest sitemap, after decompression
+	maxSitemapFetches   = 20       // Most sitemaps read through a sitemap index
+	sitemapFetchTimeout = 30 * time.Second
+)
+
+// Manifest formats a batch can be read from
+const (
+	ManifestCSV     = "csv"     // Header row of parameter names, one generation per row
+	ManifestJSONL   = "jsonl"   // One /api/generate JSON object per line
+	ManifestSitemap = "sitemap" // sitemap.xml or a sitemap index; one generation per page
+	ManifestJSON    = "json"    // The items of a JSON BatchRequest
+)
+
+// Batch is a set of generations submitted together. Its items are
+// generations that carry the batch ID.
+type Batch struct {
+	ID          string         `json:"id"`
+	Source      string         `json:"source"` // Manifest format the items were read from
+	Status      string         `json:"status"` // running, completed, partial (some items failed) or failed
+	Total       int            `json:"total"`
+	Concurrency int            `json:"concurrency"`
+	CreatedAt   time.Time      `json:"created_at"`
+	CompletedAt *time.Time     `json:"completed_at,omitempty"`
+	Counts      map[string]int `json:"counts"` // Items per status
+	Items       []BatchItem    `json:"items"`
+	ManifestURL string         `json:"manifest_url,omitempty"`
+	ZipURL      string         `json:"zip_url,omitempty"`
+	CallbackURL string         `json:"callback_url,omitempty"` // Webhook notified when the batch finishes
+
+	ManifestPath  string `json:"-"`
+	ZipPath       string `json:"-"`
+	WebhookClient string `json:"-"` // Client whose secret signs the batch's webhook
+}
+
+// BatchItem is one generation of a batch
+type BatchItem struct {
+	Index    int      `json:"index"`
+	ID       string   `json:"id"`
+	URL      string   `json:"url,omitempty"`
+	Title    string   `json:"title,omitempty"`
+	Status   string   `json:"status"`
+	Error    string   `json:"error,omitempty"`
+	ImageURL string   `json:"image_url,omitempty"`
+	Files    []string `json:"files,omitempty"` // Output files, relative to the batch zip
+
+	TextFit []TextFit `json:"text_fit,omitempty"` // How card text was fitted, for template generations
+
+	ImagePath string `json:"-"`
+	HTMLPath  string `json:"-"`
+}
+
+// BatchRequest is the JSON body of POST /api/batch. Either items or a
+// sitemap URL is given.
+type BatchRequest struct {
+	Items       []json.RawMessage `json:"items,omitempty"`        // Generation requests, as sent to /api/generate
+	SitemapURL  string            `json:"sitemap_url,omitempty"`  // Generate a card for every page of the sitemap
+	Defaults    json.RawMessage   `json:"defaults,omitempty"`     // Fields applied to every item that doesn't set them
+	Concurrency int               `json:"concurrency,omitempty"`  // Items queued or running at once
+	CallbackURL string            `json:"callback_url,omitempty"` // Webhook notified when the batch finishes
+}
+
+// batchInput is a decoded batch submission
+type batchInput struct {
+	Source      string
+	Params      []GenerationParameters
+	Concurrency int
+	CallbackURL string
+}
+
+// manifestFormat picks the manifest format from a file name
+func manifestFormat(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".gz")
+	switch filepath.Ext(name) {
+	case ".csv":
+		return ManifestCSV
+	case ".jsonl", ".ndjson":
+		return ManifestJSONL
+	case ".xml":
+		return ManifestSitemap
+	}
+	return ""
+}
+
+// manifestMediaFormat picks the manifest format from a content type
+func manifestMediaFormat(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/csv":
+		return ManifestCSV
+	case "application/x-ndjson", "application/jsonl", "application/x-jsonlines":
+		return ManifestJSONL
+	case "application/xml", "text/xml":
+		return ManifestSitemap
+	}
+	return ""
+}
+
+// parseManifest reads the generations of a manifest. Sitemap indexes are
+// followed with client. Every rejected field is reported as
+// items[i].field, counting items from 0.
+func parseManifest(ctx context.Context, client *http.Client, format string, r io.Reader) ([]GenerationParameters, error) {
+	switch format {
+	case ManifestCSV:
+		return parseCSVManifest(r)
+	case ManifestJSONL:
+		items, err := splitJSONLines(r)
+		if err != nil {
+			return nil, err
+		}
+		return decodeBatchItems(items, nil)
+	case ManifestSitemap:
+		data, err := readSitemapData(r)
+		if err != nil {
+			return nil, err
+		}
+		fetched := 0
+		pages, err := readSitemap(ctx, client, data, &fetched)
+		if err != nil {
+			return nil, err
+		}
+		return decodeBatchItems(sitemapItems(pages), nil)
+	}
+	return nil, fmt.Errorf("unknown manifest format %q", format)
+}
+
+// parseCSVManifest reads a CSV manifest. The header row names the
+// parameters, using the same keys as the /api/generate form; empty cells
+// are left unset.
+func parseCSVManifest(r io.Reader) ([]GenerationParameters, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, &ValidationError{Fields: []FieldError{{Field: "manifest", Message: err.Error()}}}
+	}
+	if len(rows) < 2 {
+		return nil, &ValidationError{Fields: []FieldError{{Field: "manifest", Message: "needs a header row and at least one item"}}}
+	}
+	if len(rows)-1 > maxBatchItems {
+		return nil, batchSizeError(len(rows) - 1)
+	}
+
+	header := rows[0]
+	for i := range header {
+		header[i] = strings.TrimSpace(strings.TrimPrefix(header[i], "\ufeff"))
+	}
+
+	var params []GenerationParameters
+	var errs []FieldError
+	for i, row := range rows[1:] {
+		form := url.Values{}
+		for col, value := range row {
+			if value = strings.TrimSpace(value); value != "" && header[col] != "" {
+				form.Add(header[col], value)
+			}
+		}
+		if err := validateForm(form); err != nil {
+			errs = append(errs, itemErrors(i, err)...)
+			continue
+		}
+		params = append(params, parametersFromForm(form))
+	}
+	if len(errs) > 0 {
+		return nil, &ValidationError{Fields: errs}
+	}
+	return params, nil
+}
+
+// splitJSONLines returns the non-blank lines of a JSON Lines manifest
+func splitJSONLines(r io.Reader) ([]json.RawMessage, error) {
+	var items []json.RawMessage
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), maxGenerateBodyBytes)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if len(items) == maxBatchItems {
+			return nil, batchSizeError(maxBatchItems + 1)
+		}
+		items = append(items, json.RawMessage(append([]byte(nil), line...)))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &ValidationError{Fields: []FieldError{{Field: "manifest", Message: err.Error()}}}
+	}
+	return items, nil
+}
+
+// decodeBatchItems decodes each item as a /api/generate JSON request, after
+// filling in the defaults it doesn't set
+func decodeBatchItems(items []json.RawMessage, defaults json.RawMessage) ([]GenerationParameters, error) {
+	if len(items) == 0 {
+		return nil, &ValidationError{Fields: []FieldError{{Field: "items", Message: "a batch needs at least one item"}}}
+	}
+	if len(items) > maxBatchItems {
+		return nil, batchSizeError(len(items))
+	}
+
+	var base map[string]json.RawMessage
+	if len(defaults) > 0 {
+		if err := json.Unmarshal(defaults, &base); err != nil {
+			return nil, &ValidationError{Fields: []FieldError{{Field: "defaults", Message: "must be a JSON object"}}}
+		}
+	}
+
+	var params []GenerationParameters
+	var errs []FieldError
+	for i, item := range items {
+		if len(base) > 0 {
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(item, &fields); err == nil && fields != nil {
+				for key, value := range base {
+					if _, ok := fields[key]; !ok {
+						fields[key] = value
+					}
+				}
+				item, _ = json.Marshal(fields)
+			}
+		}
+
+		req, err := decodeGenerateRequest(bytes.NewReader(item))
+		if err != nil {
+			errs = append(errs, itemErrors(i, err)...)
+			continue
+		}
+		params = append(params, req.Parameters())
+	}
+	if len(errs) > 0 {
+		return nil, &ValidationError{Fields: errs}
+	}
+	return params, nil
+}
+
+// itemErrors reports a rejected item's fields under items[i]
+func itemErrors(i int, err error) []FieldError {
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		return []FieldError{{Field: fmt.Sprintf("items[%d]", i), Message: err.Error()}}
+	}
+	fields := make([]FieldError, len(validationErr.Fields))
+	for j, f := range validationErr.Fields {
+		fields[j] = FieldError{Field: fmt.Sprintf("items[%d].%s", i, f.Field), Message: f.Message}
+	}
+	return fields
+}
+
+// batchSizeError rejects a batch with too many items
+func batchSizeError(n int) error {
+	return &ValidationError{Fields: []FieldError{{Field: "items", Message: fmt.Sprintf("a batch holds at most %d items, got %d", maxBatchItems, n)}}}
+}
+
+// sitemapDocument is a sitemap (urlset) or a sitemap index
+type sitemapDocument struct {
+	XMLName  xml.Name
+	URLs     []sitemapLocation `xml:"url"`
+	Sitemaps []sitemapLocation `xml:"sitemap"`
+}
+
+type sitemapLocation struct {
+	Loc string `xml:"loc"`
+}
+
+// sitemapItems turns sitemap pages into generation requests
+func sitemapItems(pages []string) []json.RawMessage {
+	items := make([]json.RawMessage, len(pages))
+	for i, page := range pages {
+		items[i], _ = json.Marshal(map[string]string{"url": page})
+	}
+	return items
+}
+
+// fetchSitemap downloads a sitemap, or a sitemap index and the sitemaps it
+// lists, and returns the pages in it
+func fetchSitemap(ctx context.Context, client *http.Client, sitemapURL string) ([]string, error) {
+	fetched := 0
+	data, err := downloadSitemap(ctx, client, sitemapURL, &fetched)
+	if err != nil {
+		return nil, err
+	}
+	return readSitemap(ctx, client, data, &fetched)
+}
+
+// downloadSitemap fetches one sitemap, counting it towards the fetch limit
+func downloadSitemap(ctx context.Context, client *http.Client, sitemapURL string, fetched *int) ([]byte, error) {
+	if *fetched >= maxSitemapFetches {
+		return nil, fmt.Errorf("sitemap index lists more than %d sitemaps", maxSitemapFetches)
+	}
+	*fetched++
+
+	normalized, err := normalizeURL(sitemapURL)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, normalized, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch sitemap %s: %w", normalized, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch sitemap %s: %s", normalized, resp.Status)
+	}
+	return readSitemapData(resp.Body)
+}
+
+// readSitemapData reads a sitemap, decompressing it if it is gzipped
+func readSitemapData(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxSitemapBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 1 && data[0] == 0x1f && data[1] == 0x8b {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzipped sitemap: %w", err)
+		}
+		if data, err = io.ReadAll(io.LimitReader(zr, maxSitemapBytes+1)); err != nil {
+			return nil, fmt.Errorf("invalid gzipped sitemap: %w", err)
+		}
+	}
+	if len(data) > maxSitemapBytes {
+		return nil, fmt.Errorf("sitemap is larger than %d bytes", maxSitemapBytes)
+	}
+	return data, nil
+}
+
+// readSitemap returns the pages of a sitemap. The sitemaps of an index are
+// fetched with client; nested indexes are not followed.
+func readSitemap(ctx context.Context, client *http.Client, data []byte, fetched *int) ([]string, error) {
+	doc, err := parseSitemap(data)
+	if err != nil {
+		return nil, err
+	}
+	if doc.XMLName.Local == "urlset" {
+		return sitemapPages(nil, doc.URLs)
+	}
+
+	if client == nil {
+		return nil, errors.New("sitemap indexes can only be read from a URL")
+	}
+	var pages []string
+	for _, child := range doc.Sitemaps {
+		if strings.TrimSpace(child.Loc) == "" {
+			continue
+		}
+		data, err := downloadSitemap(ctx, client, strings.TrimSpace(child.Loc), fetched)
+		if err != nil {
+			return nil, err
+		}
+		childDoc, err := parseSitemap(data)
+		if err != nil {
+			return nil, err
+		}
+		if childDoc.XMLName.Local != "urlset" {
+			return nil, fmt.Errorf("sitemap %s is not a urlset", child.Loc)
+		}
+		if pages, err = sitemapPages(pages, childDoc.URLs); err != nil {
+			return nil, err
+		}
+	}
+	return pages, nil
+}
+
+// parseSitemap decodes a urlset or sitemapindex document
+func parseSitemap(data []byte) (*sitemapDocument, error) {
+	var doc sitemapDocument
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid sitemap: %w", err)
+	}
+	switch doc.XMLName.Local {
+	case "urlset", "sitemapindex":
+		return &doc, nil
+	}
+	return nil, fmt.Errorf("invalid sitemap: unexpected <%s> element", doc.XMLName.Local)
+}
+
+// sitemapPages appends the pages of a urlset, skipping duplicates
+func sitemapPages(pages []string, urls []sitemapLocation) ([]string, error) {
+	seen := make(map[string]bool, len(pages))
+	for _, page := range pages {
+		seen[page] = true
+	}
+	for _, u := range urls {
+		loc := strings.TrimSpace(u.Loc)
+		if loc == "" || seen[loc] {
+			continue
+		}
+		if len(pages) == maxBatchItems {
+			return nil, batchSizeError(maxBatchItems + 1)
+		}
+		seen[loc] = true
+		pages = append(pages, loc)
+	}
+	if len(pages) == 0 {
+		return nil, errors.New("sitemap lists no pages")
+	}
+	return pages, nil
+}
+
+// runBatch submits jobs to queue, keeping at most concurrency of them
+// queued or running at once. A job the queue is too full for is retried
+// once it has room; one that cannot be submitted at all fails. finished
+// is called, from the job's own goroutine, as each job ends. runBatch
+// returns once every job has finished; cancelling ctx fails the jobs not
+// yet submitted.
+func runBatch(ctx context.Context, queue *JobQueue, jobs []*Job, concurrency int, finished func(i int, job *Job)) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, job := range jobs {
+		var err error
+		select {
+		case slots <- struct{}{}:
+			if err = submitWhenRoom(ctx, queue, job); err != nil {
+				<-slots
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			job.fail(err)
+			finished(i, job)
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, job *Job) {
+			defer wg.Done()
+			<-job.Done()
+			<-slots
+			finished(i, job)
+		}(i, job)
+	}
+	wg.Wait()
+}
+
+// submitWhenRoom submits a job, waiting for room while the queue is full
+func submitWhenRoom(ctx context.Context, queue *JobQueue, job *Job) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := queue.Submit(job)
+		if !errors.Is(err, ErrQueueFull) {
+			return err
+		}
+		select {
+		case <-time.After(queue.RetryAfter()):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// batchItemStatus is the status of a finished job's item
+func batchItemStatus(job *Job) (string, string) {
+	if _, err := job.Result(); err != nil {
+		return "failed", err.Error()
+	}
+	return "completed", ""
+}
+
+// countItems counts the items of a batch per status
+func (b *Batch) countItems() {
+	b.Counts = make(map[string]int)
+	for _, item := range b.Items {
+		b.Counts[item.Status]++
+	}
+}
+
+// finalStatus is the status of a batch whose items have all finished
+func (b *Batch) finalStatus() string {
+	switch {
+	case b.Counts["failed"] == 0:
+		return "completed"
+	case b.Counts["completed"] == 0:
+		return "failed"
+	}
+	return "partial"
+}
+
+// writeBatchArchive writes the manifest of a finished batch to dir as
+// <name>_manifest.json, and a <name>.zip holding the manifest and the
+// files of every completed item. Files are listed relative to dir.
+func writeBatchArchive(b *Batch, dir, name string) error {
+	for i := range b.Items {
+		item := &b.Items[i]
+		item.Files = nil
+		if item.Status != "completed" {
+			continue
+		}
+		for _, file := range generationFiles(item.ImagePath, item.HTMLPath) {
+			if _, err := os.Stat(filepath.Join(dir, file)); err == nil {
+				item.Files = append(item.Files, file)
+			}
+		}
+	}
+
+	manifest, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	manifestPath := filepath.Join(dir, name+"_manifest.json")
+	if err := os.WriteFile(manifestPath, manifest, 0644); err != nil {
+		return fmt.Errorf("failed to write batch manifest: %w", err)
+	}
+
+	zipPath := filepath.Join(dir, name+".zip")
+	if err := writeBatchZip(zipPath, dir, manifest, b.Items); err != nil {
+		os.Remove(zipPath)
+		return fmt.Errorf("failed to write batch zip: %w", err)
+	}
+
+	b.ManifestPath, b.ZipPath = manifestPath, zipPath
+	return nil
+}
+
+// writeBatchZip writes the zip of a batch's manifest and item files
+func writeBatchZip(path, dir string, manifest []byte, items []BatchItem) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	w, err := zw.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(manifest); err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		for _, file := range item.Files {
+			if err := addZipFile(zw, filepath.Join(dir, file), file); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// addZipFile copies a file into a zip under name
+func addZipFile(zw *zip.Writer, path, name string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+
+	dst, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// decodeBatchRequest reads a batch submission: a JSON BatchRequest, a
+// multipart upload of a "manifest" file, or a CSV, JSON Lines or sitemap
+// manifest sent as the body. Outside JSON, concurrency and callback_url
+// come from the query string or form.
+func decodeBatchRequest(w http.ResponseWriter, r *http.Request) (batchInput, error) {
+	input, err := readBatchRequest(w, r)
+	if err == nil && input.CallbackURL != "" && !isAbsoluteHTTPURL(input.CallbackURL) {
+		err = &ValidationError{Fields: []FieldError{{Field: "callback_url", Message: "must be an absolute http or https URL"}}}
+	}
+	return input, err
+}
+
+// readBatchRequest decodes a batch submission in any of its formats
+func readBatchRequest(w http.ResponseWriter, r *http.Request) (batchInput, error) {
+	var input batchInput
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchBodyBytes)
+
+	ctx, cancel := context.WithTimeout(r.Context(), sitemapFetchTimeout)
+	defer cancel()
+	client := generator.httpClient()
+
+	bodyError := func(err error) error {
+		return &ValidationError{Fields: []FieldError{{Field: "body", Message: err.Error()}}}
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var err error
+	switch {
+	case isJSONRequest(r):
+		var req BatchRequest
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			return input, bodyError(err)
+		}
+		input.Concurrency = req.Concurrency
+		input.CallbackURL = req.CallbackURL
+
+		switch {
+		case len(req.Items) > 0 && req.SitemapURL != "":
+			return input, &ValidationError{Fields: []FieldError{{Field: "sitemap_url", Message: "give either items or a sitemap_url"}}}
+		case req.SitemapURL != "":
+			input.Source = ManifestSitemap
+			pages, err := fetchSitemap(ctx, client, req.SitemapURL)
+			if err != nil {
+				var validationErr *ValidationError
+				if !errors.As(err, &validationErr) {
+					err = &ValidationError{Fields: []FieldError{{Field: "sitemap_url", Message: err.Error()}}}
+				}
+				return input, err
+			}
+			input.Params, err = decodeBatchItems(sitemapItems(pages), req.Defaults)
+		default:
+			input.Source = ManifestJSON
+			input.Params, err = decodeBatchItems(req.Items, req.Defaults)
+		}
+		return input, err
+
+	case mediaType == "multipart/form-data":
+		if err := r.ParseMultipartForm(maxBatchBodyBytes); err != nil {
+			return input, bodyError(err)
+		}
+		file, header, err := r.FormFile("manifest")
+		if err != nil {
+			return input, &ValidationError{Fields: []FieldError{{Field: "manifest", Message: "a manifest file is required"}}}
+		}
+		defer file.Close()
+
+		input.Source = firstNonEmpty(r.FormValue("format"), manifestFormat(header.Filename))
+		input.CallbackURL = r.FormValue("callback_url")
+		if input.Concurrency, err = batchConcurrencyValue(r.FormValue("concurrency")); err != nil {
+			return input, err
+		}
+		input.Params, err = parseBatchManifest(ctx, client, input.Source, file)
+		return input, err
+
+	default:
+		input.Source = manifestMediaFormat(r.Header.Get("Content-Type"))
+		if input.Source == "" {
+			return input, &ValidationError{Fields: []FieldError{{Field: "body", Message: "send JSON, multipart/form-data, text/csv, application/x-ndjson or application/xml"}}}
+		}
+		if input.Concurrency, err = batchConcurrencyValue(r.URL.Query().Get("concurrency")); err != nil {
+			return input, err
+		}
+		input.CallbackURL = r.URL.Query().Get("callback_url")
+		input.Params, err = parseBatchManifest(ctx, client, input.Source, r.Body)
+		return input, err
+	}
+}
+
+// parseBatchManifest parses an uploaded manifest, reporting problems with
+// the manifest itself as field errors
+func parseBatchManifest(ctx context.Context, client *http.Client, format string, r io.Reader) ([]GenerationParameters, error) {
+	if format != ManifestCSV && format != ManifestJSONL && format != ManifestSitemap {
+		return nil, &ValidationError{Fields: []FieldError{{Field: "format", Message: "must be csv, jsonl or sitemap"}}}
+	}
+	params, err := parseManifest(ctx, client, format, r)
+	if err != nil {
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			err = &ValidationError{Fields: []FieldError{{Field: "manifest", Message: err.Error()}}}
+		}
+		return nil, err
+	}
+	return params, nil
+}
+
+// batchConcurrencyValue parses the concurrency of a manifest upload
+func batchConcurrencyValue(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, &ValidationError{Fields: []FieldError{{Field: "concurrency", Message: "must be an integer"}}}
+	}
+	return n, nil
+}
+
+// batchConcurrency checks a requested concurrency, defaulting to the
+// number of queue workers
+func batchConcurrency(requested int) (int, error) {
+	switch {
+	case requested == 0:
+		return max(1, min(config.QueueWorkers, maxBatchConcurrency)), nil
+	case requested < 0 || requested > maxBatchConcurrency:
+		return 0, &ValidationError{Fields: []FieldError{{Field: "concurrency", Message: fmt.Sprintf("must be between 1 and %d", maxBatchConcurrency)}}}
+	}
+	return requested, nil
+}
+
+// handleBatchRequest queues a batch of generations. The batch runs in the
+// background; its status URL lists the progress of every item and, once
+// it has finished, the manifest and zip.
+func handleBatchRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if jobQueue == nil {
+		sendErrorResponse(w, "Generation queue is not running", http.StatusServiceUnavailable)
+		return
+	}
+	if db == nil {
+		sendErrorResponse(w, "Batches need the database, which is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	input, err := decodeBatchRequest(w, r)
+	if err != nil {
+		log.Printf("Rejecting batch request: %v", err)
+		sendValidationError(w, err)
+		return
+	}
+	concurrency, err := batchConcurrency(input.Concurrency)
+	if err != nil {
+		sendValidationError(w, err)
+		return
+	}
+	client, err := callbackClient(r, input.CallbackURL)
+	if err != nil {
+		sendValidationError(w, err)
+		return
+	}
+
+	batch := &Batch{
+		ID:          generateRequestID(),
+		Source:      input.Source,
+		Status:      "running",
+		Total:       len(input.Params),
+		Concurrency: concurrency,
+		CreatedAt:   time.Now().UTC(),
+		CallbackURL: input.CallbackURL,
+	}
+	if client != nil {
+		batch.WebhookClient = client.Name
+	}
+
+	var generations []*Generation
+	var errs []FieldError
+	for i := range input.Params {
+		// The batch sends one webhook for all of its items
+		if input.Params[i].CallbackURL != "" {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("items[%d].callback_url", i), Message: "set callback_url on the batch instead"})
+			continue
+		}
+		generation, err := newGeneration(generateRequestID(), &input.Params[i], r)
+		if err != nil {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("items[%d].format", i), Message: err.Error()})
+			continue
+		}
+		generation.BatchID = batch.ID
+		generation.BatchIndex = i
+		generations = append(generations, generation)
+	}
+	if len(errs) > 0 {
+		sendValidationError(w, &ValidationError{Fields: errs})
+		return
+	}
+
+	if err := os.MkdirAll(config.OutputDir, 0755); err != nil {
+		log.Printf("Error creating output directory: %v", err)
+		sendErrorResponse(w, "Failed to create output directory", http.StatusInternalServerError)
+		return
+	}
+	if err := db.SaveBatch(batch); err != nil {
+		log.Printf("Error saving batch %s: %v", batch.ID, err)
+		sendErrorResponse(w, "Failed to save batch", http.StatusInternalServerError)
+		return
+	}
+
+	jobs := make([]*Job, len(generations))
+	for i, generation := range generations {
+		if err := db.SaveGeneration(generation); err != nil {
+			log.Printf("Error saving generation record: %v", err)
+		}
+		jobs[i] = NewJob(generation.ID, input.Params[i], generation.ImagePath, generation.HTMLPath)
+		batch.Items = append(batch.Items, BatchItem{
+			Index:  i,
+			ID:     generation.ID,
+			URL:    input.Params[i].WebpageURL,
+			Title:  generation.Title,
+			Status: generation.Status,
+		})
+	}
+	batch.countItems()
+
+	log.Printf("Queued batch %s with %d items from %s", batch.ID, batch.Total, batch.Source)
+	go processBatch(batch.ID, jobQueue, jobs, concurrency)
+
+	statusURL := fmt.Sprintf("%s/api/batch/%s", config.BaseURL, batch.ID)
+	w.Header().Set("Location", statusURL)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":    true,
+		"status_url": statusURL,
+		"data":       batch,
+	})
+}
+
+// processBatch runs a batch's jobs, then writes its manifest and zip
+func processBatch(id string, queue *JobQueue, jobs []*Job, concurrency int) {
+	runBatch(context.Background(), queue, jobs, concurrency, func(i int, job *Job) {
+		// Covers jobs that never reached processGenerationJob
+		if _, err := job.Result(); err != nil {
+			recordGenerationFailure(job.ID, err)
+		}
+	})
+
+	batch, err := db.GetBatch(id)
+	if err != nil {
+		log.Printf("Error loading batch %s: %v", id, err)
+		return
+	}
+	batch.countItems()
+	batch.Status = batch.finalStatus()
+
+	if err := writeBatchArchive(batch, config.OutputDir, id+"_batch"); err != nil {
+		log.Printf("Error writing batch %s archive: %v", id, err)
+		batch.Status = "failed"
+	}
+	if err := db.FinishBatch(id, batch.Status, batch.ManifestPath, batch.ZipPath); err != nil {
+		log.Printf("Error finishing batch %s: %v", id, err)
+	}
+	log.Printf("Batch %s finished: %s (%d completed, %d failed)", id, batch.Status, batch.Counts["completed"], batch.Counts["failed"])
+
+	completedAt := time.Now().UTC()
+	batch.CompletedAt = &completedAt
+	notifyBatch(batch)
+}
+
+// handleBatchStatusRequest reports the progress of a batch
+func handleBatchStatusRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/api/batch/")
+	if id == "" || strings.Contains(id, "/") {
+		sendErrorResponse(w, "Batch ID is required", http.StatusBadRequest)
+		return
+	}
+	if db == nil {
+		sendErrorResponse(w, "Database not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	batch, err := db.GetBatch(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		sendErrorResponse(w, "Batch not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error retrieving batch %s: %v", id, err)
+		sendErrorResponse(w, "Failed to retrieve batch", http.StatusInternalServerError)
+		return
+	}
+
+	// The stored status stays running until the archive is written
+	batch.countItems()
+	batch.setURLs()
+
+	sendJSONResponse(w, map[string]interface{}{
+		"success": true,
+		"data":    batch,
+	})
+}
+
+// setURLs fills in the download URLs of the batch's finished items and
+// of its manifest and zip
+func (b *Batch) setURLs() {
+	for i := range b.Items {
+		item := &b.Items[i]
+		if item.Status == "completed" {
+			item.ImageURL = fileURL(item.ImagePath)
+			item.Files = generationFiles(item.ImagePath, item.HTMLPath)
+		}
+	}
+	if b.ManifestPath != "" {
+		b.ManifestURL = fileURL(b.ManifestPath)
+	}
+	if b.ZipPath != "" {
+		b.ZipURL = fileURL(b.ZipPath)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// validationFields lists the fields of a ValidationError
+func validationFields(t *testing.T, err error) []string {
+	t.Helper()
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("error = %v, want a ValidationError", err)
+	}
+	var fields []string
+	for _, f := range validationErr.Fields {
+		fields = append(fields, f.Field)
+	}
+	return fields
+}
+
+func TestParseManifest(t *testing.T) {
+	csvManifest := "url, title ,width\nhttps://example.com/a,First,1200\nhttps://example.com/b,,\n"
+	params, err := parseManifest(context.Background(), nil, ManifestCSV, strings.NewReader(csvManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(params) != 2 || params[0].Title != "First" || params[0].ImageWidth != 1200 || params[1].WebpageURL != "https://example.com/b" {
+		t.Errorf("CSV params = %+v", params)
+	}
+
+	_, err = parseManifest(context.Background(), nil, ManifestCSV, strings.NewReader("url,width,colour\nhttps://example.com,1200,\nhttps://example.com,50,red\n"))
+	if fields := validationFields(t, err); !reflect.DeepEqual(fields, []string{"items[1].colour", "items[1].width"}) {
+		t.Errorf("CSV errors = %v", fields)
+	}
+
+	jsonl := `{"url": "https://example.com/a", "image_width": 1200}
+
+{"url": "https://example.com/b", "title": "Second"}
+{"url": "https://example.com/c", "port": 80}
+`
+	_, err = parseManifest(context.Background(), nil, ManifestJSONL, strings.NewReader(jsonl))
+	if fields := validationFields(t, err); !reflect.DeepEqual(fields, []string{"items[2].port"}) {
+		t.Errorf("JSONL errors = %v, blank lines should not count as items", fields)
+	}
+
+	items := []json.RawMessage{[]byte(`{"url": "https://example.com/a"}`), []byte(`{"url": "https://example.com/b", "site_name": "B"}`)}
+	params, err = decodeBatchItems(items, []byte(`{"site_name": "Example", "format": "jpeg"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params[0].SiteName != "Example" || params[1].SiteName != "B" || params[1].Format != "jpeg" {
+		t.Errorf("defaults should fill in only what items leave unset: %+v", params)
+	}
+}
+
+func TestFetchSitemap(t *testing.T) {
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write([]byte(`<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+		<url><loc>https://example.com/b</loc></url>
+		<url><loc> https://example.com/a </loc></url>
+	</urlset>`))
+	zw.Close()
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sitemap.xml":
+			fmt.Fprintf(w, `<?xml version="1.0"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<sitemap><loc>%[1]s/pages.xml</loc></sitemap>
+	<sitemap><loc>%[1]s/posts.xml.gz</loc></sitemap>
+</sitemapindex>`, server.URL)
+		case "/pages.xml":
+			fmt.Fprint(w, `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<url><loc>https://example.com/a</loc><lastmod>2024-05-01</lastmod></url>
+</urlset>`)
+		case "/posts.xml.gz":
+			w.Write(gzipped.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	pages, err := fetchSitemap(context.Background(), server.Client(), server.URL+"/sitemap.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"https://example.com/a", "https://example.com/b"}; !reflect.DeepEqual(pages, want) {
+		t.Errorf("pages = %v, want %v", pages, want)
+	}
+
+	if _, err := fetchSitemap(context.Background(), server.Client(), server.URL+"/missing.xml"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("err = %v, want the failed fetch", err)
+	}
+	if _, err := parseManifest(context.Background(), nil, ManifestSitemap, strings.NewReader(`<html></html>`)); err == nil {
+		t.Error("documents other than sitemaps should be rejected")
+	}
+}
+
+func TestRunBatch(t *testing.T) {
+	var mu sync.Mutex
+	outstanding, peak := 0, 0
+	queue := NewJobQueue(4, 10, time.Minute, func(ctx context.Context, job *Job) (*Result, error) {
+		mu.Lock()
+		outstanding++
+		peak = max(peak, outstanding)
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		outstanding--
+		mu.Unlock()
+		if job.Params.Title == "bad" {
+			return nil, errors.New("render failed")
+		}
+		return &Result{}, nil
+	})
+	queue.Start()
+	defer queue.Stop()
+
+	jobs := make([]*Job, 6)
+	for i := range jobs {
+		title := "good"
+		if i == 3 {
+			title = "bad"
+		}
+		jobs[i] = NewJob(fmt.Sprint(i), GenerationParameters{Title: title}, "", "")
+	}
+
+	statuses := make([]string, len(jobs))
+	runBatch(context.Background(), queue, jobs, 2, func(i int, job *Job) {
+		statuses[i], _ = batchItemStatus(job)
+	})
+
+	if want := []string{"completed", "completed", "completed", "failed", "completed", "completed"}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("statuses = %v, want %v", statuses, want)
+	}
+	if peak > 2 {
+		t.Errorf("%d jobs ran at once, want at most 2", peak)
+	}
+
+	// Jobs not yet submitted fail once the batch is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	failed := 0
+	runBatch(ctx, queue, []*Job{NewJob("x", GenerationParameters{}, "", "")}, 1, func(i int, job *Job) {
+		if _, err := job.Result(); errors.Is(err, context.Canceled) {
+			failed++
+		}
+	})
+	if failed != 1 {
+		t.Error("a cancelled batch should fail its remaining jobs")
+	}
+}
+
+func TestWriteBatchArchive(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "0001_og_image.png"), []byte("png"), 0644)
+	os.WriteFile(filepath.Join(dir, "0001_og_meta.html"), []byte("<html></html>"), 0644)
+
+	batch := &Batch{ID: "b1", Items: []BatchItem{
+		{Index: 0, ID: "0001", Status: "completed", ImagePath: filepath.Join(dir, "0001_og_image.png"), HTMLPath: filepath.Join(dir, "0001_og_meta.html")},
+		{Index: 1, ID: "0002", Status: "failed", Error: "timeout", ImagePath: filepath.Join(dir, "0002_og_image.png"), HTMLPath: filepath.Join(dir, "0002_og_meta.html")},
+	}}
+	batch.countItems()
+	if status := batch.finalStatus(); status != "partial" {
+		t.Errorf("status = %q, want partial", status)
+	}
+	if err := writeBatchArchive(batch, dir, "batch"); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"0001_og_image.png", "0001_og_meta.html"}; !reflect.DeepEqual(batch.Items[0].Files, want) {
+		t.Errorf("files = %v, want only the files that were written", batch.Items[0].Files)
+	}
+	zr, err := zip.OpenReader(batch.ZipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if want := []string{"manifest.json", "0001_og_image.png", "0001_og_meta.html"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("zip holds %v, want %v", names, want)
+	}
+}
+
+func TestBatchHandler(t *testing.T) {
+	savedDB, savedQueue, savedDir := db, jobQueue, config.OutputDir
+	defer func() { db, jobQueue, config.OutputDir = savedDB, savedQueue, savedDir }()
+	db = newTestDatabase(t)
+	config.OutputDir = t.TempDir()
+	jobQueue = NewJobQueue(2, 10, time.Minute, func(ctx context.Context, job *Job) (*Result, error) {
+		if strings.HasSuffix(job.Params.WebpageURL, "/broken") {
+			err := errors.New("page failed to load")
+			recordGenerationFailure(job.ID, err)
+			return nil, err
+		}
+		os.WriteFile(job.ImagePath, []byte("png"), 0644)
+		recordGenerationStatus(job.ID, "completed", "")
+		return &Result{}, nil
+	})
+	jobQueue.Start()
+	defer jobQueue.Stop()
+
+	submit := func(contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/batch?concurrency=2", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		handleBatchRequest(rec, req)
+		return rec
+	}
+
+	rec := submit("text/csv", "url,width\nhttps://example.com,20\n")
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "items[0].width") {
+		t.Errorf("Expected the invalid row to be reported, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = submit("application/json", `{"items": [{"url": "https://example.com"}], "concurrency": 99}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "concurrency") {
+		t.Errorf("Expected the concurrency to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = submit("application/x-ndjson", `{"url": "https://example.com/ok"}`+"\n"+`{"url": "https://example.com/broken"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+	location := rec.Header().Get("Location")
+	id := location[strings.LastIndex(location, "/")+1:]
+
+	var batch Batch
+	deadline := time.Now().Add(5 * time.Second)
+	for batch.CompletedAt == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("batch did not finish: %+v", batch)
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/batch/"+id, nil)
+		rec := httptest.NewRecorder()
+		handleBatchStatusRequest(rec, req)
+		var response struct {
+			Data Batch `json:"data"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		batch = response.Data
+	}
+
+	if batch.Status != "partial" || batch.Counts["completed"] != 1 || batch.Counts["failed"] != 1 || batch.Source != ManifestJSONL {
+		t.Errorf("batch = %+v", batch)
+	}
+	if batch.Items[1].URL != "https://example.com/broken" || batch.Items[1].Error != "page failed to load" {
+		t.Errorf("items = %+v, want the failure reported in order", batch.Items)
+	}
+	if batch.ZipURL == "" || batch.ManifestURL == "" {
+		t.Error("a finished batch should link its zip and manifest")
+	}
+	if _, err := os.Stat(filepath.Join(config.OutputDir, id+"_batch.zip")); err != nil {
+		t.Errorf("zip was not written: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/batch/unknown", nil)
+	rec = httptest.NewRecorder()
+	handleBatchStatusRequest(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown batch, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/chromedp/chromedp"
+)
+
+// ErrPoolClosed is returned when a browser is requested from a closed pool
+var ErrPoolClosed = errors.New("browser pool is closed")
+
+// BrowserPoolOptions configures a BrowserPool
+type BrowserPoolOptions struct {
+	Size       int    // Number of Chrome processes kept running
+	MaxUses    int    // Generations served before a browser is recycled, 0 for no limit
+	ChromePath string // Chrome executable, empty to let chromedp find one
+	Proxy      string // Proxy server Chrome connects through, empty for none
+	Logf       func(format string, args ...interface{})
+}
+
+// PoolStats reports the state of a BrowserPool
+type PoolStats struct {
+	Size        int   `json:"size"`
+	Running     int   `json:"running"`
+	Idle        int   `json:"idle"`
+	Leased      int   `json:"leased"`
+	TotalLeases int64 `json:"total_leases"`
+	Launched    int64 `json:"launched"`
+	Recycled    int64 `json:"recycled"`
+	Crashed     int64 `json:"crashed"`
+}
+
+// BrowserPool keeps a fixed number of headless Chrome processes warm and
+// leases an isolated incognito tab from one of them for each generation
+type BrowserPool struct {
+	opts    BrowserPoolOptions
+	slots   chan *pooledBrowser
+	all     []*pooledBrowser
+	mu      sync.Mutex
+	stats   PoolStats
+	closed  bool
+	closing chan struct{}
+}
+
+// pooledBrowser is one slot in the pool. ctx is nil while no Chrome
+// process is running for the slot.
+type pooledBrowser struct {
+	id     int
+	ctx    context.Context
+	cancel context.CancelFunc
+	uses   int
+}
+
+// BrowserLease is a tab checked out from the pool. Ctx is a chromedp
+// context for a fresh incognito browser context; call Release when done.
+type BrowserLease struct {
+	Ctx     context.Context
+	pool    *BrowserPool
+	browser *pooledBrowser
+	cancel  context.CancelFunc
+	stop    func() bool
+	once    sync.Once
+}
+
+// NewBrowserPool creates a pool. Browsers are launched lazily on first use,
+// or up front by calling Warm.
+func NewBrowserPool(opts BrowserPoolOptions) *BrowserPool {
+	if opts.Size <= 0 {
+		opts.Size = 1
+	}
+	if opts.Logf == nil {
+		opts.Logf = log.Printf
+	}
+
+	p := &BrowserPool{
+		opts:    opts,
+		slots:   make(chan *pooledBrowser, opts.Size),
+		closing: make(chan struct{}),
+	}
+	p.stats.Size = opts.Size
+
+	for i := 0; i < opts.Size; i++ {
+		b := &pooledBrowser{id: i + 1}
+		p.all = append(p.all, b)
+		p.slots <- b
+	}
+
+	return p
+}
+
+// Warm launches every browser in the pool that is not already running
+func (p *BrowserPool) Warm() {
+	for i := 0; i < p.opts.Size; i++ {
+		var b *pooledBrowser
+		select {
+		case b = <-p.slots:
+		case <-p.closing:
+			return
+		}
+
+		if b.ctx == nil {
+			if err := p.launch(b); err != nil {
+				p.opts.Logf("Warning: Failed to warm browser %d: %v", b.id, err)
+			}
+		}
+
+		// Rotate the slot to the back so the next iteration picks another one
+		p.slots <- b
+	}
+}
+
+// Acquire leases a tab in a new incognito browser context. It blocks until a
+// browser is free or ctx is done. Cancelling ctx also closes the tab.
+func (p *BrowserPool) Acquire(ctx context.Context) (*BrowserLease, error) {
+	var b *pooledBrowser
+	select {
+	case b = <-p.slots:
+	case <-p.closing:
+		return nil, ErrPoolClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if p.isClosed() {
+		p.slots <- b
+		return nil, ErrPoolClosed
+	}
+
+	if b.ctx != nil && !p.healthy(b) {
+		p.opts.Logf("Browser %d is no longer responding, restarting it", b.id)
+		p.shutdown(b)
+		p.mu.Lock()
+		p.stats.Crashed++
+		p.mu.Unlock()
+	}
+
+	if b.ctx == nil {
+		if err := p.launch(b); err != nil {
+			p.slots <- b
+			return nil, err
+		}
+	}
+
+	tabCtx, cancel := chromedp.NewContext(b.ctx, chromedp.WithNewBrowserContext())
+	lease := &BrowserLease{
+		Ctx:     tabCtx,
+		pool:    p,
+		browser: b,
+		cancel:  cancel,
+		stop:    context.AfterFunc(ctx, cancel),
+	}
+
+	p.mu.Lock()
+	p.stats.Leased++
+	p.stats.TotalLeases++
+	p.mu.Unlock()
+
+	return lease, nil
+}
+
+// Release closes the leased tab and hands the browser back to the pool.
+// The browser is recycled once it reaches MaxUses or if it stopped
+// responding. Release is safe to call more than once.
+func (l *BrowserLease) Release() {
+	l.once.Do(func() {
+		l.stop()
+		l.cancel()
+
+		p, b := l.pool, l.browser
+		b.uses++
+
+		p.mu.Lock()
+		p.stats.Leased--
+		p.mu.Unlock()
+
+		if p.isClosed() {
+			p.shutdown(b)
+		} else if p.opts.MaxUses > 0 && b.uses >= p.opts.MaxUses {
+			p.opts.Logf("Recycling browser %d after %d uses", b.id, b.uses)
+			p.shutdown(b)
+			p.mu.Lock()
+			p.stats.Recycled++
+			p.mu.Unlock()
+		} else if !p.healthy(b) {
+			p.opts.Logf("Browser %d crashed, it will be restarted on next use", b.id)
+			p.shutdown(b)
+			p.mu.Lock()
+			p.stats.Crashed++
+			p.mu.Unlock()
+		}
+
+		p.slots <- b
+	})
+}
+
+// Stats returns a snapshot of the pool counters
+func (p *BrowserPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := p.stats
+	stats.Idle = len(p.slots)
+	for _, b := range p.all {
+		if b.ctx != nil {
+			stats.Running++
+		}
+	}
+	return stats
+}
+
+// Close shuts down idle browsers and makes leased ones shut down on release
+func (p *BrowserPool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.closing)
+	p.mu.Unlock()
+
+	for {
+		select {
+		case b := <-p.slots:
+			p.shutdown(b)
+		default:
+			return
+		}
+	}
+}
+
+// launch starts Chrome for a slot
+func (p *BrowserPool) launch(b *pooledBrowser) error {
+	opts := chromeAllocatorOptions()
+	if p.opts.ChromePath != "" {
+		opts = append(opts, chromedp.ExecPath(p.opts.ChromePath))
+	}
+	if p.opts.Proxy != "" {
+		opts = append(opts, chromedp.ProxyServer(p.opts.Proxy))
+	}
+
+	allocCtx, allocCancel := chromedp.NewExecAllocator(context.Background(), opts...)
+	browserCtx, browserCancel := chromedp.NewContext(allocCtx, chromedp.WithLogf(p.opts.Logf))
+
+	// Running with no actions starts the browser
+	if err := chromedp.Run(browserCtx); err != nil {
+		browserCancel()
+		allocCancel()
+		return fmt.Errorf("failed to start browser: %w", err)
+	}
+
+	p.mu.Lock()
+	b.ctx = browserCtx
+	b.cancel = func() {
+		browserCancel()
+		allocCancel()
+	}
+	b.uses = 0
+	p.stats.Launched++
+	p.mu.Unlock()
+
+	p.opts.Logf("Started browser %d", b.id)
+	return nil
+}
+
+// shutdown stops the Chrome process of a slot, if one is running
+func (p *BrowserPool) shutdown(b *pooledBrowser) {
+	p.mu.Lock()
+	cancel := b.cancel
+	b.ctx = nil
+	b.cancel = nil
+	p.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// healthy reports whether the slot's browser still answers DevTools calls
+func (p *BrowserPool) healthy(b *pooledBrowser) bool {
+	if b.ctx == nil || b.ctx.Err() != nil {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(b.ctx, 2*time.Second)
+	defer cancel()
+
+	_, err := chromedp.Targets(ctx)
+	return err == nil
+}
+
+// isClosed reports whether Close has been called
+func (p *BrowserPool) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// TestBrowserPoolStats tests the counters of a pool that has not launched Chrome
+func TestBrowserPoolStats(t *testing.T) {
+	pool := NewBrowserPool(BrowserPoolOptions{Size: 3})
+	defer pool.Close()
+
+	stats := pool.Stats()
+	if stats.Size != 3 {
+		t.Errorf("Expected size 3, got %d", stats.Size)
+	}
+	if stats.Idle != 3 {
+		t.Errorf("Expected 3 idle slots, got %d", stats.Idle)
+	}
+	if stats.Running != 0 || stats.Launched != 0 {
+		t.Errorf("Expected no browsers to be launched lazily, got %+v", stats)
+	}
+}
+
+// TestBrowserPoolClosed tests that a closed pool refuses new leases
+func TestBrowserPoolClosed(t *testing.T) {
+	pool := NewBrowserPool(BrowserPoolOptions{})
+	pool.Close()
+	pool.Close() // Closing twice must be safe
+
+	if _, err := pool.Acquire(context.Background()); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("Expected ErrPoolClosed, got %v", err)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg" // Register decoders used to read back screenshots
+	_ "image/png"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/chromedp"
+	xdraw "golang.org/x/image/draw"
+)
+
+// Capture modes supported by the renderer
+const (
+	CaptureModeViewport = "viewport" // Exactly the requested width x height
+	CaptureModeFullPage = "fullpage" // The whole scrollable page at the requested width
+	CaptureModeElement  = "element"  // Only the element matched by the selector
+)
+
+// Largest device scale factor accepted for retina output
+const maxDeviceScaleFactor = 4
+
+// Fill used around a capture-selector clip when no background is given
+const defaultCaptureBackground = "#ffffff"
+
+// normalizeCaptureMode maps user input such as "full page" or "Full-Page"
+// onto one of the capture mode constants
+func normalizeCaptureMode(mode string) (string, error) {
+	normalized := strings.ToLower(mode)
+	normalized = strings.NewReplacer(" ", "", "-", "", "_", "").Replace(normalized)
+
+	switch normalized {
+	case "", CaptureModeViewport:
+		return CaptureModeViewport, nil
+	case CaptureModeFullPage, "full":
+		return CaptureModeFullPage, nil
+	case CaptureModeElement:
+		return CaptureModeElement, nil
+	}
+	return "", fmt.Errorf("unsupported capture mode %q (use viewport, fullpage or element)", mode)
+}
+
+// emulateViewport sizes the page to the requested image dimensions so the
+// layout matches what ends up in the screenshot
+func emulateViewport(params GenerationParameters) chromedp.Action {
+	return emulation.SetDeviceMetricsOverride(
+		int64(params.ImageWidth),
+		int64(params.ImageHeight),
+		params.DeviceScaleFactor,
+		false,
+	)
+}
+
+// captureAction takes the screenshot for the configured capture mode in
+// the requested output format
+func captureAction(params GenerationParameters, buf *[]byte) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		shot := screenshot(params.Format, params.Quality)
+
+		switch params.CaptureMode {
+		case CaptureModeFullPage:
+			_, _, _, _, _, contentSize, err := page.GetLayoutMetrics().Do(ctx)
+			if err != nil {
+				return err
+			}
+			shot = shot.WithCaptureBeyondViewport(true).
+				WithClip(&page.Viewport{Width: contentSize.Width, Height: contentSize.Height, Scale: 1})
+		case CaptureModeElement:
+			box, err := locateElement(ctx, params.Selector)
+			if err != nil {
+				return err
+			}
+			shot = shot.WithCaptureBeyondViewport(true).WithClip(box.viewport())
+		}
+
+		var err error
+		*buf, err = shot.Do(ctx)
+		return err
+	})
+}
+
+// elementBox is the position of an element in page coordinates
+type elementBox struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// viewport converts the box into a screenshot clip
+func (b *elementBox) viewport() *page.Viewport {
+	return &page.Viewport{X: b.X, Y: b.Y, Width: b.Width, Height: b.Height, Scale: 1}
+}
+
+// locateElement finds the first element matching selector and returns its
+// box in page coordinates
+func locateElement(ctx context.Context, selector string) (*elementBox, error) {
+	quoted, err := json.Marshal(selector)
+	if err != nil {
+		return nil, err
+	}
+	script := fmt.Sprintf(`(() => {
+		const el = document.querySelector(%s);
+		if (!el) return null;
+		const r = el.getBoundingClientRect();
+		return {x: r.left + window.scrollX, y: r.top + window.scrollY, width: r.width, height: r.height};
+	})()`, quoted)
+
+	var box *elementBox
+	if err := chromedp.Evaluate(script, &box).Do(ctx); err != nil {
+		return nil, fmt.Errorf("failed to locate selector %q: %w", selector, err)
+	}
+	if box == nil {
+		return nil, fmt.Errorf("selector %q matched no element", selector)
+	}
+	if box.Width < 1 || box.Height < 1 {
+		return nil, fmt.Errorf("selector %q matched an element with no size", selector)
+	}
+	return box, nil
+}
+
+// captureSelectorAction screenshots only the element matched by
+// CaptureSelector. The clip is always taken as PNG so composing it loses
+// nothing; the final image is encoded afterwards.
+func captureSelectorAction(params GenerationParameters, buf *[]byte) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		bg, err := parseHexColor(params.CaptureBackground)
+		if err != nil {
+			return err
+		}
+		// Fills transparent areas of the element instead of leaving them white
+		if err := emulation.SetDefaultBackgroundColorOverride().
+			WithColor(&cdp.RGBA{R: int64(bg.R), G: int64(bg.G), B: int64(bg.B), A: float64(bg.A) / 255}).
+			Do(ctx); err != nil {
+			return err
+		}
+
+		box, err := locateElement(ctx, params.CaptureSelector)
+		if err != nil {
+			return err
+		}
+
+		*buf, err = screenshot(FormatPNG, 0).
+			WithCaptureBeyondViewport(true).
+			WithClip(box.viewport()).
+			Do(ctx)
+		return err
+	})
+}
+
+// composeCapture scales an element clip to fit the requested OG dimensions,
+// keeping its aspect ratio, and centres it on a background filled canvas
+// with CapturePadding CSS pixels kept clear on every side
+func composeCapture(clip []byte, params GenerationParameters) (image.Image, error) {
+	src, _, err := image.Decode(bytes.NewReader(clip))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode element capture: %w", err)
+	}
+	bg, err := parseHexColor(params.CaptureBackground)
+	if err != nil {
+		return nil, err
+	}
+
+	scale := params.DeviceScaleFactor
+	width := int(math.Round(float64(params.ImageWidth) * scale))
+	height := int(math.Round(float64(params.ImageHeight) * scale))
+	padding := int(math.Round(float64(params.CapturePadding) * scale))
+
+	if width-2*padding <= 0 || height-2*padding <= 0 {
+		return nil, fmt.Errorf("capture padding %d leaves no room in a %dx%d image", params.CapturePadding, params.ImageWidth, params.ImageHeight)
+	}
+
+	inner := image.Rect(padding, padding, width-padding, height-padding)
+
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	xdraw.Draw(canvas, canvas.Bounds(), image.NewUniform(bg), image.Point{}, xdraw.Src)
+
+	srcBounds := src.Bounds()
+	fit := math.Min(float64(inner.Dx())/float64(srcBounds.Dx()), float64(inner.Dy())/float64(srcBounds.Dy()))
+	fitWidth := int(math.Round(float64(srcBounds.Dx()) * fit))
+	fitHeight := int(math.Round(float64(srcBounds.Dy()) * fit))
+
+	x := inner.Min.X + (inner.Dx()-fitWidth)/2
+	y := inner.Min.Y + (inner.Dy()-fitHeight)/2
+	xdraw.CatmullRom.Scale(canvas, image.Rect(x, y, x+fitWidth, y+fitHeight), src, srcBounds, xdraw.Over, nil)
+
+	return canvas, nil
+}
+
+// parseHexColor parses #rgb, #rrggbb, #rrggbbaa or "transparent". An empty
+// string yields the default capture background.
+func parseHexColor(value string) (color.RGBA, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		value = defaultCaptureBackground
+	}
+	if value == "transparent" {
+		return color.RGBA{}, nil
+	}
+
+	hex := strings.TrimPrefix(value, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	if len(hex) != 8 {
+		return color.RGBA{}, fmt.Errorf("invalid color %q (use #rgb, #rrggbb or #rrggbbaa)", value)
+	}
+
+	n, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid color %q (use #rgb, #rrggbb or #rrggbbaa)", value)
+	}
+	return color.RGBA{R: uint8(n >> 24), G: uint8(n >> 16), B: uint8(n >> 8), A: uint8(n)}, nil
+}
+
+// imageDimensions reads the pixel size of an encoded image
+func imageDimensions(data []byte) (int, int, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read image dimensions: %w", err)
+	}
+	return cfg.Width, cfg.Height, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"testing"
+)
+
+func TestNormalizeCaptureMode(t *testing.T) {
+	tests := map[string]string{
+		"":          CaptureModeViewport,
+		"viewport":  CaptureModeViewport,
+		"Full-Page": CaptureModeFullPage,
+		"full_page": CaptureModeFullPage,
+		"full":      CaptureModeFullPage,
+		"element":   CaptureModeElement,
+	}
+
+	for input, expected := range tests {
+		mode, err := normalizeCaptureMode(input)
+		if err != nil {
+			t.Errorf("normalizeCaptureMode(%q) returned error: %v", input, err)
+			continue
+		}
+		if mode != expected {
+			t.Errorf("normalizeCaptureMode(%q) = %q, expected %q", input, mode, expected)
+		}
+	}
+
+	if _, err := normalizeCaptureMode("thumbnail"); err == nil {
+		t.Error("Expected an error for an unknown capture mode")
+	}
+}
+
+func TestImageDimensions(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 2400, 1260))); err != nil {
+		t.Fatalf("Failed to encode test image: %v", err)
+	}
+
+	width, height, err := imageDimensions(buf.Bytes())
+	if err != nil {
+		t.Fatalf("imageDimensions returned error: %v", err)
+	}
+	if width != 2400 || height != 1260 {
+		t.Errorf("Expected 2400x1260, got %dx%d", width, height)
+	}
+
+	if _, _, err := imageDimensions([]byte("not an image")); err == nil {
+		t.Error("Expected an error for invalid image data")
+	}
+}
+
+func TestParseHexColor(t *testing.T) {
+	tests := map[string]color.RGBA{
+		"":            {R: 255, G: 255, B: 255, A: 255},
+		"#000":        {A: 255},
+		"#0f172a":     {R: 15, G: 23, B: 42, A: 255},
+		"#FF000080":   {R: 255, A: 128},
+		"transparent": {},
+	}
+
+	for input, expected := range tests {
+		c, err := parseHexColor(input)
+		if err != nil {
+			t.Errorf("parseHexColor(%q) returned error: %v", input, err)
+			continue
+		}
+		if c != expected {
+			t.Errorf("parseHexColor(%q) = %v, expected %v", input, c, expected)
+		}
+	}
+
+	for _, input := range []string{"red", "#12345", "#gggggg"} {
+		if _, err := parseHexColor(input); err == nil {
+			t.Errorf("Expected an error for %q", input)
+		}
+	}
+}
+
+func TestComposeCapture(t *testing.T) {
+	// A wide red element should be letterboxed vertically on the background
+	clip := image.NewRGBA(image.Rect(0, 0, 400, 100))
+	draw.Draw(clip, clip.Bounds(), image.NewUniform(color.RGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, clip); err != nil {
+		t.Fatalf("Failed to encode test image: %v", err)
+	}
+
+	params := GenerationParameters{
+		ImageWidth:        200,
+		ImageHeight:       100,
+		DeviceScaleFactor: 2,
+		CapturePadding:    10,
+		CaptureBackground: "#0000ff",
+	}
+	img, err := composeCapture(buf.Bytes(), params)
+	if err != nil {
+		t.Fatalf("composeCapture returned error: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 400 || b.Dy() != 200 {
+		t.Fatalf("Expected a 400x200 image, got %dx%d", b.Dx(), b.Dy())
+	}
+
+	if r, g, b, _ := img.At(200, 100).RGBA(); r>>8 != 255 || g != 0 || b != 0 {
+		t.Errorf("Expected the element in the centre, got %v", img.At(200, 100))
+	}
+	if r, g, b, _ := img.At(200, 5).RGBA(); r != 0 || g != 0 || b>>8 != 255 {
+		t.Errorf("Expected the background above the element, got %v", img.At(200, 5))
+	}
+
+	params.CapturePadding = 60
+	if _, err := composeCapture(buf.Bytes(), params); err == nil {
+		t.Error("Expected an error when padding leaves no room")
+	}
+}
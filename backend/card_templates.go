@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+)
+
+//go:embed templates/*.html
+var cardTemplateFS embed.FS
+
+// Template used when a generation without a URL names none
+const defaultCardTemplate = "classic"
+
+// CardTemplate describes an HTML card template images can be rendered from
+type CardTemplate struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Source      string `json:"source"`            // builtin or custom
+	Version     int    `json:"version,omitempty"` // Latest version of a custom template
+}
+
+// CardData is what card templates are executed with
+type CardData struct {
+	Title           string
+	Description     string
+	SiteName        string
+	LogoURL         string
+	BackgroundColor string
+	TextColor       string
+	AccentColor     string
+	Width           int
+	Height          int
+}
+
+// Templates describe themselves with a regular meta description tag
+var templateDescriptionPattern = regexp.MustCompile(`<meta name="description" content="([^"]*)">`)
+
+// cardTemplateFuncs are available to every card template
+var cardTemplateFuncs = template.FuncMap{
+	// initial returns the first letter of the first non-empty value, for
+	// monogram placeholders when there is no logo
+	"initial": func(values ...string) string {
+		for _, v := range values {
+			for _, r := range strings.TrimSpace(v) {
+				return string(unicode.ToUpper(r))
+			}
+		}
+		return ""
+	},
+}
+
+// ListCardTemplates returns the built-in card templates sorted by name
+func ListCardTemplates() ([]CardTemplate, error) {
+	entries, err := fs.ReadDir(cardTemplateFS, "templates")
+	if err != nil {
+		return nil, err
+	}
+
+	templates := make([]CardTemplate, 0, len(entries))
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".html")
+		source, err := cardTemplateFS.ReadFile(path.Join("templates", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		tmpl := CardTemplate{Name: name, Source: "builtin"}
+		if m := templateDescriptionPattern.FindSubmatch(source); m != nil {
+			tmpl.Description = string(m[1])
+		}
+		templates = append(templates, tmpl)
+	}
+
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templates, nil
+}
+
+// isBuiltinTemplate reports whether name is one of the embedded templates
+func isBuiltinTemplate(name string) bool {
+	if name == "" || strings.ContainsAny(name, "/\\.") {
+		return false
+	}
+	_, err := fs.Stat(cardTemplateFS, path.Join("templates", name+".html"))
+	return err == nil
+}
+
+// ErrUnknownTemplate is returned when a generation names a template that
+// is neither built in nor stored
+var ErrUnknownTemplate = errors.New("unknown card template")
+
+// renderCardTemplate executes the named built-in template
+func renderCardTemplate(name string, data CardData) (string, error) {
+	if name == "" {
+		name = defaultCardTemplate
+	}
+	if strings.ContainsAny(name, "/\\.") {
+		return "", fmt.Errorf("%w %q", ErrUnknownTemplate, name)
+	}
+
+	source, err := cardTemplateFS.ReadFile(path.Join("templates", name+".html"))
+	if err != nil {
+		return "", fmt.Errorf("%w %q", ErrUnknownTemplate, name)
+	}
+
+	tmpl, err := template.New(name).Funcs(cardTemplateFuncs).Parse(string(source))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse card template %s: %w", name, err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render card template %s: %w", name, err)
+	}
+	return buf.String(), nil
+}
+
+// cardDataFromParameters collects the template inputs from a generation
+func cardDataFromParameters(params GenerationParameters) (CardData, error) {
+	for _, c := range []string{params.BackgroundColor, params.TextColor, params.AccentColor} {
+		if c == "" {
+			continue
+		}
+		if _, err := parseHexColor(c); err != nil {
+			return CardData{}, err
+		}
+	}
+
+	return CardData{
+		Title:           firstNonEmpty(params.Title, "Open Graph Generated Content"),
+		Description:     params.Description,
+		SiteName:        params.SiteName,
+		LogoURL:         params.LogoURL,
+		BackgroundColor: params.BackgroundColor,
+		TextColor:       params.TextColor,
+		AccentColor:     params.AccentColor,
+		Width:           params.ImageWidth,
+		Height:          params.ImageHeight,
+	}, nil
+}
+
+// loadHTMLContent replaces the document in the current tab with html
+func loadHTMLContent(html string) chromedp.Action {
+	return chromedp.Tasks{
+		chromedp.Navigate("about:blank"),
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			tree, err := page.GetFrameTree().Do(ctx)
+			if err != nil {
+				return err
+			}
+			return page.SetDocumentContent(tree.Frame.ID, html).Do(ctx)
+		}),
+	}
+}
+
+// waitForAssets waits until web fonts and images on the page are ready.
+// Images that fail to load are ignored.
+func waitForAssets() chromedp.Action {
+	return chromedp.Evaluate(
+		`Promise.all([document.fonts.ready, ...Array.from(document.images, img => img.decode().catch(() => null))]).then(() => true)`,
+		nil,
+		func(p *runtime.EvaluateParams) *runtime.EvaluateParams {
+			return p.WithAwaitPromise(true)
+		},
+	)
+}
+
+// handleTemplatesRequest lists the built-in and uploaded card templates on
+// GET and uploads a custom template on POST
+func handleTemplatesRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		handleTemplateUpload(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	templates, err := ListCardTemplates()
+	if err != nil {
+		sendErrorResponse(w, "Failed to list templates", http.StatusInternalServerError)
+		return
+	}
+
+	if db != nil {
+		custom, err := db.ListTemplates()
+		if err != nil {
+			log.Printf("Error listing custom templates: %v", err)
+			sendErrorResponse(w, "Failed to list templates", http.StatusInternalServerError)
+			return
+		}
+		for _, tmpl := range custom {
+			templates = append(templates, CardTemplate{
+				Name:        tmpl.Name,
+				Description: tmpl.Description,
+				Source:      "custom",
+				Version:     tmpl.Version,
+			})
+		}
+	}
+
+	sendJSONResponse(w, map[string]interface{}{
+		"success": true,
+		"data":    templates,
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestListCardTemplates(t *testing.T) {
+	templates, err := ListCardTemplates()
+	if err != nil {
+		t.Fatalf("ListCardTemplates returned error: %v", err)
+	}
+
+	found := false
+	for _, tmpl := range templates {
+		if tmpl.Description == "" {
+			t.Errorf("Template %s has no description", tmpl.Name)
+		}
+		if tmpl.Name == defaultCardTemplate {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Default template %s is not embedded", defaultCardTemplate)
+	}
+}
+
+func TestRenderCardTemplate(t *testing.T) {
+	templates, err := ListCardTemplates()
+	if err != nil {
+		t.Fatalf("ListCardTemplates returned error: %v", err)
+	}
+
+	data := CardData{
+		Title:           "Fish & <Chips>",
+		SiteName:        "ogdrip",
+		BackgroundColor: "#123456",
+		Width:           1200,
+		Height:          630,
+	}
+	for _, tmpl := range templates {
+		html, err := renderCardTemplate(tmpl.Name, data)
+		if err != nil {
+			t.Errorf("renderCardTemplate(%s) returned error: %v", tmpl.Name, err)
+			continue
+		}
+		if !strings.Contains(html, "Fish &amp; &lt;Chips&gt;") {
+			t.Errorf("Template %s does not contain the escaped title", tmpl.Name)
+		}
+		if !strings.Contains(html, "#123456") || strings.Contains(html, "ZgotmplZ") {
+			t.Errorf("Template %s did not apply the background color", tmpl.Name)
+		}
+		if !strings.Contains(html, "1200px") {
+			t.Errorf("Template %s does not size the card", tmpl.Name)
+		}
+	}
+
+	for _, name := range []string{"missing", "../templates/classic"} {
+		if _, err := renderCardTemplate(name, data); err == nil {
+			t.Errorf("Expected an error for template %q", name)
+		}
+	}
+}
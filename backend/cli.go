@@ -0,0 +1,650 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// Exit codes of the ogdrip command
+const (
+	exitOK         = 0
+	exitFailure    = 1 // The command failed
+	exitUsage      = 2 // Unknown command, flag or argument
+	exitLintErrors = 3 // validate found errors in the page's tags
+)
+
+// cliCommand is an ogdrip subcommand
+type cliCommand struct {
+	Name    string
+	Summary string
+	Run     func(c *cli, args []string) error
+}
+
+// cliCommands are the subcommands in the order help lists them
+var cliCommands = []cliCommand{
+	{"generate", "Capture a URL or render a card template to image and meta tag files", runGenerate},
+	{"validate", "Lint a page's Open Graph and Twitter tags", runValidate},
+	{"preview", "Generate, then serve the result on a local preview server", runPreview},
+	{"batch", "Generate cards for every item of a CSV or JSON Lines manifest or a sitemap", runBatchCommand},
+	{"crawl", "Crawl a site, report which pages lack Open Graph tags and generate cards for every page", runCrawl},
+	{"serve", "Run the API service", runServe},
+	{"history", "List recent generations", runHistory},
+	{"cleanup", "Delete generations past their cleanup time and their files", runCleanup},
+	{"db migrate", "Create or upgrade the database schema", runDBMigrate},
+}
+
+// cli carries the output settings shared by every subcommand
+type cli struct {
+	stdout io.Writer
+	stderr io.Writer
+	json   bool // Print results and errors as JSON on stdout
+}
+
+// usageError is a mistake in how a command was invoked
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+// exitError ends a command with a specific exit code. A nil err means the
+// command already reported the outcome.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit status %d", e.code)
+	}
+	return e.err.Error()
+}
+
+// runCLI runs the ogdrip command line and returns its exit code
+func runCLI(args []string, stdout, stderr io.Writer) int {
+	c := &cli{stdout: stdout, stderr: stderr}
+
+	if len(args) == 0 {
+		c.usage(stderr)
+		return exitUsage
+	}
+	name, rest := args[0], args[1:]
+	switch name {
+	case "help", "-h", "-help", "--help":
+		c.usage(stdout)
+		return exitOK
+	case "-service", "--service":
+		// Kept for scripts written before the subcommands
+		name = "serve"
+	case "db":
+		if len(rest) == 0 {
+			fmt.Fprintln(stderr, "ogdrip: db needs a subcommand: migrate")
+			return exitUsage
+		}
+		name, rest = "db "+rest[0], rest[1:]
+	}
+
+	for _, cmd := range cliCommands {
+		if cmd.Name == name {
+			return c.exitCode(cmd.Run(c, rest))
+		}
+	}
+	fmt.Fprintf(stderr, "ogdrip: unknown command %q\n\n", name)
+	c.usage(stderr)
+	return exitUsage
+}
+
+// usage lists the subcommands
+func (c *cli) usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: ogdrip <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range cliCommands {
+		fmt.Fprintf(tw, "  %s\t%s\n", cmd.Name, cmd.Summary)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Every command accepts -json to print its result as JSON.")
+	fmt.Fprintln(w, "Run 'ogdrip <command> -h' for the command's flags.")
+}
+
+// flagSet creates the flag set of a command, with the flags every command
+// shares. args describes the positional arguments in the usage line.
+func (c *cli) flagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet("ogdrip "+name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.BoolVar(&c.json, "json", false, "Print the result as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(c.stderr, "Usage: ogdrip %s [flags]%s\n\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse parses a command's flags. Commands that take no positional
+// arguments pass want 0; the arguments are returned otherwise.
+func (c *cli) parse(fs *flag.FlagSet, args []string, want int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, &exitError{code: exitOK}
+		}
+		// The flag package has already printed the problem and usage
+		return nil, &exitError{code: exitUsage}
+	}
+	if fs.NArg() != want {
+		if want == 0 {
+			return nil, &usageError{fmt.Sprintf("unexpected argument %q", fs.Arg(0))}
+		}
+		return nil, &usageError{fmt.Sprintf("expected %d argument(s), got %d", want, fs.NArg())}
+	}
+	return fs.Args(), nil
+}
+
+// result prints a command's result: data in the JSON envelope the API
+// uses, or the text printed by text
+func (c *cli) result(data interface{}, text func(w io.Writer)) {
+	if c.json {
+		enc := json.NewEncoder(c.stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(map[string]interface{}{"success": true, "data": data})
+		return
+	}
+	text(c.stdout)
+}
+
+// exitCode reports a command's error and returns the code to exit with
+func (c *cli) exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+
+	code := exitFailure
+	var exit *exitError
+	var usage *usageError
+	if errors.As(err, &exit) {
+		if exit.err == nil {
+			return exit.code
+		}
+		code = exit.code
+	} else if errors.As(err, &usage) {
+		code = exitUsage
+	}
+
+	if c.json {
+		enc := json.NewEncoder(c.stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(map[string]interface{}{"success": false, "error": err.Error()})
+	} else {
+		fmt.Fprintf(c.stderr, "ogdrip: %v\n", err)
+	}
+	return code
+}
+
+// interruptContext is cancelled when the process is interrupted or
+// terminated
+func interruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// runValidate lints the tags of a page, read from a URL, a file or stdin
+func runValidate(c *cli, args []string) error {
+	fs := c.flagSet("validate", " <url | file | ->")
+	baseURL := fs.String("base-url", "", "URL relative references in a file resolve against")
+	skipImages := fs.Bool("skip-images", false, "Do not download og:image to check its size")
+	timeout := fs.Duration("timeout", generationTimeout, "Time allowed for loading the page and its image")
+	args, err := c.parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	source, pageURL, err := readValidateSource(ctx, args[0], *baseURL)
+	if err != nil {
+		return err
+	}
+	tags, err := parsePageTags(strings.NewReader(source))
+	if err != nil {
+		return fmt.Errorf("failed to parse HTML: %w", err)
+	}
+
+	var client *http.Client
+	if !*skipImages {
+		client = &http.Client{Timeout: lintImageTimeout}
+	}
+	report := lintPage(ctx, pageURL, tags, client)
+
+	c.result(report, func(w io.Writer) {
+		fmt.Fprintf(w, "%s: score %d/100\n", firstNonEmpty(report.URL, args[0]), report.Score)
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		for _, issue := range report.Errors {
+			fmt.Fprintf(tw, "  error\t%s\t%s\t%s\n", issue.Property, issue.Rule, issue.Message)
+		}
+		for _, issue := range report.Warnings {
+			fmt.Fprintf(tw, "  warning\t%s\t%s\t%s\n", issue.Property, issue.Rule, issue.Message)
+		}
+		tw.Flush()
+	})
+
+	if len(report.Errors) > 0 {
+		return &exitError{code: exitLintErrors}
+	}
+	return nil
+}
+
+// readValidateSource returns the HTML to validate and the page's URL. http
+// and https URLs are rendered in a browser; anything else is a file, with
+// - for stdin.
+func readValidateSource(ctx context.Context, source, baseURL string) (string, string, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		pool := NewBrowserPool(BrowserPoolOptions{Size: 1, ChromePath: os.Getenv("CHROME_PATH")})
+		defer pool.Close()
+		html, finalURL, err := NewGenerator(pool).FetchPage(ctx, source)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to load %s: %w", source, err)
+		}
+		return html, finalURL, nil
+	}
+
+	var r io.Reader = os.Stdin
+	if source != "-" {
+		f, err := os.Open(source)
+		if err != nil {
+			return "", "", err
+		}
+		defer f.Close()
+		r = f
+	}
+	data, err := io.ReadAll(io.LimitReader(r, maxValidateBodyBytes+1))
+	if err != nil {
+		return "", "", err
+	}
+	if len(data) > maxValidateBodyBytes {
+		return "", "", fmt.Errorf("%s is larger than %d bytes", source, maxValidateBodyBytes)
+	}
+	return string(data), baseURL, nil
+}
+
+// runBatchCommand generates a card for every item of a manifest or
+// sitemap, then writes the batch manifest and a zip of every output
+func runBatchCommand(c *cli, args []string) error {
+	fs := c.flagSet("batch", " <manifest.csv | manifest.jsonl | sitemap.xml | sitemap URL | ->")
+	outDir := fs.String("out", "batch", "Directory to write the cards, manifest and zip to")
+	concurrency := fs.Int("concurrency", 2, "Number of items rendered at once")
+	format := fs.String("format", "", "Manifest format: csv, jsonl or sitemap (default from the file extension)")
+	timeout := fs.Duration("timeout", generationTimeout, "Time allowed for each item")
+	args, err := c.parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if *concurrency < 1 || *concurrency > maxBatchConcurrency {
+		return &usageError{fmt.Sprintf("-concurrency must be between 1 and %d", maxBatchConcurrency)}
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	params, source, err := readBatchSource(ctx, args[0], *format)
+	if err != nil {
+		return err
+	}
+	batch, err := c.generateBatch(ctx, source, params, *outDir, *concurrency, *timeout)
+	if err != nil {
+		return err
+	}
+
+	c.result(batch, func(w io.Writer) {
+		fmt.Fprintf(w, "Batch %s: %d completed, %d failed\n", batch.Status, batch.Counts["completed"], batch.Counts["failed"])
+		for _, item := range batch.Items {
+			if item.Status == "failed" {
+				fmt.Fprintf(w, "  %s %s: %s\n", item.ID, firstNonEmpty(item.URL, item.Title), item.Error)
+			}
+		}
+		fmt.Fprintf(w, "Manifest: %s\nZip: %s\n", batch.ManifestPath, batch.ZipPath)
+	})
+
+	if batch.Counts["failed"] > 0 {
+		return &exitError{code: exitFailure}
+	}
+	return nil
+}
+
+// generateBatch renders every item into dir, with files numbered in item
+// order, then writes the batch manifest and zip. Progress goes to stderr
+// unless the result is printed as JSON.
+func (c *cli) generateBatch(ctx context.Context, source string, params []GenerationParameters, dir string, concurrency int, timeout time.Duration) (*Batch, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	batch := &Batch{
+		ID:          generateRequestID(),
+		Source:      source,
+		Status:      "running",
+		Total:       len(params),
+		Concurrency: concurrency,
+		CreatedAt:   time.Now().UTC(),
+	}
+	jobs := make([]*Job, len(params))
+	for i, p := range params {
+		imageFormat, err := resolveImageFormat(p.Format, p.Quality)
+		if err != nil {
+			return nil, fmt.Errorf("item %d: %w", i, err)
+		}
+		p.Format = imageFormat
+
+		// Items are numbered so the files sort in manifest order
+		name := fmt.Sprintf("%04d", i+1)
+		imagePath := filepath.Join(dir, name+"_og_image"+imageExtension(imageFormat))
+		htmlPath := filepath.Join(dir, name+"_og_meta.html")
+		jobs[i] = NewJob(name, p, imagePath, htmlPath)
+		batch.Items = append(batch.Items, BatchItem{
+			Index:     i,
+			ID:        name,
+			URL:       p.WebpageURL,
+			Title:     p.Title,
+			Status:    "pending",
+			ImagePath: imagePath,
+			HTMLPath:  htmlPath,
+		})
+	}
+
+	generator, pool := newCLIGenerator(concurrency)
+	defer pool.Close()
+	queue := NewJobQueue(concurrency, len(jobs), timeout, func(ctx context.Context, job *Job) (*Result, error) {
+		result, err := generator.Generate(ctx, job.Params)
+		if err == nil {
+			err = result.WriteFiles(job.ImagePath, job.HTMLPath)
+		}
+		return result, err
+	})
+	queue.Start()
+
+	var mu sync.Mutex
+	done := 0
+	runBatch(ctx, queue, jobs, concurrency, func(i int, job *Job) {
+		status, message := batchItemStatus(job)
+
+		mu.Lock()
+		defer mu.Unlock()
+		item := &batch.Items[i]
+		item.Status, item.Error = status, message
+		done++
+		if !c.json {
+			fmt.Fprintf(c.stderr, "[%d/%d] %s %s %s\n", done, len(jobs), item.ID, status, firstNonEmpty(item.URL, item.Title))
+		}
+	})
+	queue.Stop()
+
+	completedAt := time.Now().UTC()
+	batch.CompletedAt = &completedAt
+	batch.countItems()
+	batch.Status = batch.finalStatus()
+	if err := writeBatchArchive(batch, dir, "batch"); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// readBatchSource reads the items of a batch. http and https URLs are
+// sitemaps; anything else is a manifest file, with - for stdin.
+func readBatchSource(ctx context.Context, source, format string) ([]GenerationParameters, string, error) {
+	client := &http.Client{Timeout: sitemapFetchTimeout}
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		pages, err := fetchSitemap(ctx, client, source)
+		if err != nil {
+			return nil, "", err
+		}
+		params, err := decodeBatchItems(sitemapItems(pages), nil)
+		return params, ManifestSitemap, err
+	}
+
+	format = firstNonEmpty(format, manifestFormat(source))
+	switch format {
+	case ManifestCSV, ManifestJSONL, ManifestSitemap:
+	case "":
+		return nil, "", &usageError{fmt.Sprintf("cannot tell the manifest format of %s, use -format", source)}
+	default:
+		return nil, "", &usageError{"-format must be csv, jsonl or sitemap"}
+	}
+
+	var r io.Reader = os.Stdin
+	if source != "-" {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, "", err
+		}
+		defer f.Close()
+		r = f
+	}
+	params, err := parseManifest(ctx, client, format, io.LimitReader(r, maxBatchBodyBytes))
+	return params, format, err
+}
+
+// runCrawl crawls a site from a root URL, generates a card for every page
+// it finds and writes a report of each page's existing Open Graph tags
+func runCrawl(c *cli, args []string) error {
+	fs := c.flagSet("crawl", " <root URL>")
+	outDir := fs.String("out", "crawl", "Directory to write the cards, report, manifest and zip to")
+	depth := fs.Int("depth", 2, "Links to follow from the root page")
+	maxPages := fs.Int("max-pages", 50, fmt.Sprintf("Most pages to visit (at most %d)", maxBatchItems))
+	concurrency := fs.Int("concurrency", 2, "Number of pages rendered at once")
+	timeout := fs.Duration("timeout", generationTimeout, "Time allowed for rendering each page")
+	skipImages := fs.Bool("skip-images", false, "Do not download each og:image to check its size")
+	reportOnly := fs.Bool("report-only", false, "Only report on the pages' tags, without generating cards")
+	usage := fs.Usage
+	fs.Usage = func() {
+		usage()
+		fmt.Fprintf(c.stderr, "\n%s\n", crawlTagsNote)
+	}
+	args, err := c.parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	switch {
+	case *depth < 0:
+		return &usageError{"-depth must not be negative"}
+	case *maxPages < 1 || *maxPages > maxBatchItems:
+		return &usageError{fmt.Sprintf("-max-pages must be between 1 and %d", maxBatchItems)}
+	case *concurrency < 1 || *concurrency > maxBatchConcurrency:
+		return &usageError{fmt.Sprintf("-concurrency must be between 1 and %d", maxBatchConcurrency)}
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	crawler := NewCrawler(&http.Client{Timeout: crawlFetchTimeout}, CrawlOptions{
+		MaxDepth:    *depth,
+		MaxPages:    *maxPages,
+		CheckImages: !*skipImages,
+	})
+	report, err := crawler.Crawl(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if !c.json {
+		fmt.Fprintf(c.stderr, "Crawled %d page(s), skipped %d\n", len(report.Pages), len(report.Skipped))
+	}
+
+	failed := 0
+	if !*reportOnly && len(report.Pages) > 0 {
+		params := make([]GenerationParameters, len(report.Pages))
+		for i, page := range report.Pages {
+			params[i] = GenerationParameters{WebpageURL: page.URL}
+		}
+		batch, err := c.generateBatch(ctx, "crawl", params, *outDir, *concurrency, *timeout)
+		if err != nil {
+			return err
+		}
+		for i := range report.Pages {
+			report.Pages[i].Generation = &batch.Items[i]
+		}
+		failed = batch.Counts["failed"]
+	}
+
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	reportPath := filepath.Join(*outDir, "crawl_report.json")
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(reportPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write crawl report: %w", err)
+	}
+
+	c.result(report, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "OG TAGS\tSCORE\tCARD\tURL")
+		for _, page := range report.Pages {
+			card := "-"
+			if page.Generation != nil {
+				card = page.Generation.Status
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", page.OGStatus, page.Score, card, page.URL)
+		}
+		tw.Flush()
+		for _, skip := range report.Skipped {
+			fmt.Fprintf(w, "Skipped %s: %s\n", skip.URL, skip.Reason)
+		}
+		if report.Truncated {
+			fmt.Fprintf(w, "Stopped after %d pages; raise -max-pages to crawl further\n", len(report.Pages))
+		}
+		fmt.Fprintf(w, "%d good, %d incomplete, %d missing Open Graph tags\nReport: %s\n",
+			report.Counts[OGStatusGood], report.Counts[OGStatusIncomplete], report.Counts[OGStatusMissing], reportPath)
+	})
+
+	if failed > 0 {
+		return &exitError{code: exitFailure}
+	}
+	return nil
+}
+
+// runServe runs the API service until it fails
+func runServe(c *cli, args []string) error {
+	fs := c.flagSet("serve", "")
+	port := fs.String("port", "", "Port to listen on (default $PORT or "+config.Port+")")
+	if _, err := c.parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	// ServiceMain reads its settings from the environment
+	if *port != "" {
+		os.Setenv("PORT", *port)
+	}
+	fmt.Fprintln(c.stderr, "Starting Open Graph API service...")
+	return ServiceMain()
+}
+
+// openCLIDatabase opens the generations database for a command
+func openCLIDatabase() (*Database, error) {
+	database, err := InitDB()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database %s: %w", databasePath, err)
+	}
+	return database, nil
+}
+
+// runHistory lists recent generations, newest first
+func runHistory(c *cli, args []string) error {
+	fs := c.flagSet("history", "")
+	limit := fs.Int("limit", 20, "Number of generations to list")
+	offset := fs.Int("offset", 0, "Number of newer generations to skip")
+	if _, err := c.parse(fs, args, 0); err != nil {
+		return err
+	}
+	if *limit <= 0 || *offset < 0 {
+		return &usageError{"-limit must be positive and -offset must not be negative"}
+	}
+
+	database, err := openCLIDatabase()
+	if err != nil {
+		return err
+	}
+	defer database.CloseDB()
+
+	generations, err := database.GetRecentGenerations(*limit, *offset)
+	if err != nil {
+		return err
+	}
+	if generations == nil {
+		generations = []Generation{}
+	}
+
+	c.result(generations, func(w io.Writer) {
+		if len(generations) == 0 {
+			fmt.Fprintln(w, "No generations found")
+			return
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tSTATUS\tCREATED\tTITLE\tURL")
+		for _, gen := range generations {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", gen.ID, gen.Status,
+				gen.CreatedAt.Local().Format(time.DateTime), truncateWords(gen.Title, 40), gen.TargetURL)
+		}
+		tw.Flush()
+	})
+	return nil
+}
+
+// runCleanup deletes the generations that are past their cleanup time
+func runCleanup(c *cli, args []string) error {
+	fs := c.flagSet("cleanup", "")
+	if _, err := c.parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	database, err := openCLIDatabase()
+	if err != nil {
+		return err
+	}
+	defer database.CloseDB()
+
+	removed, err := database.RunCleanup()
+	if err != nil {
+		return err
+	}
+	c.result(map[string]int{"removed": removed}, func(w io.Writer) {
+		fmt.Fprintf(w, "Removed %d expired generation(s)\n", removed)
+	})
+	return nil
+}
+
+// runDBMigrate creates the database or brings its schema up to date
+func runDBMigrate(c *cli, args []string) error {
+	fs := c.flagSet("db migrate", "")
+	if _, err := c.parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	// Opening the database applies every migration
+	database, err := openCLIDatabase()
+	if err != nil {
+		return err
+	}
+	defer database.CloseDB()
+
+	c.result(map[string]string{"database": databasePath}, func(w io.Writer) {
+		fmt.Fprintf(w, "Database %s is up to date\n", databasePath)
+	})
+	return nil
+}
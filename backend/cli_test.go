@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runTestCLI runs the command line and returns its exit code and output
+func runTestCLI(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := runCLI(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestRunCLIUsage(t *testing.T) {
+	tests := []struct {
+		args []string
+		code int
+	}{
+		{nil, exitUsage},
+		{[]string{"help"}, exitOK},
+		{[]string{"launch"}, exitUsage},
+		{[]string{"db"}, exitUsage},
+		{[]string{"db", "seed"}, exitUsage},
+		{[]string{"history", "extra"}, exitUsage},
+		{[]string{"generate", "-no-such-flag"}, exitUsage},
+		{[]string{"generate", "-format", "gif"}, exitUsage},
+		{[]string{"validate", "-h"}, exitOK},
+		{[]string{"validate"}, exitUsage},
+	}
+	for _, tt := range tests {
+		if code, _, _ := runTestCLI(tt.args...); code != tt.code {
+			t.Errorf("ogdrip %s exited with %d, want %d", strings.Join(tt.args, " "), code, tt.code)
+		}
+	}
+
+	_, stdout, _ := runTestCLI("help")
+	for _, cmd := range cliCommands {
+		if !strings.Contains(stdout, cmd.Name) {
+			t.Errorf("help does not list %s", cmd.Name)
+		}
+	}
+}
+
+func TestValidateCommand(t *testing.T) {
+	dir := t.TempDir()
+	page := filepath.Join(dir, "page.html")
+	if err := os.WriteFile(page, []byte(lintTestPage), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	code, stdout, _ := runTestCLI("validate", "-skip-images", "-base-url", "https://example.com/releases", page)
+	if code != exitLintErrors {
+		t.Errorf("exit code = %d, want %d for a page with errors", code, exitLintErrors)
+	}
+	if !strings.Contains(stdout, "https://example.com/releases: score") || !strings.Contains(stdout, "error") {
+		t.Errorf("text output = %q", stdout)
+	}
+
+	clean := filepath.Join(dir, "clean.html")
+	if err := os.WriteFile(clean, []byte(`<meta property="og:type" content="website">
+<meta property="og:url" content="https://example.com/">
+<meta property="og:title" content="Example">
+<meta property="og:description" content="An example page">
+<meta property="og:image" content="https://example.com/og.png">
+<meta property="og:image:width" content="1200">
+<meta property="og:image:height" content="630">
+<meta property="og:image:alt" content="Example logo">
+<meta name="twitter:card" content="summary_large_image">`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	code, stdout, _ = runTestCLI("validate", "-json", "-skip-images", clean)
+	if code != exitOK {
+		t.Errorf("exit code = %d for a clean page", code)
+	}
+	var resp struct {
+		Success bool       `json:"success"`
+		Data    LintReport `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &resp); err != nil {
+		t.Fatalf("output is not JSON: %s", stdout)
+	}
+	if !resp.Success || resp.Data.Score != 100 {
+		t.Errorf("response = %+v", resp)
+	}
+
+	code, stdout, _ = runTestCLI("validate", "-json", filepath.Join(dir, "missing.html"))
+	if code != exitFailure || !strings.Contains(stdout, `"success": false`) {
+		t.Errorf("missing file: exit code = %d, output = %s", code, stdout)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	crawlerAgent      = "ogdrip" // Product token robots.txt rules are matched against
+	crawlerUserAgent  = "Mozilla/5.0 (compatible; ogdrip/1.0; +https://og-drip.com)"
+	crawlFetchTimeout = 30 * time.Second
+	maxCrawlDelay     = 10 * time.Second // Longest robots.txt Crawl-delay honoured
+)
+
+// crawlTagsNote explains where a crawl reads the tags from. Link preview
+// scrapers do not run scripts either, so the served HTML is what they see.
+const crawlTagsNote = "Tags are read from the HTML as served, without running scripts, as link preview scrapers do; tags added by client-side JavaScript are reported as missing."
+
+// Open Graph states a crawled page can be in
+const (
+	OGStatusGood       = "good"       // Tags pass the lint without errors
+	OGStatusIncomplete = "incomplete" // Open Graph tags with errors, such as a missing og:image
+	OGStatusMissing    = "missing"    // No Open Graph tags at all
+)
+
+// CrawlOptions limits a crawl
+type CrawlOptions struct {
+	MaxDepth    int  // Links followed from the root; 0 only visits the root
+	MaxPages    int  // Most pages visited
+	CheckImages bool // Download each og:image to check its size
+}
+
+// CrawlPage is a page found by a crawl
+type CrawlPage struct {
+	URL        string     `json:"url"`
+	Depth      int        `json:"depth"`
+	Title      string     `json:"title,omitempty"`
+	OGStatus   string     `json:"og_status"` // good, incomplete or missing
+	Score      int        `json:"score"`
+	Errors     []string   `json:"errors,omitempty"` // Lint errors of the page's own tags
+	Generation *BatchItem `json:"generation,omitempty"`
+}
+
+// CrawlSkip is a URL a crawl found but did not visit
+type CrawlSkip struct {
+	URL    string `json:"url"`
+	Reason string `json:"reason"`
+}
+
+// CrawlReport is the outcome of a crawl
+type CrawlReport struct {
+	Root       string         `json:"root"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+	Counts     map[string]int `json:"counts"` // Pages per Open Graph status
+	Pages      []CrawlPage    `json:"pages"`
+	Skipped    []CrawlSkip    `json:"skipped,omitempty"`
+	Truncated  bool           `json:"truncated,omitempty"` // The page limit stopped the crawl
+	Note       string         `json:"note"`                // Where the tags were read from
+}
+
+// Crawler visits the pages of a site by following its same-origin links,
+// respecting robots.txt
+type Crawler struct {
+	client  *http.Client
+	options CrawlOptions
+}
+
+// NewCrawler creates a crawler that fetches pages with client
+func NewCrawler(client *http.Client, options CrawlOptions) *Crawler {
+	if options.MaxPages <= 0 {
+		options.MaxPages = maxBatchItems
+	}
+	return &Crawler{client: client, options: options}
+}
+
+// crawlTarget is a URL waiting to be visited
+type crawlTarget struct {
+	url   string
+	depth int
+}
+
+// Crawl visits the site breadth first from root. Pages are fetched one at
+// a time, waiting between fetches if robots.txt asks for it. Cancelling
+// ctx returns the pages visited so far along with the context's error.
+func (c *Crawler) Crawl(ctx context.Context, root string) (*CrawlReport, error) {
+	normalized, err := normalizeURL(root)
+	if err != nil {
+		return nil, err
+	}
+	rootURL, err := url.Parse(normalized)
+	if err != nil {
+		return nil, err
+	}
+	rootURL.Fragment, rootURL.RawFragment = "", ""
+	if rootURL.Path == "" {
+		rootURL.Path = "/"
+	}
+
+	report := &CrawlReport{Root: rootURL.String(), StartedAt: time.Now().UTC(), Note: crawlTagsNote}
+	defer func() {
+		report.FinishedAt = time.Now().UTC()
+		report.Counts = make(map[string]int)
+		for _, page := range report.Pages {
+			report.Counts[page.OGStatus]++
+		}
+	}()
+
+	robots := fetchRobots(ctx, c.client, rootURL, crawlerAgent, crawlerUserAgent)
+	if robots.disallowAll {
+		report.Skipped = append(report.Skipped, CrawlSkip{URL: report.Root, Reason: "robots.txt could not be fetched"})
+		return report, nil
+	}
+	delay := min(robots.crawlDelay, maxCrawlDelay)
+
+	queue := []crawlTarget{{url: report.Root}}
+	seen := map[string]bool{report.Root: true}
+	for len(queue) > 0 {
+		if len(report.Pages) >= c.options.MaxPages {
+			report.Truncated = true
+			break
+		}
+		target := queue[0]
+		queue = queue[1:]
+
+		u, _ := url.Parse(target.url)
+		if !robots.allowed(u) {
+			report.Skipped = append(report.Skipped, CrawlSkip{URL: target.url, Reason: "disallowed by robots.txt"})
+			continue
+		}
+
+		if len(report.Pages) > 0 && delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		page, doc, err := c.visit(ctx, rootURL, target)
+		if err != nil {
+			report.Skipped = append(report.Skipped, CrawlSkip{URL: target.url, Reason: err.Error()})
+			continue
+		}
+		// A redirect can lead to a page that was already visited
+		if page.URL != target.url {
+			if seen[page.URL] {
+				continue
+			}
+			seen[page.URL] = true
+		}
+		report.Pages = append(report.Pages, *page)
+
+		if target.depth >= c.options.MaxDepth || strings.Contains(doc.Robots, "nofollow") {
+			continue
+		}
+		for _, link := range crawlLinks(page.URL, doc, rootURL) {
+			if !seen[link] {
+				seen[link] = true
+				queue = append(queue, crawlTarget{url: link, depth: target.depth + 1})
+			}
+		}
+	}
+	return report, nil
+}
+
+// visit fetches a page and lints the tags in its HTML. Scripts are not run,
+// see crawlTagsNote.
+func (c *Crawler) visit(ctx context.Context, root *url.URL, target crawlTarget) (*CrawlPage, *pageDocument, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("User-Agent", crawlerUserAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, nil, fmt.Errorf("fetch failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	final := resp.Request.URL
+	if !sameOrigin(final, root) {
+		return nil, nil, fmt.Errorf("redirected off the site to %s", final)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("HTTP %s", resp.Status)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, nil, fmt.Errorf("not an HTML page (%s)", firstNonEmpty(mediaType, "no content type"))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxValidateBodyBytes))
+	if err != nil {
+		return nil, nil, fmt.Errorf("fetch failed: %w", err)
+	}
+	doc, err := parsePageDocument(bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid HTML: %w", err)
+	}
+
+	final.Fragment, final.RawFragment = "", ""
+	page := &CrawlPage{
+		URL:   final.String(),
+		Depth: target.depth,
+		Title: pageTagValue(doc.Tags, "title"),
+	}
+
+	var imageClient *http.Client
+	if c.options.CheckImages {
+		imageClient = c.client
+	}
+	lint := lintPage(ctx, page.URL, doc.Tags, imageClient)
+	page.Score = lint.Score
+	for _, issue := range lint.Errors {
+		page.Errors = append(page.Errors, issue.Message)
+	}
+	page.OGStatus = ogTagStatus(doc.Tags, lint)
+	return page, &doc, nil
+}
+
+// ogTagStatus sorts a page by how well its Open Graph tags are set up
+func ogTagStatus(tags []PageTag, lint LintReport) string {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag.Name, "og:") {
+			if len(lint.Errors) > 0 {
+				return OGStatusIncomplete
+			}
+			return OGStatusGood
+		}
+	}
+	return OGStatusMissing
+}
+
+// crawlLinks resolves the links of a page, keeping the ones on the site
+// being crawled without their fragments
+func crawlLinks(pageURL string, doc *pageDocument, root *url.URL) []string {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return nil
+	}
+	if doc.BaseHref != "" {
+		if b, err := base.Parse(doc.BaseHref); err == nil {
+			base = b
+		}
+	}
+
+	var links []string
+	for _, href := range doc.Links {
+		u, err := base.Parse(href)
+		if err != nil || !sameOrigin(u, root) {
+			continue
+		}
+		u.Fragment, u.RawFragment = "", ""
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		links = append(links, u.String())
+	}
+	return links
+}
+
+// sameOrigin reports whether two URLs share scheme, host and port
+func sameOrigin(a, b *url.URL) bool {
+	return strings.EqualFold(a.Scheme, b.Scheme) && strings.EqualFold(a.Host, b.Host)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const crawlTestRobots = `# Everyone else stays out
+User-agent: *
+Disallow: /
+
+User-agent: OGDrip
+User-agent: other-bot
+Disallow: /private  # comment
+Allow: /private/ok$
+Crawl-delay: 0
+`
+
+// newCrawlTestSite serves a small site for crawling
+func newCrawlTestSite(t *testing.T) *httptest.Server {
+	pages := map[string]string{
+		"/": `<html><head><title>Home</title>
+<meta property="og:title" content="Home">
+<meta property="og:type" content="website">
+<meta property="og:url" content="https://example.com/">
+<meta property="og:image" content="https://example.com/card.png">
+</head><body>
+<a href="/a">A</a> <a href="/a#top">A again</a> <a href="private/x">Private</a> <a href="/private/ok">OK</a>
+<a href="https://other.example/">Elsewhere</a> <a href="mailto:hi@example.com">Mail</a>
+<a href="/doc.pdf">PDF</a> <a href="/missing">Missing</a> <a href="/redirect">Redirect</a>
+<a rel="external nofollow" href="/nofollow">Not followed</a>
+</body></html>`,
+		"/a":          `<html><head><title>A</title><meta property="og:title" content="A"></head><body><a href="/deep">Deep</a></body></html>`,
+		"/private/ok": `<html><head><title>OK</title></head><body></body></html>`,
+		"/deep":       `<html><head><title>Deep</title></head></html>`,
+		"/nofollow":   `<html><head><title>Nofollow</title></head></html>`,
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.UserAgent(), crawlerAgent) {
+			t.Errorf("request for %s has user agent %q", r.URL.Path, r.UserAgent())
+		}
+		switch r.URL.Path {
+		case "/robots.txt":
+			fmt.Fprint(w, crawlTestRobots)
+		case "/doc.pdf":
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Write([]byte("%PDF"))
+		case "/redirect":
+			http.Redirect(w, r, "/a", http.StatusFound)
+		case "/private/x":
+			t.Error("a page disallowed by robots.txt was fetched")
+		default:
+			page, ok := pages[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, page)
+		}
+	}))
+}
+
+func TestCrawl(t *testing.T) {
+	server := newCrawlTestSite(t)
+	defer server.Close()
+
+	crawler := NewCrawler(server.Client(), CrawlOptions{MaxDepth: 1, MaxPages: 20})
+	report, err := crawler.Crawl(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pages []string
+	statuses := make(map[string]string)
+	for _, page := range report.Pages {
+		path := strings.TrimPrefix(page.URL, server.URL)
+		pages = append(pages, path)
+		statuses[path] = page.OGStatus
+	}
+	if want := []string{"/", "/a", "/private/ok"}; !reflect.DeepEqual(pages, want) {
+		t.Errorf("pages = %v, want %v", pages, want)
+	}
+	if want := map[string]string{"/": OGStatusGood, "/a": OGStatusIncomplete, "/private/ok": OGStatusMissing}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("statuses = %v, want %v", statuses, want)
+	}
+	if report.Counts[OGStatusGood] != 1 || report.Counts[OGStatusMissing] != 1 || report.Truncated {
+		t.Errorf("counts = %v, truncated = %v", report.Counts, report.Truncated)
+	}
+	if report.Note == "" {
+		t.Error("the report should say the tags are read without running scripts")
+	}
+	if errs := report.Pages[1].Errors; len(errs) == 0 || !strings.Contains(strings.Join(errs, " "), "og:image is required") {
+		t.Errorf("errors of /a = %v", errs)
+	}
+
+	reasons := make(map[string]string)
+	for _, skip := range report.Skipped {
+		reasons[strings.TrimPrefix(skip.URL, server.URL)] = skip.Reason
+	}
+	want := map[string]string{
+		"/private/x": "disallowed by robots.txt",
+		"/doc.pdf":   "not an HTML page (application/pdf)",
+		"/missing":   "HTTP 404 Not Found",
+	}
+	if !reflect.DeepEqual(reasons, want) {
+		t.Errorf("skipped = %v, want %v", reasons, want)
+	}
+
+	crawler = NewCrawler(server.Client(), CrawlOptions{MaxDepth: 3, MaxPages: 2})
+	report, err = crawler.Crawl(context.Background(), server.URL+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Pages) != 2 || !report.Truncated {
+		t.Errorf("a crawl should stop at the page limit: %d pages, truncated = %v", len(report.Pages), report.Truncated)
+	}
+}
+
+func TestCrawlRobotsUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/robots.txt" {
+			t.Errorf("%s was fetched although robots.txt failed", r.URL.Path)
+		}
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	report, err := NewCrawler(server.Client(), CrawlOptions{}).Crawl(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Pages) != 0 || len(report.Skipped) != 1 {
+		t.Errorf("report = %+v, want nothing crawled", report)
+	}
+}
+
+func TestRobotsRules(t *testing.T) {
+	rules := parseRobots(strings.NewReader(`
+User-agent: *
+Disallow: /
+
+User-agent: ogdrip
+Disallow: /shop
+Allow: /shop/*.html$
+Disallow: /*?session=
+Allow: /tmp/
+Disallow: /tmp
+Crawl-delay: 1.5
+`), crawlerAgent)
+
+	tests := map[string]bool{
+		"/":                    true,
+		"/robots.txt":          true,
+		"/shop":                false,
+		"/shop/cart":           false,
+		"/shop/item.html":      true,
+		"/shop/item.html?x=1":  false,
+		"/blog?session=abc":    false,
+		"/tmp/":                true,
+		"/tmp":                 false,
+		"/about/shop/item.htm": true,
+	}
+	for path, want := range tests {
+		u, err := url.Parse(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rules.allowed(u); got != want {
+			t.Errorf("allowed(%q) = %v, want %v", path, got, want)
+		}
+	}
+	if rules.crawlDelay.Seconds() != 1.5 {
+		t.Errorf("crawl delay = %v", rules.crawlDelay)
+	}
+
+	if rules := parseRobots(strings.NewReader("User-agent: *\nDisallow: /private\n"), crawlerAgent); rules.allowed(&url.URL{Path: "/private/a"}) {
+		t.Error("the * group should apply when no group names the crawler")
+	}
+	if rules := parseRobots(strings.NewReader("User-agent: *\nDisallow: /\n\nUser-agent: ogdrip\nDisallow:\n"), crawlerAgent); !rules.allowed(&url.URL{Path: "/page"}) {
+		t.Error("an empty group naming the crawler should override the * group")
+	}
+}
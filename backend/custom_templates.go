@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Largest template accepted for upload
+const maxTemplateBytes = 256 << 10
+
+// Names are used in URLs, so they are kept to a safe character set
+var templateNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Elements a rendered template may contain. Anything else, such as script,
+// iframe or object, could run code inside the shared rendering browser.
+var allowedTemplateElements = toSet(
+	"html", "head", "body", "meta", "title", "style", "link",
+	"div", "span", "p", "br", "hr", "h1", "h2", "h3", "h4", "h5", "h6",
+	"strong", "em", "b", "i", "u", "s", "small", "mark", "sub", "sup", "code", "pre", "blockquote",
+	"ul", "ol", "li", "table", "thead", "tbody", "tfoot", "tr", "td", "th",
+	"section", "header", "footer", "main", "article", "aside", "nav", "figure", "figcaption",
+	"img", "picture", "source", "a",
+	"svg", "g", "defs", "path", "rect", "circle", "ellipse", "line", "polyline", "polygon",
+	"text", "tspan", "lineargradient", "radialgradient", "stop", "clippath", "mask", "pattern", "symbol", "use",
+)
+
+// Attributes a rendered template may use, besides data-* and aria-*
+var allowedTemplateAttributes = toSet(
+	"class", "id", "style", "lang", "dir", "title", "role", "hidden",
+	"charset", "name", "content", "rel", "type", "media", "crossorigin",
+	"src", "srcset", "sizes", "alt", "width", "height", "loading", "decoding", "href", "xlink:href",
+	"colspan", "rowspan",
+	"xmlns", "xmlns:xlink", "viewbox", "preserveaspectratio", "transform", "d", "points",
+	"x", "y", "x1", "y1", "x2", "y2", "cx", "cy", "r", "rx", "ry", "dx", "dy", "offset",
+	"fill", "fill-opacity", "fill-rule", "stroke", "stroke-width", "stroke-opacity", "stroke-linecap",
+	"stroke-linejoin", "stroke-dasharray", "opacity", "stop-color", "stop-opacity", "clip-path", "clip-rule",
+	"mask", "gradientunits", "gradienttransform", "patternunits", "font-family", "font-size", "font-weight",
+	"text-anchor", "dominant-baseline", "letter-spacing",
+)
+
+// Attributes holding URLs, which may not use script schemes
+var templateURLAttributes = toSet("src", "srcset", "href", "xlink:href")
+
+// TemplateStore looks up uploaded card templates. Version 0 means the
+// latest version; a missing template is reported as sql.ErrNoRows.
+type TemplateStore interface {
+	GetTemplate(name string, version int) (*CustomTemplate, error)
+}
+
+// CustomTemplateData is what uploaded templates are executed with: the
+// Open Graph fields plus whatever custom_params the request carried
+type CustomTemplateData struct {
+	OpenGraphData
+	CustomParams map[string]string
+}
+
+// TemplateValidationError lists everything wrong with an uploaded template
+type TemplateValidationError struct {
+	Problems []string
+}
+
+func (e *TemplateValidationError) Error() string {
+	return "invalid template: " + strings.Join(e.Problems, "; ")
+}
+
+// validateCustomTemplate checks a template before it is stored: the name,
+// the size, markup that is not allowed and that it parses and executes
+// against sample data
+func validateCustomTemplate(name, source string) error {
+	var problems []string
+
+	if !templateNamePattern.MatchString(name) {
+		problems = append(problems, "name must be 1-64 lowercase letters, digits, - or _, starting with a letter or digit")
+	} else if isBuiltinTemplate(name) {
+		problems = append(problems, fmt.Sprintf("name %q is taken by a built-in template", name))
+	} else if name == "preview" {
+		problems = append(problems, `name "preview" is reserved`)
+	}
+
+	if strings.TrimSpace(source) == "" {
+		problems = append(problems, "html is empty")
+	} else if len(source) > maxTemplateBytes {
+		problems = append(problems, fmt.Sprintf("html is larger than %d bytes", maxTemplateBytes))
+	}
+
+	if len(problems) == 0 {
+		sample := CustomTemplateData{
+			OpenGraphData: OpenGraphData{
+				Title:       "Sample title",
+				Description: "Sample description",
+				ImageURL:    "https://example.com/og.png",
+				PageURL:     "https://example.com/",
+				Type:        defaultType,
+				SiteName:    "Example",
+				ImageWidth:  defaultImageWidth,
+				ImageHeight: defaultImageHeight,
+				TwitterCard: defaultTwitterCard,
+			},
+			CustomParams: map[string]string{},
+		}
+		// The markup is checked as rendered, so template actions cannot
+		// assemble tags the check would not see in the source
+		if _, err := renderCustomTemplate(source, sample); err != nil {
+			var validationErr *TemplateValidationError
+			if errors.As(err, &validationErr) {
+				problems = append(problems, validationErr.Problems...)
+			} else {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return &TemplateValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// renderCustomTemplate executes an uploaded template and checks the
+// markup it produced. Output with markup that is not allowed is reported
+// as a TemplateValidationError.
+func renderCustomTemplate(source string, data CustomTemplateData) (string, error) {
+	tmpl, err := template.New("custom").Funcs(cardTemplateFuncs).Option("missingkey=zero").Parse(source)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render template: %w", err)
+	}
+	if problems := checkTemplateMarkup(buf.String()); len(problems) > 0 {
+		return "", &TemplateValidationError{Problems: problems}
+	}
+	return buf.String(), nil
+}
+
+// checkTemplateMarkup tokenizes rendered template HTML the way the browser
+// will and reports every element, attribute or URL outside the allowlists
+func checkTemplateMarkup(source string) []string {
+	var problems []string
+	seen := make(map[string]bool)
+	report := func(problem string) {
+		if !seen[problem] {
+			seen[problem] = true
+			problems = append(problems, problem)
+		}
+	}
+
+	z := html.NewTokenizer(strings.NewReader(source))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return problems
+		case html.StartTagToken, html.SelfClosingTagToken, html.EndTagToken:
+			token := z.Token()
+			if !allowedTemplateElements[token.Data] {
+				report(fmt.Sprintf("<%s> elements are not allowed", token.Data))
+			}
+			for _, attr := range token.Attr {
+				key := attr.Key
+				if attr.Namespace != "" {
+					key = attr.Namespace + ":" + key
+				}
+				switch {
+				case strings.HasPrefix(key, "on"):
+					report(fmt.Sprintf("the %s event handler is not allowed", key))
+				case strings.HasPrefix(key, "data-"), strings.HasPrefix(key, "aria-"):
+				case !allowedTemplateAttributes[key]:
+					report(fmt.Sprintf("the %s attribute is not allowed", key))
+				case templateURLAttributes[key] && !safeTemplateURL(attr.Val):
+					report(fmt.Sprintf("the %s attribute has a URL scheme that is not allowed", key))
+				}
+			}
+		}
+	}
+}
+
+// safeTemplateURL accepts relative, http(s) and data:image URLs. Browsers
+// ignore whitespace and control characters in schemes, so they are
+// dropped before the scheme is read.
+func safeTemplateURL(value string) bool {
+	cleaned := strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, strings.ToLower(value))
+
+	scheme, _, found := strings.Cut(cleaned, ":")
+	if !found || strings.ContainsAny(scheme, "/?#,") {
+		return true
+	}
+	switch scheme {
+	case "http", "https":
+		return true
+	case "data":
+		return strings.HasPrefix(cleaned, "data:image/") && !strings.HasPrefix(cleaned, "data:image/svg")
+	}
+	return false
+}
+
+// toSet builds a lookup table from a list of names
+func toSet(names ...string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+// customTemplateData builds the template data for a card generation. The
+// values match what the meta tags will carry.
+func customTemplateData(params GenerationParameters) CustomTemplateData {
+	customParams := params.CustomParams
+	if customParams == nil {
+		customParams = map[string]string{}
+	}
+
+	data := OpenGraphData{
+		Title:       firstNonEmpty(params.Title, "Open Graph Generated Content"),
+		Description: firstNonEmpty(params.Description, "Content shared with Open Graph meta tags"),
+		ImageURL:    params.ImageURL,
+		PageURL:     firstNonEmpty(params.TargetURL, "https://example.com/"),
+		Type:        params.OgType,
+		SiteName:    params.SiteName,
+		ImageWidth:  params.ImageWidth,
+		ImageHeight: params.ImageHeight,
+		TwitterCard: params.TwitterCard,
+	}
+	return CustomTemplateData{
+		OpenGraphData: openGraphParameters(data, params),
+		CustomParams:  customParams,
+	}
+}
+
+// parseCustomParams decodes custom_params sent as a JSON object in a form
+func parseCustomParams(value string) (map[string]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var params map[string]string
+	if err := json.Unmarshal([]byte(value), &params); err != nil {
+		return nil, fmt.Errorf("custom_params must be a JSON object of strings: %w", err)
+	}
+	return params, nil
+}
+
+// handleTemplateUpload stores a new version of a custom template
+func handleTemplateUpload(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		sendErrorResponse(w, "Template storage is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	if err := r.ParseMultipartForm(maxTemplateBytes * 2); err != nil {
+		if err = r.ParseForm(); err != nil {
+			sendErrorResponse(w, "Failed to parse form data", http.StatusBadRequest)
+			return
+		}
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	description := strings.TrimSpace(r.FormValue("description"))
+	source := r.FormValue("html")
+
+	// The HTML may also be uploaded as a file
+	if file, _, err := r.FormFile("file"); err == nil {
+		data, err := io.ReadAll(io.LimitReader(file, maxTemplateBytes+1))
+		file.Close()
+		if err != nil {
+			sendErrorResponse(w, "Failed to read template file", http.StatusBadRequest)
+			return
+		}
+		source = string(data)
+	}
+
+	if err := validateCustomTemplate(name, source); err != nil {
+		sendTemplateValidationError(w, err)
+		return
+	}
+
+	tmpl, err := db.SaveTemplate(name, description, source)
+	if err != nil {
+		log.Printf("Error saving template %s: %v", name, err)
+		captureError(err, map[string]interface{}{
+			"operation": "save_template",
+			"template":  name,
+		})
+		sendErrorResponse(w, "Failed to save template", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl.HTML = ""
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Template %s saved as version %d", tmpl.Name, tmpl.Version),
+		"data":    tmpl,
+	})
+}
+
+// handleTemplateRequest serves /api/templates/{name}: GET returns a version
+// with its HTML and the version history, DELETE removes one or all versions
+func handleTemplateRequest(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/templates/")
+	if name == "preview" {
+		handleTemplatePreviewRequest(w, r)
+		return
+	}
+	if name == "" || strings.Contains(name, "/") {
+		sendErrorResponse(w, "Template name is required", http.StatusBadRequest)
+		return
+	}
+	if isBuiltinTemplate(name) {
+		sendErrorResponse(w, "Built-in templates cannot be fetched or changed", http.StatusBadRequest)
+		return
+	}
+	if db == nil {
+		sendErrorResponse(w, "Template storage is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	version := 0
+	if v := r.URL.Query().Get("version"); v != "" {
+		var err error
+		if version, err = strconv.Atoi(v); err != nil || version < 1 {
+			sendErrorResponse(w, "version must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		tmpl, err := db.GetTemplate(name, version)
+		if errors.Is(err, sql.ErrNoRows) {
+			sendErrorResponse(w, "Template not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Error loading template %s: %v", name, err)
+			sendErrorResponse(w, "Failed to load template", http.StatusInternalServerError)
+			return
+		}
+
+		versions, err := db.ListTemplateVersions(name)
+		if err != nil {
+			log.Printf("Error listing versions of template %s: %v", name, err)
+			sendErrorResponse(w, "Failed to load template", http.StatusInternalServerError)
+			return
+		}
+
+		sendJSONResponse(w, map[string]interface{}{
+			"success":  true,
+			"data":     tmpl,
+			"versions": versions,
+		})
+
+	case http.MethodDelete:
+		deleted, err := db.DeleteTemplate(name, version)
+		if err != nil {
+			log.Printf("Error deleting template %s: %v", name, err)
+			sendErrorResponse(w, "Failed to delete template", http.StatusInternalServerError)
+			return
+		}
+		if deleted == 0 {
+			sendErrorResponse(w, "Template not found", http.StatusNotFound)
+			return
+		}
+
+		sendJSONResponse(w, map[string]interface{}{
+			"success": true,
+			"message": fmt.Sprintf("Deleted %d version(s) of template %s", deleted, name),
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleTemplatePreviewRequest renders a stored template, or HTML sent
+// with the request, and returns the image directly without saving it
+func handleTemplatePreviewRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseMultipartForm(maxTemplateBytes * 2); err != nil {
+		if err = r.ParseForm(); err != nil {
+			sendErrorResponse(w, "Failed to parse form data", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The page URL is ignored for previews, everything else follows /api/generate
+	if err := validateForm(r.Form, "html"); err != nil {
+		sendValidationError(w, err)
+		return
+	}
+
+	params := previewParameters(r.Form)
+	if params.TemplateHTML != "" {
+		// Unsaved templates get the same checks as uploads, under a placeholder name
+		if err := validateCustomTemplate("preview-draft", params.TemplateHTML); err != nil {
+			sendTemplateValidationError(w, err)
+			return
+		}
+	} else if params.Template == "" {
+		sendErrorResponse(w, "Either template or html is required", http.StatusBadRequest)
+		return
+	}
+
+	if generator == nil || jobQueue == nil {
+		sendErrorResponse(w, "Template rendering is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), generationTimeout)
+	defer cancel()
+
+	result, err := renderPreviewQueued(ctx, params)
+	if errors.Is(err, ErrQueueFull) || errors.Is(err, ErrQueueStopped) {
+		log.Printf("Rejecting template preview: %v", err)
+		sendQueueError(w, err)
+		return
+	} else if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrUnknownTemplate) {
+			status = http.StatusBadRequest
+		}
+		sendErrorResponse(w, fmt.Sprintf("Failed to render preview: %v", err), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", result.Metadata.ImageType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(result.Image)
+}
+
+// renderPreviewQueued renders a preview as a job on the generation queue,
+// so previews share its browser tabs and its limit
+func renderPreviewQueued(ctx context.Context, params GenerationParameters) (*Result, error) {
+	job := NewJob("preview_"+generateRequestID(), params, "", "")
+	job.Task = func(jobCtx context.Context) (*Result, error) {
+		// Give up with the request as well as at the job timeout
+		jobCtx, cancel := context.WithCancel(jobCtx)
+		defer context.AfterFunc(ctx, cancel)()
+		defer cancel()
+
+		return generator.Generate(jobCtx, params)
+	}
+	if err := jobQueue.Submit(job); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-job.Done():
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return job.Result()
+}
+
+// previewParameters maps a preview form onto generation parameters. The
+// page URL is ignored; previews always render a template.
+func previewParameters(form url.Values) GenerationParameters {
+	params := parametersFromForm(form)
+	params.WebpageURL = ""
+	params.TemplateHTML = form.Get("html")
+	return params
+}
+
+// sendTemplateValidationError reports every problem found in a template
+func sendTemplateValidationError(w http.ResponseWriter, err error) {
+	var validationErr *TemplateValidationError
+	if !errors.As(err, &validationErr) {
+		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false,
+		"message": "Invalid template",
+		"errors":  validationErr.Problems,
+	})
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateCustomTemplate(t *testing.T) {
+	valid := `<html><body style="width: {{.ImageWidth}}px"><h1>{{.Title}}</h1><p>{{.CustomParams.tagline}}</p></body></html>`
+	if err := validateCustomTemplate("team-card", valid); err != nil {
+		t.Errorf("Expected a valid template, got %v", err)
+	}
+
+	tests := map[string]struct {
+		name   string
+		source string
+	}{
+		"bad name":       {"Team Card", valid},
+		"builtin name":   {defaultCardTemplate, valid},
+		"reserved name":  {"preview", valid},
+		"empty":          {"team-card", "  "},
+		"script":         {"team-card", `<h1>{{.Title}}</h1><script>fetch("/")</script>`},
+		"event handler":  {"team-card", `<img src="x" onerror="alert(1)">`},
+		"parse error":    {"team-card", `<h1>{{.Title}</h1>`},
+		"unknown field":  {"team-card", `<h1>{{.Headline}}</h1>`},
+		"too large":      {"team-card", strings.Repeat("a", maxTemplateBytes+1)},
+		"javascript url": {"team-card", `<a href="javascript:void(0)">x</a>`},
+		"split script":   {"team-card", `<scr{{/* */}}ipt>alert(1)</scr{{/* */}}ipt>`},
+		"slash handler":  {"team-card", `<svg/onload=alert(1)>`},
+		"spaced scheme":  {"team-card", `<a href=" java&#9;script:alert(1)">x</a>`},
+		"iframe":         {"team-card", `<iframe src="https://example.com"></iframe>`},
+	}
+
+	for label, tt := range tests {
+		err := validateCustomTemplate(tt.name, tt.source)
+		var validationErr *TemplateValidationError
+		if !errors.As(err, &validationErr) || len(validationErr.Problems) == 0 {
+			t.Errorf("%s: expected a validation error, got %v", label, err)
+		}
+	}
+}
+
+func TestCheckTemplateMarkup(t *testing.T) {
+	allowed := `<html><head><style>h1 { color: red }</style></head><body class="card" data-theme="dark">
+<svg viewBox="0 0 10 10"><path d="M0 0L10 10" stroke="#fff"/></svg>
+<img src="data:image/png;base64,AAAA" alt=""><img src="/logo.png"><a href="https://example.com">x</a></body></html>`
+	if problems := checkTemplateMarkup(allowed); len(problems) > 0 {
+		t.Errorf("Expected the markup to be allowed, got %v", problems)
+	}
+
+	// Template actions can split a tag the source never spells out
+	_, err := renderCustomTemplate(`<scr{{if true}}{{end}}ipt>alert(1)</script>`, customTemplateData(GenerationParameters{}))
+	var validationErr *TemplateValidationError
+	if !errors.As(err, &validationErr) || !strings.Contains(err.Error(), "<script>") {
+		t.Errorf("Expected the rendered script to be rejected, got %v", err)
+	}
+
+	problems := checkTemplateMarkup(`<svg/onload=alert(1)><img src=x onerror=alert(1)>`)
+	if strings.Join(problems, "|") != "the onload event handler is not allowed|the onerror event handler is not allowed" {
+		t.Errorf("problems = %v", problems)
+	}
+}
+
+func TestRenderCustomTemplate(t *testing.T) {
+	params := applyParameterDefaults(GenerationParameters{
+		Title:        "Launch <day>",
+		CustomParams: map[string]string{"tagline": "Ship it"},
+	})
+
+	html, err := renderCustomTemplate(`<h1>{{.Title}}</h1><p>{{.CustomParams.tagline}}</p><i>{{.CustomParams.missing}}</i>`, customTemplateData(params))
+	if err != nil {
+		t.Fatalf("renderCustomTemplate returned error: %v", err)
+	}
+	if !strings.Contains(html, "<h1>Launch &lt;day&gt;</h1>") {
+		t.Errorf("Expected the escaped title, got %s", html)
+	}
+	if !strings.Contains(html, "<p>Ship it</p>") || !strings.Contains(html, "<i></i>") {
+		t.Errorf("Expected custom params to be rendered, got %s", html)
+	}
+}
+
+func TestTemplateVersions(t *testing.T) {
+	database := newTestDatabase(t)
+
+	for _, html := range []string{"<h1>v1</h1>", "<h1>v2</h1>"} {
+		if _, err := database.SaveTemplate("team-card", "Team card", html); err != nil {
+			t.Fatalf("SaveTemplate returned error: %v", err)
+		}
+	}
+
+	latest, err := database.GetTemplate("team-card", 0)
+	if err != nil {
+		t.Fatalf("GetTemplate returned error: %v", err)
+	}
+	if latest.Version != 2 || latest.HTML != "<h1>v2</h1>" {
+		t.Errorf("Expected version 2, got version %d with %s", latest.Version, latest.HTML)
+	}
+
+	// The generator renders pinned versions from the store
+	g := NewGenerator(NewBrowserPool(BrowserPoolOptions{}))
+	g.SetTemplateStore(database)
+	html, err := g.cardHTML(GenerationParameters{Template: "team-card", TemplateVersion: 1})
+	if err != nil || html != "<h1>v1</h1>" {
+		t.Errorf("Expected version 1 to render, got %q, %v", html, err)
+	}
+	if _, err := g.cardHTML(GenerationParameters{Template: "team-card", TemplateVersion: 3}); err == nil {
+		t.Error("Expected an error for a missing version")
+	}
+
+	list, err := database.ListTemplates()
+	if err != nil || len(list) != 1 || list[0].Version != 2 {
+		t.Errorf("Expected one template at version 2, got %+v, %v", list, err)
+	}
+
+	deleted, err := database.DeleteTemplate("team-card", 1)
+	if err != nil || deleted != 1 {
+		t.Errorf("Expected one version deleted, got %d, %v", deleted, err)
+	}
+	versions, err := database.ListTemplateVersions("team-card")
+	if err != nil || len(versions) != 1 || versions[0].Version != 2 {
+		t.Errorf("Expected only version 2 to remain, got %+v, %v", versions, err)
+	}
+}
+
+func TestTemplateUploadHandler(t *testing.T) {
+	previous := db
+	db = newTestDatabase(t)
+	defer func() { db = previous }()
+
+	upload := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/templates", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handleTemplatesRequest(rec, req)
+		return rec
+	}
+
+	rec := upload(url.Values{"name": {"team-card"}, "html": {"<h1>{{.Title}}</h1>"}})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = upload(url.Values{"name": {"team-card"}, "html": {"<script></script>"}})
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "script\\u003e elements are not allowed") {
+		t.Errorf("Expected a 400 listing the problem, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/templates/team-card", nil)
+	rec = httptest.NewRecorder()
+	handleTemplateRequest(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"version":1`) {
+		t.Errorf("Expected the stored template, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/api/templates/team-card", nil)
+	rec = httptest.NewRecorder()
+	handleTemplateRequest(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected the template to be deleted, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestTemplateChangesNeedAdminToken(t *testing.T) {
+	previous := db
+	db = newTestDatabase(t)
+	defer func() { db = previous }()
+	t.Setenv("ADMIN_TOKEN", "secret")
+
+	upload := adminOnlyMethods(handleTemplatesRequest, http.MethodPost)
+	remove := adminOnlyMethods(handleTemplateRequest, http.MethodPost, http.MethodDelete)
+	call := func(handler http.HandlerFunc, method, path, token string, body url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+	form := url.Values{"name": {"team-card"}, "html": {"<h1>{{.Title}}</h1>"}}
+
+	if rec := call(upload, http.MethodPost, "/api/templates", "", form); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an upload without a token, got %d", rec.Code)
+	}
+	if rec := call(upload, http.MethodPost, "/api/templates", "wrong", form); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an upload with the wrong token, got %d", rec.Code)
+	}
+	if rec := call(upload, http.MethodPost, "/api/templates", "secret", form); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 with the token, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := call(upload, http.MethodGet, "/api/templates", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("Expected listing templates to stay open, got %d", rec.Code)
+	}
+	if rec := call(remove, http.MethodGet, "/api/templates/team-card", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("Expected fetching a template to stay open, got %d", rec.Code)
+	}
+	if rec := call(remove, http.MethodDelete, "/api/templates/team-card", "", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a delete without a token, got %d", rec.Code)
+	}
+	if rec := call(remove, http.MethodDelete, "/api/templates/team-card", "secret", nil); rec.Code != http.StatusOK {
+		t.Errorf("Expected the delete to succeed with the token, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Previews render on the generation queue, so they need the token too
+	preview := url.Values{"template": {"missing"}, "title": {"Hello"}}
+	if rec := call(remove, http.MethodPost, "/api/templates/preview", "", preview); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a preview without a token, got %d", rec.Code)
+	}
+
+	savedQueue := jobQueue
+	defer func() { jobQueue = savedQueue }()
+	jobQueue = NewJobQueue(1, 1, time.Minute, nil)
+	jobQueue.Start()
+	defer jobQueue.Stop()
+	if rec := call(remove, http.MethodPost, "/api/templates/preview", "secret", preview); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown template, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	jobQueue = NewJobQueue(1, 1, time.Minute, nil)
+	if err := jobQueue.Submit(NewJob("waiting", GenerationParameters{}, "", "")); err != nil {
+		t.Fatal(err)
+	}
+	rec := call(remove, http.MethodPost, "/api/templates/preview", "secret", preview)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("full queue: status = %d, Retry-After = %q, want 429 with a Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
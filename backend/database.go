@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -14,19 +15,32 @@ import (
 
 // Generation represents a record of an OpenGraph image generation
 type Generation struct {
-	ID            string    `json:"id"`
-	Title         string    `json:"title"`
-	Description   string    `json:"description"`
-	TargetURL     string    `json:"target_url"`
-	ImagePath     string    `json:"image_path"`
-	HTMLPath      string    `json:"html_path"`
-	CreatedAt     time.Time `json:"created_at"`
-	ClientIP      string    `json:"client_ip"`
-	UserAgent     string    `json:"user_agent"`
-	Parameters    string    `json:"parameters"` // JSON string of all parameters
-	Status        string    `json:"status"`     // pending, completed, failed
-	ErrorMessage  string    `json:"error_message,omitempty"`
-	DownloadCount int       `json:"download_count"`
+	ID            string     `json:"id"`
+	Title         string     `json:"title"`
+	Description   string     `json:"description"`
+	TargetURL     string     `json:"target_url"`
+	ImagePath     string     `json:"image_path"`
+	HTMLPath      string     `json:"html_path"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ClientIP      string     `json:"client_ip"`
+	UserAgent     string     `json:"user_agent"`
+	Parameters    string     `json:"parameters"` // JSON string of all parameters
+	Status        string     `json:"status"`     // pending, rendering, completed, failed
+	ErrorMessage  string     `json:"error_message,omitempty"`
+	DownloadCount int        `json:"download_count"`
+	RenderingAt   *time.Time `json:"rendering_at,omitempty"` // When a worker started rendering
+	CompletedAt   *time.Time `json:"completed_at,omitempty"`
+	FailedAt      *time.Time `json:"failed_at,omitempty"`
+
+	FailureReason   string `json:"failure_reason,omitempty"`   // blocked_scheme, blocked_address, unresolved_host, timeout or error
+	BlockedRequests string `json:"blocked_requests,omitempty"` // JSON list of requests the network policy refused
+	TextFit         string `json:"-"`                          // JSON list of how card text was fitted, served decoded with the asset URLs
+	Metadata        string `json:"-"`                          // JSON of the merged metadata and what the page held, served decoded with the asset URLs
+
+	BatchID    string `json:"batch_id,omitempty"`    // Batch the generation was submitted in
+	BatchIndex int    `json:"batch_index,omitempty"` // Position within the batch
+
+	WebhookClient string `json:"-"` // Client whose secret signs the generation's webhooks
 }
 
 // Database struct for SQLite operations
@@ -37,6 +51,9 @@ type Database struct {
 var dbInstance *Database
 var dbInitError error
 
+// databasePath is where the generations database is kept
+var databasePath = filepath.Join("data", "generations.db")
+
 // InitDB initializes the SQLite database
 func InitDB() (*Database, error) {
 	// If we already have an instance, return it
@@ -50,14 +67,12 @@ func InitDB() (*Database, error) {
 	}
 
 	// Ensure the data directory exists
-	dataDir := filepath.Join(".", "data")
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
+	if err := os.MkdirAll(filepath.Dir(databasePath), 0755); err != nil {
 		dbInitError = fmt.Errorf("failed to create data directory: %w", err)
 		return nil, dbInitError
 	}
 
-	dbPath := filepath.Join(dataDir, "generations.db")
-	db, err := sql.Open("sqlite3", dbPath)
+	db, err := sql.Open("sqlite3", databasePath)
 	if err != nil {
 		dbInitError = fmt.Errorf("failed to open database: %w", err)
 		return nil, dbInitError
@@ -96,11 +111,38 @@ func InitDB() (*Database, error) {
 		return nil, dbInitError
 	}
 
+	// Bring tables created by older versions up to date
+	if err := migrateGenerationsTable(db); err != nil {
+		db.Close()
+		dbInitError = fmt.Errorf("failed to migrate table: %w", err)
+		return nil, dbInitError
+	}
+
+	// Uploaded card templates live next to the generations
+	if err := createTemplatesTable(db); err != nil {
+		db.Close()
+		dbInitError = fmt.Errorf("failed to create templates table: %w", err)
+		return nil, dbInitError
+	}
+
+	if err := createBatchesTable(db); err != nil {
+		db.Close()
+		dbInitError = fmt.Errorf("failed to create batches table: %w", err)
+		return nil, dbInitError
+	}
+
+	if err := createWebhookDeliveriesTable(db); err != nil {
+		db.Close()
+		dbInitError = fmt.Errorf("failed to create webhook deliveries table: %w", err)
+		return nil, dbInitError
+	}
+
 	// Create indexes for faster queries
 	indexQueries := []string{
 		`CREATE INDEX IF NOT EXISTS idx_created_at ON generations(created_at);`,
 		`CREATE INDEX IF NOT EXISTS idx_cleanup_after ON generations(cleanup_after);`,
 		`CREATE INDEX IF NOT EXISTS idx_status ON generations(status);`,
+		`CREATE INDEX IF NOT EXISTS idx_batch_id ON generations(batch_id);`,
 	}
 
 	for _, query := range indexQueries {
@@ -113,6 +155,71 @@ func InitDB() (*Database, error) {
 	return dbInstance, nil
 }
 
+// migrateGenerationsTable adds columns introduced after the generations
+// table was first created
+func migrateGenerationsTable(db *sql.DB) error {
+	return addMissingColumns(db, "generations", []tableColumn{
+		{"rendering_at", "TIMESTAMP"},
+		{"completed_at", "TIMESTAMP"},
+		{"failed_at", "TIMESTAMP"},
+		{"failure_reason", "TEXT"},
+		{"blocked_requests", "TEXT"},
+		{"text_fit", "TEXT"},
+		{"metadata", "TEXT"},
+		{"batch_id", "TEXT"},
+		{"batch_index", "INTEGER"},
+		{"webhook_client", "TEXT"},
+	})
+}
+
+// tableColumn is a column added to a table after it was first created
+type tableColumn struct {
+	name       string
+	definition string
+}
+
+// addMissingColumns adds the columns a table created by an older version
+// does not have yet
+func addMissingColumns(db *sql.DB, table string, columns []tableColumn) error {
+	rows, err := db.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		existing[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, col := range columns {
+		if existing[col.name] {
+			continue
+		}
+		query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, col.name, col.definition)
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("failed to add column %s: %w", col.name, err)
+		}
+		log.Printf("Added column %s to %s table", col.name, table)
+	}
+
+	return nil
+}
+
 // CloseDB closes the database connection
 func (db *Database) CloseDB() error {
 	if db.db != nil {
@@ -176,8 +283,8 @@ func (db *Database) SaveGeneration(gen *Generation) error {
 	INSERT INTO generations (
 		id, title, description, target_url, image_path, html_path,
 		created_at, client_ip, user_agent, parameters, cleanup_after,
-		status, error_message, download_count
-	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		status, error_message, download_count, batch_id, batch_index, webhook_client
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
 	_, err := db.db.Exec(
@@ -196,6 +303,9 @@ func (db *Database) SaveGeneration(gen *Generation) error {
 		gen.Status,
 		gen.ErrorMessage,
 		gen.DownloadCount,
+		gen.BatchID,
+		gen.BatchIndex,
+		gen.WebhookClient,
 	)
 
 	return err
@@ -208,13 +318,17 @@ func (db *Database) GetGeneration(id string) (*Generation, error) {
 	}
 
 	query := `SELECT id, title, description, target_url, image_path, html_path,
-		created_at, client_ip, user_agent, parameters, status, error_message, download_count
+		created_at, client_ip, user_agent, parameters, status, error_message, download_count,
+		rendering_at, completed_at, failed_at,
+		COALESCE(failure_reason, ''), COALESCE(blocked_requests, ''), COALESCE(text_fit, ''), COALESCE(metadata, ''),
+		COALESCE(batch_id, ''), COALESCE(batch_index, 0), COALESCE(webhook_client, '')
 		FROM generations WHERE id = ?`
 
 	row := db.db.QueryRow(query, id)
 
 	gen := &Generation{}
 	var createdAtStr string
+	var stages stageTimes
 
 	err := row.Scan(
 		&gen.ID,
@@ -230,11 +344,22 @@ func (db *Database) GetGeneration(id string) (*Generation, error) {
 		&gen.Status,
 		&gen.ErrorMessage,
 		&gen.DownloadCount,
+		&stages.rendering,
+		&stages.completed,
+		&stages.failed,
+		&gen.FailureReason,
+		&gen.BlockedRequests,
+		&gen.TextFit,
+		&gen.Metadata,
+		&gen.BatchID,
+		&gen.BatchIndex,
+		&gen.WebhookClient,
 	)
 
 	if err != nil {
 		return nil, err
 	}
+	stages.apply(gen)
 
 	gen.CreatedAt, err = time.Parse(time.RFC3339, createdAtStr)
 	if err != nil {
@@ -313,7 +438,7 @@ func (db *Database) UpdateStatus(id string, status string) error {
 		return fmt.Errorf("database connection error: %w", err)
 	}
 
-	query := `UPDATE generations SET status = ? WHERE id = ?`
+	query := fmt.Sprintf(`UPDATE generations SET status = ?%s WHERE id = ?`, stageTimestampAssignment(status))
 	_, err := db.db.Exec(query, status, id)
 	return err
 }
@@ -324,18 +449,72 @@ func (db *Database) SetErrorMessage(id string, errorMsg string) error {
 		return fmt.Errorf("database connection error: %w", err)
 	}
 
-	query := `UPDATE generations SET status = 'failed', error_message = ? WHERE id = ?`
+	query := `UPDATE generations SET status = 'failed', error_message = ?, failed_at = CURRENT_TIMESTAMP WHERE id = ?`
 	_, err := db.db.Exec(query, errorMsg, id)
 	return err
 }
 
+// SetFailureReason records why a generation failed
+func (db *Database) SetFailureReason(id string, reason string) error {
+	if err := db.ensureConnection(); err != nil {
+		return fmt.Errorf("database connection error: %w", err)
+	}
+
+	_, err := db.db.Exec(`UPDATE generations SET failure_reason = ? WHERE id = ?`, reason, id)
+	return err
+}
+
+// SetBlockedRequests records the requests the network policy refused
+// while rendering a generation
+func (db *Database) SetBlockedRequests(id string, blocked []BlockedRequest) error {
+	if err := db.ensureConnection(); err != nil {
+		return fmt.Errorf("database connection error: %w", err)
+	}
+
+	data, err := json.Marshal(blocked)
+	if err != nil {
+		return err
+	}
+	_, err = db.db.Exec(`UPDATE generations SET blocked_requests = ? WHERE id = ?`, string(data), id)
+	return err
+}
+
+// SetTextFit records how the text of a card generation was fitted
+func (db *Database) SetTextFit(id string, fits []TextFit) error {
+	if err := db.ensureConnection(); err != nil {
+		return fmt.Errorf("database connection error: %w", err)
+	}
+
+	data, err := json.Marshal(fits)
+	if err != nil {
+		return err
+	}
+	_, err = db.db.Exec(`UPDATE generations SET text_fit = ? WHERE id = ?`, string(data), id)
+	return err
+}
+
+// SetMetadata records the merged metadata of a generation and the
+// metadata read from its page
+func (db *Database) SetMetadata(id string, fields map[string]MetadataField, extracted *PageMetadata) error {
+	if err := db.ensureConnection(); err != nil {
+		return fmt.Errorf("database connection error: %w", err)
+	}
+
+	data, err := json.Marshal(storedMetadata{Fields: fields, Extracted: extracted})
+	if err != nil {
+		return err
+	}
+	_, err = db.db.Exec(`UPDATE generations SET metadata = ? WHERE id = ?`, string(data), id)
+	return err
+}
+
 // MarkAsCompleted marks a generation as completed
 func (db *Database) MarkAsCompleted(id string) error {
 	if err := db.ensureConnection(); err != nil {
 		return fmt.Errorf("database connection error: %w", err)
 	}
 
-	query := `UPDATE generations SET status = 'completed' WHERE id = ?`
+	query := `UPDATE generations SET status = 'completed', completed_at = CURRENT_TIMESTAMP WHERE id = ?`
 	_, err := db.db.Exec(query, id)
 	return err
 }
@@ -351,17 +530,18 @@ func (db *Database) SetCleanupTime(id string, cleanupAfter time.Time) error {
 	return err
 }
 
-// RunCleanup performs cleanup of old generations
-func (db *Database) RunCleanup() error {
+// RunCleanup deletes the generations past their cleanup time, and their
+// files, and returns how many were deleted
+func (db *Database) RunCleanup() (int, error) {
 	if err := db.ensureConnection(); err != nil {
-		return fmt.Errorf("database connection error: %w", err)
+		return 0, fmt.Errorf("database connection error: %w", err)
 	}
 
 	// Get records that are due for cleanup
 	query := `SELECT id, image_path, html_path FROM generations WHERE cleanup_after < ?`
 	rows, err := db.db.Query(query, time.Now())
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer rows.Close()
 
@@ -384,7 +564,9 @@ func (db *Database) RunCleanup() error {
 			filesToDelete[imagePath] = struct{}{}
 		}
 		if htmlPath != "" {
-			filesToDelete[htmlPath] = struct{}{}
+			for _, path := range generationOutputFiles(htmlPath) {
+				filesToDelete[path] = struct{}{}
+			}
 		}
 	}
 
@@ -412,18 +594,25 @@ func (db *Database) RunCleanup() error {
 
 		deleteQuery := fmt.Sprintf(
 			"DELETE FROM generations WHERE id IN (%s)",
-			placeholders,
+			strings.Join(placeholders, ", "),
 		)
 
 		_, err = db.db.Exec(deleteQuery, args...)
 		if err != nil {
-			return fmt.Errorf("failed to delete records: %w", err)
+			return 0, fmt.Errorf("failed to delete records: %w", err)
 		}
 
 		log.Printf("Cleaned up %d records", len(ids))
 	}
 
-	return nil
+	if err := db.cleanupBatches(); err != nil {
+		return len(ids), fmt.Errorf("failed to clean up batches: %w", err)
+	}
+	if err := db.cleanupWebhookDeliveries(); err != nil {
+		return len(ids), fmt.Errorf("failed to clean up webhook deliveries: %w", err)
+	}
+
+	return len(ids), nil
 }
 
 // GenerationParameters captures all parameters for a generation
@@ -439,8 +628,67 @@ type GenerationParameters struct {
 	ImageHeight int    `json:"image_height,omitempty"`
 	Quality     int    `json:"quality,omitempty"`
 	WaitTime    int    `json:"wait_time,omitempty"`
-	Debug       bool   `json:"debug,omitempty"`
-	Verbose     bool   `json:"verbose,omitempty"`
+	Selector    string `json:"selector,omitempty"`
+	ImageURL    string `json:"image_url,omitempty"` // Public URL the image will be served from
+
+	DeviceScaleFactor float64 `json:"device_scale_factor,omitempty"` // 2 for retina output
+	CaptureMode       string  `json:"capture_mode,omitempty"`        // viewport, fullpage or element
+	Format            string  `json:"format,omitempty"`              // png, jpeg or webp
+
+	CaptureSelector   string `json:"capture_selector,omitempty"`   // Screenshot only this element, scaled into the image
+	CapturePadding    int    `json:"capture_padding,omitempty"`    // CSS pixels kept clear around the element
+	CaptureBackground string `json:"capture_background,omitempty"` // Fill around the element, e.g. #ffffff
+
+	Processing *ImageProcessing `json:"processing,omitempty"` // Steps applied to the screenshot before saving
+
+	// Card template rendered when no webpage URL is given
+	Template        string `json:"template,omitempty"`
+	LogoURL         string `json:"logo_url,omitempty"`
+	BackgroundColor string `json:"background_color,omitempty"`
+	TextColor       string `json:"text_color,omitempty"`
+	AccentColor     string `json:"accent_color,omitempty"`
+	TemplateVersion int    `json:"template_version,omitempty"` // Version of an uploaded template, 0 for the latest
+
+	// Font size range the card title is fitted within, overriding the template's
+	TitleMinFontSize int `json:"title_min_font_size,omitempty"`
+	TitleMaxFontSize int `json:"title_max_font_size,omitempty"`
+
+	MetaFormat string `json:"meta_format,omitempty"` // Meta output returned inline; all formats are written
+	Previews   bool   `json:"previews,omitempty"`    // Render each platform's link preview as an image
+	Enrich     bool   `json:"enrich,omitempty"`      // Fill every unset tag from the page's own metadata
+
+	// Extended Open Graph properties; lists are published as repeated tags
+	Locale               string   `json:"locale,omitempty"`
+	LocaleAlternates     []string `json:"locale_alternates,omitempty"`
+	ImageAlt             string   `json:"image_alt,omitempty"`
+	Images               []string `json:"images,omitempty"`
+	VideoURL             string   `json:"video_url,omitempty"`
+	VideoType            string   `json:"video_type,omitempty"`
+	VideoWidth           int      `json:"video_width,omitempty"`
+	VideoHeight          int      `json:"video_height,omitempty"`
+	AudioURL             string   `json:"audio_url,omitempty"`
+	AudioType            string   `json:"audio_type,omitempty"`
+	ArticlePublishedTime string   `json:"article_published_time,omitempty"`
+	ArticleModifiedTime  string   `json:"article_modified_time,omitempty"`
+	ArticleAuthors       []string `json:"article_authors,omitempty"`
+	ArticleSection       string   `json:"article_section,omitempty"`
+	ArticleTags          []string `json:"article_tags,omitempty"`
+	ProductPriceAmount   string   `json:"product_price_amount,omitempty"`
+	ProductPriceCurrency string   `json:"product_price_currency,omitempty"`
+	ProfileFirstName     string   `json:"profile_first_name,omitempty"`
+	ProfileLastName      string   `json:"profile_last_name,omitempty"`
+	ProfileUsername      string   `json:"profile_username,omitempty"`
+	ProfileGender        string   `json:"profile_gender,omitempty"`
+	TwitterSite          string   `json:"twitter_site,omitempty"`
+	TwitterCreator       string   `json:"twitter_creator,omitempty"`
+
+	CustomParams map[string]string `json:"custom_params,omitempty"` // Extra values for uploaded templates
+	TemplateHTML string            `json:"-"`                       // Unsaved template HTML, only used for previews
+
+	Debug   bool `json:"debug,omitempty"`
+	Verbose bool `json:"verbose,omitempty"`
+
+	CallbackURL string `json:"callback_url,omitempty"` // Webhook notified when the generation finishes
 }
 
 // SerializeParameters converts parameters to a JSON string
@@ -472,7 +720,8 @@ func (db *Database) GetRecentGenerations(limit, offset int) ([]Generation, error
 	query := `
 		SELECT id, title, description, target_url, image_path, html_path,
 		       created_at, client_ip, user_agent, parameters, status,
-		       error_message, download_count
+		       error_message, download_count, rendering_at, completed_at, failed_at,
+		       COALESCE(failure_reason, ''), COALESCE(blocked_requests, '')
 		FROM generations
 		ORDER BY created_at DESC
 		LIMIT ? OFFSET ?
@@ -488,6 +737,7 @@ func (db *Database) GetRecentGenerations(limit, offset int) ([]Generation, error
 	for rows.Next() {
 		var gen Generation
 		var createdAtStr string
+		var stages stageTimes
 
 		err := rows.Scan(
 			&gen.ID,
@@ -503,12 +753,18 @@ func (db *Database) GetRecentGenerations(limit, offset int) ([]Generation, error
 			&gen.Status,
 			&gen.ErrorMessage,
 			&gen.DownloadCount,
+			&stages.rendering,
+			&stages.completed,
+			&stages.failed,
+			&gen.FailureReason,
+			&gen.BlockedRequests,
 		)
 
 		if err != nil {
 			log.Printf("Error scanning generation row: %v", err)
 			continue
 		}
+		stages.apply(&gen)
 
 		// Parse the created_at timestamp
 		createdAt, err := time.Parse("2006-01-02 15:04:05", createdAtStr)
@@ -562,13 +818,15 @@ func (db *Database) GetGenerationByID(id string) (*Generation, error) {
 	query := `
 		SELECT id, title, description, target_url, image_path, html_path,
 		       created_at, client_ip, user_agent, parameters, status,
-		       error_message, download_count
+		       error_message, download_count, rendering_at, completed_at, failed_at,
+		       COALESCE(failure_reason, ''), COALESCE(blocked_requests, '')
 		FROM generations
 		WHERE id = ?
 	`
 
 	var gen Generation
 	var createdAtStr string
+	var stages stageTimes
 
 	err := db.db.QueryRow(query, id).Scan(
 		&gen.ID,
@@ -584,6 +842,11 @@ func (db *Database) GetGenerationByID(id string) (*Generation, error) {
 		&gen.Status,
 		&gen.ErrorMessage,
 		&gen.DownloadCount,
+		&stages.rendering,
+		&stages.completed,
+		&stages.failed,
+		&gen.FailureReason,
+		&gen.BlockedRequests,
 	)
 
 	if err != nil {
@@ -602,6 +865,7 @@ func (db *Database) GetGenerationByID(id string) (*Generation, error) {
 		createdAt = time.Now()
 	}
 	gen.CreatedAt = createdAt
+	stages.apply(&gen)
 
 	return &gen, nil
 }
@@ -621,6 +885,7 @@ func (db *Database) UpdateGenerationStatus(id string, status string, errorMessag
 	// Validate status
 	validStatuses := map[string]bool{
 		"pending":   true,
+		"rendering": true,
 		"completed": true,
 		"failed":    true,
 	}
@@ -633,11 +898,12 @@ func (db *Database) UpdateGenerationStatus(id string, status string, errorMessag
 	var query string
 	var args []interface{}
 
+	stageTimestamp := stageTimestampAssignment(status)
 	if errorMessage != "" {
-		query = `UPDATE generations SET status = ?, error_message = ? WHERE id = ?`
+		query = fmt.Sprintf(`UPDATE generations SET status = ?, error_message = ?%s WHERE id = ?`, stageTimestamp)
 		args = []interface{}{status, errorMessage, id}
 	} else {
-		query = `UPDATE generations SET status = ? WHERE id = ?`
+		query = fmt.Sprintf(`UPDATE generations SET status = ?%s WHERE id = ?`, stageTimestamp)
 		args = []interface{}{status, id}
 	}
 
@@ -659,3 +925,456 @@ func (db *Database) UpdateGenerationStatus(id string, status string, errorMessag
 
 	return nil
 }
+
+// stageTimes holds the nullable stage timestamps while scanning a row
+type stageTimes struct {
+	rendering sql.NullTime
+	completed sql.NullTime
+	failed    sql.NullTime
+}
+
+// apply copies the scanned stage timestamps onto a generation
+func (st stageTimes) apply(gen *Generation) {
+	if st.rendering.Valid {
+		gen.RenderingAt = &st.rendering.Time
+	}
+	if st.completed.Valid {
+		gen.CompletedAt = &st.completed.Time
+	}
+	if st.failed.Valid {
+		gen.FailedAt = &st.failed.Time
+	}
+}
+
+// stageTimestampAssignment returns the SQL fragment that records when a
+// generation entered the given status
+func stageTimestampAssignment(status string) string {
+	switch status {
+	case "rendering":
+		return ", rendering_at = CURRENT_TIMESTAMP"
+	case "completed":
+		return ", completed_at = CURRENT_TIMESTAMP"
+	case "failed":
+		return ", failed_at = CURRENT_TIMESTAMP"
+	}
+	return ""
+}
+
+// CustomTemplate is one version of an uploaded card template
+type CustomTemplate struct {
+	Name        string    `json:"name"`
+	Version     int       `json:"version"`
+	Description string    `json:"description,omitempty"`
+	HTML        string    `json:"html,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// createTemplatesTable creates the table holding uploaded card templates.
+// Every upload under an existing name adds a new version.
+func createTemplatesTable(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS templates (
+		name TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		description TEXT,
+		html TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (name, version)
+	);
+	`)
+	return err
+}
+
+// SaveTemplate stores html as the next version of the named template
+func (db *Database) SaveTemplate(name, description, html string) (*CustomTemplate, error) {
+	if err := db.ensureConnection(); err != nil {
+		return nil, fmt.Errorf("database connection error: %w", err)
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var latest int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM templates WHERE name = ?`, name).Scan(&latest); err != nil {
+		return nil, err
+	}
+
+	tmpl := &CustomTemplate{
+		Name:        name,
+		Version:     latest + 1,
+		Description: description,
+		HTML:        html,
+		CreatedAt:   time.Now().UTC(),
+	}
+	_, err = tx.Exec(`INSERT INTO templates (name, version, description, html, created_at) VALUES (?, ?, ?, ?, ?)`,
+		tmpl.Name, tmpl.Version, tmpl.Description, tmpl.HTML, tmpl.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return tmpl, tx.Commit()
+}
+
+// GetTemplate returns a version of the named template, or the latest one
+// when version is 0. It returns sql.ErrNoRows if there is no such template.
+func (db *Database) GetTemplate(name string, version int) (*CustomTemplate, error) {
+	if err := db.ensureConnection(); err != nil {
+		return nil, fmt.Errorf("database connection error: %w", err)
+	}
+
+	query := `SELECT name, version, description, html, created_at FROM templates
+		WHERE name = ? AND (? = 0 OR version = ?) ORDER BY version DESC LIMIT 1`
+
+	tmpl := &CustomTemplate{}
+	var description sql.NullString
+	err := db.db.QueryRow(query, name, version, version).Scan(&tmpl.Name, &tmpl.Version, &description, &tmpl.HTML, &tmpl.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.Description = description.String
+
+	return tmpl, nil
+}
+
+// ListTemplates returns the latest version of every template, without HTML
+func (db *Database) ListTemplates() ([]CustomTemplate, error) {
+	return db.queryTemplates(`SELECT t.name, t.version, t.description, t.created_at FROM templates t
+		WHERE t.version = (SELECT MAX(version) FROM templates WHERE name = t.name)
+		ORDER BY t.name`)
+}
+
+// ListTemplateVersions returns every version of the named template, newest
+// first, without HTML
+func (db *Database) ListTemplateVersions(name string) ([]CustomTemplate, error) {
+	return db.queryTemplates(`SELECT name, version, description, created_at FROM templates
+		WHERE name = ? ORDER BY version DESC`, name)
+}
+
+// queryTemplates scans template rows selected without their HTML
+func (db *Database) queryTemplates(query string, args ...interface{}) ([]CustomTemplate, error) {
+	if err := db.ensureConnection(); err != nil {
+		return nil, fmt.Errorf("database connection error: %w", err)
+	}
+
+	rows, err := db.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var templates []CustomTemplate
+	for rows.Next() {
+		var tmpl CustomTemplate
+		var description sql.NullString
+		if err := rows.Scan(&tmpl.Name, &tmpl.Version, &description, &tmpl.CreatedAt); err != nil {
+			return nil, err
+		}
+		tmpl.Description = description.String
+		templates = append(templates, tmpl)
+	}
+
+	return templates, rows.Err()
+}
+
+// DeleteTemplate removes one version of the named template, or all of them
+// when version is 0, and reports how many versions were deleted
+func (db *Database) DeleteTemplate(name string, version int) (int64, error) {
+	if err := db.ensureConnection(); err != nil {
+		return 0, fmt.Errorf("database connection error: %w", err)
+	}
+
+	result, err := db.db.Exec(`DELETE FROM templates WHERE name = ? AND (? = 0 OR version = ?)`, name, version, version)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// createBatchesTable creates the table of batches. Their items are the
+// generations with the batch's ID.
+func createBatchesTable(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS batches (
+		id TEXT PRIMARY KEY,
+		source TEXT,
+		status TEXT NOT NULL,
+		total INTEGER NOT NULL,
+		concurrency INTEGER NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		completed_at TIMESTAMP,
+		manifest_path TEXT,
+		zip_path TEXT,
+		cleanup_after TIMESTAMP
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	return addMissingColumns(db, "batches", []tableColumn{
+		{"callback_url", "TEXT"},
+		{"webhook_client", "TEXT"},
+	})
+}
+
+// SaveBatch stores a new batch. Its items are saved as generations.
+func (db *Database) SaveBatch(batch *Batch) error {
+	if err := db.ensureConnection(); err != nil {
+		return fmt.Errorf("database connection error: %w", err)
+	}
+
+	// Batches are kept as long as their generations
+	cleanupAfter := batch.CreatedAt.Add(24 * time.Hour)
+	_, err := db.db.Exec(`INSERT INTO batches (id, source, status, total, concurrency, created_at, cleanup_after,
+		callback_url, webhook_client) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		batch.ID, batch.Source, batch.Status, batch.Total, batch.Concurrency, batch.CreatedAt, cleanupAfter,
+		batch.CallbackURL, batch.WebhookClient)
+	return err
+}
+
+// GetBatch returns a batch with its items in order. It returns
+// sql.ErrNoRows if there is no such batch.
+func (db *Database) GetBatch(id string) (*Batch, error) {
+	if err := db.ensureConnection(); err != nil {
+		return nil, fmt.Errorf("database connection error: %w", err)
+	}
+
+	batch := &Batch{}
+	var source, manifestPath, zipPath, callbackURL, webhookClient sql.NullString
+	var completedAt sql.NullTime
+	err := db.db.QueryRow(`SELECT id, source, status, total, concurrency, created_at, completed_at, manifest_path, zip_path,
+		callback_url, webhook_client FROM batches WHERE id = ?`, id).Scan(&batch.ID, &source, &batch.Status, &batch.Total,
+		&batch.Concurrency, &batch.CreatedAt, &completedAt, &manifestPath, &zipPath, &callbackURL, &webhookClient)
+	if err != nil {
+		return nil, err
+	}
+	batch.Source = source.String
+	batch.CallbackURL = callbackURL.String
+	batch.WebhookClient = webhookClient.String
+	batch.ManifestPath = manifestPath.String
+	batch.ZipPath = zipPath.String
+	if completedAt.Valid {
+		batch.CompletedAt = &completedAt.Time
+	}
+
+	rows, err := db.db.Query(`SELECT id, batch_index, title, parameters, image_path, html_path, status,
+		COALESCE(error_message, ''), COALESCE(text_fit, '') FROM generations WHERE batch_id = ? ORDER BY batch_index`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item BatchItem
+		var title, parameters sql.NullString
+		var textFit string
+		if err := rows.Scan(&item.ID, &item.Index, &title, &parameters, &item.ImagePath, &item.HTMLPath,
+			&item.Status, &item.Error, &textFit); err != nil {
+			return nil, err
+		}
+		item.Title = title.String
+		item.TextFit = decodeTextFit(textFit)
+
+		var params GenerationParameters
+		if json.Unmarshal([]byte(parameters.String), &params) == nil {
+			item.URL = params.WebpageURL
+		}
+		batch.Items = append(batch.Items, item)
+	}
+	return batch, rows.Err()
+}
+
+// FinishBatch records that every item of a batch has finished, and where
+// its manifest and zip were written
+func (db *Database) FinishBatch(id, status, manifestPath, zipPath string) error {
+	if err := db.ensureConnection(); err != nil {
+		return fmt.Errorf("database connection error: %w", err)
+	}
+
+	_, err := db.db.Exec(`UPDATE batches SET status = ?, completed_at = ?, manifest_path = ?, zip_path = ? WHERE id = ?`,
+		status, time.Now().UTC(), manifestPath, zipPath, id)
+	return err
+}
+
+// cleanupBatches deletes the batches past their cleanup time along with
+// their manifests and zips
+func (db *Database) cleanupBatches() error {
+	rows, err := db.db.Query(`SELECT id, COALESCE(manifest_path, ''), COALESCE(zip_path, '') FROM batches WHERE cleanup_after < ?`, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id, manifestPath, zipPath string
+		if err := rows.Scan(&id, &manifestPath, &zipPath); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+		for _, path := range []string{manifestPath, zipPath} {
+			if path == "" {
+				continue
+			}
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				log.Printf("Error removing file %s: %v", path, err)
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if _, err := db.db.Exec(`DELETE FROM batches WHERE id = ?`, id); err != nil {
+			return err
+		}
+	}
+	if len(ids) > 0 {
+		log.Printf("Cleaned up %d batches", len(ids))
+	}
+	return nil
+}
+
+// createWebhookDeliveriesTable creates the log of webhook deliveries
+func createWebhookDeliveriesTable(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id TEXT PRIMARY KEY,
+		client TEXT NOT NULL,
+		event TEXT NOT NULL,
+		subject_id TEXT NOT NULL,
+		url TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		response_code INTEGER,
+		last_error TEXT,
+		created_at TIMESTAMP NOT NULL,
+		next_attempt_at TIMESTAMP,
+		delivered_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_webhook_due ON webhook_deliveries(status, next_attempt_at);
+	CREATE INDEX IF NOT EXISTS idx_webhook_client ON webhook_deliveries(client, created_at);
+	`)
+	return err
+}
+
+// webhookDeliveryColumns are the columns scanned by scanWebhookDelivery
+const webhookDeliveryColumns = `id, client, event, subject_id, url, payload, status, attempts,
+	COALESCE(response_code, 0), COALESCE(last_error, ''), created_at, next_attempt_at, delivered_at`
+
+// scanWebhookDelivery reads a row of webhookDeliveryColumns
+func scanWebhookDelivery(scan func(dest ...interface{}) error) (*WebhookDelivery, error) {
+	d := &WebhookDelivery{}
+	var payload string
+	var nextAttemptAt, deliveredAt sql.NullTime
+	if err := scan(&d.ID, &d.Client, &d.Event, &d.SubjectID, &d.URL, &payload, &d.Status, &d.Attempts,
+		&d.ResponseCode, &d.LastError, &d.CreatedAt, &nextAttemptAt, &deliveredAt); err != nil {
+		return nil, err
+	}
+	d.Payload = json.RawMessage(payload)
+	if nextAttemptAt.Valid {
+		d.NextAttemptAt = &nextAttemptAt.Time
+	}
+	if deliveredAt.Valid {
+		d.DeliveredAt = &deliveredAt.Time
+	}
+	return d, nil
+}
+
+// SaveWebhookDelivery stores a new webhook delivery
+func (db *Database) SaveWebhookDelivery(d *WebhookDelivery) error {
+	if err := db.ensureConnection(); err != nil {
+		return fmt.Errorf("database connection error: %w", err)
+	}
+
+	_, err := db.db.Exec(`INSERT INTO webhook_deliveries (id, client, event, subject_id, url, payload, status,
+		attempts, created_at, next_attempt_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		d.ID, d.Client, d.Event, d.SubjectID, d.URL, string(d.Payload), d.Status, d.Attempts, d.CreatedAt, d.NextAttemptAt)
+	return err
+}
+
+// UpdateWebhookDelivery records the outcome of a delivery attempt
+func (db *Database) UpdateWebhookDelivery(d *WebhookDelivery) error {
+	if err := db.ensureConnection(); err != nil {
+		return fmt.Errorf("database connection error: %w", err)
+	}
+
+	_, err := db.db.Exec(`UPDATE webhook_deliveries SET status = ?, attempts = ?, response_code = ?, last_error = ?,
+		next_attempt_at = ?, delivered_at = ? WHERE id = ?`,
+		d.Status, d.Attempts, d.ResponseCode, d.LastError, d.NextAttemptAt, d.DeliveredAt, d.ID)
+	return err
+}
+
+// GetWebhookDelivery returns a webhook delivery. It returns sql.ErrNoRows
+// if there is no such delivery.
+func (db *Database) GetWebhookDelivery(id string) (*WebhookDelivery, error) {
+	if err := db.ensureConnection(); err != nil {
+		return nil, fmt.Errorf("database connection error: %w", err)
+	}
+
+	row := db.db.QueryRow(`SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries WHERE id = ?`, id)
+	return scanWebhookDelivery(row.Scan)
+}
+
+// ListWebhookDeliveries returns a client's webhook deliveries, newest first
+func (db *Database) ListWebhookDeliveries(client string, limit, offset int) ([]*WebhookDelivery, error) {
+	if err := db.ensureConnection(); err != nil {
+		return nil, fmt.Errorf("database connection error: %w", err)
+	}
+
+	rows, err := db.db.Query(`SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries WHERE client = ?
+		ORDER BY created_at DESC LIMIT ? OFFSET ?`, client, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return collectWebhookDeliveries(rows)
+}
+
+// DueWebhookDeliveries returns the pending deliveries whose next attempt is
+// due, oldest first
+func (db *Database) DueWebhookDeliveries(now time.Time, limit int) ([]*WebhookDelivery, error) {
+	if err := db.ensureConnection(); err != nil {
+		return nil, fmt.Errorf("database connection error: %w", err)
+	}
+
+	rows, err := db.db.Query(`SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries
+		WHERE status = 'pending' AND next_attempt_at <= ? ORDER BY next_attempt_at LIMIT ?`, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	return collectWebhookDeliveries(rows)
+}
+
+// collectWebhookDeliveries reads every row of a delivery query
+func collectWebhookDeliveries(rows *sql.Rows) ([]*WebhookDelivery, error) {
+	defer rows.Close()
+
+	var deliveries []*WebhookDelivery
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// cleanupWebhookDeliveries deletes finished deliveries older than a week
+func (db *Database) cleanupWebhookDeliveries() error {
+	result, err := db.db.Exec(`DELETE FROM webhook_deliveries WHERE status != 'pending' AND created_at < ?`,
+		time.Now().UTC().Add(-webhookRetention))
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("Cleaned up %d webhook deliveries", n)
+	}
+	return nil
+}
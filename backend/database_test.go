@@ -0,0 +1,146 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestDatabase opens an in-memory database with the original schema,
+// before any migrations were added
+func newTestDatabase(t *testing.T) *Database {
+	t.Helper()
+
+	conn, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	// Every connection to :memory: is a separate database
+	conn.SetMaxOpenConns(1)
+	t.Cleanup(func() { conn.Close() })
+
+	_, err = conn.Exec(`
+	CREATE TABLE generations (
+		id TEXT PRIMARY KEY,
+		title TEXT,
+		description TEXT,
+		target_url TEXT,
+		image_path TEXT,
+		html_path TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		client_ip TEXT,
+		user_agent TEXT,
+		parameters TEXT,
+		downloaded BOOLEAN DEFAULT 0,
+		cleanup_after TIMESTAMP,
+		status TEXT DEFAULT 'pending',
+		error_message TEXT,
+		download_count INTEGER DEFAULT 0
+	)`)
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	if err := migrateGenerationsTable(conn); err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+	// Running the migration again must be a no-op
+	if err := migrateGenerationsTable(conn); err != nil {
+		t.Fatalf("Second migration failed: %v", err)
+	}
+	if err := createTemplatesTable(conn); err != nil {
+		t.Fatalf("Failed to create templates table: %v", err)
+	}
+	if err := createBatchesTable(conn); err != nil {
+		t.Fatalf("Failed to create batches table: %v", err)
+	}
+	if err := createWebhookDeliveriesTable(conn); err != nil {
+		t.Fatalf("Failed to create webhook deliveries table: %v", err)
+	}
+
+	return &Database{db: conn}
+}
+
+// TestGenerationStageTimestamps tests that each status change records when it happened
+func TestGenerationStageTimestamps(t *testing.T) {
+	database := newTestDatabase(t)
+
+	gen := &Generation{ID: "stage-test", Title: "Stages", CreatedAt: time.Now()}
+	if err := database.SaveGeneration(gen); err != nil {
+		t.Fatalf("SaveGeneration failed: %v", err)
+	}
+
+	if err := database.UpdateGenerationStatus("stage-test", "rendering", ""); err != nil {
+		t.Fatalf("Failed to mark rendering: %v", err)
+	}
+
+	stored, err := database.GetGeneration("stage-test")
+	if err != nil {
+		t.Fatalf("GetGeneration failed: %v", err)
+	}
+	if stored.Status != "rendering" || stored.RenderingAt == nil {
+		t.Errorf("Expected rendering status with timestamp, got %s / %v", stored.Status, stored.RenderingAt)
+	}
+	if stored.CompletedAt != nil || stored.FailedAt != nil {
+		t.Errorf("Expected no completion timestamps yet")
+	}
+
+	if err := database.UpdateGenerationStatus("stage-test", "failed", "boom"); err != nil {
+		t.Fatalf("Failed to mark failed: %v", err)
+	}
+
+	stored, err = database.GetGenerationByID("stage-test")
+	if err != nil {
+		t.Fatalf("GetGenerationByID failed: %v", err)
+	}
+	if stored.Status != "failed" || stored.FailedAt == nil || stored.ErrorMessage != "boom" {
+		t.Errorf("Expected failed status with timestamp and message, got %+v", stored)
+	}
+
+	if err := database.UpdateGenerationStatus("stage-test", "bogus", ""); err == nil {
+		t.Errorf("Expected an error for an unknown status")
+	}
+}
+
+// TestRunCleanup tests that expired generations and their files are removed
+func TestRunCleanup(t *testing.T) {
+	database := newTestDatabase(t)
+	dir := t.TempDir()
+
+	for _, id := range []string{"expired-1", "expired-2", "current"} {
+		imagePath := filepath.Join(dir, id+".png")
+		if err := os.WriteFile(imagePath, []byte("png"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		gen := &Generation{ID: id, ImagePath: imagePath, CreatedAt: time.Now()}
+		if err := database.SaveGeneration(gen); err != nil {
+			t.Fatalf("SaveGeneration failed: %v", err)
+		}
+		cleanupAfter := time.Now().Add(-time.Hour)
+		if id == "current" {
+			cleanupAfter = time.Now().Add(time.Hour)
+		}
+		if err := database.SetCleanupTime(id, cleanupAfter); err != nil {
+			t.Fatalf("SetCleanupTime failed: %v", err)
+		}
+	}
+
+	removed, err := database.RunCleanup()
+	if err != nil {
+		t.Fatalf("RunCleanup failed: %v", err)
+	}
+	if removed != 2 {
+		t.Errorf("Expected 2 generations removed, got %d", removed)
+	}
+	if _, err := database.GetGeneration("expired-1"); err == nil {
+		t.Errorf("Expected the expired generation to be deleted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "expired-2.png")); !os.IsNotExist(err) {
+		t.Errorf("Expected the expired image to be deleted")
+	}
+	if _, err := database.GetGeneration("current"); err != nil {
+		t.Errorf("Expected the current generation to be kept: %v", err)
+	}
+}
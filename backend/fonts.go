@@ -0,0 +1,827 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/image/font/sfnt"
+)
+
+//go:embed fonts/*.ttf
+var bundledFontFS embed.FS
+
+// Largest font file accepted for upload
+const maxFontBytes = 20 << 20
+
+// Longest font family name accepted
+const maxFontFamilyLength = 100
+
+// ErrFontNotFound is returned for an unknown font ID
+var ErrFontNotFound = errors.New("font not found")
+
+// ErrBundledFont is returned when removing a font shipped with the binary
+var ErrBundledFont = errors.New("bundled fonts cannot be removed")
+
+// Font is one face in the registry
+type Font struct {
+	ID     string `json:"id"`
+	Family string `json:"family"`
+	Weight int    `json:"weight"`
+	Style  string `json:"style"`  // normal or italic
+	Source string `json:"source"` // bundled or uploaded
+	Glyphs int    `json:"glyphs"`
+	Size   int    `json:"size"`
+
+	data []byte
+	font *sfnt.Font
+}
+
+// fontFileTypes are the font formats accepted, by the extension they are
+// stored and served under
+var fontFileTypes = map[string]struct{ format, mediaType string }{
+	".ttf": {"truetype", "font/ttf"},
+	".otf": {"opentype", "font/otf"},
+}
+
+// fileExt is the extension the face is stored and served under: .otf for
+// OpenType with PostScript outlines, .ttf otherwise
+func (f *Font) fileExt() string {
+	if bytes.HasPrefix(f.data, []byte("OTTO")) {
+		return ".otf"
+	}
+	return ".ttf"
+}
+
+// covers reports whether the face has a glyph for r
+func (f *Font) covers(r rune) bool {
+	var buf sfnt.Buffer
+	idx, err := f.font.GlyphIndex(&buf, r)
+	return err == nil && idx != 0
+}
+
+// FontRegistry holds the fonts templates can use. Bundled fonts are always
+// present; uploaded fonts are kept in a directory so they survive restarts.
+type FontRegistry struct {
+	dir     string // Where uploads are stored, empty to keep them in memory
+	baseURL string // Where the service serves font files, empty for data: URLs
+
+	mu    sync.RWMutex
+	fonts map[string]*Font
+}
+
+// NewFontRegistry loads the bundled fonts and any fonts uploaded to dir
+func NewFontRegistry(dir string) (*FontRegistry, error) {
+	r := &FontRegistry{dir: dir, fonts: make(map[string]*Font)}
+
+	entries, err := fs.ReadDir(bundledFontFS, "fonts")
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		data, err := bundledFontFS.ReadFile(path.Join("fonts", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		f, err := parseFont(data, "", 0, "")
+		if err != nil {
+			return nil, fmt.Errorf("bundled font %s: %w", entry.Name(), err)
+		}
+		f.Source = "bundled"
+		r.fonts[f.ID] = f
+	}
+
+	if dir == "" {
+		return r, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create fonts directory: %w", err)
+	}
+
+	var files []string
+	for ext := range fontFileTypes {
+		matches, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		f, err := parseFont(data, "", 0, "")
+		if err != nil {
+			log.Printf("Warning: Skipping unreadable font %s: %v", file, err)
+			continue
+		}
+		// The file name is the ID it was uploaded under
+		f.ID = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		f.Source = "uploaded"
+		r.fonts[f.ID] = f
+	}
+
+	return r, nil
+}
+
+// SetBaseURL makes @font-face rules point at the service's /fonts/ handler
+// instead of embedding the files as data: URLs
+func (r *FontRegistry) SetBaseURL(baseURL string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.baseURL = strings.TrimSuffix(baseURL, "/")
+}
+
+// Add registers an uploaded TrueType or OpenType font. Family, weight and
+// style are read from the font unless given. A font with the same ID is
+// replaced.
+func (r *FontRegistry) Add(data []byte, family string, weight int, style string) (*Font, error) {
+	if len(data) > maxFontBytes {
+		return nil, fmt.Errorf("font is larger than %d bytes", maxFontBytes)
+	}
+	f, err := parseFont(data, family, weight, style)
+	if err != nil {
+		return nil, err
+	}
+	f.Source = "uploaded"
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.fonts[f.ID]
+	if ok && existing.Source == "bundled" {
+		return nil, fmt.Errorf("font %s is bundled and cannot be replaced", f.ID)
+	}
+	if r.dir != "" {
+		if err := os.WriteFile(filepath.Join(r.dir, f.ID+f.fileExt()), data, 0644); err != nil {
+			return nil, fmt.Errorf("failed to store font: %w", err)
+		}
+		// A replacement in the other format must not leave the old file behind
+		if ok && existing.fileExt() != f.fileExt() {
+			os.Remove(filepath.Join(r.dir, f.ID+existing.fileExt()))
+		}
+	}
+	r.fonts[f.ID] = f
+	return f, nil
+}
+
+// Remove deletes an uploaded font
+func (r *FontRegistry) Remove(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, ok := r.fonts[id]
+	if !ok {
+		return ErrFontNotFound
+	}
+	if f.Source == "bundled" {
+		return ErrBundledFont
+	}
+	if r.dir != "" {
+		if err := os.Remove(filepath.Join(r.dir, id+f.fileExt())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	delete(r.fonts, id)
+	return nil
+}
+
+// Get returns a font by ID
+func (r *FontRegistry) Get(id string) (*Font, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	f, ok := r.fonts[id]
+	return f, ok
+}
+
+// List returns every font sorted by family, weight and style
+func (r *FontRegistry) List() []*Font {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	fonts := make([]*Font, 0, len(r.fonts))
+	for _, f := range r.fonts {
+		fonts = append(fonts, f)
+	}
+	sort.Slice(fonts, func(i, j int) bool {
+		a, b := fonts[i], fonts[j]
+		if a.Family != b.Family {
+			return a.Family < b.Family
+		}
+		if a.Weight != b.Weight {
+			return a.Weight < b.Weight
+		}
+		return a.Style < b.Style
+	})
+	return fonts
+}
+
+// familyFaces returns the faces of a family, matched case-insensitively.
+// Callers must hold r.mu.
+func (r *FontRegistry) familyFaces(family string) []*Font {
+	var faces []*Font
+	for _, f := range r.fonts {
+		if strings.EqualFold(f.Family, family) {
+			faces = append(faces, f)
+		}
+	}
+	sort.Slice(faces, func(i, j int) bool { return faces[i].ID < faces[j].ID })
+	return faces
+}
+
+// FontCoverage reports how well a set of families covers some text
+type FontCoverage struct {
+	Families  []string          `json:"families"`            // Registered families the check was made against
+	Missing   []string          `json:"missing,omitempty"`   // Characters none of them can draw
+	Fallbacks map[string]string `json:"fallbacks,omitempty"` // Character to the family that will draw it
+	Uncovered []string          `json:"uncovered,omitempty"` // Characters no registered font can draw
+}
+
+// CheckCoverage finds the characters of text that the given families lack
+// and picks fallback families from the registry for them. Families that are
+// not registered are ignored.
+func (r *FontRegistry) CheckCoverage(families []string, text string) FontCoverage {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.checkCoverageLocked(families, text)
+}
+
+func (r *FontRegistry) checkCoverageLocked(families []string, text string) FontCoverage {
+	report := FontCoverage{Families: []string{}}
+
+	var primary []*Font
+	for _, family := range families {
+		if faces := r.familyFaces(family); len(faces) > 0 {
+			report.Families = append(report.Families, faces[0].Family)
+			primary = append(primary, faces...)
+		}
+	}
+
+	// Candidate fallbacks in a stable order, bundled fonts last so uploaded
+	// CJK or emoji fonts are preferred
+	var candidates []*Font
+	for _, f := range r.fonts {
+		candidates = append(candidates, f)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Source != candidates[j].Source {
+			return candidates[i].Source == "uploaded"
+		}
+		return candidates[i].ID < candidates[j].ID
+	})
+
+	seen := make(map[rune]bool)
+	for _, ch := range text {
+		if seen[ch] || unicode.IsSpace(ch) || unicode.IsControl(ch) || isJoiner(ch) {
+			continue
+		}
+		seen[ch] = true
+
+		if coveredBy(primary, ch) != nil {
+			continue
+		}
+		report.Missing = append(report.Missing, string(ch))
+
+		if f := coveredBy(candidates, ch); f != nil {
+			if report.Fallbacks == nil {
+				report.Fallbacks = make(map[string]string)
+			}
+			report.Fallbacks[string(ch)] = f.Family
+		} else {
+			report.Uncovered = append(report.Uncovered, string(ch))
+		}
+	}
+
+	return report
+}
+
+// FontFaceCSS returns @font-face rules for every registered font. For each
+// registered family a template uses, faces of the chosen fallback fonts are
+// added under that family name, limited with unicode-range to the
+// characters it lacks, so the browser switches fonts per character without
+// the template listing the fallbacks itself.
+func (r *FontRegistry) FontFaceCSS(families []string, text string) (string, FontCoverage) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.fontFaceCSSLocked(r.baseURL, families, text)
+}
+
+// FontFaceCSSAt is FontFaceCSS with the font files linked from baseURL
+// rather than the base set for the renderer, for stylesheets served to
+// clients outside the service
+func (r *FontRegistry) FontFaceCSSAt(baseURL string, families []string, text string) (string, FontCoverage) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.fontFaceCSSLocked(strings.TrimSuffix(baseURL, "/"), families, text)
+}
+
+// fontFaceCSSLocked builds the rules of FontFaceCSS, linking the font
+// files from baseURL or embedding them when it is empty. Callers must hold
+// r.mu.
+func (r *FontRegistry) fontFaceCSSLocked(baseURL string, families []string, text string) (string, FontCoverage) {
+	var css strings.Builder
+	for _, f := range r.sortedLocked() {
+		css.WriteString(r.fontFaceLocked(baseURL, f.Family, f, ""))
+	}
+
+	report := r.checkCoverageLocked(families, text)
+
+	// Group the fallback characters by the face that draws them
+	byFont := make(map[*Font][]rune)
+	for ch, fallbackFamily := range report.Fallbacks {
+		c := []rune(ch)[0]
+		if f := coveredBy(r.familyFaces(fallbackFamily), c); f != nil {
+			byFont[f] = append(byFont[f], c)
+		}
+	}
+	fallbacks := make([]*Font, 0, len(byFont))
+	for f := range byFont {
+		fallbacks = append(fallbacks, f)
+	}
+	sort.Slice(fallbacks, func(i, j int) bool { return fallbacks[i].ID < fallbacks[j].ID })
+
+	// Browsers narrow faces by weight and style before looking at
+	// unicode-range, so the fallback is declared for every primary face
+	for _, family := range report.Families {
+		for _, primary := range r.familyFaces(family) {
+			for _, f := range fallbacks {
+				alias := *f
+				alias.Weight, alias.Style = primary.Weight, primary.Style
+				css.WriteString(r.fontFaceLocked(baseURL, family, &alias, unicodeRange(byFont[f])))
+			}
+		}
+	}
+
+	return css.String(), report
+}
+
+// sortedLocked returns the fonts ordered by ID. Callers must hold r.mu.
+func (r *FontRegistry) sortedLocked() []*Font {
+	fonts := make([]*Font, 0, len(r.fonts))
+	for _, f := range r.fonts {
+		fonts = append(fonts, f)
+	}
+	sort.Slice(fonts, func(i, j int) bool { return fonts[i].ID < fonts[j].ID })
+	return fonts
+}
+
+// fontFaceLocked writes one @font-face rule. Callers must hold r.mu.
+func (r *FontRegistry) fontFaceLocked(baseURL, family string, f *Font, unicodeRange string) string {
+	fileType := fontFileTypes[f.fileExt()]
+	src := "data:" + fileType.mediaType + ";base64," + base64.StdEncoding.EncodeToString(f.data)
+	if baseURL != "" {
+		src = baseURL + "/fonts/" + f.ID + f.fileExt()
+	}
+
+	var rule strings.Builder
+	fmt.Fprintf(&rule, "@font-face { font-family: %s; src: url(%s) format(\"%s\"); font-weight: %d; font-style: %s; font-display: block;",
+		cssString(family), cssString(src), fileType.format, f.Weight, f.Style)
+	if unicodeRange != "" {
+		fmt.Fprintf(&rule, " unicode-range: %s;", unicodeRange)
+	}
+	rule.WriteString(" }\n")
+	return rule.String()
+}
+
+// cssString quotes s as a CSS string. Quotes, backslashes, angle brackets
+// and control characters are written as hex escapes, so the value can
+// neither end the string nor the <style> element it is placed in.
+func cssString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"', r == '\\', r == '<', r == '>', r == '&', r < 0x20, r == 0x7f:
+			fmt.Fprintf(&b, "\\%x ", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// checkFontFamily only accepts family names made of letters, digits,
+// spaces, hyphens and underscores
+func checkFontFamily(family string) error {
+	if len(family) > maxFontFamilyLength {
+		return fmt.Errorf("font family must be at most %d characters", maxFontFamilyLength)
+	}
+	for _, r := range family {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != ' ' && r != '-' && r != '_' {
+			return fmt.Errorf("font family may only contain letters, digits, spaces, hyphens and underscores")
+		}
+	}
+	return nil
+}
+
+// Templates name their fonts in font-family declarations
+var fontFamilyPattern = regexp.MustCompile(`(?i)font-family\s*:\s*([^;}]+)`)
+
+// templateFontFamilies lists the families named in the font-family
+// declarations of a template, in order of appearance
+func templateFontFamilies(html string) []string {
+	var families []string
+	seen := make(map[string]bool)
+	for _, m := range fontFamilyPattern.FindAllStringSubmatch(html, -1) {
+		for _, family := range strings.Split(m[1], ",") {
+			family = strings.Trim(strings.TrimSpace(family), `"'`)
+			key := strings.ToLower(family)
+			if family == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			families = append(families, family)
+		}
+	}
+	return families
+}
+
+// injectFontFaces adds the registry's @font-face rules to a card page,
+// ahead of the template's own styles
+func injectFontFaces(html, css string) string {
+	style := "<style>\n" + css + "</style>\n"
+	lower := strings.ToLower(html)
+	if i := strings.Index(lower, "<head>"); i >= 0 {
+		i += len("<head>")
+		return html[:i] + "\n" + style + html[i:]
+	}
+	return style + html
+}
+
+// parseFont reads a TrueType or OpenType font and fills in its metadata
+func parseFont(data []byte, family string, weight int, style string) (*Font, error) {
+	parsed, err := sfnt.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("not a TrueType or OpenType font: %w", err)
+	}
+
+	var buf sfnt.Buffer
+	if family == "" {
+		if family, err = parsed.Name(&buf, sfnt.NameIDFamily); err != nil || family == "" {
+			return nil, fmt.Errorf("font has no family name, please provide one")
+		}
+		family = strings.TrimSpace(family)
+		if err := checkFontFamily(family); err != nil {
+			return nil, fmt.Errorf("the font's own family name is unusable (%v), please provide one", err)
+		}
+	} else if err := checkFontFamily(family); err != nil {
+		return nil, err
+	}
+	subfamily, _ := parsed.Name(&buf, sfnt.NameIDSubfamily)
+	subfamily = strings.ToLower(subfamily)
+
+	if weight == 0 {
+		// The longest keyword wins so "extrabold" is not read as "bold"
+		weight = 400
+		matched := ""
+		for name, w := range fontWeightNames {
+			if strings.Contains(subfamily, name) && len(name) > len(matched) {
+				weight, matched = w, name
+			}
+		}
+	}
+	if weight < 100 || weight > 900 {
+		return nil, fmt.Errorf("font weight must be between 100 and 900")
+	}
+
+	if style == "" {
+		style = "normal"
+		if strings.Contains(subfamily, "italic") || strings.Contains(subfamily, "oblique") {
+			style = "italic"
+		}
+	}
+	if style != "normal" && style != "italic" {
+		return nil, fmt.Errorf("font style must be normal or italic")
+	}
+
+	f := &Font{
+		Family: family,
+		Weight: weight,
+		Style:  style,
+		Glyphs: parsed.NumGlyphs(),
+		Size:   len(data),
+		data:   data,
+		font:   parsed,
+	}
+	f.ID = fontID(family, weight, style)
+	return f, nil
+}
+
+// Weight keywords found in subfamily names
+var fontWeightNames = map[string]int{
+	"thin":       100,
+	"extralight": 200,
+	"light":      300,
+	"medium":     500,
+	"semibold":   600,
+	"bold":       700,
+	"extrabold":  800,
+	"black":      900,
+}
+
+// fontID builds a URL-safe ID such as "go-700-italic"
+func fontID(family string, weight int, style string) string {
+	var id strings.Builder
+	for _, r := range strings.ToLower(family) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			id.WriteRune(r)
+		case id.Len() > 0 && !strings.HasSuffix(id.String(), "-"):
+			id.WriteByte('-')
+		}
+	}
+	base := strings.TrimSuffix(id.String(), "-")
+	if base == "" {
+		base = "font"
+	}
+	if style == "italic" {
+		return fmt.Sprintf("%s-%d-italic", base, weight)
+	}
+	return fmt.Sprintf("%s-%d", base, weight)
+}
+
+// coveredBy returns the first face with a glyph for r
+func coveredBy(faces []*Font, r rune) *Font {
+	for _, f := range faces {
+		if f.covers(r) {
+			return f
+		}
+	}
+	return nil
+}
+
+// isJoiner reports characters that never need a glyph of their own, such as
+// the joiners and variation selectors inside emoji sequences
+func isJoiner(r rune) bool {
+	return r == '\u200d' || r == '\u200c' || (r >= '\ufe00' && r <= '\ufe0f')
+}
+
+// unicodeRange formats characters as a CSS unicode-range, merging runs
+func unicodeRange(runes []rune) string {
+	sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+
+	var parts []string
+	for i := 0; i < len(runes); {
+		j := i
+		for j+1 < len(runes) && runes[j+1] <= runes[j]+1 {
+			j++
+		}
+		if runes[i] == runes[j] {
+			parts = append(parts, fmt.Sprintf("U+%X", runes[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("U+%X-%X", runes[i], runes[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ", ")
+}
+
+// cardText collects the text a card will show, for the coverage check
+func cardText(params GenerationParameters) string {
+	parts := []string{
+		firstNonEmpty(params.Title, "Open Graph Generated Content"),
+		params.Description,
+		params.SiteName,
+	}
+	keys := make([]string, 0, len(params.CustomParams))
+	for k := range params.CustomParams {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		parts = append(parts, params.CustomParams[k])
+	}
+	return strings.Join(parts, "\n")
+}
+
+// templateSource returns the unrendered HTML of a built-in template or one
+// from the generator's template store, for reading its font-family
+// declarations
+func (g *Generator) templateSource(name string) (string, error) {
+	if isBuiltinTemplate(name) {
+		source, err := cardTemplateFS.ReadFile(path.Join("templates", name+".html"))
+		return string(source), err
+	}
+	if g.templates == nil {
+		return "", fmt.Errorf("%w %q", ErrUnknownTemplate, name)
+	}
+	tmpl, err := g.templates.GetTemplate(name, 0)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("%w %q", ErrUnknownTemplate, name)
+	} else if err != nil {
+		return "", err
+	}
+	return tmpl.HTML, nil
+}
+
+// splitFamilies parses a comma separated list of font families
+func splitFamilies(value string) []string {
+	var families []string
+	for _, family := range strings.Split(value, ",") {
+		if family = strings.Trim(strings.TrimSpace(family), `"'`); family != "" {
+			families = append(families, family)
+		}
+	}
+	return families
+}
+
+// handleFontsRequest lists the registered fonts on GET and uploads a font
+// on POST
+func handleFontsRequest(w http.ResponseWriter, r *http.Request) {
+	if fonts == nil {
+		sendErrorResponse(w, "Font registry is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		sendJSONResponse(w, map[string]interface{}{
+			"success": true,
+			"data":    fonts.List(),
+		})
+
+	case http.MethodPost:
+		if err := r.ParseMultipartForm(maxFontBytes + 1<<20); err != nil {
+			sendErrorResponse(w, "Failed to parse form data", http.StatusBadRequest)
+			return
+		}
+
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			sendErrorResponse(w, "A font file is required", http.StatusBadRequest)
+			return
+		}
+		data, err := io.ReadAll(io.LimitReader(file, maxFontBytes+1))
+		file.Close()
+		if err != nil {
+			sendErrorResponse(w, "Failed to read font file", http.StatusBadRequest)
+			return
+		}
+
+		weight := 0
+		if v := r.FormValue("weight"); v != "" {
+			if weight, err = strconv.Atoi(v); err != nil {
+				sendErrorResponse(w, "weight must be a number between 100 and 900", http.StatusBadRequest)
+				return
+			}
+		}
+
+		f, err := fonts.Add(data, strings.TrimSpace(r.FormValue("family")), weight, strings.ToLower(r.FormValue("style")))
+		if err != nil {
+			sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Registered font %s (%s %d %s, %d glyphs)", f.ID, f.Family, f.Weight, f.Style, f.Glyphs)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"message": fmt.Sprintf("Font %s registered", f.ID),
+			"data":    f,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleFontRequest serves /api/fonts/{id}: GET returns the font's details
+// and DELETE removes an uploaded font. /api/fonts/check runs a coverage check.
+func handleFontRequest(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/fonts/")
+	if id == "check" {
+		handleFontCheckRequest(w, r)
+		return
+	}
+	if fonts == nil {
+		sendErrorResponse(w, "Font registry is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		f, ok := fonts.Get(id)
+		if !ok {
+			sendErrorResponse(w, "Font not found", http.StatusNotFound)
+			return
+		}
+		sendJSONResponse(w, map[string]interface{}{
+			"success": true,
+			"data":    f,
+		})
+
+	case http.MethodDelete:
+		switch err := fonts.Remove(id); {
+		case errors.Is(err, ErrFontNotFound):
+			sendErrorResponse(w, "Font not found", http.StatusNotFound)
+		case errors.Is(err, ErrBundledFont):
+			sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		case err != nil:
+			log.Printf("Error removing font %s: %v", id, err)
+			sendErrorResponse(w, "Failed to remove font", http.StatusInternalServerError)
+		default:
+			sendJSONResponse(w, map[string]interface{}{
+				"success": true,
+				"message": fmt.Sprintf("Font %s removed", id),
+			})
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleFontCheckRequest reports which characters of some text the fonts of
+// a template, or a list of families, cannot draw and which fallbacks would
+// be used for them
+func handleFontCheckRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if fonts == nil {
+		sendErrorResponse(w, "Font registry is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		sendErrorResponse(w, "Failed to parse form data", http.StatusBadRequest)
+		return
+	}
+
+	families := splitFamilies(r.FormValue("families"))
+	if name := r.FormValue("template"); name != "" {
+		source, err := generator.templateSource(name)
+		if err != nil {
+			sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		families = append(families, templateFontFamilies(source)...)
+	}
+	if len(families) == 0 {
+		source, _ := generator.templateSource(defaultCardTemplate)
+		families = templateFontFamilies(source)
+	}
+
+	sendJSONResponse(w, map[string]interface{}{
+		"success": true,
+		"data":    fonts.CheckCoverage(families, r.FormValue("text")),
+	})
+}
+
+// handleFontFileRequest serves /fonts/{id}.ttf and /fonts/{id}.otf for
+// @font-face rules
+func handleFontFileRequest(w http.ResponseWriter, r *http.Request) {
+	if fonts == nil {
+		http.Error(w, "Font registry is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/fonts/")
+	ext := path.Ext(name)
+	f, ok := fonts.Get(strings.TrimSuffix(name, ext))
+	if !ok || f.fileExt() != ext {
+		http.Error(w, "Font not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", fontFileTypes[ext].mediaType)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(f.data)
+}
+
+// handleFontCSSRequest serves /fonts.css with @font-face rules for every
+// registered font. With families and text, fallback faces are included for
+// the characters those families lack. The font files are linked from the
+// public base URL, as the renderer's loopback address only works inside
+// the service.
+func handleFontCSSRequest(w http.ResponseWriter, r *http.Request) {
+	if fonts == nil {
+		http.Error(w, "Font registry is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	css, _ := fonts.FontFaceCSSAt(config.BaseURL, splitFamilies(r.URL.Query().Get("families")), r.URL.Query().Get("text"))
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	w.Write([]byte(css))
+}
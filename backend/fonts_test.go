@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBundledFonts(t *testing.T) {
+	registry, err := NewFontRegistry("")
+	if err != nil {
+		t.Fatalf("NewFontRegistry() error = %v", err)
+	}
+
+	families := make(map[string]bool)
+	for _, f := range registry.List() {
+		if f.Source != "bundled" || f.Glyphs == 0 {
+			t.Errorf("font %s: source %q, %d glyphs", f.ID, f.Source, f.Glyphs)
+		}
+		families[f.Family] = true
+	}
+	if !families["Go"] {
+		t.Fatalf("bundled families = %v, want Go", families)
+	}
+
+	if _, ok := registry.Get("go-700"); !ok {
+		t.Error("Go Bold should be registered as go-700")
+	}
+	if err := registry.Remove("go-400"); err != ErrBundledFont {
+		t.Errorf("Remove(bundled) error = %v, want ErrBundledFont", err)
+	}
+}
+
+func TestCheckCoverage(t *testing.T) {
+	registry, err := NewFontRegistry("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := registry.CheckCoverage([]string{"Go", "Arial"}, "Hello 你好 😀")
+	if len(report.Families) != 1 || report.Families[0] != "Go" {
+		t.Errorf("Families = %v, want only the registered Go family", report.Families)
+	}
+	want := []string{"你", "好", "😀"}
+	if strings.Join(report.Missing, "") != strings.Join(want, "") {
+		t.Errorf("Missing = %v, want %v", report.Missing, want)
+	}
+	if strings.Join(report.Uncovered, "") != strings.Join(want, "") {
+		t.Errorf("Uncovered = %v, want %v", report.Uncovered, want)
+	}
+}
+
+func TestFontFallbacks(t *testing.T) {
+	dir := t.TempDir()
+	registry, err := NewFontRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The test font only draws a few digits, so everything else in the
+	// text needs a fallback
+	data, err := os.ReadFile("testdata/subset.ttf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := registry.Add(data, "Digits", 0, "")
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if f.ID != "digits-400" || f.Source != "uploaded" {
+		t.Errorf("Add() = %s from %s, want digits-400 uploaded", f.ID, f.Source)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "digits-400.ttf")); err != nil {
+		t.Errorf("uploaded font was not stored: %v", err)
+	}
+
+	text := "10 ab"
+	report := registry.CheckCoverage([]string{"Digits"}, text)
+	if strings.Join(report.Missing, "") != "ab" {
+		t.Errorf("Missing = %v, want a and b", report.Missing)
+	}
+	if report.Fallbacks["a"] != "Go" || report.Fallbacks["b"] != "Go" {
+		t.Fatalf("Fallbacks = %v, want a and b drawn by Go", report.Fallbacks)
+	}
+
+	registry.SetBaseURL("http://127.0.0.1:8888/")
+	css, _ := registry.FontFaceCSS([]string{"Digits"}, text)
+	for _, want := range []string{
+		`font-family: "Digits"; src: url("http://127.0.0.1:8888/fonts/digits-400.ttf")`,
+		`font-family: "Digits"; src: url("http://127.0.0.1:8888/fonts/go-400.ttf") format("truetype"); font-weight: 400; font-style: normal; font-display: block; unicode-range: U+61-62;`,
+	} {
+		if !strings.Contains(css, want) {
+			t.Errorf("FontFaceCSS() is missing %s", want)
+		}
+	}
+
+	// Uploads survive a restart
+	reloaded, err := NewFontRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reloaded.Get("digits-400"); !ok {
+		t.Error("uploaded font was not reloaded")
+	}
+	if err := reloaded.Remove("digits-400"); err != nil {
+		t.Errorf("Remove() error = %v", err)
+	}
+}
+
+func TestTemplateFontFamilies(t *testing.T) {
+	html := `<style>body { font-family: "Go", Arial, sans-serif; } h1 { font-family: 'Go Medium', Go; }</style>`
+	got := strings.Join(templateFontFamilies(html), "|")
+	if want := "Go|Arial|sans-serif|Go Medium"; got != want {
+		t.Errorf("templateFontFamilies() = %s, want %s", got, want)
+	}
+
+	if got := unicodeRange([]rune{'c', 'a', 'b', 'x'}); got != "U+61-63, U+78" {
+		t.Errorf("unicodeRange() = %s", got)
+	}
+}
+
+func TestFontFileHandler(t *testing.T) {
+	saved := fonts
+	defer func() { fonts = saved }()
+
+	var err error
+	if fonts, err = NewFontRegistry(""); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	handleFontFileRequest(rec, httptest.NewRequest(http.MethodGet, "/fonts/go-400.ttf", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "font/ttf" || rec.Body.Len() == 0 {
+		t.Errorf("GET /fonts/go-400.ttf = %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	rec = httptest.NewRecorder()
+	handleFontFileRequest(rec, httptest.NewRequest(http.MethodGet, "/fonts/missing.ttf", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET /fonts/missing.ttf = %d, want 404", rec.Code)
+	}
+}
+
+func TestFontCSSHandlerUsesPublicURL(t *testing.T) {
+	saved, savedBaseURL := fonts, config.BaseURL
+	defer func() { fonts, config.BaseURL = saved, savedBaseURL }()
+
+	var err error
+	if fonts, err = NewFontRegistry(""); err != nil {
+		t.Fatal(err)
+	}
+	fonts.SetBaseURL("http://127.0.0.1:8888")
+	config.BaseURL = "https://og.example.com/"
+
+	rec := httptest.NewRecorder()
+	handleFontCSSRequest(rec, httptest.NewRequest(http.MethodGet, "/fonts.css", nil))
+	css := rec.Body.String()
+	if !strings.Contains(css, `url("https://og.example.com/fonts/go-400.ttf")`) || strings.Contains(css, "127.0.0.1") {
+		t.Errorf("GET /fonts.css = %s, want font files linked from the public base URL", css)
+	}
+
+	// The renderer keeps the loopback address
+	if css, _ := fonts.FontFaceCSS(nil, ""); !strings.Contains(css, `url("http://127.0.0.1:8888/fonts/go-400.ttf")`) {
+		t.Errorf("FontFaceCSS() = %s, want font files linked from the loopback address", css)
+	}
+}
+
+func TestOpenTypeFonts(t *testing.T) {
+	saved := fonts
+	defer func() { fonts = saved }()
+
+	dir := t.TempDir()
+	var err error
+	if fonts, err = NewFontRegistry(dir); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile("testdata/cff.otf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fonts.Add(data, "Outlines", 0, "")
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, f.ID+".otf")); err != nil {
+		t.Errorf("OpenType font was not stored as .otf: %v", err)
+	}
+
+	fonts.SetBaseURL("http://127.0.0.1:8888")
+	css, _ := fonts.FontFaceCSS(nil, "")
+	if want := `src: url("http://127.0.0.1:8888/fonts/outlines-400.otf") format("opentype")`; !strings.Contains(css, want) {
+		t.Errorf("FontFaceCSS() is missing %s", want)
+	}
+
+	rec := httptest.NewRecorder()
+	handleFontFileRequest(rec, httptest.NewRequest(http.MethodGet, "/fonts/outlines-400.otf", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "font/otf" {
+		t.Errorf("GET /fonts/outlines-400.otf = %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	rec = httptest.NewRecorder()
+	handleFontFileRequest(rec, httptest.NewRequest(http.MethodGet, "/fonts/outlines-400.ttf", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET /fonts/outlines-400.ttf = %d, want 404", rec.Code)
+	}
+
+	reloaded, err := NewFontRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reloaded.Get("outlines-400"); !ok {
+		t.Error("OpenType font was not reloaded")
+	}
+}
+
+func TestFontCheckUsesTemplateStore(t *testing.T) {
+	savedFonts, savedGenerator := fonts, generator
+	defer func() { fonts, generator = savedFonts, savedGenerator }()
+
+	var err error
+	if fonts, err = NewFontRegistry(""); err != nil {
+		t.Fatal(err)
+	}
+	database := newTestDatabase(t)
+	if _, err := database.SaveTemplate("stored", "", `<style>h1 { font-family: "Go Mono"; }</style><h1>{{.Title}}</h1>`); err != nil {
+		t.Fatal(err)
+	}
+	generator = NewGenerator(NewBrowserPool(BrowserPoolOptions{}))
+	generator.SetTemplateStore(database)
+
+	form := url.Values{"template": {"stored"}, "text": {"Hi"}}
+	req := httptest.NewRequest(http.MethodPost, "/api/fonts/check", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	handleFontCheckRequest(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"Go Mono"`) {
+		t.Errorf("font check of a stored template = %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestFontUploadRejectsUnsafeFamily(t *testing.T) {
+	saved := fonts
+	defer func() { fonts = saved }()
+
+	var err error
+	if fonts, err = NewFontRegistry(""); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile("testdata/subset.ttf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload := func(family string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", "subset.ttf")
+		fw.Write(data)
+		mw.WriteField("family", family)
+		mw.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/api/fonts", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rec := httptest.NewRecorder()
+		handleFontsRequest(rec, req)
+		return rec
+	}
+
+	for _, family := range []string{`x</style><script>alert(1)</script>`, `Evil"; } body { color: red`, "Tab\tName"} {
+		if rec := upload(family); rec.Code != http.StatusBadRequest {
+			t.Errorf("family %q was accepted: %d %s", family, rec.Code, rec.Body.String())
+		}
+	}
+	if rec := upload("Noto Sans_JP-2"); rec.Code != http.StatusCreated {
+		t.Errorf("a plain family was rejected: %d %s", rec.Code, rec.Body.String())
+	}
+
+	css, _ := fonts.FontFaceCSS(nil, "")
+	if strings.Contains(css, "<") {
+		t.Errorf("FontFaceCSS() contains markup: %s", css)
+	}
+	if got := cssString(`a"</style>\`); got != `"a\22 \3c /style\3e \5c "` {
+		t.Errorf("cssString() = %s", got)
+	}
+}
+
+func TestFontChangesNeedAdminToken(t *testing.T) {
+	saved := fonts
+	defer func() { fonts = saved }()
+	t.Setenv("ADMIN_TOKEN", "secret")
+
+	var err error
+	if fonts, err = NewFontRegistry(""); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile("testdata/subset.ttf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload := adminOnlyMethods(handleFontsRequest, http.MethodPost)
+	remove := adminOnlyMethods(handleFontRequest, http.MethodDelete)
+	call := func(handler http.HandlerFunc, method, path, token string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", "subset.ttf")
+		fw.Write(data)
+		mw.WriteField("family", "Digits")
+		mw.Close()
+
+		req := httptest.NewRequest(method, path, &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	if rec := call(upload, http.MethodPost, "/api/fonts", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an upload without a token, got %d", rec.Code)
+	}
+	if rec := call(upload, http.MethodPost, "/api/fonts", "secret"); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 with the token, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := call(upload, http.MethodGet, "/api/fonts", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected listing fonts to stay open, got %d", rec.Code)
+	}
+	if rec := call(remove, http.MethodDelete, "/api/fonts/digits-400", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a removal without a token, got %d", rec.Code)
+	}
+	if rec := call(remove, http.MethodDelete, "/api/fonts/digits-400", "secret"); rec.Code != http.StatusOK {
+		t.Errorf("Expected the removal to succeed with the token, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
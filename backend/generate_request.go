@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Largest JSON body accepted by /api/generate
+const maxGenerateBodyBytes = 1 << 20
+
+// GenerateRequest represents a request to generate Open Graph assets. It is
+// the body of a JSON /api/generate request; field names follow the stored
+// generation parameters.
+type GenerateRequest struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	OgType      string `json:"og_type,omitempty"`
+	SiteName    string `json:"site_name,omitempty"`
+	TargetURL   string `json:"target_url,omitempty"`
+	TwitterCard string `json:"twitter_card,omitempty"`
+	ImageWidth  int    `json:"image_width,omitempty"`
+	ImageHeight int    `json:"image_height,omitempty"`
+	Quality     int    `json:"quality,omitempty"`
+	WaitTime    int    `json:"wait_time,omitempty"`
+	Selector    string `json:"selector,omitempty"`
+
+	DeviceScaleFactor float64 `json:"device_scale_factor,omitempty"`
+	CaptureMode       string  `json:"capture_mode,omitempty"`
+	Format            string  `json:"format,omitempty"`
+	CaptureSelector   string  `json:"capture_selector,omitempty"`
+	CapturePadding    int     `json:"capture_padding,omitempty"`
+	CaptureBackground string  `json:"capture_background,omitempty"`
+
+	Processing *ImageProcessing `json:"processing,omitempty"`
+
+	Template         string `json:"template,omitempty"`
+	TemplateVersion  int    `json:"template_version,omitempty"`
+	LogoURL          string `json:"logo_url,omitempty"`
+	BackgroundColor  string `json:"background_color,omitempty"`
+	TextColor        string `json:"text_color,omitempty"`
+	AccentColor      string `json:"accent_color,omitempty"`
+	TitleMinFontSize int    `json:"title_min_font_size,omitempty"`
+	TitleMaxFontSize int    `json:"title_max_font_size,omitempty"`
+
+	MetaFormat string `json:"meta_format,omitempty"`
+	Previews   bool   `json:"previews,omitempty"`
+	Enrich     bool   `json:"enrich,omitempty"`
+
+	Locale               string   `json:"locale,omitempty"`
+	LocaleAlternates     []string `json:"locale_alternates,omitempty"`
+	ImageAlt             string   `json:"image_alt,omitempty"`
+	Images               []string `json:"images,omitempty"`
+	VideoURL             string   `json:"video_url,omitempty"`
+	VideoType            string   `json:"video_type,omitempty"`
+	VideoWidth           int      `json:"video_width,omitempty"`
+	VideoHeight          int      `json:"video_height,omitempty"`
+	AudioURL             string   `json:"audio_url,omitempty"`
+	AudioType            string   `json:"audio_type,omitempty"`
+	ArticlePublishedTime string   `json:"article_published_time,omitempty"`
+	ArticleModifiedTime  string   `json:"article_modified_time,omitempty"`
+	ArticleAuthors       []string `json:"article_authors,omitempty"`
+	ArticleSection       string   `json:"article_section,omitempty"`
+	ArticleTags          []string `json:"article_tags,omitempty"`
+	ProductPriceAmount   string   `json:"product_price_amount,omitempty"`
+	ProductPriceCurrency string   `json:"product_price_currency,omitempty"`
+	ProfileFirstName     string   `json:"profile_first_name,omitempty"`
+	ProfileLastName      string   `json:"profile_last_name,omitempty"`
+	ProfileUsername      string   `json:"profile_username,omitempty"`
+	ProfileGender        string   `json:"profile_gender,omitempty"`
+	TwitterSite          string   `json:"twitter_site,omitempty"`
+	TwitterCreator       string   `json:"twitter_creator,omitempty"`
+
+	CustomParams map[string]string `json:"custom_params,omitempty"`
+
+	Debug   bool `json:"debug,omitempty"`
+	Verbose bool `json:"verbose,omitempty"`
+	Async   bool `json:"async,omitempty"` // Return 202 right away instead of waiting
+
+	CallbackURL string `json:"callback_url,omitempty"` // Webhook notified when the generation finishes
+}
+
+// FieldError describes a problem with one request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every field of a request that was rejected
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		problems[i] = f.Field + ": " + f.Message
+	}
+	return "invalid request: " + strings.Join(problems, "; ")
+}
+
+// isJSONRequest reports whether the request body is JSON
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// decodeGenerateRequest reads a JSON generation request. Every field is
+// decoded on its own so that all unknown fields, type mismatches and
+// invalid values are reported together.
+func decodeGenerateRequest(body io.Reader) (GenerateRequest, error) {
+	var req GenerateRequest
+
+	data, err := io.ReadAll(io.LimitReader(body, maxGenerateBodyBytes+1))
+	if err != nil {
+		return req, fmt.Errorf("failed to read request body: %w", err)
+	}
+	if len(data) > maxGenerateBodyBytes {
+		return req, &ValidationError{Fields: []FieldError{{Field: "body", Message: fmt.Sprintf("body is larger than %d bytes", maxGenerateBodyBytes)}}}
+	}
+
+	var fields map[string]json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(&fields); err != nil || fields == nil {
+		message := "body must be a JSON object"
+		if err != nil {
+			message = fmt.Sprintf("%s: %v", message, err)
+		}
+		return req, &ValidationError{Fields: []FieldError{{Field: "body", Message: message}}}
+	}
+	if dec.More() {
+		return req, &ValidationError{Fields: []FieldError{{Field: "body", Message: "body must contain a single JSON object"}}}
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	target := reflect.ValueOf(&req).Elem()
+	index := jsonFieldIndex(target.Type())
+
+	var errs []FieldError
+	failed := make(map[string]bool)
+	for _, key := range keys {
+		i, ok := index[key]
+		if !ok {
+			errs = append(errs, FieldError{Field: key, Message: "unknown field"})
+			failed[key] = true
+			continue
+		}
+		if err := decodeStrict(fields[key], target.Field(i).Addr().Interface()); err != nil {
+			errs = append(errs, jsonFieldError(key, err))
+			failed[key] = true
+		}
+	}
+
+	// Values are only checked for fields that decoded
+	for _, fe := range req.validate(presentFields(fields)) {
+		if !failed[strings.SplitN(fe.Field, ".", 2)[0]] {
+			errs = append(errs, fe)
+		}
+	}
+
+	if len(errs) > 0 {
+		return req, &ValidationError{Fields: errs}
+	}
+	return req, nil
+}
+
+// presentFields lists the fields a JSON body set, with the fields of
+// nested objects as dotted names
+func presentFields(fields map[string]json.RawMessage) map[string]bool {
+	present := make(map[string]bool, len(fields))
+	for key, raw := range fields {
+		present[key] = true
+
+		var nested map[string]json.RawMessage
+		if json.Unmarshal(raw, &nested) == nil && key != "custom_params" {
+			for name := range nested {
+				present[key+"."+name] = true
+			}
+		}
+	}
+	return present
+}
+
+// jsonFieldIndex maps the JSON names of a struct's fields to their index
+func jsonFieldIndex(t reflect.Type) map[string]int {
+	index := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			index[name] = i
+		}
+	}
+	return index
+}
+
+// decodeStrict decodes one value, rejecting unknown fields of objects
+func decodeStrict(raw json.RawMessage, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// jsonFieldError turns a decoding error into a message about the field
+func jsonFieldError(key string, err error) FieldError {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		field := key
+		if typeErr.Field != "" && typeErr.Field != key {
+			field = key + "." + typeErr.Field
+		}
+		return FieldError{Field: field, Message: "must be " + jsonTypeName(typeErr.Type)}
+	}
+
+	// encoding/json has no error type for unknown fields
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return FieldError{Field: key + "." + strings.Trim(name, `"`), Message: "unknown field"}
+	}
+	return FieldError{Field: key, Message: err.Error()}
+}
+
+// jsonTypeName describes a Go type the way a JSON client thinks of it
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Map:
+		if t.Elem().Kind() == reflect.String {
+			return "an object of strings"
+		}
+		return "an object"
+	case reflect.Struct, reflect.Ptr:
+		return "an object"
+	case reflect.Slice:
+		return "an array of " + strings.TrimPrefix(strings.TrimPrefix(jsonTypeName(t.Elem()), "a "), "an ") + "s"
+	}
+	return "a " + t.String()
+}
+
+// validate checks the fields present in a decoded request against the
+// schema, then the values the schema cannot describe
+func (req GenerateRequest) validate(present map[string]bool) []FieldError {
+	errs := validateJSONParams(req, present)
+
+	failed := make(map[string]bool)
+	for _, fe := range errs {
+		failed[fe.Field] = true
+	}
+	for _, fe := range checkParameterValues(req.Parameters()) {
+		if !failed[fe.Field] {
+			errs = append(errs, fe)
+		}
+	}
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+	return errs
+}
+
+// Parameters maps the request onto generation parameters
+func (req GenerateRequest) Parameters() GenerationParameters {
+	return GenerationParameters{
+		WebpageURL:  req.URL,
+		Title:       req.Title,
+		Description: req.Description,
+		OgType:      req.OgType,
+		SiteName:    req.SiteName,
+		TargetURL:   req.TargetURL,
+		TwitterCard: req.TwitterCard,
+		ImageWidth:  req.ImageWidth,
+		ImageHeight: req.ImageHeight,
+		Quality:     req.Quality,
+		WaitTime:    req.WaitTime,
+		Selector:    req.Selector,
+		Debug:       req.Debug,
+		Verbose:     req.Verbose,
+		CallbackURL: req.CallbackURL,
+
+		DeviceScaleFactor: req.DeviceScaleFactor,
+		CaptureMode:       req.CaptureMode,
+		Format:            req.Format,
+		CaptureSelector:   req.CaptureSelector,
+		CapturePadding:    req.CapturePadding,
+		CaptureBackground: req.CaptureBackground,
+
+		Processing: req.Processing,
+
+		Template:         req.Template,
+		TemplateVersion:  req.TemplateVersion,
+		LogoURL:          req.LogoURL,
+		BackgroundColor:  req.BackgroundColor,
+		TextColor:        req.TextColor,
+		AccentColor:      req.AccentColor,
+		TitleMinFontSize: req.TitleMinFontSize,
+		TitleMaxFontSize: req.TitleMaxFontSize,
+		MetaFormat:       req.MetaFormat,
+		Previews:         req.Previews,
+		Enrich:           req.Enrich,
+		CustomParams:     req.CustomParams,
+
+		Locale:               req.Locale,
+		LocaleAlternates:     req.LocaleAlternates,
+		ImageAlt:             req.ImageAlt,
+		Images:               req.Images,
+		VideoURL:             req.VideoURL,
+		VideoType:            req.VideoType,
+		VideoWidth:           req.VideoWidth,
+		VideoHeight:          req.VideoHeight,
+		AudioURL:             req.AudioURL,
+		AudioType:            req.AudioType,
+		ArticlePublishedTime: req.ArticlePublishedTime,
+		ArticleModifiedTime:  req.ArticleModifiedTime,
+		ArticleAuthors:       req.ArticleAuthors,
+		ArticleSection:       req.ArticleSection,
+		ArticleTags:          req.ArticleTags,
+		ProductPriceAmount:   req.ProductPriceAmount,
+		ProductPriceCurrency: req.ProductPriceCurrency,
+		ProfileFirstName:     req.ProfileFirstName,
+		ProfileLastName:      req.ProfileLastName,
+		ProfileUsername:      req.ProfileUsername,
+		ProfileGender:        req.ProfileGender,
+		TwitterSite:          req.TwitterSite,
+		TwitterCreator:       req.TwitterCreator,
+	}
+}
+
+// sendValidationError reports every rejected field of a request
+func sendValidationError(w http.ResponseWriter, err error) {
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": false,
+		"message": "Invalid request",
+		"errors":  validationErr.Fields,
+	})
+}
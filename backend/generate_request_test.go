@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeGenerateRequest(t *testing.T) {
+	body := `{
+		"url": "https://example.com",
+		"title": "Hello",
+		"image_width": 1200,
+		"format": "webp",
+		"processing": {"fit": "cover", "corner_radius": 24},
+		"custom_params": {"tagline": "Ship it"},
+		"title_min_font_size": 0,
+		"title_max_font_size": 0,
+		"async": true
+	}`
+
+	req, err := decodeGenerateRequest(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("decodeGenerateRequest() error = %v", err)
+	}
+	if !req.Async {
+		t.Error("async was not decoded")
+	}
+
+	params := req.Parameters()
+	if params.WebpageURL != "https://example.com" || params.Title != "Hello" || params.ImageWidth != 1200 || params.Format != "webp" {
+		t.Errorf("Parameters() = %+v", params)
+	}
+	if params.Processing == nil || params.Processing.Fit != FitCover || params.Processing.CornerRadius != 24 {
+		t.Errorf("Processing = %+v", params.Processing)
+	}
+	if params.CustomParams["tagline"] != "Ship it" {
+		t.Errorf("CustomParams = %v", params.CustomParams)
+	}
+}
+
+func TestDecodeGenerateRequestErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want map[string]string // field to a fragment of its message
+	}{
+		{
+			name: "not an object",
+			body: `["https://example.com"]`,
+			want: map[string]string{"body": "JSON object"},
+		},
+		{
+			name: "trailing data",
+			body: `{"url": "https://example.com"} {}`,
+			want: map[string]string{"body": "single JSON object"},
+		},
+		{
+			name: "every problem reported",
+			body: `{
+				"url": "https://example.com",
+				"output": "/etc/passwd",
+				"image_width": "wide",
+				"quality": 150,
+				"format": "gif",
+				"background_color": "blue",
+				"processing": {"fit": "stretch", "shadow": true},
+				"custom_params": {"count": 3}
+			}`,
+			want: map[string]string{
+				"output":              "unknown field",
+				"image_width":         "must be an integer",
+				"quality":             "between 10 and 100",
+				"format":              "one of png",
+				"background_color":    "invalid color",
+				"processing.shadow":   "unknown field",
+				"custom_params.count": "must be a string",
+			},
+		},
+		{
+			name: "open graph lists",
+			body: `{"url": "https://example.com", "og_type": "article", "article_tags": "go", "images": ["https://example.com/a.png", "https://example.com/b.png", "https://example.com/c.png", "https://example.com/d.png", "https://example.com/e.png", "https://example.com/f.png", "https://example.com/g.png", "https://example.com/h.png", "https://example.com/i.png", "https://example.com/j.png", "https://example.com/k.png"]}`,
+			want: map[string]string{
+				"article_tags": "must be an array of strings",
+				"images":       "at most 10 items",
+			},
+		},
+		{
+			name: "custom params limits",
+			body: `{"custom_params": {` + manyCustomParams(51) + `}}`,
+			want: map[string]string{"custom_params": "at most 50 entries"},
+		},
+		{
+			name: "custom params size",
+			body: `{"custom_params": {"long": "` + strings.Repeat("x", 16<<10) + `"}}`,
+			want: map[string]string{"custom_params": "at most 16384 characters"},
+		},
+		{
+			name: "processing values",
+			body: `{"processing": {"fit": "stretch", "watermark_opacity": 2, "border_width": -1}}`,
+			want: map[string]string{
+				"processing.fit":               "one of cover, contain",
+				"processing.watermark_opacity": "between 0 and 1",
+				"processing.border_width":      "between 0 and 1000",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeGenerateRequest(strings.NewReader(tt.body))
+			validationErr, ok := err.(*ValidationError)
+			if !ok {
+				t.Fatalf("decodeGenerateRequest() error = %v, want a ValidationError", err)
+			}
+
+			got := make(map[string]string)
+			for _, f := range validationErr.Fields {
+				got[f.Field] = f.Message
+			}
+			for field, fragment := range tt.want {
+				if !strings.Contains(strings.ToLower(got[field]), strings.ToLower(fragment)) {
+					t.Errorf("%s: message %q does not mention %q", field, got[field], fragment)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("errors = %v, want only %d fields", got, len(tt.want))
+			}
+		})
+	}
+}
+
+// manyCustomParams returns n distinct custom_params entries for a JSON object
+func manyCustomParams(n int) string {
+	entries := make([]string, n)
+	for i := range entries {
+		entries[i] = fmt.Sprintf(`"key%d": "value"`, i)
+	}
+	return strings.Join(entries, ", ")
+}
+
+func TestGenerateHandlerRejectsInvalidJSON(t *testing.T) {
+	saved := jobQueue
+	defer func() { jobQueue = saved }()
+	jobQueue = NewJobQueue(1, 1, time.Minute, func(ctx context.Context, job *Job) (*Result, error) {
+		t.Error("an invalid request must not be queued")
+		return &Result{}, nil
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(`{"url": "https://example.com", "port": "9999"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handleGenerateRequest(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", rec.Code)
+	}
+
+	var response struct {
+		Success bool         `json:"success"`
+		Errors  []FieldError `json:"errors"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Success || len(response.Errors) != 1 || response.Errors[0].Field != "port" {
+		t.Errorf("response = %+v, want one error for port", response)
+	}
+}
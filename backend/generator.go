@@ -0,0 +1,646 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chromedp/chromedp"
+)
+
+// Result holds the assets produced by a single generation
+type Result struct {
+	Image     []byte                   // Captured screenshot, empty when no URL was given
+	MetaHTML  string                   // HTML page with the Open Graph meta tags
+	Metadata  OpenGraphData            // Data the meta tags were built from
+	Extracted *PageMetadata            // Metadata read from the rendered page, nil for cards
+	Fields    map[string]MetadataField // Merged metadata values and where each came from
+	PageHTML  string                   // Rendered page HTML, only captured in debug mode
+	Fonts     *FontCoverage            // Glyph coverage of the card's text, nil for page captures
+	TextFit   []TextFit                // How card text was fitted to its boxes, nil for page captures
+	Blocked   []BlockedRequest         // Requests the network policy refused
+	Outputs   map[string]string        // Every meta output format, MetaHTML among them
+	Gallery   string                   // Page with each platform's link preview
+	Previews  map[string][]byte        // PNG previews keyed by platform_theme, only when requested
+}
+
+// Generator renders Open Graph assets in-process. It keeps no per-request
+// state, so a single instance can serve concurrent generations.
+type Generator struct {
+	pool      *BrowserPool
+	templates TemplateStore
+	fonts     *FontRegistry
+	policy    *NetworkPolicy
+	logf      func(format string, args ...interface{})
+}
+
+// NewGenerator creates a Generator that renders pages with browsers leased
+// from pool and logs through the standard logger
+func NewGenerator(pool *BrowserPool) *Generator {
+	return &Generator{pool: pool, logf: log.Printf}
+}
+
+// Pool returns the browser pool the generator renders with
+func (g *Generator) Pool() *BrowserPool {
+	return g.pool
+}
+
+// SetTemplateStore lets cards be rendered from uploaded templates as well
+// as the built-in ones. Call it before the generator is used.
+func (g *Generator) SetTemplateStore(store TemplateStore) {
+	g.templates = store
+}
+
+// SetFontRegistry makes the registry's fonts available to card templates,
+// with fallbacks for characters the template's fonts cannot draw. Call it
+// before the generator is used.
+func (g *Generator) SetFontRegistry(fonts *FontRegistry) {
+	g.fonts = fonts
+}
+
+// SetNetworkPolicy restricts what pages, their sub-requests and watermark
+// downloads may connect to. Without a policy every URL is loaded. Call it
+// before the generator is used.
+func (g *Generator) SetNetworkPolicy(policy *NetworkPolicy) {
+	g.policy = policy
+}
+
+// httpClient returns the client for downloads made on behalf of a request
+func (g *Generator) httpClient() *http.Client {
+	if g.policy == nil {
+		return &http.Client{Timeout: watermarkFetchLimit}
+	}
+	return g.policy.HTTPClient(watermarkFetchLimit)
+}
+
+// Generate captures the requested page (if any) and builds the meta tags.
+// The context bounds the whole generation, including the browser session.
+func (g *Generator) Generate(ctx context.Context, params GenerationParameters) (*Result, error) {
+	supplied := params
+	params = applyParameterDefaults(params)
+	result := &Result{}
+
+	mode, err := normalizeCaptureMode(params.CaptureMode)
+	if err != nil {
+		return nil, err
+	}
+	params.CaptureMode = mode
+
+	if params.Format, err = resolveImageFormat(params.Format, params.Quality); err != nil {
+		return nil, err
+	}
+	if params.MetaFormat != "" && metaOutputPath("", params.MetaFormat) == "" {
+		return nil, fmt.Errorf("unsupported meta format %q", params.MetaFormat)
+	}
+
+	if params.DeviceScaleFactor > maxDeviceScaleFactor {
+		return nil, fmt.Errorf("device scale factor %.1f exceeds the maximum of %d", params.DeviceScaleFactor, maxDeviceScaleFactor)
+	}
+	if params.CapturePadding < 0 {
+		return nil, fmt.Errorf("capture padding must not be negative")
+	}
+	if _, err := parseHexColor(params.CaptureBackground); err != nil {
+		return nil, err
+	}
+
+	steps, err := buildPipeline(ctx, params, g.httpClient())
+	if err != nil {
+		return nil, err
+	}
+
+	if params.WebpageURL != "" {
+		pageURL, err := normalizeURL(params.WebpageURL)
+		if err != nil {
+			return nil, err
+		}
+		if params.Verbose {
+			g.logf("Using URL: %s", pageURL)
+		}
+
+		// Refuse private and disallowed targets before a browser is involved
+		if g.policy != nil {
+			if err := g.policy.Check(ctx, pageURL); err != nil {
+				g.logf("Blocked navigation: %v", err)
+				return nil, err
+			}
+		}
+
+		if err := g.capture(ctx, pageURL, params, steps, result); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := g.renderCard(ctx, params, steps, result); err != nil {
+			return nil, err
+		}
+	}
+
+	// og:image:width/height must describe the pixels actually produced,
+	// which differ from the viewport for retina, full page and element captures
+	imageWidth, imageHeight := params.ImageWidth, params.ImageHeight
+	if len(result.Image) > 0 {
+		imageWidth, imageHeight, err = imageDimensions(result.Image)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// User-supplied values win over anything read from the page
+	result.Metadata, result.Fields = mergeMetadata(supplied, result.Extracted, params.Enrich)
+	result.Metadata.ImageURL = params.ImageURL
+	result.Metadata.ImageWidth = imageWidth
+	result.Metadata.ImageHeight = imageHeight
+	result.Metadata.TwitterCard = params.TwitterCard
+	if len(result.Image) > 0 {
+		result.Metadata.ImageType = imageMIMEType(params.Format)
+	}
+	if result.Outputs, err = renderMetaOutputs(result.Metadata); err != nil {
+		return nil, err
+	}
+	result.MetaHTML = result.Outputs[MetaFormatPage]
+
+	if result.Gallery, err = generatePreviewGallery(result.Metadata); err != nil {
+		return nil, err
+	}
+	if params.Previews {
+		if params.Verbose {
+			g.logf("Rendering link previews for %s", strings.Join(PreviewPlatforms(), ", "))
+		}
+		if result.Previews, err = g.RenderPreviews(ctx, result.Metadata, result.Image, result.Metadata.ImageType); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// capture loads the page in a headless browser, takes the screenshot and
+// extracts whatever metadata the page already carries
+func (g *Generator) capture(ctx context.Context, pageURL string, params GenerationParameters, steps []ImageStep, result *Result) error {
+	g.logf("Navigating to %s and waiting for content to load...", pageURL)
+
+	if err := g.render(ctx, pageLoadActions(pageURL, params), params, steps, true, result); err != nil {
+		var blocked *BlockedError
+		if errors.As(err, &blocked) {
+			return err
+		}
+		if strings.Contains(err.Error(), "ERR_SSL_PROTOCOL_ERROR") || strings.Contains(err.Error(), "ERR_CERT") {
+			return fmt.Errorf("SSL certificate error accessing %s (check the domain name and the site's certificate): %w", pageURL, err)
+		}
+		return fmt.Errorf("error capturing %s: %w", pageURL, err)
+	}
+	return nil
+}
+
+// renderCard renders the requested card template in place of a webpage
+func (g *Generator) renderCard(ctx context.Context, params GenerationParameters, steps []ImageStep, result *Result) error {
+	html, err := g.cardHTML(params)
+	if err != nil {
+		return err
+	}
+	ranges, err := titleFitRange(params)
+	if err != nil {
+		return err
+	}
+
+	if params.Verbose {
+		g.logf("Rendering card template %s", firstNonEmpty(params.Template, defaultCardTemplate))
+	}
+
+	if g.fonts != nil {
+		css, coverage := g.fonts.FontFaceCSS(templateFontFamilies(html), cardText(params))
+		html = injectFontFaces(html, css)
+		result.Fonts = &coverage
+		if len(coverage.Uncovered) > 0 {
+			g.logf("Warning: No registered font can draw %s", strings.Join(coverage.Uncovered, " "))
+		}
+	}
+
+	load := chromedp.Tasks{loadHTMLContent(html), waitForAssets(), fitText(ranges, &result.TextFit)}
+	if err := g.render(ctx, load, params, steps, false, result); err != nil {
+		return fmt.Errorf("error rendering card template: %w", err)
+	}
+
+	for _, fit := range result.TextFit {
+		if fit.Strategy != FitNone && params.Verbose {
+			g.logf("Fitted %s text with %s at %.1fpx", fit.Element, fit.Strategy, fit.FontSize)
+		}
+	}
+	return nil
+}
+
+// cardHTML renders the card page: HTML sent for a preview, a built-in
+// template, or an uploaded one, in that order
+func (g *Generator) cardHTML(params GenerationParameters) (string, error) {
+	if params.TemplateHTML != "" {
+		return renderCustomTemplate(params.TemplateHTML, customTemplateData(params))
+	}
+
+	if params.Template == "" || isBuiltinTemplate(params.Template) {
+		data, err := cardDataFromParameters(params)
+		if err != nil {
+			return "", err
+		}
+		return renderCardTemplate(params.Template, data)
+	}
+
+	if g.templates == nil {
+		return "", fmt.Errorf("%w %q", ErrUnknownTemplate, params.Template)
+	}
+	tmpl, err := g.templates.GetTemplate(params.Template, params.TemplateVersion)
+	if errors.Is(err, sql.ErrNoRows) {
+		if params.TemplateVersion > 0 {
+			return "", fmt.Errorf("%w %q version %d", ErrUnknownTemplate, params.Template, params.TemplateVersion)
+		}
+		return "", fmt.Errorf("%w %q", ErrUnknownTemplate, params.Template)
+	} else if err != nil {
+		return "", fmt.Errorf("failed to load template %s: %w", params.Template, err)
+	}
+
+	return renderCustomTemplate(tmpl.HTML, customTemplateData(params))
+}
+
+// render runs load in a leased tab, takes the screenshot and runs the image
+// steps over it. With extract set the page's own metadata is read as well.
+func (g *Generator) render(ctx context.Context, load chromedp.Action, params GenerationParameters, steps []ImageStep, extract bool, result *Result) error {
+	lease, err := g.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("no browser available: %w", err)
+	}
+	defer lease.Release()
+
+	browserCtx := lease.Ctx
+
+	// Every request the tab makes, including redirects of the page itself,
+	// is checked against the network policy
+	var guard *requestGuard
+	var intercept chromedp.Action = chromedp.Tasks{}
+	if g.policy != nil {
+		guard = newRequestGuard(g.policy, g.logf)
+		intercept = guard.enable()
+		defer func() { result.Blocked = guard.Blocked() }()
+	}
+
+	// Screenshots that are processed further are taken losslessly and
+	// encoded in the requested format at the end
+	reencode := params.CaptureSelector != "" || len(steps) > 0
+	shotParams := params
+	if reencode {
+		shotParams.Format = FormatPNG
+	}
+
+	screenshot := captureAction(shotParams, &result.Image)
+	if params.CaptureSelector != "" {
+		screenshot = captureSelectorAction(params, &result.Image)
+	}
+
+	var htmlContent string
+	if err := chromedp.Run(browserCtx,
+		intercept,
+		emulateViewport(params),
+		load,
+		chromedp.OuterHTML("html", &htmlContent, chromedp.ByQuery),
+		screenshot,
+	); err != nil {
+		if guard != nil {
+			return guard.navigationError(err)
+		}
+		return err
+	}
+
+	if params.Debug {
+		result.PageHTML = htmlContent
+	}
+
+	// Read the page before WebP encoding navigates the tab away from it
+	if extract {
+		result.Extracted = extractPageMetadata(browserCtx, htmlContent)
+	}
+
+	if reencode {
+		var img image.Image
+		if params.CaptureSelector != "" {
+			img, err = composeCapture(result.Image, params)
+		} else {
+			img, _, err = image.Decode(bytes.NewReader(result.Image))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decode screenshot: %w", err)
+		}
+
+		if len(steps) > 0 {
+			if params.Verbose {
+				g.logf("Applying image steps: %s", strings.Join(stepNames(steps), ", "))
+			}
+			if img, err = runPipeline(img, steps); err != nil {
+				return err
+			}
+		}
+
+		if result.Image, err = encodeImage(browserCtx, img, params.Format, params.Quality); err != nil {
+			return err
+		}
+	}
+
+	if params.Processing != nil && params.Processing.Optimize && params.Format == FormatPNG {
+		optimized, err := optimizePNG(result.Image)
+		if err != nil {
+			return err
+		}
+		if params.Verbose {
+			g.logf("Optimized PNG from %d to %d bytes", len(result.Image), len(optimized))
+		}
+		result.Image = optimized
+	}
+
+	return nil
+}
+
+// FetchPage loads a page in a browser, with the same network policy as
+// captures, and returns its rendered HTML and the URL it ended up at
+func (g *Generator) FetchPage(ctx context.Context, pageURL string) (string, string, error) {
+	pageURL, err := normalizeURL(pageURL)
+	if err != nil {
+		return "", "", err
+	}
+	if g.policy != nil {
+		if err := g.policy.Check(ctx, pageURL); err != nil {
+			return "", "", err
+		}
+	}
+
+	lease, err := g.pool.Acquire(ctx)
+	if err != nil {
+		return "", "", fmt.Errorf("no browser available: %w", err)
+	}
+	defer lease.Release()
+
+	var guard *requestGuard
+	var intercept chromedp.Action = chromedp.Tasks{}
+	if g.policy != nil {
+		guard = newRequestGuard(g.policy, g.logf)
+		intercept = guard.enable()
+	}
+
+	params := applyParameterDefaults(GenerationParameters{})
+	var htmlContent, finalURL string
+	if err := chromedp.Run(lease.Ctx,
+		intercept,
+		pageLoadActions(pageURL, params),
+		chromedp.OuterHTML("html", &htmlContent, chromedp.ByQuery),
+		chromedp.Location(&finalURL),
+	); err != nil {
+		if guard != nil {
+			return "", "", guard.navigationError(err)
+		}
+		return "", "", err
+	}
+	return htmlContent, finalURL, nil
+}
+
+// WriteFiles saves the generated assets. The image is only written when one
+// was captured; an empty path skips that asset. The meta outputs other than
+// the page, and the previews, are written next to htmlPath.
+func (r *Result) WriteFiles(imagePath, htmlPath string) error {
+	if imagePath != "" && len(r.Image) > 0 {
+		if err := os.WriteFile(imagePath, r.Image, 0644); err != nil {
+			return fmt.Errorf("failed to write image: %w", err)
+		}
+		if r.PageHTML != "" {
+			if err := os.WriteFile(imagePath+".html", []byte(r.PageHTML), 0644); err != nil {
+				log.Printf("Warning: Failed to save debug HTML: %v", err)
+			}
+		}
+	}
+
+	if htmlPath != "" {
+		if err := os.WriteFile(htmlPath, []byte(r.MetaHTML), 0644); err != nil {
+			return fmt.Errorf("failed to write meta tags HTML: %w", err)
+		}
+		for format, out := range r.Outputs {
+			if format == MetaFormatPage {
+				continue
+			}
+			if err := os.WriteFile(metaOutputPath(htmlPath, format), []byte(out), 0644); err != nil {
+				return fmt.Errorf("failed to write %s meta output: %w", format, err)
+			}
+		}
+		if r.Gallery != "" {
+			if err := os.WriteFile(previewGalleryPath(htmlPath), []byte(r.Gallery), 0644); err != nil {
+				return fmt.Errorf("failed to write preview gallery: %w", err)
+			}
+		}
+		for key, img := range r.Previews {
+			if err := os.WriteFile(previewImagePath(htmlPath, key), img, 0644); err != nil {
+				return fmt.Errorf("failed to write %s preview: %w", key, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// applyParameterDefaults fills in defaults for any unset generation parameter
+func applyParameterDefaults(params GenerationParameters) GenerationParameters {
+	if params.OgType == "" {
+		params.OgType = defaultType
+	}
+	if params.TwitterCard == "" {
+		params.TwitterCard = defaultTwitterCard
+	}
+	if params.ImageWidth <= 0 {
+		params.ImageWidth = defaultImageWidth
+	}
+	if params.ImageHeight <= 0 {
+		params.ImageHeight = defaultImageHeight
+	}
+	if params.Quality <= 0 {
+		params.Quality = defaultQuality
+	}
+	if params.WaitTime <= 0 {
+		params.WaitTime = defaultWaitTime
+	}
+	if params.Selector == "" {
+		params.Selector = defaultSelector
+	}
+	if params.DeviceScaleFactor <= 0 {
+		params.DeviceScaleFactor = 1
+	}
+	return params
+}
+
+// normalizeURL fixes common URL mistakes and makes sure a scheme is present
+func normalizeURL(rawURL string) (string, error) {
+	fixedURL := strings.TrimSpace(rawURL)
+
+	// Handle double protocol issue (like https://www://example.com)
+	if strings.Count(fixedURL, "://") > 1 {
+		parts := strings.SplitN(fixedURL, "://", 2)
+		secondPart := parts[1]
+		if strings.HasPrefix(secondPart, "www://") {
+			secondPart = strings.Replace(secondPart, "www://", "www.", 1)
+		}
+		fixedURL = parts[0] + "://" + secondPart
+	}
+
+	// Add http:// prefix if no protocol is present
+	if !strings.Contains(fixedURL, "://") {
+		fixedURL = "http://" + fixedURL
+	}
+
+	if _, err := url.Parse(fixedURL); err != nil {
+		return "", fmt.Errorf("invalid URL %q: %w", fixedURL, err)
+	}
+
+	return fixedURL, nil
+}
+
+// firstNonEmpty returns the first non-empty string
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// chromeAllocatorOptions returns the Chrome flags used for rendering
+func chromeAllocatorOptions() []chromedp.ExecAllocatorOption {
+	return append(chromedp.DefaultExecAllocatorOptions[:],
+		chromedp.Flag("disable-background-networking", false),
+		chromedp.Flag("enable-features", "NetworkService,NetworkServiceInProcess"),
+		chromedp.Flag("disable-background-timer-throttling", true),
+		chromedp.Flag("disable-backgrounding-occluded-windows", true),
+		chromedp.Flag("disable-breakpad", true),
+		chromedp.Flag("disable-client-side-phishing-detection", true),
+		chromedp.Flag("disable-default-apps", true),
+		chromedp.Flag("disable-dev-shm-usage", true),
+		chromedp.Flag("disable-extensions", true),
+		chromedp.Flag("disable-features", "site-per-process,TranslateUI,BlinkGenPropertyTrees"),
+		chromedp.Flag("disable-hang-monitor", true),
+		chromedp.Flag("disable-ipc-flooding-protection", true),
+		chromedp.Flag("disable-popup-blocking", true),
+		chromedp.Flag("disable-prompt-on-repost", true),
+		chromedp.Flag("disable-renderer-backgrounding", true),
+		chromedp.Flag("disable-sync", true),
+		chromedp.Flag("force-color-profile", "srgb"),
+		chromedp.Flag("metrics-recording-only", true),
+		chromedp.Flag("safebrowsing-disable-auto-update", true),
+		chromedp.Flag("enable-automation", true),
+		chromedp.Flag("password-store", "basic"),
+		chromedp.Flag("use-mock-keychain", true),
+		// Additional rendering optimization flags
+		chromedp.Flag("disable-accelerated-2d-canvas", false),
+		chromedp.Flag("enable-gpu-rasterization", true),
+		chromedp.Flag("disable-gpu-vsync", true),
+		chromedp.UserAgent("Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.110 Safari/537.36"),
+	)
+}
+
+// pageLoadActions navigates to the page and coaxes lazy content into view
+// before the screenshot is taken
+func pageLoadActions(pageURL string, params GenerationParameters) chromedp.Tasks {
+	return chromedp.Tasks{
+		// Navigate to the URL
+		chromedp.Navigate(pageURL),
+
+		// Wait for the specified selector to be visible
+		chromedp.WaitVisible(params.Selector, chromedp.ByQuery),
+
+		// Wait for document to be ready
+		chromedp.Evaluate(`
+			new Promise((resolve) => {
+				if (document.readyState === 'complete') {
+					resolve();
+				} else {
+					window.addEventListener('load', resolve);
+				}
+			})
+		`, nil),
+
+		// Ensure text elements are visible by forcing display properties
+		chromedp.Evaluate(`
+			new Promise((resolve) => {
+				// Force all elements to be visible
+				const textElements = document.querySelectorAll('p, h1, h2, h3, h4, h5, h6, span, div, a, button, input, textarea, label');
+
+				textElements.forEach(el => {
+					// Check if element or its ancestors might have text content
+					if (el.textContent && el.textContent.trim() !== '') {
+						// Check computed style
+						const style = window.getComputedStyle(el);
+						if (style.display === 'none') {
+							el.style.setProperty('display', 'block', 'important');
+						}
+						if (style.visibility === 'hidden') {
+							el.style.setProperty('visibility', 'visible', 'important');
+						}
+						if (parseFloat(style.opacity) === 0) {
+							el.style.setProperty('opacity', '1', 'important');
+						}
+					}
+				});
+
+				// Force all potential text-containing elements to render
+				document.querySelectorAll('[style*="display:none"], [style*="display: none"]').forEach(el => {
+					if (el.textContent && el.textContent.trim() !== '') {
+						el.style.setProperty('display', 'block', 'important');
+					}
+				});
+
+				// Allow a bit of time for changes to take effect
+				setTimeout(resolve, 500);
+			})
+		`, nil),
+
+		// Simulate user scrolling to trigger lazy-loaded content
+		chromedp.Evaluate(`
+			new Promise((resolve) => {
+				const scrollHeight = Math.max(
+					document.body.scrollHeight, document.documentElement.scrollHeight,
+					document.body.offsetHeight, document.documentElement.offsetHeight,
+					document.body.clientHeight, document.documentElement.clientHeight
+				);
+
+				// Scroll in increments to trigger events
+				const increment = Math.max(window.innerHeight / 2, 200);
+				let currentScroll = 0;
+
+				const scrollInterval = setInterval(() => {
+					window.scrollTo(0, currentScroll);
+					currentScroll += increment;
+
+					if (currentScroll >= scrollHeight) {
+						clearInterval(scrollInterval);
+						// Scroll back to top
+						window.scrollTo(0, 0);
+						resolve();
+					}
+				}, 100);
+			})
+		`, nil),
+
+		// Simulate hovering on elements to trigger any hover effects
+		chromedp.Evaluate(`
+			document.querySelectorAll('a, button, [role="button"], [tabindex]').forEach(el => {
+				el.dispatchEvent(new MouseEvent('mouseenter', {
+					view: window,
+					bubbles: true,
+					cancelable: true
+				}));
+			});
+		`, nil),
+
+		// Additional wait time to ensure all content is fully loaded
+		chromedp.Sleep(time.Duration(params.WaitTime) * time.Millisecond),
+	}
+}
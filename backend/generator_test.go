@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// TestGenerateWithoutURL tests that a title-only generation renders a card
+// template with a browser instead of pointing at a placeholder service
+func TestGenerateWithoutURL(t *testing.T) {
+	pool := NewBrowserPool(BrowserPoolOptions{})
+	pool.Close()
+
+	params := GenerationParameters{
+		Title:       "Concurrent Title",
+		Description: "Concurrent Description",
+	}
+
+	_, err := NewGenerator(pool).Generate(context.Background(), params)
+	if !errors.Is(err, ErrPoolClosed) {
+		t.Fatalf("Expected the card to need a browser, got %v", err)
+	}
+
+	params.Template = "does-not-exist"
+	_, err = NewGenerator(pool).Generate(context.Background(), params)
+	if !errors.Is(err, ErrUnknownTemplate) {
+		t.Errorf("Expected an unknown template error, got %v", err)
+	}
+}
+
+// TestNormalizeURL tests the URL clean-up applied before navigation
+func TestNormalizeURL(t *testing.T) {
+	tests := map[string]string{
+		"example.com":               "http://example.com",
+		"https://www://example.com": "https://www.example.com",
+		" https://example.com/a ":   "https://example.com/a",
+	}
+
+	for input, expected := range tests {
+		got, err := normalizeURL(input)
+		if err != nil {
+			t.Errorf("normalizeURL(%q) returned error: %v", input, err)
+			continue
+		}
+		if got != expected {
+			t.Errorf("normalizeURL(%q) = %q, expected %q", input, got, expected)
+		}
+	}
+}
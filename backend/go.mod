@@ -5,16 +5,19 @@ go 1.24
 toolchain go1.24.1
 
 require (
+	github.com/chromedp/cdproto v0.0.0-20241030022559-23c28aebe8cb
 	github.com/chromedp/chromedp v0.11.1
 	github.com/getsentry/sentry-go v0.31.1
 	github.com/mattn/go-sqlite3 v1.14.24
 	github.com/rs/cors v1.10.1
 	github.com/swaggo/http-swagger v1.3.4
+	golang.org/x/image v0.25.0
+	golang.org/x/net v0.25.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/KyleBanks/depth v1.2.1 // indirect
-	github.com/chromedp/cdproto v0.0.0-20241030022559-23c28aebe8cb // indirect
 	github.com/chromedp/sysutil v1.1.0 // indirect
 	github.com/go-openapi/jsonpointer v0.21.0 // indirect
 	github.com/go-openapi/jsonreference v0.21.0 // indirect
@@ -27,9 +30,7 @@ require (
 	github.com/mailru/easyjson v0.7.7 // indirect
 	github.com/swaggo/files v1.0.1 // indirect
 	github.com/swaggo/swag v1.16.3 // indirect
-	golang.org/x/net v0.25.0 // indirect
 	golang.org/x/sys v0.26.0 // indirect
-	golang.org/x/text v0.15.0 // indirect
-	golang.org/x/tools v0.21.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	golang.org/x/text v0.23.0 // indirect
+	golang.org/x/tools v0.21.1-0.20240508182429-e35e4ccd0d2d // indirect
 )
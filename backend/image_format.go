@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"path/filepath"
+	"strings"
+
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+	_ "golang.org/x/image/webp" // Register the WebP decoder for imageDimensions
+)
+
+// Image formats the generator can produce
+const (
+	FormatPNG  = "png"
+	FormatJPEG = "jpeg"
+	FormatWebP = "webp"
+	FormatAVIF = "avif"
+)
+
+// imageFormats maps each output format to its file extension and MIME type
+var imageFormats = map[string]struct {
+	Extension string
+	MIMEType  string
+	Lossy     bool
+}{
+	FormatPNG:  {".png", "image/png", false},
+	FormatJPEG: {".jpg", "image/jpeg", true},
+	FormatWebP: {".webp", "image/webp", true},
+}
+
+// resolveImageFormat validates the requested format. Without one the format
+// follows the quality setting like the original screenshots did: PNG at
+// quality 100, JPEG below that.
+func resolveImageFormat(format string, quality int) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "":
+		if quality == 100 {
+			return FormatPNG, nil
+		}
+		return FormatJPEG, nil
+	case "png":
+		return FormatPNG, nil
+	case "jpeg", "jpg":
+		return FormatJPEG, nil
+	case "webp":
+		return FormatWebP, nil
+	case "avif":
+		// Chrome can decode AVIF but exposes no way to encode it, neither
+		// through DevTools screenshots nor canvas.toBlob
+		return "", fmt.Errorf("image format avif is not supported by the renderer yet (use png, jpeg or webp)")
+	}
+	return "", fmt.Errorf("unsupported image format %q (use png, jpeg or webp)", format)
+}
+
+// imageExtension returns the file extension for a resolved format
+func imageExtension(format string) string {
+	if f, ok := imageFormats[format]; ok {
+		return f.Extension
+	}
+	return ".png"
+}
+
+// imageMIMEType returns the MIME type for a resolved format
+func imageMIMEType(format string) string {
+	return imageFormats[format].MIMEType
+}
+
+// contentTypeForFile picks the Content-Type of a generated file from its
+// extension, or returns an empty string for unknown files
+func contentTypeForFile(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".jpeg" {
+		ext = ".jpg"
+	}
+	for _, f := range imageFormats {
+		if f.Extension == ext {
+			return f.MIMEType
+		}
+	}
+	if mimeType := metaOutputMIMEType(path); mimeType != "" {
+		return mimeType
+	}
+	if ext == ".html" {
+		return "text/html"
+	}
+	return ""
+}
+
+// screenshot builds a DevTools screenshot call for a resolved format.
+// Quality is only sent for lossy formats.
+func screenshot(format string, quality int) *page.CaptureScreenshotParams {
+	params := page.CaptureScreenshot().WithFromSurface(true)
+	switch format {
+	case FormatJPEG:
+		params = params.WithFormat(page.CaptureScreenshotFormatJpeg)
+	case FormatWebP:
+		params = params.WithFormat(page.CaptureScreenshotFormatWebp)
+	default:
+		params = params.WithFormat(page.CaptureScreenshotFormatPng)
+	}
+	if imageFormats[format].Lossy {
+		params = params.WithQuality(int64(quality))
+	}
+	return params
+}
+
+// encodeImage encodes an image produced in Go, such as a composed element
+// capture. PNG and JPEG are encoded directly; WebP has no Go encoder, so the
+// image is handed back to the browser and screenshotted in that format.
+func encodeImage(ctx context.Context, img image.Image, format string, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case FormatJPEG:
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	case FormatWebP:
+		return transcodeInBrowser(ctx, img, format, quality)
+	default:
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// transcodeInBrowser renders img in the current tab at its native size and
+// captures it in the requested format
+func transcodeInBrowser(ctx context.Context, img image.Image, format string, quality int) ([]byte, error) {
+	var source bytes.Buffer
+	if err := png.Encode(&source, img); err != nil {
+		return nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+
+	bounds := img.Bounds()
+	html := fmt.Sprintf(`<html><body style="margin:0"><img id="og" src="data:image/png;base64,%s"></body></html>`,
+		base64.StdEncoding.EncodeToString(source.Bytes()))
+
+	var out []byte
+	err := chromedp.Run(ctx,
+		emulation.SetDeviceMetricsOverride(int64(bounds.Dx()), int64(bounds.Dy()), 1, false),
+		chromedp.Navigate("about:blank"),
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			tree, err := page.GetFrameTree().Do(ctx)
+			if err != nil {
+				return err
+			}
+			return page.SetDocumentContent(tree.Frame.ID, html).Do(ctx)
+		}),
+		chromedp.Evaluate(`document.getElementById("og").decode()`, nil, func(p *runtime.EvaluateParams) *runtime.EvaluateParams {
+			return p.WithAwaitPromise(true)
+		}),
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			var err error
+			out, err = screenshot(format, quality).
+				WithClip(&page.Viewport{Width: float64(bounds.Dx()), Height: float64(bounds.Dy()), Scale: 1}).
+				Do(ctx)
+			return err
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode image as %s: %w", format, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestResolveImageFormat(t *testing.T) {
+	tests := []struct {
+		format   string
+		quality  int
+		expected string
+	}{
+		{"", 100, FormatPNG},
+		{"", 90, FormatJPEG},
+		{"PNG", 90, FormatPNG},
+		{"jpg", 100, FormatJPEG},
+		{"webp", 80, FormatWebP},
+	}
+
+	for _, tt := range tests {
+		format, err := resolveImageFormat(tt.format, tt.quality)
+		if err != nil {
+			t.Errorf("resolveImageFormat(%q, %d) returned error: %v", tt.format, tt.quality, err)
+			continue
+		}
+		if format != tt.expected {
+			t.Errorf("resolveImageFormat(%q, %d) = %q, expected %q", tt.format, tt.quality, format, tt.expected)
+		}
+	}
+
+	for _, format := range []string{"avif", "gif"} {
+		if _, err := resolveImageFormat(format, 90); err == nil {
+			t.Errorf("Expected an error for format %q", format)
+		}
+	}
+}
+
+func TestContentTypeForFile(t *testing.T) {
+	tests := map[string]string{
+		"abc_og_image.png":  "image/png",
+		"abc_og_image.jpg":  "image/jpeg",
+		"abc_og_image.JPEG": "image/jpeg",
+		"abc_og_image.webp": "image/webp",
+		"abc_og_meta.html":  "text/html",
+		"notes.txt":         "",
+	}
+
+	for path, expected := range tests {
+		if got := contentTypeForFile(path); got != expected {
+			t.Errorf("contentTypeForFile(%q) = %q, expected %q", path, got, expected)
+		}
+	}
+}
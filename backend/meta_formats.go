@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Meta output formats. Every generation writes all of them; meta_format
+// picks the one returned inline.
+const (
+	MetaFormatPage    = "page"    // Standalone preview page
+	MetaFormatSnippet = "snippet" // Bare <head> tags
+	MetaFormatJSONLD  = "jsonld"  // schema.org structured data
+	MetaFormatJSON    = "json"    // Tag name to value
+	MetaFormatNextJS  = "nextjs"  // Next.js metadata export
+	MetaFormatAstro   = "astro"   // Astro component
+	MetaFormatHugo    = "hugo"    // Hugo partial
+)
+
+// metaOutput describes how one format is rendered and stored
+type metaOutput struct {
+	Format   string
+	Suffix   string // Replaces the page's .html extension in the file name
+	MIMEType string
+	render   func(OpenGraphData) (string, error)
+}
+
+// metaOutputs lists the formats in the order they are offered
+var metaOutputs = []metaOutput{
+	{MetaFormatPage, ".html", "text/html", generateMetaTags},
+	{MetaFormatSnippet, "_snippet.html", "text/html", generateMetaSnippet},
+	{MetaFormatJSONLD, ".jsonld", "application/ld+json", generateJSONLD},
+	{MetaFormatJSON, ".json", "application/json", generateMetaJSON},
+	{MetaFormatNextJS, "_metadata.ts", "text/plain; charset=utf-8", generateNextMetadata},
+	{MetaFormatAstro, ".astro", "text/plain; charset=utf-8", generateAstroComponent},
+	{MetaFormatHugo, "_hugo.html", "text/html", generateHugoPartial},
+}
+
+// MetaFormats returns the names of the meta output formats
+func MetaFormats() []string {
+	names := make([]string, len(metaOutputs))
+	for i, o := range metaOutputs {
+		names[i] = o.Format
+	}
+	return names
+}
+
+// renderMetaOutputs renders every format from the same data
+func renderMetaOutputs(data OpenGraphData) (map[string]string, error) {
+	outputs := make(map[string]string, len(metaOutputs))
+	for _, o := range metaOutputs {
+		out, err := o.render(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render %s meta output: %w", o.Format, err)
+		}
+		outputs[o.Format] = out
+	}
+	return outputs, nil
+}
+
+// metaOutputPath returns where a format is stored next to the page
+func metaOutputPath(htmlPath, format string) string {
+	base := strings.TrimSuffix(htmlPath, filepath.Ext(htmlPath))
+	for _, o := range metaOutputs {
+		if o.Format == format {
+			return base + o.Suffix
+		}
+	}
+	return ""
+}
+
+// metaOutputMIMEType returns the content type of a stored output file, or
+// an empty string when the file is not one
+func metaOutputMIMEType(path string) string {
+	for _, o := range metaOutputs {
+		if o.Format != MetaFormatPage && strings.HasSuffix(path, o.Suffix) {
+			return o.MIMEType
+		}
+	}
+	return ""
+}
+
+// metaJSONTags groups the tags by name; repeated tags become lists
+func metaJSONTags(tags []MetaTag) map[string]interface{} {
+	values := make(map[string]interface{}, len(tags))
+	for _, tag := range tags {
+		switch existing := values[tag.Name].(type) {
+		case nil:
+			values[tag.Name] = tag.Content
+		case string:
+			values[tag.Name] = []string{existing, tag.Content}
+		case []string:
+			values[tag.Name] = append(existing, tag.Content)
+		}
+	}
+	return values
+}
+
+// generateMetaJSON renders the tags as a JSON object of name to value
+func generateMetaJSON(data OpenGraphData) (string, error) {
+	data = data.sanitized()
+	values := metaJSONTags(data.Tags())
+	values["title"] = data.Title
+
+	out, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(out) + "\n", nil
+}
+
+// schema.org types for the Open Graph types that have a close match
+var jsonLDTypes = map[string]string{
+	"article": "Article",
+	"book":    "Book",
+	"product": "Product",
+	"profile": "ProfilePage",
+}
+
+// generateJSONLD renders schema.org structured data for the page
+func generateJSONLD(data OpenGraphData) (string, error) {
+	data = data.sanitized()
+
+	schemaType := jsonLDTypes[data.Type]
+	if schemaType == "" {
+		schemaType = "WebPage"
+	}
+	doc := map[string]interface{}{
+		"@context": "https://schema.org",
+		"@type":    schemaType,
+	}
+
+	nameKey := "name"
+	if schemaType == "Article" {
+		nameKey = "headline"
+	}
+	set := func(key string, value interface{}) {
+		if value != "" && value != nil {
+			doc[key] = value
+		}
+	}
+	set(nameKey, data.Title)
+	set("description", data.Description)
+	set("url", data.PageURL)
+
+	if data.Locale != "" {
+		doc["inLanguage"] = strings.ReplaceAll(data.Locale, "_", "-")
+	}
+
+	var images []interface{}
+	if data.ImageURL != "" {
+		image := map[string]interface{}{"@type": "ImageObject", "url": data.ImageURL}
+		if data.ImageWidth > 0 && data.ImageHeight > 0 {
+			image["width"] = data.ImageWidth
+			image["height"] = data.ImageHeight
+		}
+		if data.ImageType != "" {
+			image["encodingFormat"] = data.ImageType
+		}
+		if data.ImageAlt != "" {
+			image["caption"] = data.ImageAlt
+		}
+		images = append(images, image)
+	}
+	for _, u := range data.Images {
+		images = append(images, u)
+	}
+	switch len(images) {
+	case 0:
+	case 1:
+		doc["image"] = images[0]
+	default:
+		doc["image"] = images
+	}
+
+	media := func(schemaType string, m OpenGraphMedia) map[string]interface{} {
+		obj := map[string]interface{}{"@type": schemaType, "name": data.Title, "contentUrl": m.URL}
+		if m.Type != "" {
+			obj["encodingFormat"] = m.Type
+		}
+		if m.Width > 0 && m.Height > 0 {
+			obj["width"] = m.Width
+			obj["height"] = m.Height
+		}
+		return obj
+	}
+	if data.Video.URL != "" {
+		doc["video"] = media("VideoObject", data.Video)
+	}
+	if data.Audio.URL != "" {
+		doc["audio"] = media("AudioObject", data.Audio)
+	}
+
+	if data.SiteName != "" {
+		doc["publisher"] = map[string]string{"@type": "Organization", "name": data.SiteName}
+	}
+
+	switch data.Type {
+	case "article":
+		set("datePublished", data.Article.PublishedTime)
+		set("dateModified", data.Article.ModifiedTime)
+		set("articleSection", data.Article.Section)
+		set("keywords", strings.Join(data.Article.Tags, ", "))
+		var authors []map[string]string
+		for _, author := range data.Article.Authors {
+			key := "name"
+			if isAbsoluteHTTPURL(author) {
+				key = "url"
+			}
+			authors = append(authors, map[string]string{"@type": "Person", key: author})
+		}
+		if len(authors) > 0 {
+			doc["author"] = authors
+		}
+	case "product":
+		if data.Product.PriceAmount != "" {
+			doc["offers"] = map[string]string{
+				"@type":         "Offer",
+				"price":         data.Product.PriceAmount,
+				"priceCurrency": data.Product.PriceCurrency,
+			}
+		}
+	case "profile":
+		person := map[string]string{"@type": "Person"}
+		for key, value := range map[string]string{
+			"givenName":     data.Profile.FirstName,
+			"familyName":    data.Profile.LastName,
+			"alternateName": data.Profile.Username,
+			"gender":        data.Profile.Gender,
+		} {
+			if value != "" {
+				person[key] = value
+			}
+		}
+		if len(person) > 1 {
+			doc["mainEntity"] = person
+		}
+	}
+
+	// Marshal escapes <, > and & so the output can go in a script element
+	out, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(out) + "\n", nil
+}
+
+// Open Graph types the Next.js Metadata type accepts for openGraph.type
+var nextOpenGraphTypes = []string{
+	"article", "book", "profile", "website",
+	"music.song", "music.album", "music.playlist", "music.radio_station",
+	"video.movie", "video.episode", "video.tv_show", "video.other",
+}
+
+// nextImage is an entry of openGraph.images
+type nextImage struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	Type   string `json:"type,omitempty"`
+	Alt    string `json:"alt,omitempty"`
+}
+
+// nextMedia is an entry of openGraph.videos or openGraph.audio
+type nextMedia struct {
+	URL    string `json:"url"`
+	Type   string `json:"type,omitempty"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+}
+
+// nextMetadata mirrors the parts of the Next.js Metadata type we fill in
+type nextMetadata struct {
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	OpenGraph   struct {
+		Type            string      `json:"type,omitempty"`
+		URL             string      `json:"url,omitempty"`
+		Title           string      `json:"title,omitempty"`
+		Description     string      `json:"description,omitempty"`
+		SiteName        string      `json:"siteName,omitempty"`
+		Locale          string      `json:"locale,omitempty"`
+		AlternateLocale []string    `json:"alternateLocale,omitempty"`
+		Images          []nextImage `json:"images,omitempty"`
+		Videos          []nextMedia `json:"videos,omitempty"`
+		Audio           []nextMedia `json:"audio,omitempty"`
+
+		// Article fields
+		PublishedTime string   `json:"publishedTime,omitempty"`
+		ModifiedTime  string   `json:"modifiedTime,omitempty"`
+		Authors       []string `json:"authors,omitempty"`
+		Section       string   `json:"section,omitempty"`
+		Tags          []string `json:"tags,omitempty"`
+
+		// Profile fields
+		FirstName string `json:"firstName,omitempty"`
+		LastName  string `json:"lastName,omitempty"`
+		Username  string `json:"username,omitempty"`
+		Gender    string `json:"gender,omitempty"`
+	} `json:"openGraph"`
+	Twitter struct {
+		Card        string   `json:"card,omitempty"`
+		Site        string   `json:"site,omitempty"`
+		Creator     string   `json:"creator,omitempty"`
+		Title       string   `json:"title,omitempty"`
+		Description string   `json:"description,omitempty"`
+		Images      []string `json:"images,omitempty"`
+	} `json:"twitter"`
+	Other map[string]string `json:"other,omitempty"`
+}
+
+// generateNextMetadata renders a metadata export for a Next.js App Router
+// page or layout. JSON is valid TypeScript, so the object is marshalled.
+func generateNextMetadata(data OpenGraphData) (string, error) {
+	data = data.sanitized()
+
+	var meta nextMetadata
+	meta.Title = data.Title
+	meta.Description = data.Description
+	other := make(map[string]string)
+
+	og := &meta.OpenGraph
+	og.URL = data.PageURL
+	og.Title = data.Title
+	og.Description = data.Description
+	og.SiteName = data.SiteName
+	og.Locale = data.Locale
+	og.AlternateLocale = data.LocaleAlternates
+	if containsFold(nextOpenGraphTypes, data.Type) {
+		og.Type = data.Type
+	} else if data.Type != "" {
+		// Types Next.js does not know, such as product, are passed through
+		other["og:type"] = data.Type
+	}
+	if data.ImageURL != "" {
+		og.Images = []nextImage{{URL: data.ImageURL, Width: data.ImageWidth, Height: data.ImageHeight, Type: data.ImageType, Alt: data.ImageAlt}}
+		meta.Twitter.Images = []string{data.ImageURL}
+	}
+	for _, image := range data.Images {
+		og.Images = append(og.Images, nextImage{URL: image})
+	}
+	if v := data.Video; v.URL != "" {
+		og.Videos = []nextMedia{{URL: v.URL, Type: v.Type, Width: v.Width, Height: v.Height}}
+	}
+	if a := data.Audio; a.URL != "" {
+		og.Audio = []nextMedia{{URL: a.URL, Type: a.Type}}
+	}
+
+	switch data.Type {
+	case "article":
+		og.PublishedTime = data.Article.PublishedTime
+		og.ModifiedTime = data.Article.ModifiedTime
+		og.Authors = data.Article.Authors
+		og.Section = data.Article.Section
+		og.Tags = data.Article.Tags
+	case "profile":
+		og.FirstName = data.Profile.FirstName
+		og.LastName = data.Profile.LastName
+		og.Username = data.Profile.Username
+		og.Gender = data.Profile.Gender
+	case "product":
+		if data.Product.PriceAmount != "" {
+			other["product:price:amount"] = data.Product.PriceAmount
+			other["product:price:currency"] = data.Product.PriceCurrency
+		}
+	}
+	if len(other) > 0 {
+		meta.Other = other
+	}
+
+	meta.Twitter.Card = data.TwitterCard
+	meta.Twitter.Site = twitterHandle(data.TwitterSite)
+	meta.Twitter.Creator = twitterHandle(data.TwitterCreator)
+	meta.Twitter.Title = data.Title
+	meta.Twitter.Description = data.Description
+
+	out, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return "import type { Metadata } from \"next\";\n\nexport const metadata: Metadata = " + string(out) + ";\n", nil
+}
+
+// generateAstroComponent renders an Astro component for a layout's <head>.
+// The values live in the frontmatter so nothing in them is parsed as markup.
+func generateAstroComponent(data OpenGraphData) (string, error) {
+	data = data.sanitized()
+
+	type astroTag struct {
+		Property string `json:"property,omitempty"`
+		Name     string `json:"name,omitempty"`
+		Content  string `json:"content"`
+	}
+	var tags []astroTag
+	for _, tag := range data.Tags() {
+		if tag.Attr == "property" {
+			tags = append(tags, astroTag{Property: tag.Name, Content: tag.Content})
+		} else {
+			tags = append(tags, astroTag{Name: tag.Name, Content: tag.Content})
+		}
+	}
+
+	title, err := json.Marshal(data.Title)
+	if err != nil {
+		return "", err
+	}
+	// One tag per line keeps the component readable
+	lines := make([]string, len(tags))
+	for i, tag := range tags {
+		line, err := json.Marshal(tag)
+		if err != nil {
+			return "", err
+		}
+		lines[i] = "  " + string(line)
+	}
+
+	var b strings.Builder
+	b.WriteString("---\n")
+	b.WriteString("// Open Graph tags; render with <OpenGraph /> inside <head>\n")
+	fmt.Fprintf(&b, "const title = %s;\n", title)
+	fmt.Fprintf(&b, "const tags = [\n%s,\n];\n", strings.Join(lines, ",\n"))
+	b.WriteString("---\n")
+	b.WriteString("<title>{title}</title>\n")
+	b.WriteString("{tags.map((tag) => <meta {...tag} />)}\n")
+	return b.String(), nil
+}
+
+// generateHugoPartial renders a partial for layouts/partials. The tags are
+// static, so template delimiters in the values are escaped for Hugo.
+func generateHugoPartial(data OpenGraphData) (string, error) {
+	snippet, err := generateMetaSnippet(data)
+	if err != nil {
+		return "", err
+	}
+
+	escaped := strings.ReplaceAll(snippet, "{{", `{{ "{{" }}`)
+	return "{{/* Open Graph tags, include with: partial \"opengraph.html\" . */}}\n" + escaped, nil
+}
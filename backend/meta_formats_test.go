@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testOpenGraphData is a product page with values that need escaping
+var testOpenGraphData = OpenGraphData{
+	Title:       `Ship {{ .Site }} & "more"`,
+	Description: "Fast <b>builds</b>",
+	ImageURL:    "https://cdn.example.com/og.png",
+	PageURL:     "https://example.com/p/1",
+	Type:        "product",
+	SiteName:    "Example",
+	ImageWidth:  1200,
+	ImageHeight: 630,
+	ImageType:   "image/png",
+	TwitterCard: "summary_large_image",
+}
+
+func TestMetaOutputs(t *testing.T) {
+	outputs, err := renderMetaOutputs(testOpenGraphData)
+	if err != nil {
+		t.Fatalf("renderMetaOutputs() error = %v", err)
+	}
+	if len(outputs) != len(MetaFormats()) {
+		t.Fatalf("got %d outputs, want %d", len(outputs), len(MetaFormats()))
+	}
+
+	snippet := outputs[MetaFormatSnippet]
+	if !strings.HasPrefix(snippet, "<title>Ship {{ .Site }} &amp; &#34;more&#34;</title>") ||
+		!strings.Contains(snippet, `<meta property="og:type" content="product">`) ||
+		!strings.Contains(snippet, "<!-- Twitter -->") {
+		t.Errorf("snippet =\n%s", snippet)
+	}
+	if !strings.Contains(outputs[MetaFormatPage], snippet) {
+		t.Error("the page head should carry the snippet")
+	}
+
+	var tags map[string]interface{}
+	if err := json.Unmarshal([]byte(outputs[MetaFormatJSON]), &tags); err != nil {
+		t.Fatalf("json output: %v", err)
+	}
+	if tags["og:title"] != testOpenGraphData.Title || tags["og:image:width"] != "1200" {
+		t.Errorf("json output = %v", tags)
+	}
+
+	var ld map[string]interface{}
+	if err := json.Unmarshal([]byte(outputs[MetaFormatJSONLD]), &ld); err != nil {
+		t.Fatalf("jsonld output: %v", err)
+	}
+	if ld["@type"] != "Product" || ld["name"] != testOpenGraphData.Title {
+		t.Errorf("jsonld output = %v", ld)
+	}
+	if strings.Contains(outputs[MetaFormatJSONLD], "<b>") {
+		t.Error("jsonld output must not contain raw markup")
+	}
+
+	next := outputs[MetaFormatNextJS]
+	if !strings.HasPrefix(next, "import type { Metadata } from \"next\";") ||
+		!strings.Contains(next, `"og:type": "product"`) || strings.Contains(next, `"type": "product"`) {
+		t.Errorf("nextjs output =\n%s", next)
+	}
+
+	astro := outputs[MetaFormatAstro]
+	if !strings.HasPrefix(astro, "---\n") || !strings.Contains(astro, `{"property":"og:title","content":`) {
+		t.Errorf("astro output =\n%s", astro)
+	}
+
+	hugo := outputs[MetaFormatHugo]
+	if !strings.Contains(hugo, `<title>Ship {{ "{{" }} .Site }} &amp;`) {
+		t.Errorf("hugo output should escape template delimiters:\n%s", hugo)
+	}
+}
+
+func TestWriteFilesWritesEveryMetaOutput(t *testing.T) {
+	outputs, err := renderMetaOutputs(testOpenGraphData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := &Result{MetaHTML: outputs[MetaFormatPage], Outputs: outputs}
+
+	htmlPath := filepath.Join(t.TempDir(), "abc_og_meta.html")
+	if err := result.WriteFiles("", htmlPath); err != nil {
+		t.Fatalf("WriteFiles() error = %v", err)
+	}
+
+	for _, format := range MetaFormats() {
+		path := metaOutputPath(htmlPath, format)
+		data, err := os.ReadFile(path)
+		if err != nil || string(data) != outputs[format] {
+			t.Errorf("%s output was not written to %s: %v", format, path, err)
+		}
+	}
+	if got := contentTypeForFile(metaOutputPath(htmlPath, MetaFormatJSONLD)); got != "application/ld+json" {
+		t.Errorf("content type of the jsonld file = %s", got)
+	}
+	if got := filepath.Base(metaOutputPath(htmlPath, MetaFormatNextJS)); got != "abc_og_meta_metadata.ts" {
+		t.Errorf("nextjs file = %s", got)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// PageTag is a metadata tag read from a page. Line is where the tag starts
+// in the source.
+type PageTag struct {
+	Attr    string `json:"attr"` // property or name; title and link for those elements
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	Line    int    `json:"line,omitempty"`
+}
+
+// metaNamespaces are the tag prefixes that are read from pages
+var metaNamespaces = []string{"og:", "twitter:", "article:", "product:", "profile:", "book:", "music:", "video:", "fb:"}
+
+// pageDocument is what is read from an HTML document: its metadata tags
+// and the page-level details around them
+type pageDocument struct {
+	Tags       []PageTag
+	Lang       string     // lang attribute of <html>
+	ThemeColor string     // first theme-color, preferring one without a media query
+	Icons      []pageIcon // icon and apple-touch-icon links
+	JSONLD     []string   // contents of each application/ld+json script
+	Links      []string   // href of each <a> not marked rel="nofollow"
+	BaseHref   string     // href of the first <base>
+	Robots     string     // content of the robots meta tag
+}
+
+// pageIcon is an icon link of a page
+type pageIcon struct {
+	Rel   string
+	Href  string
+	Sizes string
+}
+
+// parsePageTags reads the <title>, canonical link, description and every
+// Open Graph and Twitter tag from an HTML document, in document order
+func parsePageTags(r io.Reader) ([]PageTag, error) {
+	doc, err := parsePageDocument(r)
+	return doc.Tags, err
+}
+
+// parsePageDocument reads the metadata tags of an HTML document along with
+// its language, theme color, icons and JSON-LD blocks
+func parsePageDocument(r io.Reader) (pageDocument, error) {
+	var doc pageDocument
+	var themeMedia bool
+	z := html.NewTokenizer(r)
+	line := 1
+	inTitle, inJSONLD := false, false
+
+	for {
+		tt := z.Next()
+		raw := z.Raw()
+		start := line
+		line += strings.Count(string(raw), "\n")
+
+		switch tt {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return doc, nil
+			}
+			return doc, z.Err()
+
+		case html.TextToken:
+			if inTitle {
+				text := strings.Join(strings.Fields(string(z.Text())), " ")
+				doc.Tags = append(doc.Tags, PageTag{Attr: "title", Name: "title", Content: text, Line: start})
+				inTitle = false
+			}
+			if inJSONLD {
+				doc.JSONLD = append(doc.JSONLD, string(z.Text()))
+				inJSONLD = false
+			}
+
+		case html.EndTagToken:
+			switch name, _ := z.TagName(); string(name) {
+			case "title":
+				inTitle = false
+			case "script":
+				inJSONLD = false
+			}
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			attrs := make(map[string]string)
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = z.TagAttr()
+				attrs[string(key)] = string(val)
+			}
+
+			switch string(name) {
+			case "html":
+				doc.Lang = strings.TrimSpace(attrs["lang"])
+			case "title":
+				// Only the first title counts, as in browsers
+				inTitle = tt == html.StartTagToken && !hasPageTag(doc.Tags, "title", "title")
+			case "script":
+				inJSONLD = tt == html.StartTagToken && strings.EqualFold(strings.TrimSpace(attrs["type"]), "application/ld+json")
+			case "link":
+				href := strings.TrimSpace(attrs["href"])
+				if href == "" {
+					break
+				}
+				rel := strings.ToLower(strings.TrimSpace(attrs["rel"]))
+				if rel == "canonical" {
+					doc.Tags = append(doc.Tags, PageTag{Attr: "link", Name: "canonical", Content: href, Line: start})
+				} else if isIconRel(rel) {
+					doc.Icons = append(doc.Icons, pageIcon{Rel: rel, Href: href, Sizes: strings.ToLower(attrs["sizes"])})
+				}
+			case "a":
+				href := strings.TrimSpace(attrs["href"])
+				if href != "" && !containsFold(strings.Fields(attrs["rel"]), "nofollow") {
+					doc.Links = append(doc.Links, href)
+				}
+			case "base":
+				if doc.BaseHref == "" {
+					doc.BaseHref = strings.TrimSpace(attrs["href"])
+				}
+			case "meta":
+				if strings.EqualFold(attrs["name"], "robots") {
+					doc.Robots = strings.ToLower(attrs["content"])
+				}
+				if tag, ok := metaPageTag(attrs); ok {
+					tag.Line = start
+					doc.Tags = append(doc.Tags, tag)
+				} else if strings.EqualFold(attrs["name"], "theme-color") {
+					// Prefer the color that applies whatever the color scheme
+					_, hasMedia := attrs["media"]
+					if doc.ThemeColor == "" || (themeMedia && !hasMedia) {
+						doc.ThemeColor = strings.TrimSpace(attrs["content"])
+						themeMedia = hasMedia
+					}
+				}
+			}
+		}
+	}
+}
+
+// isIconRel reports whether a link rel names a favicon or touch icon
+func isIconRel(rel string) bool {
+	for _, token := range strings.Fields(rel) {
+		if token == "icon" || strings.HasPrefix(token, "apple-touch-icon") {
+			return true
+		}
+	}
+	return false
+}
+
+// metaPageTag turns the attributes of a <meta> element into a tag when it
+// is one we read. Facebook reads property and Twitter reads name, but both
+// accept either, so both are checked.
+func metaPageTag(attrs map[string]string) (PageTag, bool) {
+	for _, attr := range []string{"property", "name"} {
+		name := strings.ToLower(strings.TrimSpace(attrs[attr]))
+		if name == "" {
+			continue
+		}
+		content, ok := attrs["content"]
+		if !ok {
+			content = attrs["value"]
+		}
+		if name == "description" || hasMetaNamespace(name) {
+			return PageTag{Attr: attr, Name: name, Content: strings.TrimSpace(content)}, true
+		}
+	}
+	return PageTag{}, false
+}
+
+// hasMetaNamespace reports whether a tag name is in one of metaNamespaces
+func hasMetaNamespace(name string) bool {
+	for _, prefix := range metaNamespaces {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPageTag reports whether tags contains a tag
+func hasPageTag(tags []PageTag, attr, name string) bool {
+	for _, tag := range tags {
+		if tag.Attr == attr && tag.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// pageTagValues returns the values of every tag with the name, in order
+func pageTagValues(tags []PageTag, name string) []string {
+	var values []string
+	for _, tag := range tags {
+		if tag.Name == name && tag.Content != "" {
+			values = append(values, tag.Content)
+		}
+	}
+	return values
+}
+
+// pageTagValue returns the first value of the named tag
+func pageTagValue(tags []PageTag, name string) string {
+	if values := pageTagValues(tags, name); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// openGraphFromTags builds Open Graph data from the og:, twitter: and type
+// namespace tags of a page. The first value of a property wins; structured
+// image properties only describe the first og:image.
+func openGraphFromTags(tags []PageTag) OpenGraphData {
+	get := func(name string) string { return pageTagValue(tags, name) }
+	size := func(name string) int {
+		n, _ := strconv.Atoi(get(name))
+		return n
+	}
+
+	d := OpenGraphData{
+		Title:            get("og:title"),
+		Description:      get("og:description"),
+		PageURL:          get("og:url"),
+		Type:             get("og:type"),
+		SiteName:         get("og:site_name"),
+		Locale:           get("og:locale"),
+		LocaleAlternates: pageTagValues(tags, "og:locale:alternate"),
+		TwitterCard:      get("twitter:card"),
+		TwitterSite:      get("twitter:site"),
+		TwitterCreator:   get("twitter:creator"),
+		Video: OpenGraphMedia{
+			URL:    firstNonEmpty(get("og:video"), get("og:video:url")),
+			Type:   get("og:video:type"),
+			Width:  size("og:video:width"),
+			Height: size("og:video:height"),
+		},
+		Audio: OpenGraphMedia{
+			URL:  firstNonEmpty(get("og:audio"), get("og:audio:url")),
+			Type: get("og:audio:type"),
+		},
+		Article: ArticleData{
+			PublishedTime: get("article:published_time"),
+			ModifiedTime:  get("article:modified_time"),
+			Authors:       pageTagValues(tags, "article:author"),
+			Section:       get("article:section"),
+			Tags:          pageTagValues(tags, "article:tag"),
+		},
+		Product: ProductData{
+			PriceAmount:   get("product:price:amount"),
+			PriceCurrency: get("product:price:currency"),
+		},
+		Profile: ProfileData{
+			FirstName: get("profile:first_name"),
+			LastName:  get("profile:last_name"),
+			Username:  get("profile:username"),
+			Gender:    get("profile:gender"),
+		},
+	}
+
+	images := pageTagValues(tags, "og:image")
+	if len(images) == 0 {
+		images = pageTagValues(tags, "og:image:url")
+	}
+	if len(images) > 0 {
+		d.ImageURL = images[0]
+		d.Images = images[1:]
+		d.ImageType = get("og:image:type")
+		d.ImageWidth = size("og:image:width")
+		d.ImageHeight = size("og:image:height")
+		d.ImageAlt = get("og:image:alt")
+	}
+	return d
+}
+
+// resolvePageURL resolves a reference found on a page against the page URL.
+// References that cannot be resolved are returned unchanged.
+func resolvePageURL(base, ref string) string {
+	if base == "" || ref == "" {
+		return ref
+	}
+	b, err := url.Parse(base)
+	if err != nil {
+		return ref
+	}
+	u, err := b.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return u.String()
+}
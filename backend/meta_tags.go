@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// OpenGraphData represents the data needed for Open Graph meta tags
+type OpenGraphData struct {
+	Title       string
+	Description string
+	ImageURL    string
+	PageURL     string
+	Type        string
+	SiteName    string
+	ImageWidth  int
+	ImageHeight int
+	ImageType   string // MIME type of the image, empty when unknown
+	ImageAlt    string
+	TwitterCard string
+	LocalImage  bool // If true, ImageURL is a local path
+
+	Locale           string   // Language and territory, e.g. en_US
+	LocaleAlternates []string // Other locales the page is available in
+	Images           []string // Further images, listed after ImageURL
+
+	Video OpenGraphMedia
+	Audio OpenGraphMedia
+
+	// Properties of the og:type namespaces; only the one matching Type is
+	// published
+	Article ArticleData
+	Product ProductData
+	Profile ProfileData
+
+	TwitterSite    string // @username of the site
+	TwitterCreator string // @username of the author
+}
+
+// OpenGraphMedia is an og:video or og:audio attachment
+type OpenGraphMedia struct {
+	URL    string
+	Type   string // MIME type
+	Width  int    // Video only
+	Height int
+}
+
+// ArticleData holds the article:* properties
+type ArticleData struct {
+	PublishedTime string // ISO 8601
+	ModifiedTime  string
+	Authors       []string // Names or profile URLs
+	Section       string
+	Tags          []string
+}
+
+// ProductData holds the product:* price properties
+type ProductData struct {
+	PriceAmount   string // Decimal, e.g. 19.99
+	PriceCurrency string // ISO 4217 code
+}
+
+// ProfileData holds the profile:* properties
+type ProfileData struct {
+	FirstName string
+	LastName  string
+	Username  string
+	Gender    string // male or female
+}
+
+// MetaTag is one <meta> element. Attr is property for Open Graph tags and
+// name for the others.
+type MetaTag struct {
+	Attr    string
+	Name    string
+	Content string
+	Group   string // Heading the tag is listed under in HTML output
+}
+
+// Groups the tags are listed under, in order
+const (
+	metaGroupOpenGraph = "Open Graph / Facebook"
+	metaGroupTwitter   = "Twitter"
+	metaGroupLinkedIn  = "LinkedIn"
+	metaGroupOther     = "Additional helpful meta tags"
+)
+
+// sanitized returns the data with every URL made safe to publish. Every
+// output format starts from it.
+func (d OpenGraphData) sanitized() OpenGraphData {
+	d.PageURL = sanitizeMetaURL(d.PageURL)
+	d.ImageURL = sanitizeMetaURL(d.ImageURL)
+	d.Video.URL = sanitizeMetaURL(d.Video.URL)
+	d.Audio.URL = sanitizeMetaURL(d.Audio.URL)
+
+	var images []string
+	for _, image := range d.Images {
+		if image = sanitizeMetaURL(image); image != "" {
+			images = append(images, image)
+		}
+	}
+	d.Images = images
+	return d
+}
+
+// Tags lists the meta tags for the data in document order. Structured
+// properties such as og:image:width follow the tag they describe, and tags
+// without a value are left out.
+func (d OpenGraphData) Tags() []MetaTag {
+	var tags []MetaTag
+	add := func(group, attr, name, content string) {
+		if content != "" {
+			tags = append(tags, MetaTag{Attr: attr, Name: name, Content: content, Group: group})
+		}
+	}
+	og := func(name, content string) { add(metaGroupOpenGraph, "property", name, content) }
+	size := func(n int) string {
+		if n <= 0 {
+			return ""
+		}
+		return strconv.Itoa(n)
+	}
+	// secure_url repeats https URLs for older crawlers
+	secure := func(u string) string {
+		if strings.HasPrefix(strings.ToLower(u), "https://") {
+			return u
+		}
+		return ""
+	}
+
+	og("og:type", d.Type)
+	og("og:url", d.PageURL)
+	og("og:title", d.Title)
+	og("og:description", d.Description)
+	og("og:site_name", d.SiteName)
+	og("og:locale", d.Locale)
+	for _, locale := range d.LocaleAlternates {
+		og("og:locale:alternate", locale)
+	}
+
+	if d.ImageURL != "" {
+		og("og:image", d.ImageURL)
+		og("og:image:secure_url", secure(d.ImageURL))
+		og("og:image:type", d.ImageType)
+		og("og:image:width", size(d.ImageWidth))
+		og("og:image:height", size(d.ImageHeight))
+		og("og:image:alt", d.ImageAlt)
+	}
+	for _, image := range d.Images {
+		og("og:image", image)
+		og("og:image:secure_url", secure(image))
+	}
+	if d.Video.URL != "" {
+		og("og:video", d.Video.URL)
+		og("og:video:secure_url", secure(d.Video.URL))
+		og("og:video:type", d.Video.Type)
+		og("og:video:width", size(d.Video.Width))
+		og("og:video:height", size(d.Video.Height))
+	}
+	if d.Audio.URL != "" {
+		og("og:audio", d.Audio.URL)
+		og("og:audio:secure_url", secure(d.Audio.URL))
+		og("og:audio:type", d.Audio.Type)
+	}
+
+	switch d.Type {
+	case "article":
+		og("article:published_time", d.Article.PublishedTime)
+		og("article:modified_time", d.Article.ModifiedTime)
+		for _, author := range d.Article.Authors {
+			og("article:author", author)
+		}
+		og("article:section", d.Article.Section)
+		for _, tag := range d.Article.Tags {
+			og("article:tag", tag)
+		}
+	case "product":
+		og("product:price:amount", d.Product.PriceAmount)
+		og("product:price:currency", d.Product.PriceCurrency)
+	case "profile":
+		og("profile:first_name", d.Profile.FirstName)
+		og("profile:last_name", d.Profile.LastName)
+		og("profile:username", d.Profile.Username)
+		og("profile:gender", d.Profile.Gender)
+	}
+
+	add(metaGroupTwitter, "name", "twitter:card", d.TwitterCard)
+	add(metaGroupTwitter, "name", "twitter:site", twitterHandle(d.TwitterSite))
+	add(metaGroupTwitter, "name", "twitter:creator", twitterHandle(d.TwitterCreator))
+	add(metaGroupTwitter, "name", "twitter:url", d.PageURL)
+	add(metaGroupTwitter, "name", "twitter:title", d.Title)
+	add(metaGroupTwitter, "name", "twitter:description", d.Description)
+	add(metaGroupTwitter, "name", "twitter:image", d.ImageURL)
+	if d.ImageURL != "" {
+		add(metaGroupTwitter, "name", "twitter:image:alt", d.ImageAlt)
+	}
+
+	add(metaGroupLinkedIn, "name", "linkedin:title", d.Title)
+	add(metaGroupLinkedIn, "name", "linkedin:description", d.Description)
+	add(metaGroupLinkedIn, "name", "linkedin:image", d.ImageURL)
+
+	add(metaGroupOther, "name", "description", d.Description)
+	return tags
+}
+
+// twitterHandle returns a Twitter username with its leading @
+func twitterHandle(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" || strings.HasPrefix(name, "@") {
+		return name
+	}
+	return "@" + name
+}
+
+// metaSnippetTemplate renders the tags that go in a page's <head>
+const metaSnippetTemplate = `<title>{{.Title}}</title>
+{{range $i, $tag := .Tags}}{{if groupStart $i}}
+{{comment $tag.Group}}
+{{end}}{{if eq $tag.Attr "property"}}<meta property="{{$tag.Name}}" content="{{$tag.Content}}">{{else}}<meta name="{{$tag.Name}}" content="{{$tag.Content}}">{{end}}
+{{end}}`
+
+// metaPageTemplate is the preview page served next to a generated image.
+// The head carries the snippet and the code block shows it as text.
+const metaPageTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1.0">
+{{.Head}}</head>
+<body>
+    <h1>Open Graph Preview for: {{.Title}}</h1>
+    <p>This page contains the Open Graph meta tags for your content.</p>
+
+    <div style="margin: 20px 0;">
+        <h2>Preview:</h2>
+        <div style="border: 1px solid #ccc; border-radius: 8px; overflow: hidden; max-width: 600px;">
+            {{if .ImageURL}}<img src="{{.ImageURL}}" style="width: 100%; height: auto;" alt="Open Graph preview image">{{end}}
+            <div style="padding: 15px;">
+                <h3 style="margin: 0 0 10px; font-size: 18px;">{{.Title}}</h3>
+                <p style="margin: 0; color: #666; font-size: 14px;">{{.Description}}</p>
+                <p style="margin: 5px 0 0; color: #999; font-size: 12px;">{{.PageURL}}</p>
+            </div>
+        </div>
+    </div>
+
+    <div style="margin: 30px 0;">
+        <h2>HTML Code:</h2>
+        <pre style="background: #f4f4f4; padding: 15px; border-radius: 5px; overflow: auto;"><code>{{.Code}}</code></pre>
+    </div>
+</body>
+</html>`
+
+// generateMetaSnippet renders the bare <head> tags for the data
+func generateMetaSnippet(data OpenGraphData) (string, error) {
+	data = data.sanitized()
+	tags := data.Tags()
+
+	funcs := template.FuncMap{
+		"groupStart": func(i int) bool { return i == 0 || tags[i].Group != tags[i-1].Group },
+		// Group names are constants, so they are safe inside a comment
+		"comment": func(group string) template.HTML { return template.HTML("<!-- " + group + " -->") },
+	}
+	tmpl, err := template.New("snippet").Funcs(funcs).Parse(metaSnippetTemplate)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse meta snippet template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, struct {
+		Title string
+		Tags  []MetaTag
+	}{data.Title, tags}); err != nil {
+		return "", fmt.Errorf("failed to render meta snippet: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// generateMetaTags creates the standalone preview page. Values are escaped
+// for their context and the page and image URLs are sanitized.
+func generateMetaTags(data OpenGraphData) (string, error) {
+	snippet, err := generateMetaSnippet(data)
+	if err != nil {
+		return "", err
+	}
+
+	tmpl, err := template.New("metatags").Parse(metaPageTemplate)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse meta tags template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, struct {
+		OpenGraphData
+		Head template.HTML // Rendered by html/template above
+		Code string
+	}{data.sanitized(), template.HTML(snippet), snippet}); err != nil {
+		return "", fmt.Errorf("failed to render meta tags: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// sanitizeMetaURL returns an http(s) URL or a relative reference in its
+// canonical encoding. Anything else, such as javascript: or data: URLs,
+// becomes empty so the tag is left out.
+func sanitizeMetaURL(rawURL string) string {
+	rawURL = strings.TrimSpace(rawURL)
+	if rawURL == "" || strings.ContainsAny(rawURL, "\x00\r\n\t") {
+		return ""
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		if u.Host == "" {
+			return ""
+		}
+	case "":
+		// Relative references are kept for local previews
+	default:
+		return ""
+	}
+	return u.String()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerateMetaTagsEscapesValues(t *testing.T) {
+	out, err := generateMetaTags(OpenGraphData{
+		Title:       `"><script>alert(1)</script>`,
+		Description: `Tom & Jerry's <b>show</b>`,
+		PageURL:     `javascript:alert(document.cookie)`,
+		ImageURL:    `https://cdn.example.com/og image.png?a=1&b="2"`,
+		Type:        "website",
+		SiteName:    `Site" onmouseover="x`,
+		TwitterCard: "summary_large_image",
+	})
+	if err != nil {
+		t.Fatalf("generateMetaTags() error = %v", err)
+	}
+
+	for _, bad := range []string{"<script>", `onmouseover="x`, "javascript:", `"2"`} {
+		if strings.Contains(out, bad) {
+			t.Errorf("output contains unescaped %s", bad)
+		}
+	}
+	for _, want := range []string{
+		`<meta property="og:title" content="&#34;&gt;&lt;script&gt;alert(1)&lt;/script&gt;">`,
+		`<meta property="og:description" content="Tom &amp; Jerry&#39;s &lt;b&gt;show&lt;/b&gt;">`,
+		`<meta property="og:image" content="https://cdn.example.com/og%20image.png?a=1&amp;b=&#34;2&#34;">`,
+		// The code block shows the tag as it would be written
+		`&lt;meta property=&#34;og:title&#34; content=&#34;&amp;#34;&amp;gt;&amp;lt;script&amp;gt;alert(1)&amp;lt;/script&amp;gt;&#34;&gt;`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output is missing %s", want)
+		}
+	}
+	if strings.Contains(out, `property="og:url"`) {
+		t.Error("a javascript: page URL must leave og:url out")
+	}
+}
+
+func TestSanitizeMetaURL(t *testing.T) {
+	tests := map[string]string{
+		"https://example.com/a b":   "https://example.com/a%20b",
+		"HTTP://Example.com/":       "http://Example.com/",
+		"/og_image.png":             "/og_image.png",
+		"  https://example.com/  ":  "https://example.com/",
+		"javascript:alert(1)":       "",
+		"data:text/html,<script>":   "",
+		"https://":                  "",
+		"https://example.com/\nfoo": "",
+		"vbscript:msgbox":           "",
+		"file:///etc/passwd":        "",
+		"":                          "",
+	}
+	for in, want := range tests {
+		if got := sanitizeMetaURL(in); got != want {
+			t.Errorf("sanitizeMetaURL(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
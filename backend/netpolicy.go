@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/fetch"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+)
+
+// Reasons a generation can fail, stored on the generation record. The
+// blocked_* reasons come from the network policy.
+const (
+	FailureBlockedScheme  = "blocked_scheme"  // The URL scheme is not allowed
+	FailureBlockedAddress = "blocked_address" // The host resolves to a denied address
+	FailureUnresolvedHost = "unresolved_host" // The host could not be resolved
+	FailureTimeout        = "timeout"
+	FailureError          = "error"
+)
+
+// defaultDeniedCIDRs keeps renders away from loopback, private, link-local
+// (including cloud metadata services) and other non-public addresses
+var defaultDeniedCIDRs = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// Schemes that never leave the browser, so they are always allowed
+var localSchemes = []string{"about", "data", "blob"}
+
+// URL patterns for WebSocket connections, which renders may not open
+var blockedSocketPatterns = []string{"ws://*", "wss://*"}
+
+// BlockedRequest is a request the network policy refused
+type BlockedRequest struct {
+	URL          string `json:"url"`
+	Reason       string `json:"reason"`
+	Address      string `json:"address,omitempty"`       // The denied address, for blocked_address
+	ResourceType string `json:"resource_type,omitempty"` // Set for requests made by the page
+}
+
+// BlockedError is returned when the page itself may not be loaded
+type BlockedError struct {
+	BlockedRequest
+}
+
+func (e *BlockedError) Error() string {
+	switch e.Reason {
+	case FailureBlockedScheme:
+		return fmt.Sprintf("URL %s is not allowed: scheme is not permitted", e.URL)
+	case FailureUnresolvedHost:
+		return fmt.Sprintf("URL %s is not allowed: host could not be resolved", e.URL)
+	}
+	return fmt.Sprintf("URL %s is not allowed: %s is not a public address", e.URL, e.Address)
+}
+
+// NetworkPolicy decides which URLs renders may load. Addresses in Allow are
+// always permitted; otherwise an address in Deny blocks the request. Every
+// address a host resolves to must pass.
+type NetworkPolicy struct {
+	Schemes       []string
+	Allow         []*net.IPNet
+	Deny          []*net.IPNet
+	AllowPrefixes []string // URLs starting with one of these skip the checks
+	Resolver      *net.Resolver
+}
+
+// NewNetworkPolicy creates a policy allowing http and https to public
+// addresses. allow and deny are extra CIDRs; deny adds to the defaults.
+func NewNetworkPolicy(schemes, allow, deny []string) (*NetworkPolicy, error) {
+	if len(schemes) == 0 {
+		schemes = []string{"http", "https"}
+	}
+	p := &NetworkPolicy{Resolver: net.DefaultResolver}
+	for _, s := range schemes {
+		p.Schemes = append(p.Schemes, strings.ToLower(strings.TrimSuffix(strings.TrimSpace(s), ":")))
+	}
+
+	var err error
+	if p.Allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if p.Deny, err = parseCIDRs(append(append([]string{}, defaultDeniedCIDRs...), deny...)); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// AllowPrefix exempts URLs starting with prefix, such as the fonts this
+// service serves to its own card renders
+func (p *NetworkPolicy) AllowPrefix(prefix string) {
+	p.AllowPrefixes = append(p.AllowPrefixes, prefix)
+}
+
+// Check resolves the URL's host and returns a *BlockedError if the URL may
+// not be loaded
+func (p *NetworkPolicy) Check(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return &BlockedError{BlockedRequest{URL: rawURL, Reason: FailureBlockedScheme}}
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if containsFold(localSchemes, scheme) || p.allowedByPrefix(u) {
+		return nil
+	}
+	if !containsFold(p.Schemes, scheme) || u.Hostname() == "" {
+		return &BlockedError{BlockedRequest{URL: rawURL, Reason: FailureBlockedScheme}}
+	}
+
+	ips, err := p.resolve(ctx, u.Hostname())
+	if err != nil {
+		return &BlockedError{BlockedRequest{URL: rawURL, Reason: FailureUnresolvedHost}}
+	}
+	for _, ip := range ips {
+		if !p.Permits(ip) {
+			return &BlockedError{BlockedRequest{URL: rawURL, Reason: FailureBlockedAddress, Address: ip.String()}}
+		}
+	}
+	return nil
+}
+
+// allowedByPrefix reports whether the URL falls under one of AllowPrefixes.
+// The URL is compared after its path is decoded and cleaned, so encoded dot
+// segments such as /fonts/..%2f..%2fapi cannot climb out of a prefix.
+func (p *NetworkPolicy) allowedByPrefix(u *url.URL) bool {
+	if len(p.AllowPrefixes) == 0 || u.Host == "" || u.User != nil {
+		return false
+	}
+	cleaned := path.Clean("/" + u.Path)
+	if strings.HasSuffix(u.Path, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	canonical := strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host) + cleaned
+	for _, prefix := range p.AllowPrefixes {
+		if strings.HasPrefix(canonical, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Permits reports whether an address may be connected to
+func (p *NetworkPolicy) Permits(ip net.IP) bool {
+	for _, n := range p.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	for _, n := range p.Deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// resolve looks up a host, or parses it when it is an address literal
+func (p *NetworkPolicy) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	addrs, err := p.Resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, nil
+}
+
+// dialer returns a dialer that refuses addresses the policy denies. Checking
+// at dial time covers hosts whose DNS answer changes between the check and
+// the connection.
+func (p *NetworkPolicy) dialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !p.Permits(ip) {
+				return &BlockedError{BlockedRequest{URL: address, Reason: FailureBlockedAddress, Address: host}}
+			}
+			return nil
+		},
+	}
+}
+
+// transport returns an HTTP transport that only dials permitted addresses
+func (p *NetworkPolicy) transport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = p.dialer().DialContext
+	return transport
+}
+
+// HTTPClient returns a client that checks every URL, redirect and dialled
+// address against the policy
+func (p *NetworkPolicy) HTTPClient(timeout time.Duration) *http.Client {
+	transport := p.transport()
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return p.Check(req.Context(), req.URL.String())
+		},
+	}
+}
+
+// Proxy returns a forward proxy that connects only to permitted addresses.
+// Chrome is pointed at it so the address it connects to is checked after
+// the lookup, which the Fetch guard cannot do: a host whose DNS answer
+// changes between the guard's check and Chrome's own lookup is still
+// refused. Chrome never sends loopback requests through a proxy, and those
+// remain covered by the guard.
+func (p *NetworkPolicy) Proxy() http.Handler {
+	return &policyProxy{dialer: p.dialer(), transport: p.transport()}
+}
+
+// StartProxy serves Proxy on a loopback port and returns its address
+func (p *NetworkPolicy) StartProxy() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("failed to start the network policy proxy: %w", err)
+	}
+	go func() {
+		if err := http.Serve(listener, p.Proxy()); err != nil {
+			log.Printf("Network policy proxy stopped: %v", err)
+		}
+	}()
+	return "http://" + listener.Addr().String(), nil
+}
+
+// policyProxy forwards plain HTTP requests and tunnels CONNECT requests,
+// which carry HTTPS and WebSocket traffic
+type policyProxy struct {
+	dialer    *net.Dialer
+	transport *http.Transport
+}
+
+func (pp *policyProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		pp.tunnel(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "only proxy requests are accepted", http.StatusBadRequest)
+		return
+	}
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.Header.Del("Proxy-Connection")
+	out.Header.Del("Proxy-Authorization")
+	resp, err := pp.transport.RoundTrip(out)
+	if err != nil {
+		proxyError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// tunnel connects to the requested host and copies bytes both ways
+func (pp *policyProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	upstream, err := pp.dialer.DialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		proxyError(w, err)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "tunnelling is not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+
+	go func() {
+		defer upstream.Close()
+		io.Copy(upstream, buffered)
+	}()
+	go func() {
+		defer client.Close()
+		io.Copy(client, upstream)
+	}()
+}
+
+// proxyError answers 403 for addresses the policy refuses and 502 otherwise
+func proxyError(w http.ResponseWriter, err error) {
+	var blocked *BlockedError
+	if errors.As(err, &blocked) {
+		http.Error(w, blocked.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+// requestGuard checks every request a tab makes through the DevTools Fetch
+// domain and fails the ones the policy refuses. Chrome resolves the host
+// again when it connects, so the check is made as late as Chrome allows.
+// WebSocket handshakes never reach the Fetch domain, so they are blocked
+// outright.
+type requestGuard struct {
+	policy  *NetworkPolicy
+	logf    func(format string, args ...interface{})
+	mu      sync.Mutex
+	hosts   map[string]error // Check results by scheme and host, so each host resolves once
+	blocked []BlockedRequest
+}
+
+// newRequestGuard prepares a guard for one render
+func newRequestGuard(policy *NetworkPolicy, logf func(format string, args ...interface{})) *requestGuard {
+	if logf == nil {
+		logf = log.Printf
+	}
+	return &requestGuard{policy: policy, logf: logf, hosts: make(map[string]error)}
+}
+
+// enable starts intercepting the requests of the tab in ctx. It has to run
+// before the page is loaded.
+func (g *requestGuard) enable() chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		chromedp.ListenTarget(ctx, func(ev interface{}) {
+			if paused, ok := ev.(*fetch.EventRequestPaused); ok {
+				// Handlers must not block the event loop
+				go g.handle(ctx, paused)
+			}
+		})
+		if err := network.Enable().Do(ctx); err != nil {
+			return err
+		}
+		if err := network.SetBlockedURLS(blockedSocketPatterns).Do(ctx); err != nil {
+			return err
+		}
+		return fetch.Enable().WithPatterns([]*fetch.RequestPattern{{URLPattern: "*", RequestStage: fetch.RequestStageRequest}}).Do(ctx)
+	})
+}
+
+// handle lets a paused request continue or fails it
+func (g *requestGuard) handle(ctx context.Context, ev *fetch.EventRequestPaused) {
+	c := chromedp.FromContext(ctx)
+	if c == nil || c.Target == nil {
+		return
+	}
+	execCtx := cdp.WithExecutor(ctx, c.Target)
+
+	var err error
+	if err = g.check(ctx, ev.Request.URL); err != nil {
+		var blocked *BlockedError
+		if errors.As(err, &blocked) {
+			req := blocked.BlockedRequest
+			req.ResourceType = ev.ResourceType.String()
+			g.mu.Lock()
+			g.blocked = append(g.blocked, req)
+			g.mu.Unlock()
+			g.logf("Blocked %s request to %s: %s", req.ResourceType, req.URL, req.Reason)
+		}
+		err = fetch.FailRequest(ev.RequestID, network.ErrorReasonBlockedByClient).Do(execCtx)
+	} else {
+		err = fetch.ContinueRequest(ev.RequestID).Do(execCtx)
+	}
+	if err != nil && ctx.Err() == nil {
+		g.logf("Warning: Failed to resume request %s: %v", ev.Request.URL, err)
+	}
+}
+
+// check runs the policy, reusing the result for hosts already checked
+func (g *requestGuard) check(ctx context.Context, rawURL string) error {
+	key := rawURL
+	if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+		key = strings.ToLower(u.Scheme) + "://" + u.Host
+		if g.policy.allowedByPrefix(u) {
+			return nil
+		}
+	}
+
+	g.mu.Lock()
+	err, ok := g.hosts[key]
+	g.mu.Unlock()
+	if ok {
+		if blocked, isBlocked := err.(*BlockedError); isBlocked {
+			copied := *blocked
+			copied.URL = rawURL
+			return &copied
+		}
+		return err
+	}
+
+	err = g.policy.Check(ctx, rawURL)
+	g.mu.Lock()
+	g.hosts[key] = err
+	g.mu.Unlock()
+	return err
+}
+
+// Blocked returns the requests refused so far
+func (g *requestGuard) Blocked() []BlockedRequest {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]BlockedRequest(nil), g.blocked...)
+}
+
+// navigationError explains a failed load: when the page's own document was
+// refused, for instance after a redirect, the policy's reason is returned
+func (g *requestGuard) navigationError(err error) error {
+	if !strings.Contains(err.Error(), "ERR_BLOCKED_BY_CLIENT") {
+		return err
+	}
+	for _, req := range g.Blocked() {
+		if req.ResourceType == network.ResourceTypeDocument.String() {
+			return &BlockedError{req}
+		}
+	}
+	return err
+}
+
+// parseCIDRs parses a list of CIDRs; bare addresses are taken as one host
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid CIDR %q", v)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", v, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// splitList splits a comma separated setting, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// failureReason classifies a generation error for the generation record
+func failureReason(err error) string {
+	var blocked *BlockedError
+	switch {
+	case errors.As(err, &blocked):
+		return blocked.Reason
+	case errors.Is(err, ErrGenerationTimeout), errors.Is(err, context.DeadlineExceeded):
+		return FailureTimeout
+	}
+	return FailureError
+}
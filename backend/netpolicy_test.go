@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestNetworkPolicyCheck(t *testing.T) {
+	policy, err := NewNetworkPolicy(nil, []string{"10.1.2.0/24"}, []string{"93.184.215.14"})
+	if err != nil {
+		t.Fatalf("NewNetworkPolicy() error = %v", err)
+	}
+	policy.AllowPrefix("http://127.0.0.1:8888/fonts/")
+
+	tests := []struct {
+		url    string
+		reason string // empty when the URL is allowed
+	}{
+		{"http://8.8.8.8/", ""},
+		{"https://[2606:4700::1111]/", ""},
+		{"http://127.0.0.1:8888/api/admin", FailureBlockedAddress},
+		{"http://169.254.169.254/latest/meta-data/", FailureBlockedAddress},
+		{"http://192.168.1.1/", FailureBlockedAddress},
+		{"http://[::1]:8080/", FailureBlockedAddress},
+		{"http://[::ffff:127.0.0.1]/", FailureBlockedAddress},
+		{"http://[fd00::1]/", FailureBlockedAddress},
+		{"http://93.184.215.14/", FailureBlockedAddress},
+		{"http://10.1.2.3/", ""},
+		{"http://10.1.3.3/", FailureBlockedAddress},
+		{"file:///etc/passwd", FailureBlockedScheme},
+		{"ftp://8.8.8.8/", FailureBlockedScheme},
+		{"data:image/png;base64,AAAA", ""},
+		{"about:blank", ""},
+		{"http://127.0.0.1:8888/fonts/go-400.ttf", ""},
+		{"http://127.0.0.1:8888/fonts/..%2f..%2fapi/admin", FailureBlockedAddress},
+		{"http://127.0.0.1:8888/fonts/%2e%2e/api/admin", FailureBlockedAddress},
+		{"http://user@127.0.0.1:8888/fonts/go-400.ttf", FailureBlockedAddress},
+		{"ws://8.8.8.8/", FailureBlockedScheme},
+		{"http://localhost.invalid/", FailureUnresolvedHost},
+	}
+
+	for _, tt := range tests {
+		err := policy.Check(context.Background(), tt.url)
+		var blocked *BlockedError
+		switch {
+		case tt.reason == "" && err != nil:
+			t.Errorf("Check(%s) error = %v, want allowed", tt.url, err)
+		case tt.reason != "" && !errors.As(err, &blocked):
+			t.Errorf("Check(%s) error = %v, want %s", tt.url, err, tt.reason)
+		case tt.reason != "" && blocked.Reason != tt.reason:
+			t.Errorf("Check(%s) reason = %s, want %s", tt.url, blocked.Reason, tt.reason)
+		}
+	}
+
+	if _, err := NewNetworkPolicy(nil, []string{"10.0.0.0/33"}, nil); err == nil {
+		t.Error("NewNetworkPolicy() accepted an invalid CIDR")
+	}
+}
+
+func TestNetworkPolicyHTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+
+	policy, err := NewNetworkPolicy(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The test server listens on loopback, which is denied by default
+	_, err = policy.HTTPClient(time.Second).Get(server.URL)
+	var blocked *BlockedError
+	if !errors.As(err, &blocked) || blocked.Reason != FailureBlockedAddress {
+		t.Fatalf("Get() error = %v, want a blocked address", err)
+	}
+	if failureReason(fmt.Errorf("failed to fetch watermark: %w", err)) != FailureBlockedAddress {
+		t.Error("failureReason() does not see through wrapped errors")
+	}
+
+	allowed, err := NewNetworkPolicy(nil, []string{"127.0.0.0/8"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := allowed.HTTPClient(time.Second).Get(server.URL)
+	if err != nil {
+		t.Fatalf("Get() with loopback allowed error = %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestNetworkPolicyProxy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer tlsServer.Close()
+
+	// get fetches a URL through a proxy applying the policy
+	get := func(policy *NetworkPolicy, target string) (*http.Response, error) {
+		proxy := httptest.NewServer(policy.Proxy())
+		defer proxy.Close()
+		proxyURL, _ := url.Parse(proxy.URL)
+		transport := tlsServer.Client().Transport.(*http.Transport).Clone()
+		transport.Proxy = http.ProxyURL(proxyURL)
+		client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+		return client.Get(target)
+	}
+
+	denied, err := NewNetworkPolicy(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Plain requests are answered by the proxy; tunnels fail to open
+	resp, err := get(denied, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("proxied request to loopback status = %d, want 403", resp.StatusCode)
+	}
+	if resp, err := get(denied, tlsServer.URL); err == nil {
+		resp.Body.Close()
+		t.Error("tunnel to loopback was opened")
+	}
+
+	allowed, err := NewNetworkPolicy(nil, []string{"127.0.0.0/8"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{server.URL, tlsServer.URL} {
+		resp, err := get(allowed, target)
+		if err != nil {
+			t.Fatalf("Get(%s) with loopback allowed error = %v", target, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+			t.Errorf("Get(%s) = %d %q, want 200 ok", target, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestFailureReasonRecorded(t *testing.T) {
+	database := newTestDatabase(t)
+
+	gen := &Generation{ID: "blocked-test", CreatedAt: time.Now()}
+	if err := database.SaveGeneration(gen); err != nil {
+		t.Fatal(err)
+	}
+
+	blocked := BlockedRequest{URL: "http://169.254.169.254/", Reason: FailureBlockedAddress, Address: "169.254.169.254"}
+	if err := database.SetFailureReason(gen.ID, failureReason(&BlockedError{blocked})); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.SetBlockedRequests(gen.ID, []BlockedRequest{blocked}); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := database.GetGeneration(gen.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.FailureReason != FailureBlockedAddress {
+		t.Errorf("FailureReason = %q, want %s", stored.FailureReason, FailureBlockedAddress)
+	}
+	want := `[{"url":"http://169.254.169.254/","reason":"blocked_address","address":"169.254.169.254"}]`
+	if stored.BlockedRequests != want {
+		t.Errorf("BlockedRequests = %s, want %s", stored.BlockedRequests, want)
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // Pages use GIF images too; PNG, JPEG and WebP are registered elsewhere
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxValidateBodyBytes = 2 << 20 // Largest /api/validate body, HTML included
+	maxLintImageBytes    = 8 << 20 // Facebook's limit for og:image
+	lintImageTimeout     = 10 * time.Second
+
+	lintErrorPenalty   = 15 // Score lost per error
+	lintWarningPenalty = 5  // Score lost per warning
+)
+
+// LintIssue is one problem found with a page's tags
+type LintIssue struct {
+	Rule     string `json:"rule"`
+	Property string `json:"property,omitempty"`
+	Platform string `json:"platform,omitempty"`
+	Message  string `json:"message"`
+}
+
+// ImageCheck describes what was found at the page's og:image
+type ImageCheck struct {
+	URL         string  `json:"url"`
+	Reachable   bool    `json:"reachable"`
+	Status      int     `json:"status,omitempty"`
+	ContentType string  `json:"content_type,omitempty"`
+	Bytes       int     `json:"bytes,omitempty"`
+	Width       int     `json:"width,omitempty"`
+	Height      int     `json:"height,omitempty"`
+	AspectRatio float64 `json:"aspect_ratio,omitempty"`
+}
+
+// LintReport is the result of validating a page's tags. The score starts
+// at 100 and loses lintErrorPenalty per error and lintWarningPenalty per
+// warning.
+type LintReport struct {
+	URL      string      `json:"url,omitempty"`
+	Score    int         `json:"score"`
+	Errors   []LintIssue `json:"errors"`
+	Warnings []LintIssue `json:"warnings"`
+	Tags     []PageTag   `json:"tags"`
+	Image    *ImageCheck `json:"image,omitempty"`
+}
+
+// platformLimit is how much of the title and description a platform shows
+// before truncating
+type platformLimit struct {
+	Platform    string
+	Title       int
+	Description int
+	TitleTags   []string // Tags the platform reads the title from, in order
+	DescTags    []string
+}
+
+var platformLimits = []platformLimit{
+	{"facebook", 88, 200, []string{"og:title", "title"}, []string{"og:description", "description"}},
+	{"twitter", 70, 200, []string{"twitter:title", "og:title", "title"}, []string{"twitter:description", "og:description", "description"}},
+	{"linkedin", 120, 160, []string{"og:title", "title"}, []string{"og:description", "description"}},
+}
+
+// repeatableTags may appear more than once; other tags must not
+var repeatableTags = []string{
+	"og:image", "og:video", "og:audio", "og:locale:alternate",
+	"article:author", "article:tag", "book:author", "book:tag",
+	"music:", "video:actor", "video:director", "video:writer", "video:tag",
+}
+
+// isRepeatableTag reports whether a tag may be given more than once.
+// Structured properties such as og:image:width repeat with their image.
+func isRepeatableTag(name string) bool {
+	for _, prefix := range repeatableTags {
+		if name == prefix || strings.HasPrefix(name, prefix+":") || (strings.HasSuffix(prefix, ":") && strings.HasPrefix(name, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// linter collects the issues of one report
+type linter struct {
+	report *LintReport
+}
+
+func (l *linter) errorf(rule, property, platform, format string, args ...interface{}) {
+	l.report.Errors = append(l.report.Errors, LintIssue{rule, property, platform, fmt.Sprintf(format, args...)})
+}
+
+func (l *linter) warnf(rule, property, platform, format string, args ...interface{}) {
+	l.report.Warnings = append(l.report.Warnings, LintIssue{rule, property, platform, fmt.Sprintf(format, args...)})
+}
+
+// lintPage checks the tags read from a page. pageURL resolves relative
+// references and may be empty. The og:image is downloaded with client to
+// check it; a nil client skips that check.
+func lintPage(ctx context.Context, pageURL string, tags []PageTag, client *http.Client) LintReport {
+	report := LintReport{URL: pageURL, Errors: []LintIssue{}, Warnings: []LintIssue{}, Tags: tags}
+	if report.Tags == nil {
+		report.Tags = []PageTag{}
+	}
+	l := &linter{report: &report}
+	data := openGraphFromTags(tags)
+
+	l.checkRequired(tags, data)
+	l.checkDuplicates(tags)
+	l.checkStructure(tags)
+	l.checkURLs(tags, data)
+	l.checkConflicts(tags)
+	for _, problem := range validateOpenGraph(data) {
+		l.errorf("type-properties", problem.Property, "", "%s %s", problem.Property, problem.Message)
+	}
+	for _, problem := range missingTypeProperties(data) {
+		l.warnf("type-properties", problem.Property, "", "%s %s", problem.Property, problem.Message)
+	}
+	l.checkLengths(tags)
+
+	if data.ImageURL != "" {
+		if data.ImageAlt == "" {
+			l.warnf("image-alt", "og:image:alt", "", "og:image:alt describes the image to screen reader users")
+		}
+		if data.ImageWidth == 0 || data.ImageHeight == 0 {
+			l.warnf("image-dimensions", "og:image:width", "facebook", "og:image:width and og:image:height let the image show on the first share")
+		}
+		if client != nil {
+			l.checkImage(ctx, client, resolvePageURL(pageURL, data.ImageURL), data)
+		}
+	}
+
+	report.Score = 100 - lintErrorPenalty*len(report.Errors) - lintWarningPenalty*len(report.Warnings)
+	if report.Score < 0 {
+		report.Score = 0
+	}
+	return report
+}
+
+// checkRequired reports the basic tags every page should have. The image
+// may be given as og:image or og:image:url.
+func (l *linter) checkRequired(tags []PageTag, data OpenGraphData) {
+	for _, tag := range [][2]string{
+		{"og:title", pageTagValue(tags, "og:title")},
+		{"og:type", pageTagValue(tags, "og:type")},
+		{"og:image", data.ImageURL},
+		{"og:url", pageTagValue(tags, "og:url")},
+	} {
+		if name, value := tag[0], tag[1]; value == "" {
+			l.errorf("required", name, "", "%s is required", name)
+		}
+	}
+	if pageTagValue(tags, "og:description") == "" {
+		l.warnf("recommended", "og:description", "", "og:description is missing")
+	}
+	if pageTagValue(tags, "twitter:card") == "" {
+		l.warnf("recommended", "twitter:card", "twitter", "twitter:card is missing, so Twitter shows a small summary card")
+	}
+}
+
+// checkDuplicates reports tags that may only appear once but repeat
+func (l *linter) checkDuplicates(tags []PageTag) {
+	seen := make(map[string][]string)
+	var order []string
+	for _, tag := range tags {
+		if tag.Attr == "title" || tag.Attr == "link" || isRepeatableTag(tag.Name) {
+			continue
+		}
+		if _, ok := seen[tag.Name]; !ok {
+			order = append(order, tag.Name)
+		}
+		seen[tag.Name] = append(seen[tag.Name], tag.Content)
+	}
+
+	for _, name := range order {
+		values := seen[name]
+		if len(values) < 2 {
+			continue
+		}
+		conflicting := false
+		for _, v := range values[1:] {
+			if v != values[0] {
+				conflicting = true
+			}
+		}
+		if conflicting {
+			l.errorf("conflict", name, "", "%s is given %d times with different values; platforms pick different ones", name, len(values))
+		} else {
+			l.warnf("duplicate", name, "", "%s is given %d times", name, len(values))
+		}
+	}
+}
+
+// checkStructure reports structured properties that come before the tag
+// they describe
+func (l *linter) checkStructure(tags []PageTag) {
+	seen := make(map[string]bool)
+	reported := make(map[string]bool)
+	for _, tag := range tags {
+		for _, parent := range []string{"og:image", "og:video", "og:audio"} {
+			if tag.Name == parent || tag.Name == parent+":url" {
+				seen[parent] = true
+			} else if strings.HasPrefix(tag.Name, parent+":") && !seen[parent] && !reported[tag.Name] {
+				l.errorf("structure", tag.Name, "", "%s must follow the %s it describes", tag.Name, parent)
+				reported[tag.Name] = true
+			}
+		}
+	}
+}
+
+// checkURLs reports URLs crawlers cannot use
+func (l *linter) checkURLs(tags []PageTag, data OpenGraphData) {
+	// Further og:image values are checked with the other properties
+	for _, tag := range [][2]string{
+		{"og:url", data.PageURL},
+		{"og:image", data.ImageURL},
+		{"twitter:image", pageTagValue(tags, "twitter:image")},
+	} {
+		name, value := tag[0], tag[1]
+		if value != "" && !isAbsoluteHTTPURL(value) {
+			l.errorf("absolute-url", name, "", "%s must be an absolute http or https URL, got %q", name, value)
+		}
+	}
+
+	canonical := pageTagValue(tags, "canonical")
+	if canonical != "" && data.PageURL != "" && strings.TrimSuffix(canonical, "/") != strings.TrimSuffix(data.PageURL, "/") {
+		l.warnf("conflict", "og:url", "", "og:url %q differs from the canonical URL %q, so shares are counted separately", data.PageURL, canonical)
+	}
+}
+
+// checkConflicts reports Twitter tags that disagree with their Open Graph
+// counterparts. Twitter reads its own tag first, so the previews differ.
+func (l *linter) checkConflicts(tags []PageTag) {
+	for _, pair := range [][2]string{
+		{"twitter:title", "og:title"},
+		{"twitter:description", "og:description"},
+		{"twitter:image", "og:image"},
+	} {
+		tw, og := pageTagValue(tags, pair[0]), pageTagValue(tags, pair[1])
+		if tw != "" && og != "" && tw != og {
+			l.warnf("conflict", pair[0], "twitter", "%s differs from %s, so Twitter shows different content than other platforms", pair[0], pair[1])
+		}
+	}
+}
+
+// checkLengths reports titles and descriptions each platform truncates
+func (l *linter) checkLengths(tags []PageTag) {
+	first := func(names []string) (string, string) {
+		for _, name := range names {
+			if v := pageTagValue(tags, name); v != "" {
+				return name, v
+			}
+		}
+		return "", ""
+	}
+
+	for _, limit := range platformLimits {
+		if name, title := first(limit.TitleTags); title != "" {
+			if n := utf8.RuneCountInString(title); n > limit.Title {
+				l.warnf("length", name, limit.Platform, "%s is %d characters; %s truncates it after %d", name, n, limit.Platform, limit.Title)
+			}
+		}
+		if name, desc := first(limit.DescTags); desc != "" {
+			if n := utf8.RuneCountInString(desc); n > limit.Description {
+				l.warnf("length", name, limit.Platform, "%s is %d characters; %s truncates it after %d", name, n, limit.Platform, limit.Description)
+			}
+		}
+	}
+}
+
+// checkImage downloads the og:image and checks it can be shown
+func (l *linter) checkImage(ctx context.Context, client *http.Client, imageURL string, data OpenGraphData) {
+	check := &ImageCheck{URL: imageURL}
+	l.report.Image = check
+	if !isAbsoluteHTTPURL(imageURL) {
+		return
+	}
+
+	body, err := fetchLintImage(ctx, client, check)
+	if err != nil {
+		var blocked *BlockedError
+		if errors.As(err, &blocked) {
+			l.errorf("image-reachable", "og:image", "", "og:image is blocked by the network policy: %s", blocked.Reason)
+		} else {
+			l.errorf("image-reachable", "og:image", "", "og:image could not be downloaded: %v", err)
+		}
+		return
+	}
+	check.Reachable = true
+
+	if !strings.HasPrefix(check.ContentType, "image/") {
+		l.errorf("image-type", "og:image", "", "og:image is served as %q, not as an image", check.ContentType)
+	}
+	if check.Bytes > maxLintImageBytes {
+		l.errorf("image-size", "og:image", "facebook", "og:image is larger than %d MB", maxLintImageBytes>>20)
+		return
+	}
+	if check.Bytes > 5<<20 {
+		l.warnf("image-size", "og:image", "twitter", "og:image is larger than 5 MB, which Twitter does not show")
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		l.errorf("image-type", "og:image", "", "og:image is not a PNG, JPEG, GIF or WebP image")
+		return
+	}
+	check.Width, check.Height = cfg.Width, cfg.Height
+	if cfg.Width == 0 || cfg.Height == 0 {
+		l.errorf("image-dimensions", "og:image", "", "og:image is %dx%d, so there is nothing to show", cfg.Width, cfg.Height)
+		return
+	}
+	check.AspectRatio = math.Round(float64(cfg.Width)/float64(cfg.Height)*100) / 100
+
+	if data.ImageWidth > 0 && data.ImageWidth != cfg.Width {
+		l.errorf("image-dimensions", "og:image:width", "", "og:image:width is %d but the image is %d pixels wide", data.ImageWidth, cfg.Width)
+	}
+	if data.ImageHeight > 0 && data.ImageHeight != cfg.Height {
+		l.errorf("image-dimensions", "og:image:height", "", "og:image:height is %d but the image is %d pixels high", data.ImageHeight, cfg.Height)
+	}
+
+	switch {
+	case cfg.Width < 200 || cfg.Height < 200:
+		l.errorf("image-dimensions", "og:image", "facebook", "og:image is %dx%d; images smaller than 200x200 are not shown", cfg.Width, cfg.Height)
+	case cfg.Width < 600 || cfg.Height < 315:
+		l.warnf("image-dimensions", "og:image", "facebook", "og:image is %dx%d; images smaller than 600x315 are shown as a small thumbnail", cfg.Width, cfg.Height)
+	}
+
+	// Large cards are cropped to 1.91:1, summary cards to a square
+	if data.TwitterCard == "summary" {
+		if check.AspectRatio < 0.8 || check.AspectRatio > 1.25 {
+			l.warnf("aspect-ratio", "og:image", "twitter", "og:image has an aspect ratio of %.2f; summary cards crop it to 1:1", check.AspectRatio)
+		}
+	} else if check.AspectRatio < 1.7 || check.AspectRatio > 2.1 {
+		l.warnf("aspect-ratio", "og:image", "", "og:image has an aspect ratio of %.2f; large previews crop it to 1.91:1 (e.g. 1200x630)", check.AspectRatio)
+	}
+}
+
+// fetchLintImage downloads an image, recording the response in check
+func fetchLintImage(ctx context.Context, client *http.Client, check *ImageCheck) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, lintImageTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, check.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	check.Status = resp.StatusCode
+	check.ContentType = resp.Header.Get("Content-Type")
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxLintImageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	check.Bytes = len(body)
+	return body, nil
+}
+
+// ValidateRequest is the body of /api/validate. With HTML given, URL is
+// only used to resolve relative references; otherwise the page at URL is
+// loaded in a browser.
+type ValidateRequest struct {
+	URL        string `json:"url,omitempty"`
+	HTML       string `json:"html,omitempty"`
+	SkipImages bool   `json:"skip_images,omitempty"` // Don't download the og:image
+}
+
+// decodeValidateRequest reads a JSON or form /api/validate request
+func decodeValidateRequest(w http.ResponseWriter, r *http.Request) (ValidateRequest, error) {
+	var req ValidateRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxValidateBodyBytes)
+
+	if isJSONRequest(r) {
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			return req, &ValidationError{Fields: []FieldError{{Field: "body", Message: err.Error()}}}
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			return req, &ValidationError{Fields: []FieldError{{Field: "body", Message: err.Error()}}}
+		}
+		req.URL = r.PostForm.Get("url")
+		req.HTML = r.PostForm.Get("html")
+		req.SkipImages = r.PostForm.Get("skip_images") == "true"
+	}
+
+	req.URL = strings.TrimSpace(req.URL)
+	var errs []FieldError
+	switch {
+	case req.URL == "" && strings.TrimSpace(req.HTML) == "":
+		errs = append(errs, FieldError{Field: "url", Message: "a url or html is required"})
+	case req.URL != "":
+		if _, err := normalizeURL(req.URL); err != nil {
+			errs = append(errs, FieldError{Field: "url", Message: err.Error()})
+		}
+	}
+	if len(errs) > 0 {
+		return req, &ValidationError{Fields: errs}
+	}
+	return req, nil
+}
+
+// fetchPageQueued loads a page on a queue worker, so validations take their
+// turn for a browser with the generations
+func fetchPageQueued(ctx context.Context, pageURL string) (string, string, error) {
+	var source, finalURL string
+	job := NewJob("validate_"+generateRequestID(), GenerationParameters{}, "", "")
+	job.Task = func(jobCtx context.Context) (*Result, error) {
+		// Give up with the request as well as at the job timeout
+		jobCtx, cancel := context.WithCancel(jobCtx)
+		defer context.AfterFunc(ctx, cancel)()
+		defer cancel()
+
+		var err error
+		source, finalURL, err = generator.FetchPage(jobCtx, pageURL)
+		return nil, err
+	}
+	if err := jobQueue.Submit(job); err != nil {
+		return "", "", err
+	}
+
+	select {
+	case <-job.Done():
+	case <-ctx.Done():
+		return "", "", ctx.Err()
+	}
+	if _, err := job.Result(); err != nil {
+		return "", "", err
+	}
+	return source, finalURL, nil
+}
+
+// handleValidateRequest lints the Open Graph and Twitter tags of a page
+// given by URL or as HTML
+func handleValidateRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, err := decodeValidateRequest(w, r)
+	if err != nil {
+		sendValidationError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), generationTimeout)
+	defer cancel()
+
+	pageURL, source := req.URL, req.HTML
+	if source == "" {
+		if generator == nil || jobQueue == nil {
+			sendErrorResponse(w, "Page rendering is unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if source, pageURL, err = fetchPageQueued(ctx, req.URL); errors.Is(err, ErrQueueFull) || errors.Is(err, ErrQueueStopped) {
+			log.Printf("Rejecting validation of %s: %v", req.URL, err)
+			sendQueueError(w, err)
+			return
+		} else if err != nil {
+			var blocked *BlockedError
+			if errors.As(err, &blocked) {
+				sendErrorResponse(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			log.Printf("Failed to load %s for validation: %v", req.URL, err)
+			sendErrorResponse(w, "Failed to load page: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+	} else if pageURL != "" {
+		pageURL, _ = normalizeURL(pageURL)
+	}
+
+	tags, err := parsePageTags(strings.NewReader(source))
+	if err != nil {
+		sendErrorResponse(w, "Failed to parse HTML: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var client *http.Client
+	if generator != nil && !req.SkipImages {
+		client = generator.httpClient()
+	}
+	report := lintPage(ctx, pageURL, tags, client)
+
+	sendJSONResponse(w, map[string]interface{}{
+		"success": true,
+		"data":    report,
+	})
+}
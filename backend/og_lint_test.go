@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const lintTestPage = `<!DOCTYPE html>
+<html>
+<head>
+<title>  Release
+  notes </title>
+<link rel="canonical" href="https://example.com/releases">
+<meta property="og:image:width" content="1200">
+<meta property="og:title" content="Release notes">
+<meta name="og:title" content="Old release notes">
+<meta property="og:type" content="article">
+<meta property="og:url" content="https://example.com/releases/">
+<meta property="og:image" content="/og.png">
+<meta property="og:image:width" content="1200">
+<meta property="og:image:height" content="600">
+<meta name="twitter:card" content="summary_large_image">
+<meta name="twitter:title" content="Release notes for this month, with every change we shipped and more words than Twitter shows">
+<meta name="description" content="What changed">
+</head>
+<body><title>Ignored</title></body>
+</html>`
+
+func TestParsePageTags(t *testing.T) {
+	tags, err := parsePageTags(strings.NewReader(lintTestPage))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := pageTagValue(tags, "title"); got != "Release notes" {
+		t.Errorf("title = %q", got)
+	}
+	if got := pageTagValue(tags, "canonical"); got != "https://example.com/releases" {
+		t.Errorf("canonical = %q", got)
+	}
+	if got := pageTagValues(tags, "og:title"); len(got) != 2 {
+		t.Errorf("og:title values = %v, want both the property and name tags", got)
+	}
+	if tags[2].Name != "og:image:width" || tags[2].Line != 7 {
+		t.Errorf("third tag = %+v, want og:image:width on line 7", tags[2])
+	}
+}
+
+func TestLintPage(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 1200, 630))); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+
+	tags, err := parsePageTags(strings.NewReader(lintTestPage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := lintPage(context.Background(), server.URL+"/releases", tags, server.Client())
+
+	rules := func(issues []LintIssue) map[string]bool {
+		found := make(map[string]bool)
+		for _, issue := range issues {
+			found[issue.Rule+" "+issue.Property] = true
+		}
+		return found
+	}
+	errs, warnings := rules(report.Errors), rules(report.Warnings)
+
+	for _, want := range []string{
+		"structure og:image:width",
+		"conflict og:title",
+		"absolute-url og:image",
+		"image-dimensions og:image:height",
+	} {
+		if !errs[want] {
+			t.Errorf("missing error %q in %+v", want, report.Errors)
+		}
+	}
+	for _, want := range []string{
+		"recommended og:description",
+		"conflict twitter:title",
+		"length twitter:title",
+		"image-alt og:image:alt",
+		"type-properties article:published_time",
+	} {
+		if !warnings[want] {
+			t.Errorf("missing warning %q in %+v", want, report.Warnings)
+		}
+	}
+	if warnings["conflict og:url"] {
+		t.Error("a trailing slash should not count as a different canonical URL")
+	}
+
+	if report.Image == nil || !report.Image.Reachable || report.Image.Width != 1200 || report.Image.AspectRatio != 1.9 {
+		t.Errorf("image = %+v", report.Image)
+	}
+	wantScore := 100 - lintErrorPenalty*len(report.Errors) - lintWarningPenalty*len(report.Warnings)
+	if wantScore < 0 {
+		wantScore = 0
+	}
+	if report.Score != wantScore {
+		t.Errorf("score = %d, want %d", report.Score, wantScore)
+	}
+}
+
+func TestLintImageURLProperty(t *testing.T) {
+	page := `<head>
+<meta property="og:type" content="website">
+<meta property="og:url" content="https://example.com/">
+<meta property="og:title" content="Example">
+<meta property="og:image:url" content="https://example.com/og.png">
+</head>`
+	tags, err := parsePageTags(strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := lintPage(context.Background(), "", tags, nil)
+	for _, issue := range report.Errors {
+		if issue.Rule == "required" {
+			t.Errorf("og:image:url should satisfy the required image, got %+v", issue)
+		}
+	}
+}
+
+func TestLintEmptyImage(t *testing.T) {
+	// A GIF header with a height of 0 still decodes
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write([]byte("GIF89a\x10\x00\x00\x00\x00\x00\x00;"))
+	}))
+	defer server.Close()
+
+	tags := []PageTag{{Attr: "property", Name: "og:image", Content: server.URL + "/og.gif"}}
+	report := lintPage(context.Background(), "", tags, server.Client())
+
+	found := false
+	for _, issue := range report.Errors {
+		found = found || issue.Rule+" "+issue.Property == "image-dimensions og:image"
+	}
+	if !found {
+		t.Errorf("errors = %+v, want an image-dimensions error", report.Errors)
+	}
+	if _, err := json.Marshal(report); err != nil {
+		t.Errorf("report does not encode: %v", err)
+	}
+}
+
+func TestLintPageClean(t *testing.T) {
+	page := `<head>
+<meta property="og:type" content="website">
+<meta property="og:url" content="https://example.com/">
+<meta property="og:title" content="Example">
+<meta property="og:description" content="An example page">
+<meta property="og:image" content="https://example.com/og.png">
+<meta property="og:image:width" content="1200">
+<meta property="og:image:height" content="630">
+<meta property="og:image:alt" content="Example logo">
+<meta name="twitter:card" content="summary_large_image">
+</head>`
+	tags, err := parsePageTags(strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := lintPage(context.Background(), "", tags, nil)
+	if report.Score != 100 || len(report.Errors) != 0 || len(report.Warnings) != 0 {
+		t.Errorf("report = %+v, want a clean score", report)
+	}
+	if report.Image != nil {
+		t.Error("the image should not be checked without a client")
+	}
+}
+
+func TestValidateHandler(t *testing.T) {
+	post := func(body string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		req := httptest.NewRequest(http.MethodPost, "/api/validate", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handleValidateRequest(rec, req)
+
+		var resp map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("response is not JSON: %s", rec.Body.String())
+		}
+		return rec, resp
+	}
+
+	body, _ := json.Marshal(ValidateRequest{HTML: lintTestPage, URL: "https://example.com/releases", SkipImages: true})
+	rec, resp := post(string(body))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+	data := resp["data"].(map[string]interface{})
+	if data["url"] != "https://example.com/releases" || data["score"].(float64) >= 100 {
+		t.Errorf("report = %v", data)
+	}
+
+	rec, _ = post(`{"html": "  "}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("empty request: status = %d, want 400", rec.Code)
+	}
+	rec, _ = post(`{"html": "<title>x</title>", "strict": true}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown field: status = %d, want 400", rec.Code)
+	}
+
+	// Pages are loaded on the generation queue, and turned away when it is full
+	savedQueue := jobQueue
+	defer func() { jobQueue = savedQueue }()
+	jobQueue = NewJobQueue(1, 1, time.Minute, nil)
+	if err := jobQueue.Submit(NewJob("waiting", GenerationParameters{}, "", "")); err != nil {
+		t.Fatal(err)
+	}
+	rec, _ = post(`{"url": "https://example.com"}`)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("full queue: status = %d, Retry-After = %q, want 429 with a Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
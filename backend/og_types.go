@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MetaProblem is a property that is missing or has an invalid value
+type MetaProblem struct {
+	Property string `json:"property"`
+	Message  string `json:"message"`
+}
+
+var (
+	localePattern   = regexp.MustCompile(`^[a-z]{2,3}_[A-Z]{2}$`)
+	mimeTypePattern = regexp.MustCompile(`^[a-z]+/[a-z0-9.+-]+$`)
+	pricePattern    = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+	currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+	twitterPattern  = regexp.MustCompile(`^@?[A-Za-z0-9_]{1,15}$`)
+)
+
+// openGraphTypeRules checks the formats of the properties specific to each
+// og:type. Types without an entry, such as website, have none.
+var openGraphTypeRules = map[string]func(OpenGraphData) []MetaProblem{
+	"article": func(d OpenGraphData) []MetaProblem {
+		var problems []MetaProblem
+		published, err := parseOpenGraphTime(d.Article.PublishedTime)
+		if d.Article.PublishedTime != "" && err != nil {
+			problems = append(problems, MetaProblem{"article:published_time", err.Error()})
+		}
+		if d.Article.ModifiedTime != "" {
+			modified, modErr := parseOpenGraphTime(d.Article.ModifiedTime)
+			if modErr != nil {
+				problems = append(problems, MetaProblem{"article:modified_time", modErr.Error()})
+			} else if err == nil && !published.IsZero() && modified.Before(published) {
+				problems = append(problems, MetaProblem{"article:modified_time", "must not be before article:published_time"})
+			}
+		}
+		return problems
+	},
+	"product": func(d OpenGraphData) []MetaProblem {
+		var problems []MetaProblem
+		if d.Product.PriceAmount != "" && !pricePattern.MatchString(d.Product.PriceAmount) {
+			problems = append(problems, MetaProblem{"product:price:amount", "must be a decimal number such as 19.99"})
+		}
+		if d.Product.PriceCurrency != "" && !currencyPattern.MatchString(d.Product.PriceCurrency) {
+			problems = append(problems, MetaProblem{"product:price:currency", "must be an ISO 4217 code such as USD"})
+		}
+		return problems
+	},
+}
+
+// openGraphTypeProperties lists the properties each og:type should carry.
+// Pages without them still share, so they are only worth a warning.
+var openGraphTypeProperties = map[string]func(OpenGraphData) []MetaProblem{
+	"article": func(d OpenGraphData) []MetaProblem {
+		if d.Article.PublishedTime == "" {
+			return []MetaProblem{{"article:published_time", "is expected for og:type article"}}
+		}
+		return nil
+	},
+	"product": func(d OpenGraphData) []MetaProblem {
+		var problems []MetaProblem
+		if d.Product.PriceAmount == "" {
+			problems = append(problems, MetaProblem{"product:price:amount", "is expected for og:type product"})
+		}
+		if d.Product.PriceCurrency == "" {
+			problems = append(problems, MetaProblem{"product:price:currency", "is expected for og:type product"})
+		}
+		return problems
+	},
+	"profile": func(d OpenGraphData) []MetaProblem {
+		p := d.Profile
+		if p.Username == "" && p.FirstName == "" && p.LastName == "" {
+			return []MetaProblem{{"profile:username", "a username or a name is expected for og:type profile"}}
+		}
+		return nil
+	},
+}
+
+// typeNamespaces maps the namespaced properties to the og:type they belong to
+var typeNamespaces = []struct {
+	Type string
+	Set  func(OpenGraphData) string // First property that is set, if any
+}{
+	{"article", func(d OpenGraphData) string {
+		a := d.Article
+		return firstSetProperty(
+			"article:published_time", a.PublishedTime,
+			"article:modified_time", a.ModifiedTime,
+			"article:author", strings.Join(a.Authors, ""),
+			"article:section", a.Section,
+			"article:tag", strings.Join(a.Tags, ""))
+	}},
+	{"product", func(d OpenGraphData) string {
+		return firstSetProperty(
+			"product:price:amount", d.Product.PriceAmount,
+			"product:price:currency", d.Product.PriceCurrency)
+	}},
+	{"profile", func(d OpenGraphData) string {
+		p := d.Profile
+		return firstSetProperty(
+			"profile:first_name", p.FirstName,
+			"profile:last_name", p.LastName,
+			"profile:username", p.Username,
+			"profile:gender", p.Gender)
+	}},
+}
+
+// firstSetProperty takes property and value pairs and returns the first
+// property with a value
+func firstSetProperty(pairs ...string) string {
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] != "" {
+			return pairs[i]
+		}
+	}
+	return ""
+}
+
+// validateOpenGraph checks the extended properties: their formats and
+// namespaced properties that do not match the og:type. Properties the type
+// expects but that are absent are left to missingTypeProperties. The basic
+// tags are filled in by the generator and are not checked here.
+func validateOpenGraph(d OpenGraphData) []MetaProblem {
+	var problems []MetaProblem
+	add := func(property, message string) {
+		problems = append(problems, MetaProblem{property, message})
+	}
+
+	if d.Locale != "" && !localePattern.MatchString(d.Locale) {
+		add("og:locale", "must be a language and territory such as en_US")
+	}
+	for _, locale := range d.LocaleAlternates {
+		if !localePattern.MatchString(locale) {
+			add("og:locale:alternate", fmt.Sprintf("%q must be a language and territory such as fr_FR", locale))
+			break
+		}
+		if locale == d.Locale {
+			add("og:locale:alternate", fmt.Sprintf("%q repeats og:locale", locale))
+			break
+		}
+	}
+
+	for _, image := range d.Images {
+		if !isAbsoluteHTTPURL(image) {
+			add("og:image", fmt.Sprintf("%q must be an absolute http or https URL", image))
+			break
+		}
+	}
+
+	checkMedia := func(name string, m OpenGraphMedia) {
+		if m.URL == "" {
+			if m.Type != "" || m.Width != 0 || m.Height != 0 {
+				add("og:"+name, "is required when other og:"+name+" properties are set")
+			}
+			return
+		}
+		if !isAbsoluteHTTPURL(m.URL) {
+			add("og:"+name, "must be an absolute http or https URL")
+		}
+		if m.Type != "" && !mimeTypePattern.MatchString(m.Type) {
+			add("og:"+name+":type", "must be a MIME type such as "+name+"/mp4")
+		}
+	}
+	checkMedia("video", d.Video)
+	checkMedia("audio", d.Audio)
+
+	if d.TwitterSite != "" && !twitterPattern.MatchString(d.TwitterSite) {
+		add("twitter:site", "must be a Twitter username such as @example")
+	}
+	if d.TwitterCreator != "" && !twitterPattern.MatchString(d.TwitterCreator) {
+		add("twitter:creator", "must be a Twitter username such as @example")
+	}
+
+	for _, ns := range typeNamespaces {
+		if property := ns.Set(d); property != "" && d.Type != ns.Type {
+			add(property, "only applies to og:type "+ns.Type)
+		}
+	}
+	if rule := openGraphTypeRules[d.Type]; rule != nil {
+		problems = append(problems, rule(d)...)
+	}
+
+	return problems
+}
+
+// missingTypeProperties reports the properties d's og:type expects that are
+// not set
+func missingTypeProperties(d OpenGraphData) []MetaProblem {
+	if rule := openGraphTypeProperties[d.Type]; rule != nil {
+		return rule(d)
+	}
+	return nil
+}
+
+// openGraphParameters fills in the extended properties from the generation
+// parameters
+func openGraphParameters(d OpenGraphData, params GenerationParameters) OpenGraphData {
+	d.Locale = params.Locale
+	d.LocaleAlternates = params.LocaleAlternates
+	d.ImageAlt = params.ImageAlt
+	d.Images = params.Images
+	d.Video = OpenGraphMedia{URL: params.VideoURL, Type: params.VideoType, Width: params.VideoWidth, Height: params.VideoHeight}
+	d.Audio = OpenGraphMedia{URL: params.AudioURL, Type: params.AudioType}
+	d.Article = ArticleData{
+		PublishedTime: params.ArticlePublishedTime,
+		ModifiedTime:  params.ArticleModifiedTime,
+		Authors:       params.ArticleAuthors,
+		Section:       params.ArticleSection,
+		Tags:          params.ArticleTags,
+	}
+	d.Product = ProductData{PriceAmount: params.ProductPriceAmount, PriceCurrency: params.ProductPriceCurrency}
+	d.Profile = ProfileData{
+		FirstName: params.ProfileFirstName,
+		LastName:  params.ProfileLastName,
+		Username:  params.ProfileUsername,
+		Gender:    params.ProfileGender,
+	}
+	d.TwitterSite = params.TwitterSite
+	d.TwitterCreator = params.TwitterCreator
+	return d
+}
+
+// parseOpenGraphTime parses an ISO 8601 date or date and time
+func parseOpenGraphTime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("must be an ISO 8601 date such as 2024-05-01 or 2024-05-01T09:30:00Z")
+}
+
+// isAbsoluteHTTPURL reports whether s is an http or https URL with a host
+func isAbsoluteHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateOpenGraph(t *testing.T) {
+	tests := []struct {
+		name string
+		data OpenGraphData
+		want map[string]string // property to message
+	}{
+		{
+			name: "website needs nothing",
+			data: OpenGraphData{Type: "website"},
+		},
+		{
+			name: "article",
+			data: OpenGraphData{Type: "article", Article: ArticleData{PublishedTime: "2024-05-01T09:30:00Z", ModifiedTime: "2024-04-01"}},
+			want: map[string]string{"article:modified_time": "must not be before article:published_time"},
+		},
+		{
+			name: "article without a date",
+			data: OpenGraphData{Type: "article", Article: ArticleData{PublishedTime: "May 1st"}},
+			want: map[string]string{"article:published_time": "must be an ISO 8601 date such as 2024-05-01 or 2024-05-01T09:30:00Z"},
+		},
+		{
+			name: "product",
+			data: OpenGraphData{Type: "product", Product: ProductData{PriceAmount: "19.99", PriceCurrency: "usd"}},
+			want: map[string]string{"product:price:currency": "must be an ISO 4217 code such as USD"},
+		},
+		{
+			name: "expected properties may be missing",
+			data: OpenGraphData{Type: "product"},
+		},
+		{
+			name: "namespace of another type",
+			data: OpenGraphData{Type: "website", Profile: ProfileData{Username: "gopher"}},
+			want: map[string]string{"profile:username": "only applies to og:type profile"},
+		},
+		{
+			name: "formats",
+			data: OpenGraphData{
+				Type:             "website",
+				Locale:           "en-US",
+				LocaleAlternates: []string{"fr_FR", "en-GB"},
+				Images:           []string{"/relative.png"},
+				Video:            OpenGraphMedia{Type: "video/mp4"},
+				Audio:            OpenGraphMedia{URL: "https://example.com/a.mp3", Type: "mp3"},
+				TwitterSite:      "@not a handle",
+			},
+			want: map[string]string{
+				"og:locale":           "must be a language and territory such as en_US",
+				"og:locale:alternate": `"en-GB" must be a language and territory such as fr_FR`,
+				"og:image":            `"/relative.png" must be an absolute http or https URL`,
+				"og:video":            "is required when other og:video properties are set",
+				"og:audio:type":       "must be a MIME type such as audio/mp4",
+				"twitter:site":        "must be a Twitter username such as @example",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make(map[string]string)
+			for _, p := range validateOpenGraph(tt.data) {
+				got[p.Property] = p.Message
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("problems = %v, want %v", got, tt.want)
+			}
+			for property, message := range tt.want {
+				if got[property] != message {
+					t.Errorf("%s: %q, want %q", property, got[property], message)
+				}
+			}
+		})
+	}
+}
+
+func TestMissingTypeProperties(t *testing.T) {
+	tests := []struct {
+		data OpenGraphData
+		want []string
+	}{
+		{OpenGraphData{Type: "website"}, nil},
+		{OpenGraphData{Type: "article"}, []string{"article:published_time"}},
+		{OpenGraphData{Type: "product", Product: ProductData{PriceAmount: "9,99"}}, []string{"product:price:currency"}},
+		{OpenGraphData{Type: "profile", Profile: ProfileData{Gender: "female"}}, []string{"profile:username"}},
+		{OpenGraphData{Type: "profile", Profile: ProfileData{Username: "gopher"}}, nil},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, p := range missingTypeProperties(tt.data) {
+			got = append(got, p.Property)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("missingTypeProperties(%+v) = %v, want %v", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestExtendedTags(t *testing.T) {
+	data := OpenGraphData{
+		Type:             "article",
+		Title:            "Release notes",
+		ImageURL:         "https://cdn.example.com/og.png",
+		ImageType:        "image/png",
+		ImageAlt:         "Release banner",
+		Images:           []string{"http://cdn.example.com/second.png", "javascript:alert(1)"},
+		Locale:           "en_US",
+		LocaleAlternates: []string{"de_DE", "fr_FR"},
+		Video:            OpenGraphMedia{URL: "https://cdn.example.com/demo.mp4", Type: "video/mp4", Width: 1280, Height: 720},
+		Article:          ArticleData{PublishedTime: "2024-05-01", Authors: []string{"Ada"}, Tags: []string{"go", "og"}},
+		Product:          ProductData{PriceAmount: "1"}, // Not an article property
+		TwitterSite:      "example",
+	}
+
+	var got []string
+	for _, tag := range data.sanitized().Tags() {
+		if strings.HasPrefix(tag.Name, "og:image") || strings.HasPrefix(tag.Name, "og:locale") ||
+			strings.HasPrefix(tag.Name, "article:") || strings.HasPrefix(tag.Name, "product:") || tag.Name == "twitter:site" {
+			got = append(got, tag.Name+"="+tag.Content)
+		}
+	}
+	want := []string{
+		"og:locale=en_US",
+		"og:locale:alternate=de_DE",
+		"og:locale:alternate=fr_FR",
+		"og:image=https://cdn.example.com/og.png",
+		"og:image:secure_url=https://cdn.example.com/og.png",
+		"og:image:type=image/png",
+		"og:image:alt=Release banner",
+		"og:image=http://cdn.example.com/second.png",
+		"article:published_time=2024-05-01",
+		"article:author=Ada",
+		"article:tag=go",
+		"article:tag=og",
+		"twitter:site=@example",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("tags =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
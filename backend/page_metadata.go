@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/chromedp/chromedp"
+)
+
+// Sources of merged metadata values other than page tags, which are named
+// after the tag (og:title, twitter:site, ...)
+const (
+	SourceUser      = "user"        // Supplied with the request
+	SourceDefault   = "default"     // Nothing else had a value
+	SourceTitle     = "title"       // The page's <title>
+	SourceMetaDesc  = "description" // <meta name="description">
+	SourceJSONLD    = "json-ld"     // Structured data on the page
+	SourceCanonical = "canonical"   // <link rel="canonical">
+	SourceLang      = "lang"        // The lang attribute of <html>
+	SourceHeroImage = "hero_image"  // Largest image in view on the page
+	SourcePageURL   = "page_url"    // Where the page ended up after redirects
+	SourceDomain    = "domain"      // Host name of the page
+)
+
+const (
+	defaultTitle       = "Open Graph Generated Content"
+	defaultDescription = "Content shared with Open Graph meta tags"
+	defaultPageURL     = "https://example.com/"
+)
+
+// PageMetadata holds metadata extracted from a rendered page. URLs are
+// resolved against the page URL.
+type PageMetadata struct {
+	URL            string                   `json:"url,omitempty"`         // After redirects
+	Title          string                   `json:"title,omitempty"`       // Text of <title>
+	Description    string                   `json:"description,omitempty"` // <meta name="description">
+	Canonical      string                   `json:"canonical,omitempty"`
+	Lang           string                   `json:"lang,omitempty"`
+	ThemeColor     string                   `json:"theme_color,omitempty"`
+	Favicon        string                   `json:"favicon,omitempty"`
+	AppleTouchIcon string                   `json:"apple_touch_icon,omitempty"`
+	HeroImage      *HeroImage               `json:"hero_image,omitempty"`
+	Tags           []PageTag                `json:"tags,omitempty"`    // og:, twitter: and type namespace tags
+	JSONLD         []map[string]interface{} `json:"json_ld,omitempty"` // Structured data nodes, @graph flattened
+}
+
+// HeroImage is the largest image shown near the top of a page
+type HeroImage struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Alt    string `json:"alt,omitempty"`
+}
+
+// MetadataField is a merged metadata value and where it came from
+type MetadataField struct {
+	Value  interface{} `json:"value"` // A string, or a list of strings
+	Source string      `json:"source"`
+}
+
+// storedMetadata is the metadata kept with a generation
+type storedMetadata struct {
+	Fields    map[string]MetadataField `json:"metadata,omitempty"`
+	Extracted *PageMetadata            `json:"extracted,omitempty"`
+}
+
+// decodeMetadata reads the metadata stored with a generation
+func decodeMetadata(data string) storedMetadata {
+	var stored storedMetadata
+	if data == "" {
+		return stored
+	}
+	if err := json.Unmarshal([]byte(data), &stored); err != nil {
+		log.Printf("Error decoding stored metadata: %v", err)
+	}
+	return stored
+}
+
+// heroImageScript finds the image with the largest rendered area within the
+// first two screens, ignoring hidden images, icons and inline data
+const heroImageScript = `(() => {
+	let best = null, bestArea = 0;
+	for (const img of document.images) {
+		const src = img.currentSrc || img.src;
+		if (!src || src.startsWith('data:') || img.naturalWidth < 200 || img.naturalHeight < 100) continue;
+		const rect = img.getBoundingClientRect();
+		const area = rect.width * rect.height;
+		if (area <= bestArea || rect.bottom < 0 || rect.top > window.innerHeight * 2) continue;
+		const style = getComputedStyle(img);
+		if (style.display === 'none' || style.visibility === 'hidden' || style.opacity === '0') continue;
+		best = {url: src, width: img.naturalWidth, height: img.naturalHeight, alt: img.alt || ''};
+		bestArea = area;
+	}
+	return best;
+})()`
+
+// extractPageMetadata reads the metadata of the loaded page from its
+// rendered HTML, and the hero image from the laid out DOM. Failed lookups
+// are left empty.
+func extractPageMetadata(ctx context.Context, htmlContent string) *PageMetadata {
+	var pageURL string
+	var hero *HeroImage
+	_ = chromedp.Run(ctx, chromedp.Location(&pageURL))
+	_ = chromedp.Run(ctx, chromedp.Evaluate(heroImageScript, &hero))
+
+	meta := parsePageMetadata(htmlContent, pageURL)
+	if hero != nil && hero.URL != "" {
+		hero.URL = resolvePageURL(pageURL, hero.URL)
+		meta.HeroImage = hero
+	}
+	return meta
+}
+
+// parsePageMetadata reads the metadata of a page's HTML. pageURL is where
+// the page was loaded from and resolves relative references.
+func parsePageMetadata(htmlContent, pageURL string) *PageMetadata {
+	doc, _ := parsePageDocument(strings.NewReader(htmlContent))
+
+	meta := &PageMetadata{
+		URL:            pageURL,
+		Lang:           doc.Lang,
+		ThemeColor:     doc.ThemeColor,
+		Favicon:        resolvePageURL(pageURL, pickIcon(doc.Icons, false)),
+		AppleTouchIcon: resolvePageURL(pageURL, pickIcon(doc.Icons, true)),
+		JSONLD:         jsonLDNodes(doc.JSONLD),
+	}
+	for _, tag := range doc.Tags {
+		switch {
+		case tag.Attr == "title":
+			meta.Title = tag.Content
+		case tag.Name == "canonical":
+			meta.Canonical = resolvePageURL(pageURL, tag.Content)
+		case tag.Name == "description":
+			if meta.Description == "" {
+				meta.Description = tag.Content
+			}
+		default:
+			meta.Tags = append(meta.Tags, tag)
+		}
+	}
+	return meta
+}
+
+// pickIcon returns the largest favicon, or apple-touch-icon with touch set.
+// Scalable icons count as the largest.
+func pickIcon(icons []pageIcon, touch bool) string {
+	best, bestSize := "", -1
+	for _, icon := range icons {
+		if strings.HasPrefix(icon.Rel, "apple-touch-icon") != touch {
+			continue
+		}
+		size := 0
+		for _, s := range strings.Fields(icon.Sizes) {
+			if s == "any" {
+				size = 1 << 20
+				break
+			}
+			if w, _, ok := strings.Cut(s, "x"); ok {
+				if n, err := strconv.Atoi(w); err == nil && n > size {
+					size = n
+				}
+			}
+		}
+		if size > bestSize {
+			best, bestSize = icon.Href, size
+		}
+	}
+	return best
+}
+
+// jsonLDNodes decodes JSON-LD blocks into their nodes, flattening top-level
+// arrays and @graph. Blocks that are not valid JSON are skipped.
+func jsonLDNodes(blocks []string) []map[string]interface{} {
+	var nodes []map[string]interface{}
+	var add func(v interface{})
+	add = func(v interface{}) {
+		switch v := v.(type) {
+		case []interface{}:
+			for _, item := range v {
+				add(item)
+			}
+		case map[string]interface{}:
+			if graph, ok := v["@graph"]; ok {
+				add(graph)
+				return
+			}
+			nodes = append(nodes, v)
+		}
+	}
+	for _, block := range blocks {
+		var v interface{}
+		if json.Unmarshal([]byte(block), &v) == nil {
+			add(v)
+		}
+	}
+	return nodes
+}
+
+// structuredData is what the merge reads from JSON-LD
+type structuredData struct {
+	Type          string // The Open Graph type the main node corresponds to
+	Headline      string
+	Description   string
+	SiteName      string
+	Image         string
+	PublishedTime string
+	ModifiedTime  string
+	Authors       []string
+	Section       string
+	Keywords      []string
+	PriceAmount   string
+	PriceCurrency string
+}
+
+// jsonLDOpenGraphTypes maps schema.org types to Open Graph types
+var jsonLDOpenGraphTypes = map[string]string{
+	"Article":        "article",
+	"NewsArticle":    "article",
+	"BlogPosting":    "article",
+	"TechArticle":    "article",
+	"Report":         "article",
+	"Product":        "product",
+	"ProfilePage":    "profile",
+	"WebPage":        "website",
+	"WebSite":        "website",
+	"CollectionPage": "website",
+}
+
+// structuredData reads the page's main JSON-LD node: the first article,
+// product or profile, else the first web page, else the first node. The
+// site name comes from a WebSite or Organization node or the publisher.
+func (m *PageMetadata) structuredData() structuredData {
+	var main map[string]interface{}
+	var sd structuredData
+	rank := 0
+	for _, node := range m.JSONLD {
+		ogType := ""
+		for _, t := range jsonLDStrings(node["@type"]) {
+			if ogType = jsonLDOpenGraphTypes[t]; ogType != "" {
+				break
+			}
+		}
+		r := 1
+		if ogType == "website" {
+			r = 2
+		} else if ogType != "" {
+			r = 3
+		}
+		if r > rank {
+			main, rank, sd.Type = node, r, ogType
+		}
+
+		for _, t := range jsonLDStrings(node["@type"]) {
+			if (t == "WebSite" || t == "Organization") && sd.SiteName == "" {
+				sd.SiteName = jsonLDText(node["name"])
+			}
+		}
+	}
+	if main == nil {
+		return sd
+	}
+
+	sd.Headline = firstNonEmpty(jsonLDText(main["headline"]), jsonLDText(main["name"]))
+	sd.Description = jsonLDText(main["description"])
+	sd.SiteName = firstNonEmpty(sd.SiteName, jsonLDText(main["publisher"]))
+	sd.Image = jsonLDURL(main["image"])
+	sd.PublishedTime = jsonLDText(main["datePublished"])
+	sd.ModifiedTime = jsonLDText(main["dateModified"])
+	sd.Authors = jsonLDStrings(main["author"])
+	sd.Section = jsonLDText(main["articleSection"])
+	if keywords, ok := main["keywords"].(string); ok {
+		sd.Keywords = splitList(keywords)
+	} else {
+		sd.Keywords = jsonLDStrings(main["keywords"])
+	}
+	if offers := jsonLDFirst(main["offers"]); offers != nil {
+		if offer, ok := offers.(map[string]interface{}); ok {
+			sd.PriceAmount = jsonLDText(offer["price"])
+			sd.PriceCurrency = jsonLDText(offer["priceCurrency"])
+		}
+	}
+	return sd
+}
+
+// jsonLDFirst returns the first item of a list, or the value itself
+func jsonLDFirst(v interface{}) interface{} {
+	if list, ok := v.([]interface{}); ok {
+		if len(list) == 0 {
+			return nil
+		}
+		return list[0]
+	}
+	return v
+}
+
+// jsonLDText returns a JSON-LD value as text. Nodes are named by their
+// name and lists by their first item.
+func jsonLDText(v interface{}) string {
+	switch v := jsonLDFirst(v).(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case map[string]interface{}:
+		return firstNonEmpty(jsonLDText(v["name"]), jsonLDText(v["@value"]))
+	}
+	return ""
+}
+
+// jsonLDStrings returns every item of a JSON-LD value as text
+func jsonLDStrings(v interface{}) []string {
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+	var values []string
+	for _, item := range list {
+		if text := jsonLDText(item); text != "" {
+			values = append(values, text)
+		}
+	}
+	return values
+}
+
+// jsonLDURL returns the URL of an image value, which may be a URL, an
+// ImageObject or a list of either
+func jsonLDURL(v interface{}) string {
+	if node, ok := jsonLDFirst(v).(map[string]interface{}); ok {
+		return firstNonEmpty(jsonLDText(node["url"]), jsonLDText(node["contentUrl"]))
+	}
+	return jsonLDText(v)
+}
+
+// metadataCandidate is one possible value of a merged field
+type metadataCandidate struct {
+	Source string
+	Value  string
+}
+
+// metadataListCandidate is one possible value of a merged list field
+type metadataListCandidate struct {
+	Source string
+	Value  []string
+}
+
+// metadataFields records the merged value of each field and its source
+type metadataFields map[string]MetadataField
+
+// pick returns the first non-empty candidate and records it for the field
+func (f metadataFields) pick(field string, candidates ...metadataCandidate) string {
+	for _, c := range candidates {
+		if value := strings.TrimSpace(c.Value); value != "" {
+			f[field] = MetadataField{Value: value, Source: c.Source}
+			return value
+		}
+	}
+	return ""
+}
+
+// pickList returns the first non-empty list and records it for the field
+func (f metadataFields) pickList(field string, candidates ...metadataListCandidate) []string {
+	for _, c := range candidates {
+		if len(c.Value) > 0 {
+			f[field] = MetadataField{Value: c.Value, Source: c.Source}
+			return c.Value
+		}
+	}
+	return nil
+}
+
+// mergeMetadata combines the values the user supplied with those read from
+// the page (nil for cards). User values always win. Otherwise each field
+// takes the first value found in this order:
+//
+//	title          og:title, twitter:title, JSON-LD headline or name, <title>, default
+//	description    og:description, twitter:description, meta description, JSON-LD, default
+//	site_name      og:site_name, JSON-LD site or publisher name, the page's domain
+//
+// Those three are always merged. With enrich set the rest are as well:
+//
+//	target_url     og:url, canonical link, the page URL after redirects
+//	og_type        og:type, the type of the main JSON-LD node, website
+//	locale         og:locale, the <html> lang when it names a territory
+//	images         og:image, the hero image, the JSON-LD image
+//	twitter_*      twitter:site and twitter:creator
+//	video, audio   og:video and og:audio with their properties
+//	article_*      article: tags, then JSON-LD, for articles
+//	product_*      product: tags, then JSON-LD offers, for products
+//	profile_*      profile: tags, for profiles
+//
+// The image itself is always the generated one.
+func mergeMetadata(user GenerationParameters, page *PageMetadata, enrich bool) (OpenGraphData, map[string]MetadataField) {
+	fields := make(metadataFields)
+	d := openGraphParameters(OpenGraphData{}, user)
+	if page == nil {
+		page = &PageMetadata{}
+	}
+	og := openGraphFromTags(page.Tags)
+	sd := page.structuredData()
+	tag := func(name string) metadataCandidate {
+		return metadataCandidate{name, pageTagValue(page.Tags, name)}
+	}
+	userValue := func(value string) metadataCandidate {
+		return metadataCandidate{SourceUser, value}
+	}
+
+	d.Title = fields.pick("title", userValue(user.Title), tag("og:title"), tag("twitter:title"),
+		metadataCandidate{SourceJSONLD, sd.Headline}, metadataCandidate{SourceTitle, page.Title},
+		metadataCandidate{SourceDefault, defaultTitle})
+	d.Description = fields.pick("description", userValue(user.Description), tag("og:description"),
+		tag("twitter:description"), metadataCandidate{SourceMetaDesc, page.Description},
+		metadataCandidate{SourceJSONLD, sd.Description}, metadataCandidate{SourceDefault, defaultDescription})
+	d.SiteName = fields.pick("site_name", userValue(user.SiteName), tag("og:site_name"),
+		metadataCandidate{SourceJSONLD, sd.SiteName}, metadataCandidate{SourceDomain, pageHost(page.URL)})
+
+	if !enrich {
+		d.PageURL = fields.pick("target_url", userValue(user.TargetURL), userValue(user.WebpageURL),
+			metadataCandidate{SourceDefault, defaultPageURL})
+		d.Type = fields.pick("og_type", userValue(user.OgType), metadataCandidate{SourceDefault, defaultType})
+		return d, fields
+	}
+
+	d.PageURL = fields.pick("target_url", userValue(user.TargetURL), metadataCandidate{"og:url", resolvePageURL(page.URL, og.PageURL)},
+		metadataCandidate{SourceCanonical, page.Canonical}, metadataCandidate{SourcePageURL, page.URL},
+		userValue(user.WebpageURL), metadataCandidate{SourceDefault, defaultPageURL})
+	d.Type = fields.pick("og_type", userValue(user.OgType), tag("og:type"),
+		metadataCandidate{SourceJSONLD, sd.Type}, metadataCandidate{SourceDefault, defaultType})
+	d.Locale = fields.pick("locale", userValue(user.Locale), tag("og:locale"),
+		metadataCandidate{SourceLang, langLocale(page.Lang)})
+	d.LocaleAlternates = fields.pickList("locale_alternates",
+		metadataListCandidate{SourceUser, user.LocaleAlternates}, metadataListCandidate{"og:locale:alternate", og.LocaleAlternates})
+	d.TwitterSite = fields.pick("twitter_site", userValue(user.TwitterSite), tag("twitter:site"))
+	d.TwitterCreator = fields.pick("twitter_creator", userValue(user.TwitterCreator), tag("twitter:creator"))
+
+	// The page's own share images are kept as further images after ours
+	var pageImages []string
+	for _, image := range append([]string{og.ImageURL}, og.Images...) {
+		if image != "" {
+			pageImages = append(pageImages, resolvePageURL(page.URL, image))
+		}
+	}
+	var hero, ldImage []string
+	if page.HeroImage != nil {
+		hero = []string{page.HeroImage.URL}
+	}
+	if sd.Image != "" {
+		ldImage = []string{resolvePageURL(page.URL, sd.Image)}
+	}
+	d.Images = fields.pickList("images", metadataListCandidate{SourceUser, user.Images},
+		metadataListCandidate{"og:image", pageImages}, metadataListCandidate{SourceHeroImage, hero},
+		metadataListCandidate{SourceJSONLD, ldImage})
+
+	if user.VideoURL == "" && og.Video.URL != "" {
+		d.Video = og.Video
+		d.Video.URL = resolvePageURL(page.URL, og.Video.URL)
+	}
+	fields.pick("video_url", userValue(user.VideoURL), metadataCandidate{"og:video", d.Video.URL})
+	if user.AudioURL == "" && og.Audio.URL != "" {
+		d.Audio = og.Audio
+		d.Audio.URL = resolvePageURL(page.URL, og.Audio.URL)
+	}
+	fields.pick("audio_url", userValue(user.AudioURL), metadataCandidate{"og:audio", d.Audio.URL})
+
+	// Type namespace properties only apply to the merged type
+	ld := func(value string) metadataCandidate {
+		return metadataCandidate{SourceJSONLD, value}
+	}
+	switch d.Type {
+	case "article":
+		d.Article.PublishedTime = fields.pick("article_published_time", userValue(user.ArticlePublishedTime),
+			tag("article:published_time"), ld(sd.PublishedTime))
+		d.Article.ModifiedTime = fields.pick("article_modified_time", userValue(user.ArticleModifiedTime),
+			tag("article:modified_time"), ld(sd.ModifiedTime))
+		d.Article.Authors = fields.pickList("article_authors", metadataListCandidate{SourceUser, user.ArticleAuthors},
+			metadataListCandidate{"article:author", og.Article.Authors}, metadataListCandidate{SourceJSONLD, sd.Authors})
+		d.Article.Section = fields.pick("article_section", userValue(user.ArticleSection),
+			tag("article:section"), ld(sd.Section))
+		d.Article.Tags = fields.pickList("article_tags", metadataListCandidate{SourceUser, user.ArticleTags},
+			metadataListCandidate{"article:tag", og.Article.Tags}, metadataListCandidate{SourceJSONLD, sd.Keywords})
+	case "product":
+		d.Product.PriceAmount = fields.pick("product_price_amount", userValue(user.ProductPriceAmount),
+			tag("product:price:amount"), ld(sd.PriceAmount))
+		d.Product.PriceCurrency = fields.pick("product_price_currency", userValue(user.ProductPriceCurrency),
+			tag("product:price:currency"), ld(sd.PriceCurrency))
+	case "profile":
+		d.Profile.FirstName = fields.pick("profile_first_name", userValue(user.ProfileFirstName), tag("profile:first_name"))
+		d.Profile.LastName = fields.pick("profile_last_name", userValue(user.ProfileLastName), tag("profile:last_name"))
+		d.Profile.Username = fields.pick("profile_username", userValue(user.ProfileUsername), tag("profile:username"))
+		d.Profile.Gender = fields.pick("profile_gender", userValue(user.ProfileGender), tag("profile:gender"))
+	}
+	return d, fields
+}
+
+// langLocale turns an HTML language tag such as en-US into the Open Graph
+// locale en_US. Tags without a territory have no locale.
+func langLocale(lang string) string {
+	parts := strings.Split(strings.ReplaceAll(lang, "_", "-"), "-")
+	if len(parts) < 2 || len(parts[0]) != 2 || len(parts[1]) != 2 {
+		return ""
+	}
+	return strings.ToLower(parts[0]) + "_" + strings.ToUpper(parts[1])
+}
+
+// pageHost returns the host name of a page URL
+func pageHost(pageURL string) string {
+	u, err := url.Parse(pageURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+const enrichTestPage = `<!DOCTYPE html>
+<html lang="en-GB">
+<head>
+<title>Release notes | Example</title>
+<meta name="description" content="Everything we shipped">
+<meta name="theme-color" media="(prefers-color-scheme: dark)" content="#000000">
+<meta name="theme-color" content="#1a73e8">
+<link rel="canonical" href="/releases">
+<link rel="icon" href="/favicon-16.png" sizes="16x16">
+<link rel="icon" href="/favicon-32.png" sizes="32x32">
+<link rel="apple-touch-icon" href="/touch.png">
+<meta property="og:title" content="Release notes">
+<meta name="twitter:title" content="Release notes on X">
+<meta name="twitter:site" content="example">
+<meta property="og:image" content="/share.png">
+<script type="application/ld+json">
+{"@context": "https://schema.org", "@graph": [
+	{"@type": "WebSite", "name": "Example"},
+	{"@type": "BlogPosting", "headline": "Release notes for May",
+	 "datePublished": "2024-05-01", "author": [{"@type": "Person", "name": "Ada"}, "Grace"],
+	 "keywords": "releases, changelog", "image": {"@type": "ImageObject", "url": "/hero.jpg"}}
+]}
+</script>
+<script type="application/ld+json">not json</script>
+</head>
+<body><p>Hi</p></body>
+</html>`
+
+func TestParsePageMetadata(t *testing.T) {
+	meta := parsePageMetadata(enrichTestPage, "https://example.com/blog/may")
+
+	if meta.Title != "Release notes | Example" || meta.Description != "Everything we shipped" {
+		t.Errorf("title = %q, description = %q", meta.Title, meta.Description)
+	}
+	if meta.Lang != "en-GB" || meta.ThemeColor != "#1a73e8" {
+		t.Errorf("lang = %q, theme color = %q", meta.Lang, meta.ThemeColor)
+	}
+	if meta.Canonical != "https://example.com/releases" {
+		t.Errorf("canonical = %q", meta.Canonical)
+	}
+	if meta.Favicon != "https://example.com/favicon-32.png" || meta.AppleTouchIcon != "https://example.com/touch.png" {
+		t.Errorf("favicon = %q, apple touch icon = %q", meta.Favicon, meta.AppleTouchIcon)
+	}
+	if len(meta.JSONLD) != 2 {
+		t.Fatalf("JSON-LD nodes = %v, want the two @graph nodes", meta.JSONLD)
+	}
+	for _, tag := range meta.Tags {
+		if tag.Name == "title" || tag.Name == "canonical" || tag.Name == "description" {
+			t.Errorf("tags should only hold metadata tags, got %+v", tag)
+		}
+	}
+
+	sd := meta.structuredData()
+	if sd.Type != "article" || sd.SiteName != "Example" || sd.Image != "/hero.jpg" {
+		t.Errorf("structured data = %+v", sd)
+	}
+	if !reflect.DeepEqual(sd.Authors, []string{"Ada", "Grace"}) || !reflect.DeepEqual(sd.Keywords, []string{"releases", "changelog"}) {
+		t.Errorf("authors = %v, keywords = %v", sd.Authors, sd.Keywords)
+	}
+}
+
+func TestMergeMetadata(t *testing.T) {
+	page := parsePageMetadata(enrichTestPage, "https://example.com/blog/may")
+	page.HeroImage = &HeroImage{URL: "https://example.com/banner.jpg", Width: 1600, Height: 900}
+	user := GenerationParameters{WebpageURL: "https://example.com/blog/may", Description: "Our May release"}
+
+	source := func(fields map[string]MetadataField, name string) string {
+		return fields[name].Source
+	}
+
+	d, fields := mergeMetadata(user, page, false)
+	if d.Title != "Release notes" || source(fields, "title") != "og:title" {
+		t.Errorf("title = %q from %q, want og:title to win over twitter:title and <title>", d.Title, source(fields, "title"))
+	}
+	if d.Description != "Our May release" || source(fields, "description") != SourceUser {
+		t.Errorf("description = %q, user values should always win", d.Description)
+	}
+	if d.SiteName != "Example" || source(fields, "site_name") != SourceJSONLD {
+		t.Errorf("site name = %q from %q", d.SiteName, source(fields, "site_name"))
+	}
+	if d.PageURL != user.WebpageURL || d.Type != defaultType || d.TwitterSite != "" {
+		t.Errorf("without enrich only title, description and site name come from the page: %+v", d)
+	}
+
+	d, fields = mergeMetadata(user, page, true)
+	if d.PageURL != "https://example.com/releases" || source(fields, "target_url") != SourceCanonical {
+		t.Errorf("url = %q from %q", d.PageURL, source(fields, "target_url"))
+	}
+	if d.Type != "article" || source(fields, "og_type") != SourceJSONLD {
+		t.Errorf("type = %q from %q", d.Type, source(fields, "og_type"))
+	}
+	if d.Locale != "en_GB" || d.TwitterSite != "example" {
+		t.Errorf("locale = %q, twitter site = %q", d.Locale, d.TwitterSite)
+	}
+	if !reflect.DeepEqual(d.Images, []string{"https://example.com/share.png"}) || source(fields, "images") != "og:image" {
+		t.Errorf("images = %v, the page's og:image should win over the hero image", d.Images)
+	}
+	if d.Article.PublishedTime != "2024-05-01" || len(d.Article.Authors) != 2 || source(fields, "article_tags") != SourceJSONLD {
+		t.Errorf("article = %+v", d.Article)
+	}
+
+	user.OgType = "product"
+	user.TargetURL = "https://example.org/may"
+	d, fields = mergeMetadata(user, page, true)
+	if d.Type != "product" || d.PageURL != user.TargetURL || d.Article.PublishedTime != "" {
+		t.Errorf("user type and URL should win and drop article properties: %+v", d)
+	}
+	if _, ok := fields["article_published_time"]; ok {
+		t.Error("article fields should not be merged for other types")
+	}
+
+	d, fields = mergeMetadata(GenerationParameters{}, nil, true)
+	if d.Title != defaultTitle || source(fields, "title") != SourceDefault || d.PageURL != defaultPageURL {
+		t.Errorf("cards without values should get the defaults: %+v", d)
+	}
+}
+
+func TestLangLocale(t *testing.T) {
+	for lang, want := range map[string]string{"en-us": "en_US", "pt_BR": "pt_BR", "fr": "", "zh-Hant-TW": "", "": ""} {
+		if got := langLocale(lang); got != want {
+			t.Errorf("langLocale(%q) = %q, want %q", lang, got, want)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Types a generation parameter can have
+const (
+	ParamString  = "string"
+	ParamInteger = "integer"
+	ParamNumber  = "number"
+	ParamBoolean = "boolean"
+	ParamObject  = "object" // A JSON object; forms send it as a JSON string
+	ParamList    = "array"  // A JSON array of strings; forms send it comma separated
+)
+
+// ParamSpec declares one generation parameter: the names it is accepted
+// under and the values it may take. Zero limits are not checked.
+type ParamSpec struct {
+	Name      string   // Name in JSON bodies, dotted for nested fields
+	Form      []string // Form keys accepted for it, the documented one first
+	Type      string
+	Min       float64 // Inclusive range for integers and numbers, when Max is set
+	Max       float64
+	Enum      []string
+	MaxLength int // For lists, the limit of each item
+	MaxItems  int
+	Ignored   bool // Accepted for older clients but not used
+}
+
+// generationParams is the schema of /api/generate and template previews.
+// Form fields that are not listed here are rejected, which keeps clients
+// away from anything but generation parameters.
+var generationParams = []ParamSpec{
+	{Name: "url", Form: []string{"url"}, Type: ParamString, MaxLength: 2048},
+	{Name: "title", Form: []string{"title"}, Type: ParamString, MaxLength: 300},
+	{Name: "description", Form: []string{"description"}, Type: ParamString, MaxLength: 1000},
+	{Name: "og_type", Form: []string{"type"}, Type: ParamString, Enum: []string{"website", "article", "product", "profile", "book"}},
+	{Name: "site_name", Form: []string{"site"}, Type: ParamString, MaxLength: 200},
+	{Name: "target_url", Form: []string{"target_url", "target-url", "targetUrl"}, Type: ParamString, MaxLength: 2048},
+	{Name: "twitter_card", Form: []string{"twitter_card", "twitter-card", "twitterCard"}, Type: ParamString, Enum: []string{"summary", "summary_large_image", "app", "player"}},
+	{Name: "image_width", Form: []string{"width"}, Type: ParamInteger, Min: 200, Max: 2400},
+	{Name: "image_height", Form: []string{"height"}, Type: ParamInteger, Min: 200, Max: 2400},
+	{Name: "quality", Form: []string{"quality"}, Type: ParamInteger, Min: 10, Max: 100},
+	{Name: "wait_time", Form: []string{"wait"}, Type: ParamInteger, Min: 0, Max: 15000},
+	{Name: "selector", Form: []string{"selector"}, Type: ParamString, MaxLength: 500},
+	{Name: "debug", Form: []string{"debug"}, Type: ParamBoolean},
+	{Name: "verbose", Form: []string{"verbose"}, Type: ParamBoolean},
+	{Name: "async", Form: []string{"async"}, Type: ParamBoolean},
+	{Name: "callback_url", Form: []string{"callback_url", "callbackUrl"}, Type: ParamString, MaxLength: 2048},
+
+	{Name: "device_scale_factor", Form: []string{"scale", "device_scale_factor", "deviceScaleFactor"}, Type: ParamNumber, Min: 1, Max: maxDeviceScaleFactor},
+	{Name: "capture_mode", Form: []string{"capture_mode", "capture", "captureMode"}, Type: ParamString, Enum: []string{CaptureModeViewport, CaptureModeFullPage, CaptureModeElement}},
+	{Name: "format", Form: []string{"format"}, Type: ParamString, Enum: []string{FormatPNG, FormatJPEG, "jpg", FormatWebP}},
+	{Name: "capture_selector", Form: []string{"capture_selector", "capture-selector", "captureSelector"}, Type: ParamString, MaxLength: 500},
+	{Name: "capture_padding", Form: []string{"capture_padding", "capture-padding", "capturePadding"}, Type: ParamInteger, Min: 0, Max: 1000},
+	{Name: "capture_background", Form: []string{"capture_background", "capture-background", "captureBackground"}, Type: ParamString, MaxLength: 32},
+
+	{Name: "processing.fit", Form: []string{"fit"}, Type: ParamString, Enum: []string{FitCover, FitContain}},
+	{Name: "processing.background", Form: []string{"background"}, Type: ParamString, MaxLength: 32},
+	{Name: "processing.corner_radius", Form: []string{"corner_radius", "corner-radius", "cornerRadius"}, Type: ParamInteger, Min: 0, Max: 1000},
+	{Name: "processing.border_width", Form: []string{"border_width", "border-width", "borderWidth"}, Type: ParamInteger, Min: 0, Max: 1000},
+	{Name: "processing.border_color", Form: []string{"border_color", "border-color", "borderColor"}, Type: ParamString, MaxLength: 32},
+	{Name: "processing.watermark_url", Form: []string{"watermark_url", "watermark-url", "watermarkUrl"}, Type: ParamString, MaxLength: 8 << 20},
+	{Name: "processing.watermark_position", Form: []string{"watermark_position", "watermark-position", "watermarkPosition"}, Type: ParamString,
+		Enum: []string{PositionTopLeft, PositionTopRight, PositionBottomLeft, PositionBottomRight, PositionCenter}},
+	{Name: "processing.watermark_size", Form: []string{"watermark_size", "watermark-size", "watermarkSize"}, Type: ParamNumber, Min: 0, Max: 1},
+	{Name: "processing.watermark_opacity", Form: []string{"watermark_opacity", "watermark-opacity", "watermarkOpacity"}, Type: ParamNumber, Min: 0, Max: 1},
+	{Name: "processing.watermark_margin", Form: []string{"watermark_margin", "watermark-margin", "watermarkMargin"}, Type: ParamInteger, Min: 0, Max: 1000},
+	{Name: "processing.optimize", Form: []string{"optimize"}, Type: ParamBoolean},
+
+	{Name: "template", Form: []string{"template"}, Type: ParamString, MaxLength: 64},
+	{Name: "template_version", Form: []string{"template_version", "template-version", "templateVersion"}, Type: ParamInteger, Min: 0, Max: 1000000},
+	{Name: "logo_url", Form: []string{"logo_url", "logo", "logo-url", "logoUrl"}, Type: ParamString, MaxLength: 2048},
+	{Name: "background_color", Form: []string{"background_color", "background-color", "backgroundColor"}, Type: ParamString, MaxLength: 32},
+	{Name: "text_color", Form: []string{"text_color", "text-color", "textColor"}, Type: ParamString, MaxLength: 32},
+	{Name: "accent_color", Form: []string{"accent_color", "accent-color", "accentColor"}, Type: ParamString, MaxLength: 32},
+	{Name: "title_min_font_size", Form: []string{"title_min_font_size", "title-min-font-size", "titleMinFontSize"}, Type: ParamInteger, Min: 0, Max: maxFitFontSize},
+	{Name: "title_max_font_size", Form: []string{"title_max_font_size", "title-max-font-size", "titleMaxFontSize"}, Type: ParamInteger, Min: 0, Max: maxFitFontSize},
+	{Name: "meta_format", Form: []string{"meta_format", "meta-format", "metaFormat"}, Type: ParamString, Enum: MetaFormats()},
+	{Name: "previews", Form: []string{"previews"}, Type: ParamBoolean},
+	{Name: "enrich", Form: []string{"enrich"}, Type: ParamBoolean},
+
+	{Name: "locale", Form: []string{"locale"}, Type: ParamString, MaxLength: 16},
+	{Name: "locale_alternates", Form: []string{"locale_alternates", "locale-alternates", "localeAlternates"}, Type: ParamList, MaxLength: 16, MaxItems: 20},
+	{Name: "image_alt", Form: []string{"image_alt", "image-alt", "imageAlt"}, Type: ParamString, MaxLength: 420},
+	{Name: "images", Form: []string{"images"}, Type: ParamList, MaxLength: 2048, MaxItems: 10},
+	{Name: "video_url", Form: []string{"video_url", "video-url", "videoUrl"}, Type: ParamString, MaxLength: 2048},
+	{Name: "video_type", Form: []string{"video_type", "video-type", "videoType"}, Type: ParamString, MaxLength: 100},
+	{Name: "video_width", Form: []string{"video_width", "video-width", "videoWidth"}, Type: ParamInteger, Min: 1, Max: 7680},
+	{Name: "video_height", Form: []string{"video_height", "video-height", "videoHeight"}, Type: ParamInteger, Min: 1, Max: 4320},
+	{Name: "audio_url", Form: []string{"audio_url", "audio-url", "audioUrl"}, Type: ParamString, MaxLength: 2048},
+	{Name: "audio_type", Form: []string{"audio_type", "audio-type", "audioType"}, Type: ParamString, MaxLength: 100},
+	{Name: "article_published_time", Form: []string{"article_published_time", "article-published-time", "articlePublishedTime"}, Type: ParamString, MaxLength: 64},
+	{Name: "article_modified_time", Form: []string{"article_modified_time", "article-modified-time", "articleModifiedTime"}, Type: ParamString, MaxLength: 64},
+	{Name: "article_authors", Form: []string{"article_authors", "article-authors", "articleAuthors"}, Type: ParamList, MaxLength: 2048, MaxItems: 10},
+	{Name: "article_section", Form: []string{"article_section", "article-section", "articleSection"}, Type: ParamString, MaxLength: 200},
+	{Name: "article_tags", Form: []string{"article_tags", "article-tags", "articleTags"}, Type: ParamList, MaxLength: 100, MaxItems: 20},
+	{Name: "product_price_amount", Form: []string{"product_price_amount", "product-price-amount", "productPriceAmount"}, Type: ParamString, MaxLength: 32},
+	{Name: "product_price_currency", Form: []string{"product_price_currency", "product-price-currency", "productPriceCurrency"}, Type: ParamString, MaxLength: 3},
+	{Name: "profile_first_name", Form: []string{"profile_first_name", "profile-first-name", "profileFirstName"}, Type: ParamString, MaxLength: 100},
+	{Name: "profile_last_name", Form: []string{"profile_last_name", "profile-last-name", "profileLastName"}, Type: ParamString, MaxLength: 100},
+	{Name: "profile_username", Form: []string{"profile_username", "profile-username", "profileUsername"}, Type: ParamString, MaxLength: 100},
+	{Name: "profile_gender", Form: []string{"profile_gender", "profile-gender", "profileGender"}, Type: ParamString, Enum: []string{"male", "female"}},
+	{Name: "twitter_site", Form: []string{"twitter_site", "twitter-site", "twitterSite"}, Type: ParamString, MaxLength: 16},
+	{Name: "twitter_creator", Form: []string{"twitter_creator", "twitter-creator", "twitterCreator"}, Type: ParamString, MaxLength: 16},
+
+	{Name: "custom_params", Form: []string{"custom_params", "customParams"}, Type: ParamObject, MaxLength: 16 << 10, MaxItems: 50},
+
+	{Name: "image_type", Form: []string{"imageType"}, Type: ParamString, Ignored: true},
+}
+
+// formParamSpecs indexes the schema by form key
+var formParamSpecs = func() map[string]*ParamSpec {
+	index := make(map[string]*ParamSpec)
+	for i := range generationParams {
+		for _, key := range generationParams[i].Form {
+			index[key] = &generationParams[i]
+		}
+	}
+	return index
+}()
+
+// check validates one value against the spec. Values from forms arrive as
+// strings and are parsed according to the type first.
+func (spec *ParamSpec) check(value interface{}) string {
+	if s, ok := value.(string); ok {
+		switch spec.Type {
+		case ParamInteger:
+			n, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return "must be an integer"
+			}
+			value = n
+		case ParamNumber:
+			n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil {
+				return "must be a number"
+			}
+			value = n
+		case ParamBoolean:
+			switch strings.ToLower(strings.TrimSpace(s)) {
+			case "true", "false", "on", "off", "1", "0", "yes", "no":
+				return ""
+			}
+			return "must be true or false"
+		case ParamList:
+			value = splitList(s)
+		case ParamObject:
+			if len(s) > spec.MaxLength {
+				return fmt.Sprintf("must be at most %d characters", spec.MaxLength)
+			}
+			params, err := parseCustomParams(s)
+			if err != nil {
+				return "must be a JSON object of strings"
+			}
+			value = params
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		if spec.MaxLength > 0 && len([]rune(v)) > spec.MaxLength {
+			return fmt.Sprintf("must be at most %d characters", spec.MaxLength)
+		}
+		if len(spec.Enum) > 0 && v != "" && !containsFold(spec.Enum, v) {
+			return "must be one of " + strings.Join(spec.Enum, ", ")
+		}
+	case []string:
+		if spec.MaxItems > 0 && len(v) > spec.MaxItems {
+			return fmt.Sprintf("must have at most %d items", spec.MaxItems)
+		}
+		for _, item := range v {
+			if spec.MaxLength > 0 && len([]rune(item)) > spec.MaxLength {
+				return fmt.Sprintf("items must be at most %d characters", spec.MaxLength)
+			}
+		}
+	case map[string]string:
+		// Keys and values together, so JSON bodies get the same budget as
+		// the encoded form value
+		size := 0
+		for key, item := range v {
+			size += len(key) + len(item)
+		}
+		if spec.MaxItems > 0 && len(v) > spec.MaxItems {
+			return fmt.Sprintf("must have at most %d entries", spec.MaxItems)
+		}
+		if spec.MaxLength > 0 && size > spec.MaxLength {
+			return fmt.Sprintf("must be at most %d characters", spec.MaxLength)
+		}
+	case int:
+		return spec.checkRange(float64(v))
+	case float64:
+		return spec.checkRange(v)
+	}
+	return ""
+}
+
+// checkRange validates a number against the spec's range
+func (spec *ParamSpec) checkRange(v float64) string {
+	if spec.Max == 0 && spec.Min == 0 {
+		return ""
+	}
+	if v < spec.Min || v > spec.Max {
+		return fmt.Sprintf("must be between %s and %s", formatLimit(spec.Min), formatLimit(spec.Max))
+	}
+	return ""
+}
+
+// formatLimit prints a range limit without trailing zeros
+func formatLimit(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// containsFold reports whether list contains s, ignoring case
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateForm checks submitted form fields against the schema. Unknown
+// keys are rejected; extra lists keys a handler accepts on top of the
+// generation parameters.
+func validateForm(form url.Values, extra ...string) error {
+	keys := make([]string, 0, len(form))
+	for key := range form {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []FieldError
+	for _, key := range keys {
+		spec, ok := formParamSpecs[key]
+		if !ok {
+			if !containsFold(extra, key) {
+				errs = append(errs, FieldError{Field: key, Message: "unknown parameter"})
+			}
+			continue
+		}
+		if len(form[key]) > 1 {
+			errs = append(errs, FieldError{Field: key, Message: "must be given once"})
+			continue
+		}
+		if strings.TrimSpace(form.Get(key)) == "" {
+			continue
+		}
+		if message := spec.check(form.Get(key)); message != "" {
+			errs = append(errs, FieldError{Field: key, Message: message})
+		}
+	}
+
+	if len(errs) > 0 {
+		return &ValidationError{Fields: errs}
+	}
+
+	// Values the schema cannot describe are reported under the key the
+	// client used
+	for _, fe := range checkParameterValues(parametersFromForm(form)) {
+		errs = append(errs, FieldError{Field: formKeyFor(form, fe.Field), Message: fe.Message})
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Fields: errs}
+	}
+	return nil
+}
+
+// formKeyFor returns the form key a parameter was sent under
+func formKeyFor(form url.Values, name string) string {
+	for i := range generationParams {
+		if generationParams[i].Name != name {
+			continue
+		}
+		for _, key := range generationParams[i].Form {
+			if _, ok := form[key]; ok {
+				return key
+			}
+		}
+		return generationParams[i].Form[0]
+	}
+	return name
+}
+
+// checkParameterValues validates what the schema cannot express: URLs,
+// colors and the title size range. Fields are named as in JSON bodies.
+func checkParameterValues(params GenerationParameters) []FieldError {
+	var errs []FieldError
+	add := func(field, message string) {
+		errs = append(errs, FieldError{Field: field, Message: message})
+	}
+
+	if params.WebpageURL != "" {
+		if _, err := normalizeURL(params.WebpageURL); err != nil {
+			add("url", err.Error())
+		}
+	}
+	if params.TargetURL != "" && !isAbsoluteHTTPURL(params.TargetURL) {
+		add("target_url", "must be an absolute http or https URL")
+	}
+	if params.CallbackURL != "" && !isAbsoluteHTTPURL(params.CallbackURL) {
+		add("callback_url", "must be an absolute http or https URL")
+	}
+
+	colors := map[string]string{
+		"capture_background": params.CaptureBackground,
+		"background_color":   params.BackgroundColor,
+		"text_color":         params.TextColor,
+		"accent_color":       params.AccentColor,
+	}
+	if p := params.Processing; p != nil {
+		colors["processing.background"] = p.Background
+		colors["processing.border_color"] = p.BorderColor
+	}
+	for field, c := range colors {
+		if _, err := parseHexColor(c); err != nil {
+			add(field, err.Error())
+		}
+	}
+
+	if _, err := titleFitRange(params); err != nil {
+		add("title_min_font_size", err.Error())
+	}
+
+	og := openGraphParameters(OpenGraphData{Type: firstNonEmpty(params.OgType, defaultType)}, params)
+	for _, problem := range validateOpenGraph(og) {
+		add(openGraphParamNames[problem.Property], problem.Message)
+	}
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+	return errs
+}
+
+// openGraphParamNames maps Open Graph properties to the parameter that
+// sets them
+var openGraphParamNames = map[string]string{
+	"og:locale":              "locale",
+	"og:locale:alternate":    "locale_alternates",
+	"og:image":               "images",
+	"og:video":               "video_url",
+	"og:video:type":          "video_type",
+	"og:audio":               "audio_url",
+	"og:audio:type":          "audio_type",
+	"article:published_time": "article_published_time",
+	"article:modified_time":  "article_modified_time",
+	"article:author":         "article_authors",
+	"article:section":        "article_section",
+	"article:tag":            "article_tags",
+	"product:price:amount":   "product_price_amount",
+	"product:price:currency": "product_price_currency",
+	"profile:first_name":     "profile_first_name",
+	"profile:last_name":      "profile_last_name",
+	"profile:username":       "profile_username",
+	"profile:gender":         "profile_gender",
+	"twitter:site":           "twitter_site",
+	"twitter:creator":        "twitter_creator",
+}
+
+// validateJSONParams checks the fields present in a decoded JSON request
+// against the schema
+func validateJSONParams(req GenerateRequest, present map[string]bool) []FieldError {
+	var errs []FieldError
+	for i := range generationParams {
+		spec := &generationParams[i]
+		if !present[spec.Name] {
+			continue
+		}
+		value, ok := jsonValue(reflect.ValueOf(req), spec.Name)
+		if !ok {
+			continue
+		}
+		if message := spec.check(value); message != "" {
+			errs = append(errs, FieldError{Field: spec.Name, Message: message})
+		}
+	}
+	return errs
+}
+
+// jsonValue looks up a dotted JSON field name in a struct
+func jsonValue(v reflect.Value, name string) (interface{}, bool) {
+	for _, part := range strings.Split(name, ".") {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return nil, false
+			}
+			v = v.Elem()
+		}
+		i, ok := jsonFieldIndex(v.Type())[part]
+		if !ok {
+			return nil, false
+		}
+		v = v.Field(i)
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), true
+	case reflect.Int:
+		return int(v.Int()), true
+	case reflect.Float64:
+		return v.Float(), true
+	}
+	return v.Interface(), true
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestValidateForm(t *testing.T) {
+	tests := []struct {
+		name string
+		form url.Values
+		want map[string]string // field to message, nil when the form is valid
+	}{
+		{
+			name: "aliases accepted",
+			form: url.Values{"url": {"https://example.com"}, "width": {"1200"}, "twitter-card": {"summary"}, "scale": {"2"}, "debug": {"on"}},
+		},
+		{
+			name: "flag injection",
+			form: url.Values{"url": {"https://example.com"}, "output": {"/etc/cron.d/x"}, "port": {"9999"}, "preview": {"true"}},
+			want: map[string]string{"output": "unknown parameter", "port": "unknown parameter", "preview": "unknown parameter"},
+		},
+		{
+			name: "ranges, enums and lengths",
+			form: url.Values{
+				"width":   {"5000"},
+				"quality": {"abc"},
+				"wait":    {"-1"},
+				"type":    {"video"},
+				"title":   {string(make([]byte, 301))},
+			},
+			want: map[string]string{
+				"width":   "must be between 200 and 2400",
+				"quality": "must be an integer",
+				"wait":    "must be between 0 and 15000",
+				"type":    "must be one of website, article, product, profile, book",
+				"title":   "must be at most 300 characters",
+			},
+		},
+		{
+			name: "semantic checks use the submitted key",
+			form: url.Values{"url": {"https://example.com"}, "backgroundColor": {"blue"}},
+			want: map[string]string{"backgroundColor": "invalid color"},
+		},
+		{
+			name: "og:type properties",
+			form: url.Values{"url": {"https://example.com"}, "type": {"product"}, "product-price-amount": {"9,99"}, "articleSection": {"News"}},
+			want: map[string]string{
+				"product-price-amount": "must be a decimal number such as 19.99",
+				"articleSection":       "only applies to og:type article",
+			},
+		},
+		{
+			name: "og:type properties may be left out",
+			form: url.Values{"url": {"https://example.com"}, "type": {"article"}},
+		},
+		{
+			name: "lists",
+			form: url.Values{"url": {"https://example.com"}, "type": {"article"}, "article_published_time": {"2024-05-01"}, "article_tags": {"go, web ,og"}},
+		},
+		{
+			name: "custom params and default title sizes",
+			form: url.Values{"url": {"https://example.com"}, "custom_params": {"{" + manyCustomParams(51) + "}"}, "title_min_font_size": {"0"}},
+			want: map[string]string{"custom_params": "must have at most 50 entries"},
+		},
+		{
+			name: "repeated key",
+			form: url.Values{"url": {"https://a.example", "https://b.example"}},
+			want: map[string]string{"url": "must be given once"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateForm(tt.form)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("validateForm() error = %v", err)
+				}
+				return
+			}
+			validationErr, ok := err.(*ValidationError)
+			if !ok {
+				t.Fatalf("validateForm() error = %v, want a ValidationError", err)
+			}
+			got := make(map[string]string)
+			for _, f := range validationErr.Fields {
+				got[f.Field] = f.Message
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("errors = %v, want %d fields", got, len(tt.want))
+			}
+			for field, message := range tt.want {
+				if !strings.HasPrefix(got[field], message) {
+					t.Errorf("%s: message %q, want %q", field, got[field], message)
+				}
+			}
+		})
+	}
+}
+
+// TestUndeclaredParameters sends generator flags that are not generation
+// parameters through the form and JSON paths of the generate handler
+func TestUndeclaredParameters(t *testing.T) {
+	saved := jobQueue
+	defer func() { jobQueue = saved }()
+	jobQueue = NewJobQueue(1, 1, time.Minute, func(ctx context.Context, job *Job) (*Result, error) {
+		t.Error("a request with undeclared parameters must not be queued")
+		return &Result{}, nil
+	})
+
+	undeclared := []string{"html", "output", "port", "preview"}
+
+	form := url.Values{"url": {"https://example.com"}}
+	body := map[string]string{"url": "https://example.com"}
+	for _, key := range undeclared {
+		form.Set(key, "/tmp/evil")
+		body[key] = "/tmp/evil"
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := map[string]*http.Request{
+		"form": httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(form.Encode())),
+		"json": httptest.NewRequest(http.MethodPost, "/api/generate", bytes.NewReader(data)),
+	}
+	requests["form"].Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	requests["json"].Header.Set("Content-Type", "application/json")
+
+	for name, req := range requests {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handleGenerateRequest(rec, req)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400", rec.Code)
+			}
+
+			var response struct {
+				Errors []FieldError `json:"errors"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			var fields []string
+			for _, fe := range response.Errors {
+				fields = append(fields, fe.Field)
+			}
+			if !reflect.DeepEqual(fields, undeclared) {
+				t.Errorf("error fields = %v, want %v", fields, undeclared)
+			}
+		})
+	}
+
+	// Keys that slip past validation never reach the parameters
+	if got, want := parametersFromForm(form), parametersFromForm(url.Values{"url": {"https://example.com"}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("parametersFromForm = %+v, want %+v", got, want)
+	}
+}
+
+// TestOpenAPIMatchesSchema keeps the published spec in step with generationParams
+func TestOpenAPIMatchesSchema(t *testing.T) {
+	data, err := os.ReadFile("openapi.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type property struct {
+		Type      string   `yaml:"type"`
+		Enum      []string `yaml:"enum"`
+		Minimum   *float64 `yaml:"minimum"`
+		Maximum   *float64 `yaml:"maximum"`
+		MaxLength int      `yaml:"maxLength"`
+		Aliases   []string `yaml:"x-aliases"`
+	}
+	var spec struct {
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]property `yaml:"properties"`
+			} `yaml:"schemas"`
+		} `yaml:"components"`
+	}
+	if err := yaml.Unmarshal(data, &spec); err != nil {
+		t.Fatalf("openapi.yaml: %v", err)
+	}
+	schemas := spec.Components.Schemas
+
+	compare := func(where string, p property, ok bool, param ParamSpec) {
+		if !ok {
+			t.Errorf("%s is not documented", where)
+			return
+		}
+		if len(param.Enum) != len(p.Enum) {
+			t.Errorf("%s: enum %v, want %v", where, p.Enum, param.Enum)
+		}
+		if param.MaxLength != p.MaxLength && param.Type == ParamString {
+			t.Errorf("%s: maxLength %d, want %d", where, p.MaxLength, param.MaxLength)
+		}
+		if param.Max != 0 {
+			if p.Minimum == nil || p.Maximum == nil || *p.Minimum != param.Min || *p.Maximum != param.Max {
+				t.Errorf("%s: range %v-%v, want %v-%v", where, p.Minimum, p.Maximum, param.Min, param.Max)
+			}
+		}
+	}
+
+	for _, param := range generationParams {
+		if param.Ignored {
+			continue
+		}
+
+		form, ok := schemas["GenerateRequest"].Properties[param.Form[0]]
+		compare("GenerateRequest."+param.Form[0], form, ok, param)
+		if ok && len(form.Aliases) != len(param.Form)-1 {
+			t.Errorf("GenerateRequest.%s: x-aliases %v, want %v", param.Form[0], form.Aliases, param.Form[1:])
+		}
+
+		if name, nested := strings.CutPrefix(param.Name, "processing."); nested {
+			p, ok := schemas["ImageProcessing"].Properties[name]
+			compare("ImageProcessing."+name, p, ok, param)
+		} else {
+			p, ok := schemas["GenerateJSONRequest"].Properties[param.Name]
+			compare("GenerateJSONRequest."+param.Name, p, ok, param)
+		}
+	}
+}
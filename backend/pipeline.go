@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// Fit modes for resizing the capture to the requested dimensions
+const (
+	FitCover   = "cover"   // Scale to fill, cropping the overflow
+	FitContain = "contain" // Scale to fit, letterboxing the rest
+)
+
+// Watermark positions
+const (
+	PositionTopLeft     = "top-left"
+	PositionTopRight    = "top-right"
+	PositionBottomLeft  = "bottom-left"
+	PositionBottomRight = "bottom-right"
+	PositionCenter      = "center"
+)
+
+// Limits for fetching watermark images
+const (
+	maxWatermarkBytes   = 5 << 20
+	watermarkFetchLimit = 10 * time.Second
+)
+
+// ImageProcessing configures the steps applied to a capture before it is
+// saved. Sizes are in CSS pixels and scale with the device scale factor.
+type ImageProcessing struct {
+	Fit        string `json:"fit,omitempty"`        // cover or contain, empty to keep the capture size
+	Background string `json:"background,omitempty"` // Letterbox fill, and what transparent areas flatten to for JPEG
+
+	CornerRadius int    `json:"corner_radius,omitempty"`
+	BorderWidth  int    `json:"border_width,omitempty"`
+	BorderColor  string `json:"border_color,omitempty"`
+
+	WatermarkURL      string  `json:"watermark_url,omitempty"`      // http(s) or data: URL of a logo
+	WatermarkPosition string  `json:"watermark_position,omitempty"` // top-left, top-right, bottom-left, bottom-right or center
+	WatermarkSize     float64 `json:"watermark_size,omitempty"`     // Fraction of the image width, default 0.15
+	WatermarkOpacity  float64 `json:"watermark_opacity,omitempty"`  // 0-1, default 1
+	WatermarkMargin   int     `json:"watermark_margin,omitempty"`   // Distance from the edges, default 24
+
+	Optimize bool `json:"optimize,omitempty"` // Losslessly shrink PNG output
+}
+
+// ImageStep is one stage of the post-capture pipeline
+type ImageStep interface {
+	Name() string
+	Apply(img *image.RGBA) (*image.RGBA, error)
+}
+
+// buildPipeline turns the processing options into steps, in the order they
+// are applied. The watermark is fetched here, with client, so a bad URL
+// fails the generation before a browser is leased.
+func buildPipeline(ctx context.Context, params GenerationParameters, client *http.Client) ([]ImageStep, error) {
+	p := params.Processing
+	if p == nil {
+		return nil, nil
+	}
+
+	scale := params.DeviceScaleFactor
+	px := func(v int) int { return int(math.Round(float64(v) * scale)) }
+
+	if p.CornerRadius < 0 || p.BorderWidth < 0 || p.WatermarkMargin < 0 {
+		return nil, fmt.Errorf("corner radius, border width and watermark margin must not be negative")
+	}
+
+	background, err := parseHexColor(p.Background)
+	if err != nil {
+		return nil, fmt.Errorf("invalid processing background: %w", err)
+	}
+
+	var steps []ImageStep
+
+	switch strings.ToLower(p.Fit) {
+	case "":
+	case FitCover, FitContain:
+		steps = append(steps, &fitStep{
+			width:      px(params.ImageWidth),
+			height:     px(params.ImageHeight),
+			mode:       strings.ToLower(p.Fit),
+			background: background,
+		})
+	default:
+		return nil, fmt.Errorf("unsupported fit %q (use cover or contain)", p.Fit)
+	}
+
+	if p.WatermarkURL != "" {
+		step, err := newWatermarkStep(ctx, client, p, px)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+
+	if p.BorderWidth > 0 {
+		borderColor, err := parseHexColor(firstNonEmpty(p.BorderColor, "#000000"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid border color: %w", err)
+		}
+		steps = append(steps, &borderStep{width: px(p.BorderWidth), radius: px(p.CornerRadius), color: borderColor})
+	}
+
+	if p.CornerRadius > 0 {
+		steps = append(steps, &roundCornersStep{radius: px(p.CornerRadius)})
+		// JPEG has no alpha channel, so the cut corners need a solid fill
+		if params.Format == FormatJPEG {
+			steps = append(steps, &flattenStep{background: background})
+		}
+	}
+
+	return steps, nil
+}
+
+// runPipeline applies the steps in order
+func runPipeline(img image.Image, steps []ImageStep) (*image.RGBA, error) {
+	rgba := toRGBA(img)
+	for _, step := range steps {
+		var err error
+		if rgba, err = step.Apply(rgba); err != nil {
+			return nil, fmt.Errorf("image step %s failed: %w", step.Name(), err)
+		}
+	}
+	return rgba, nil
+}
+
+// stepNames lists the steps for logging
+func stepNames(steps []ImageStep) []string {
+	names := make([]string, len(steps))
+	for i, step := range steps {
+		names[i] = step.Name()
+	}
+	return names
+}
+
+// toRGBA returns img as an *image.RGBA starting at the origin
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Bounds().Min == (image.Point{}) {
+		return rgba
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	xdraw.Draw(rgba, rgba.Bounds(), img, b.Min, xdraw.Src)
+	return rgba
+}
+
+// fitStep resizes the capture to exactly width x height
+type fitStep struct {
+	width, height int
+	mode          string
+	background    color.RGBA
+}
+
+func (s *fitStep) Name() string { return "fit:" + s.mode }
+
+func (s *fitStep) Apply(img *image.RGBA) (*image.RGBA, error) {
+	src := img.Bounds()
+	if src.Dx() == s.width && src.Dy() == s.height {
+		return img, nil
+	}
+
+	sx := float64(s.width) / float64(src.Dx())
+	sy := float64(s.height) / float64(src.Dy())
+	factor := math.Min(sx, sy)
+	if s.mode == FitCover {
+		factor = math.Max(sx, sy)
+	}
+
+	w := int(math.Round(float64(src.Dx()) * factor))
+	h := int(math.Round(float64(src.Dy()) * factor))
+	x := (s.width - w) / 2
+	y := (s.height - h) / 2
+
+	out := image.NewRGBA(image.Rect(0, 0, s.width, s.height))
+	if s.mode == FitContain {
+		xdraw.Draw(out, out.Bounds(), image.NewUniform(s.background), image.Point{}, xdraw.Src)
+	}
+	// Cover overflows the canvas on one axis; drawing clips it to the centre
+	xdraw.CatmullRom.Scale(out, image.Rect(x, y, x+w, y+h), img, src, xdraw.Over, nil)
+	return out, nil
+}
+
+// watermarkStep overlays a logo in one corner or the centre
+type watermarkStep struct {
+	logo     image.Image
+	position string
+	size     float64
+	opacity  float64
+	margin   int
+}
+
+// newWatermarkStep validates the watermark options and loads the logo
+func newWatermarkStep(ctx context.Context, client *http.Client, p *ImageProcessing, px func(int) int) (*watermarkStep, error) {
+	step := &watermarkStep{
+		position: strings.ToLower(firstNonEmpty(p.WatermarkPosition, PositionBottomRight)),
+		size:     p.WatermarkSize,
+		opacity:  p.WatermarkOpacity,
+		margin:   px(24),
+	}
+	if p.WatermarkMargin > 0 {
+		step.margin = px(p.WatermarkMargin)
+	}
+	if step.size == 0 {
+		step.size = 0.15
+	}
+	if step.opacity == 0 {
+		step.opacity = 1
+	}
+
+	switch step.position {
+	case PositionTopLeft, PositionTopRight, PositionBottomLeft, PositionBottomRight, PositionCenter:
+	default:
+		return nil, fmt.Errorf("unsupported watermark position %q", p.WatermarkPosition)
+	}
+	if step.size <= 0 || step.size > 1 {
+		return nil, fmt.Errorf("watermark size must be between 0 and 1")
+	}
+	if step.opacity < 0 || step.opacity > 1 {
+		return nil, fmt.Errorf("watermark opacity must be between 0 and 1")
+	}
+
+	logo, err := loadWatermark(ctx, client, p.WatermarkURL)
+	if err != nil {
+		return nil, err
+	}
+	step.logo = logo
+	return step, nil
+}
+
+func (s *watermarkStep) Name() string { return "watermark" }
+
+func (s *watermarkStep) Apply(img *image.RGBA) (*image.RGBA, error) {
+	bounds := img.Bounds()
+	logoBounds := s.logo.Bounds()
+
+	w := int(math.Round(float64(bounds.Dx()) * s.size))
+	h := int(math.Round(float64(logoBounds.Dy()) * float64(w) / float64(logoBounds.Dx())))
+	if w < 1 || h < 1 {
+		return img, nil
+	}
+
+	var x, y int
+	switch s.position {
+	case PositionTopLeft:
+		x, y = s.margin, s.margin
+	case PositionTopRight:
+		x, y = bounds.Dx()-w-s.margin, s.margin
+	case PositionBottomLeft:
+		x, y = s.margin, bounds.Dy()-h-s.margin
+	case PositionCenter:
+		x, y = (bounds.Dx()-w)/2, (bounds.Dy()-h)/2
+	default:
+		x, y = bounds.Dx()-w-s.margin, bounds.Dy()-h-s.margin
+	}
+
+	scaled := image.NewRGBA(image.Rect(0, 0, w, h))
+	xdraw.CatmullRom.Scale(scaled, scaled.Bounds(), s.logo, logoBounds, xdraw.Src, nil)
+
+	mask := image.NewUniform(color.Alpha{A: uint8(math.Round(s.opacity * 255))})
+	xdraw.DrawMask(img, image.Rect(x, y, x+w, y+h), scaled, image.Point{}, mask, image.Point{}, xdraw.Over)
+	return img, nil
+}
+
+// loadWatermark decodes a logo from a data: URL or downloads it
+func loadWatermark(ctx context.Context, client *http.Client, src string) (image.Image, error) {
+	var data []byte
+
+	if strings.HasPrefix(src, "data:") {
+		comma := strings.Index(src, ",")
+		if comma < 0 || !strings.HasSuffix(src[:comma], ";base64") {
+			return nil, fmt.Errorf("watermark data URL must be base64 encoded")
+		}
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(src[comma+1:]); err != nil {
+			return nil, fmt.Errorf("invalid watermark data URL: %w", err)
+		}
+	} else {
+		if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+			return nil, fmt.Errorf("watermark URL must be an http(s) or data: URL")
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, watermarkFetchLimit)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid watermark URL: %w", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch watermark: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to fetch watermark: %s", resp.Status)
+		}
+		if data, err = io.ReadAll(io.LimitReader(resp.Body, maxWatermarkBytes+1)); err != nil {
+			return nil, fmt.Errorf("failed to read watermark: %w", err)
+		}
+		if len(data) > maxWatermarkBytes {
+			return nil, fmt.Errorf("watermark is larger than %d bytes", maxWatermarkBytes)
+		}
+	}
+
+	logo, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode watermark: %w", err)
+	}
+	return logo, nil
+}
+
+// borderStep paints a border along the edge, following the corner radius
+type borderStep struct {
+	width  int
+	radius int
+	color  color.RGBA
+}
+
+func (s *borderStep) Name() string { return "border" }
+
+func (s *borderStep) Apply(img *image.RGBA) (*image.RGBA, error) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	src := image.NewUniform(s.color)
+	if 2*s.width >= min(w, h) {
+		xdraw.Draw(img, b, src, image.Point{}, xdraw.Over)
+		return img, nil
+	}
+
+	// The curves are confined to the corner squares; between them the
+	// border is four straight bands
+	r := min(s.radius, min(w, h)/2)
+	c := max(r, s.width)
+	for _, band := range []image.Rectangle{
+		image.Rect(c, 0, w-c, s.width),
+		image.Rect(c, h-s.width, w-c, h),
+		image.Rect(0, c, s.width, h-c),
+		image.Rect(w-s.width, c, w, h-c),
+	} {
+		xdraw.Draw(img, band.Add(b.Min), src, image.Point{}, xdraw.Over)
+	}
+
+	for _, corner := range []image.Point{{0, 0}, {w - c, 0}, {0, h - c}, {w - c, h - c}} {
+		mask := image.NewAlpha(image.Rect(corner.X, corner.Y, corner.X+c, corner.Y+c))
+		for y := corner.Y; y < corner.Y+c; y++ {
+			for x := corner.X; x < corner.X+c; x++ {
+				// Antialiased coverage of the band between the edge and the inner line
+				coverage := clamp01(float64(s.width) - edgeDistance(x, y, w, h, r) + 0.5)
+				mask.SetAlpha(x, y, color.Alpha{A: uint8(coverage * 255)})
+			}
+		}
+		xdraw.DrawMask(img, mask.Bounds().Add(b.Min), src, image.Point{}, mask, mask.Bounds().Min, xdraw.Over)
+	}
+	return img, nil
+}
+
+// roundCornersStep makes everything outside the rounded rectangle transparent
+type roundCornersStep struct {
+	radius int
+}
+
+func (s *roundCornersStep) Name() string { return "round-corners" }
+
+func (s *roundCornersStep) Apply(img *image.RGBA) (*image.RGBA, error) {
+	b := img.Bounds()
+	r := min(s.radius, min(b.Dx(), b.Dy())/2)
+
+	for y := 0; y < b.Dy(); y++ {
+		// Only the corner squares can be affected
+		if y >= r && y < b.Dy()-r {
+			continue
+		}
+		for x := 0; x < b.Dx(); x++ {
+			if x >= r && x < b.Dx()-r {
+				continue
+			}
+			coverage := clamp01(edgeDistance(x, y, b.Dx(), b.Dy(), r) + 0.5)
+			if coverage >= 1 {
+				continue
+			}
+			// Pixels are premultiplied, so every channel scales with alpha
+			i := img.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				img.Pix[i+c] = uint8(float64(img.Pix[i+c]) * coverage)
+			}
+		}
+	}
+	return img, nil
+}
+
+// flattenStep composites the image onto a solid background
+type flattenStep struct {
+	background color.RGBA
+}
+
+func (s *flattenStep) Name() string { return "flatten" }
+
+func (s *flattenStep) Apply(img *image.RGBA) (*image.RGBA, error) {
+	bg := s.background
+	bg.A = 255
+	out := image.NewRGBA(img.Bounds())
+	xdraw.Draw(out, out.Bounds(), image.NewUniform(bg), image.Point{}, xdraw.Src)
+	xdraw.Draw(out, out.Bounds(), img, image.Point{}, xdraw.Over)
+	return out, nil
+}
+
+// edgeDistance returns how far the centre of pixel (x, y) lies inside a
+// w x h rectangle with corners rounded by radius r. Negative values are
+// outside.
+func edgeDistance(x, y, w, h, r int) float64 {
+	px, py := float64(x)+0.5, float64(y)+0.5
+	fw, fh, fr := float64(w), float64(h), float64(r)
+
+	// Nearest point on the inner rectangle the corner circles are centred on
+	cx := math.Max(fr, math.Min(px, fw-fr))
+	cy := math.Max(fr, math.Min(py, fh-fr))
+	if px != cx && py != cy {
+		return fr - math.Hypot(px-cx, py-cy)
+	}
+	return math.Min(math.Min(px, fw-px), math.Min(py, fh-py))
+}
+
+// clamp01 limits v to the range 0 to 1
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+// optimizePNG losslessly recompresses a PNG, switching to a palette when the
+// image has 256 colours or fewer. The original is kept if nothing is saved.
+func optimizePNG(data []byte) ([]byte, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode PNG for optimization: %w", err)
+	}
+
+	if paletted := toPalette(img); paletted != nil {
+		img = paletted
+	}
+
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := encoder.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to optimize PNG: %w", err)
+	}
+
+	if buf.Len() >= len(data) {
+		return data, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// toPalette converts img to a paletted image if that loses nothing, or
+// returns nil when it has more than 256 distinct colours
+func toPalette(img image.Image) *image.Paletted {
+	b := img.Bounds()
+	index := make(map[color.NRGBA]uint8)
+	var palette color.Palette
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if _, ok := index[c]; ok {
+				continue
+			}
+			if len(palette) == 256 {
+				return nil
+			}
+			index[c] = uint8(len(palette))
+			palette = append(palette, c)
+		}
+	}
+
+	out := image.NewPaletted(b, palette)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			out.SetColorIndex(x, y, index[c])
+		}
+	}
+	return out
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// solidImage returns a w x h image filled with c
+func solidImage(w, h int, c color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+func TestBuildPipeline(t *testing.T) {
+	var logo bytes.Buffer
+	if err := png.Encode(&logo, solidImage(10, 10, color.RGBA{G: 255, A: 255})); err != nil {
+		t.Fatalf("Failed to encode logo: %v", err)
+	}
+
+	params := applyParameterDefaults(GenerationParameters{
+		Format: FormatJPEG,
+		Processing: &ImageProcessing{
+			Fit:          "contain",
+			CornerRadius: 16,
+			BorderWidth:  4,
+			WatermarkURL: "data:image/png;base64," + base64.StdEncoding.EncodeToString(logo.Bytes()),
+		},
+	})
+
+	steps, err := buildPipeline(context.Background(), params, http.DefaultClient)
+	if err != nil {
+		t.Fatalf("buildPipeline returned error: %v", err)
+	}
+
+	expected := []string{"fit:contain", "watermark", "border", "round-corners", "flatten"}
+	if names := stepNames(steps); !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected steps %v, got %v", expected, names)
+	}
+
+	invalid := []*ImageProcessing{
+		{Fit: "stretch"},
+		{BorderWidth: -1},
+		{BorderWidth: 2, BorderColor: "blue"},
+		{WatermarkURL: "ftp://example.com/logo.png"},
+		{WatermarkURL: "data:image/png;base64,AAAA", WatermarkPosition: "middle"},
+	}
+	for _, p := range invalid {
+		params.Processing = p
+		if _, err := buildPipeline(context.Background(), params, http.DefaultClient); err == nil {
+			t.Errorf("Expected an error for %+v", *p)
+		}
+	}
+}
+
+func TestFitStep(t *testing.T) {
+	red := color.RGBA{R: 255, A: 255}
+	src := solidImage(400, 100, red)
+
+	contain := &fitStep{width: 200, height: 100, mode: FitContain, background: color.RGBA{B: 255, A: 255}}
+	img, err := contain.Apply(src)
+	if err != nil {
+		t.Fatalf("contain returned error: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 200 || b.Dy() != 100 {
+		t.Fatalf("Expected 200x100, got %dx%d", b.Dx(), b.Dy())
+	}
+	if c := img.RGBAAt(100, 5); c.B != 255 || c.R != 0 {
+		t.Errorf("Expected letterbox above the capture, got %v", c)
+	}
+	if c := img.RGBAAt(100, 50); c.R != 255 {
+		t.Errorf("Expected the capture in the centre, got %v", c)
+	}
+
+	cover := &fitStep{width: 200, height: 100, mode: FitCover}
+	if img, err = cover.Apply(src); err != nil {
+		t.Fatalf("cover returned error: %v", err)
+	}
+	if c := img.RGBAAt(100, 5); c != red {
+		t.Errorf("Expected cover to fill the whole image, got %v", c)
+	}
+}
+
+func TestBorderAndRoundCorners(t *testing.T) {
+	img := solidImage(100, 60, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+
+	border := &borderStep{width: 4, radius: 10, color: color.RGBA{A: 255}}
+	img, _ = border.Apply(img)
+	corners := &roundCornersStep{radius: 10}
+	img, _ = corners.Apply(img)
+
+	if c := img.RGBAAt(0, 0); c.A != 0 {
+		t.Errorf("Expected a transparent corner, got %v", c)
+	}
+	if c := img.RGBAAt(50, 1); c != (color.RGBA{A: 255}) {
+		t.Errorf("Expected the border along the top edge, got %v", c)
+	}
+	if c := img.RGBAAt(50, 30); c != (color.RGBA{R: 255, G: 255, B: 255, A: 255}) {
+		t.Errorf("Expected the centre untouched, got %v", c)
+	}
+}
+
+func TestBorderCoverage(t *testing.T) {
+	for _, step := range []*borderStep{
+		{width: 4, radius: 10, color: color.RGBA{R: 255, A: 255}},
+		{width: 12, radius: 5, color: color.RGBA{R: 255, A: 255}},
+		{width: 3, radius: 0, color: color.RGBA{R: 255, A: 255}},
+		{width: 40, radius: 10, color: color.RGBA{R: 255, A: 255}},
+	} {
+		img, _ := step.Apply(image.NewRGBA(image.Rect(0, 0, 64, 48)))
+		for y := 0; y < 48; y++ {
+			for x := 0; x < 64; x++ {
+				coverage := clamp01(float64(step.width) - edgeDistance(x, y, 64, 48, step.radius) + 0.5)
+				if want := uint8(coverage * 255); img.RGBAAt(x, y).A != want {
+					t.Fatalf("width %d radius %d: alpha at (%d, %d) = %d, want %d", step.width, step.radius, x, y, img.RGBAAt(x, y).A, want)
+				}
+			}
+		}
+	}
+}
+
+func TestWatermarkStep(t *testing.T) {
+	img := solidImage(200, 100, color.RGBA{A: 255})
+	step := &watermarkStep{
+		logo:     solidImage(10, 10, color.RGBA{G: 255, A: 255}),
+		position: PositionTopLeft,
+		size:     0.1,
+		opacity:  1,
+		margin:   5,
+	}
+
+	img, _ = step.Apply(img)
+	if c := img.RGBAAt(10, 10); c.G != 255 {
+		t.Errorf("Expected the logo in the top left corner, got %v", c)
+	}
+	if c := img.RGBAAt(150, 80); c.G != 0 {
+		t.Errorf("Expected no logo in the bottom right, got %v", c)
+	}
+}
+
+func TestOptimizePNG(t *testing.T) {
+	img := solidImage(300, 200, color.RGBA{R: 10, G: 20, B: 30, A: 255})
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.NoCompression}
+	if err := encoder.Encode(&buf, img); err != nil {
+		t.Fatalf("Failed to encode test image: %v", err)
+	}
+
+	optimized, err := optimizePNG(buf.Bytes())
+	if err != nil {
+		t.Fatalf("optimizePNG returned error: %v", err)
+	}
+	if len(optimized) >= buf.Len() {
+		t.Errorf("Expected the PNG to shrink, got %d bytes from %d", len(optimized), buf.Len())
+	}
+
+	decoded, err := png.Decode(bytes.NewReader(optimized))
+	if err != nil {
+		t.Fatalf("Failed to decode optimized PNG: %v", err)
+	}
+	if r, g, b, a := decoded.At(150, 100).RGBA(); r>>8 != 10 || g>>8 != 20 || b>>8 != 30 || a>>8 != 255 {
+		t.Errorf("Optimization changed the pixels")
+	}
+}
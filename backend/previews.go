@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/chromedp"
+)
+
+// Themes previews are rendered in
+const (
+	PreviewLight = "light"
+	PreviewDark  = "dark"
+)
+
+// previewThemes lists the themes in gallery order
+var previewThemes = []string{PreviewLight, PreviewDark}
+
+// previewPlatform describes how a platform unfurls a link. Lengths are in
+// characters; the text is cut at the last word that fits and ends with an
+// ellipsis. A zero length hides the text.
+type previewPlatform struct {
+	Name        string
+	Label       string
+	Width       int     // Card width in CSS pixels
+	ImageRatio  float64 // Width over height the image is cropped to, 0 to keep its own
+	Title       int
+	Description int
+	Uppercase   bool // Domain shown in capitals
+}
+
+// previewPlatforms are approximations of each platform's current layout
+var previewPlatforms = []previewPlatform{
+	{Name: "facebook", Label: "Facebook", Width: 500, ImageRatio: 1.91, Title: 88, Description: 110, Uppercase: true},
+	{Name: "x", Label: "X", Width: 506, ImageRatio: 1.91, Title: 70},
+	{Name: "linkedin", Label: "LinkedIn", Width: 552, ImageRatio: 1.91, Title: 120},
+	{Name: "slack", Label: "Slack", Width: 520, Title: 150, Description: 300},
+	{Name: "discord", Label: "Discord", Width: 432, Title: 256, Description: 350},
+}
+
+// PreviewPlatforms returns the names of the platforms previews are made for
+func PreviewPlatforms() []string {
+	names := make([]string, len(previewPlatforms))
+	for i, p := range previewPlatforms {
+		names[i] = p.Name
+	}
+	return names
+}
+
+// previewCard is the template data of one preview
+type previewCard struct {
+	Platform    string
+	Label       string
+	Theme       string
+	Width       int
+	Title       string
+	Description string
+	SiteName    string
+	Domain      string
+	Image       template.URL // Sanitized URL or a data: URL built here
+	ImageStyle  template.CSS // Crop of the image
+	Summary     bool         // X summary card with a square thumbnail
+}
+
+// newPreviewCard applies a platform's truncation and crop rules to the data
+func newPreviewCard(p previewPlatform, theme string, data OpenGraphData, image template.URL) previewCard {
+	card := previewCard{
+		Platform:    p.Name,
+		Label:       p.Label,
+		Theme:       theme,
+		Width:       p.Width,
+		Title:       truncateWords(data.Title, p.Title),
+		Description: truncateWords(data.Description, p.Description),
+		SiteName:    data.SiteName,
+		Image:       image,
+	}
+	if u, err := url.Parse(data.PageURL); err == nil {
+		card.Domain = strings.TrimPrefix(u.Hostname(), "www.")
+		if p.Uppercase {
+			card.Domain = strings.ToUpper(card.Domain)
+		}
+	}
+
+	// X shows small cards with a square thumbnail, the title and description
+	if p.Name == "x" && data.TwitterCard == "summary" {
+		card.Summary = true
+		card.Description = truncateWords(data.Description, 200)
+	}
+
+	switch {
+	case card.Summary:
+		card.ImageStyle = "width: 130px; height: 130px; object-fit: cover;"
+	case p.ImageRatio > 0:
+		card.ImageStyle = template.CSS(fmt.Sprintf("width: 100%%; aspect-ratio: %.2f; object-fit: cover;", p.ImageRatio))
+	default:
+		// Slack and Discord keep the image's shape within a bounding box
+		card.ImageStyle = "max-width: 100%; max-height: 300px; object-fit: contain;"
+	}
+	return card
+}
+
+// truncateWords shortens s to at most n characters, cutting at the last
+// space that fits and adding an ellipsis
+func truncateWords(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	runes := []rune(s)
+	if n <= 0 {
+		return ""
+	}
+	if len(runes) <= n {
+		return s
+	}
+	cut := string(runes[:n-1])
+	if i := strings.LastIndex(cut, " "); i > len(cut)/2 {
+		cut = cut[:i]
+	}
+	return strings.TrimRight(cut, " ,.;:-") + "…"
+}
+
+// previewStyles lay out the cards. Colors follow each platform's light and
+// dark themes.
+const previewStyles = `
+.preview { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; box-sizing: border-box; overflow: hidden; }
+.preview * { box-sizing: border-box; }
+.preview img { display: block; }
+.preview .clamp1, .preview .clamp2, .preview .clamp3 { display: -webkit-box; -webkit-box-orient: vertical; overflow: hidden; }
+.preview .clamp1 { -webkit-line-clamp: 1; } .preview .clamp2 { -webkit-line-clamp: 2; } .preview .clamp3 { -webkit-line-clamp: 3; }
+
+.facebook { border: 1px solid #dadde1; }
+.facebook .body { padding: 10px 12px; background: #f0f2f5; border-top: 1px solid #dadde1; }
+.facebook .domain { font-size: 12px; color: #65676b; }
+.facebook .title { font-size: 16px; font-weight: 600; color: #050505; line-height: 20px; margin: 3px 0 2px; }
+.facebook .description { font-size: 14px; color: #65676b; line-height: 20px; }
+.dark .facebook { border-color: #3e4042; }
+.dark .facebook .body { background: #3a3b3c; border-color: #3e4042; }
+.dark .facebook .domain, .dark .facebook .description { color: #b0b3b8; }
+.dark .facebook .title { color: #e4e6eb; }
+
+.x { position: relative; border: 1px solid #cfd9de; border-radius: 16px; }
+.x .overlay { position: absolute; left: 12px; bottom: 12px; max-width: calc(100% - 24px); padding: 0 4px; border-radius: 4px; background: rgba(0,0,0,0.77); color: #fff; font-size: 13px; line-height: 20px; white-space: nowrap; overflow: hidden; text-overflow: ellipsis; }
+.x-from { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; font-size: 13px; color: #536471; padding-top: 4px; }
+.x .domain { font-size: 13px; color: #536471; }
+.x.summary { display: flex; }
+.x.summary img { border-right: 1px solid #cfd9de; flex: none; }
+.x.summary .body { padding: 12px; font-size: 15px; line-height: 20px; display: flex; flex-direction: column; justify-content: center; min-width: 0; }
+.x.summary .title { color: #0f1419; }
+.x.summary .description { color: #536471; }
+.dark .x { border-color: #2f3336; }
+.dark .x.summary img { border-color: #2f3336; }
+.dark .x.summary .title { color: #e7e9ea; }
+.dark .x-from, .dark .x .domain, .dark .x.summary .description { color: #71767b; }
+
+.linkedin { border-radius: 8px; box-shadow: 0 0 0 1px rgba(0,0,0,0.08); }
+.linkedin .body { padding: 8px 12px; background: #eef3f8; }
+.linkedin .title { font-size: 14px; font-weight: 600; color: rgba(0,0,0,0.9); line-height: 20px; }
+.linkedin .domain { font-size: 12px; color: rgba(0,0,0,0.6); margin-top: 4px; }
+.dark .linkedin { box-shadow: 0 0 0 1px rgba(255,255,255,0.15); }
+.dark .linkedin .body { background: #38434f; }
+.dark .linkedin .title { color: rgba(255,255,255,0.9); }
+.dark .linkedin .domain { color: rgba(255,255,255,0.6); }
+
+.slack { border-left: 4px solid #dddddd; padding: 0 0 0 12px; font-size: 15px; line-height: 22px; }
+.slack .site { font-weight: 700; color: #1d1c1d; }
+.slack .title { font-weight: 700; color: #1264a3; }
+.slack .description { color: #1d1c1d; }
+.slack img { margin-top: 8px; border-radius: 8px; max-width: 360px; }
+.dark .slack { border-left-color: #35373b; }
+.dark .slack .site, .dark .slack .description { color: #d1d2d3; }
+.dark .slack .title { color: #1d9bd1; }
+
+.discord { border-left: 4px solid #e3e5e8; border-radius: 4px; padding: 8px 16px 16px 12px; background: #f2f3f5; font-size: 14px; line-height: 18px; }
+.discord .site { font-size: 12px; color: #4e5058; margin-top: 8px; }
+.discord .title { font-size: 16px; font-weight: 600; color: #006ce7; margin-top: 8px; }
+.discord .description { color: #313338; margin-top: 8px; }
+.discord img { margin-top: 16px; border-radius: 4px; max-width: 400px; }
+.dark .discord { background: #2b2d31; border-left-color: #1e1f22; }
+.dark .discord .site { color: #dbdee1; }
+.dark .discord .title { color: #00a8fc; }
+.dark .discord .description { color: #dbdee1; }
+
+.theme { padding: 16px; }
+.theme.light { background: #ffffff; color: #1c1e21; }
+.theme.dark { background: #18191a; color: #e4e6eb; }
+`
+
+// previewTemplates render each platform's card; "card" dispatches on the
+// platform
+const previewTemplates = `
+{{define "card"}}{{if eq .Platform "facebook"}}{{template "facebook" .}}{{else if eq .Platform "x"}}{{template "x" .}}{{else if eq .Platform "linkedin"}}{{template "linkedin" .}}{{else if eq .Platform "slack"}}{{template "slack" .}}{{else}}{{template "discord" .}}{{end}}{{end}}
+
+{{define "facebook"}}<div class="preview facebook" style="width: {{.Width}}px">
+{{if .Image}}<img src="{{.Image}}" alt="" style="{{.ImageStyle}}">{{end}}
+<div class="body"><div class="domain clamp1">{{.Domain}}</div><div class="title clamp2">{{.Title}}</div>{{if .Description}}<div class="description clamp1">{{.Description}}</div>{{end}}</div>
+</div>{{end}}
+
+{{define "x"}}{{if .Summary}}<div class="preview x summary" style="width: {{.Width}}px">
+{{if .Image}}<img src="{{.Image}}" alt="" style="{{.ImageStyle}}">{{end}}
+<div class="body"><div class="domain clamp1">{{.Domain}}</div><div class="title clamp1">{{.Title}}</div><div class="description clamp2">{{.Description}}</div></div>
+</div>{{else}}<div style="width: {{.Width}}px"><div class="preview x">
+{{if .Image}}<img src="{{.Image}}" alt="" style="{{.ImageStyle}}">{{end}}
+<div class="overlay">{{.Title}}</div>
+</div><div class="x-from">From {{.Domain}}</div></div>{{end}}{{end}}
+
+{{define "linkedin"}}<div class="preview linkedin" style="width: {{.Width}}px">
+{{if .Image}}<img src="{{.Image}}" alt="" style="{{.ImageStyle}}">{{end}}
+<div class="body"><div class="title clamp2">{{.Title}}</div><div class="domain clamp1">{{.Domain}}</div></div>
+</div>{{end}}
+
+{{define "slack"}}<div class="preview slack" style="width: {{.Width}}px">
+<div class="site">{{or .SiteName .Domain}}</div><div class="title">{{.Title}}</div>{{if .Description}}<div class="description clamp3">{{.Description}}</div>{{end}}
+{{if .Image}}<img src="{{.Image}}" alt="" style="{{.ImageStyle}}">{{end}}
+</div>{{end}}
+
+{{define "discord"}}<div class="preview discord" style="width: {{.Width}}px">
+{{if .SiteName}}<div class="site">{{.SiteName}}</div>{{end}}<div class="title">{{.Title}}</div>{{if .Description}}<div class="description">{{.Description}}</div>{{end}}
+{{if .Image}}<img src="{{.Image}}" alt="" style="{{.ImageStyle}}">{{end}}
+</div>{{end}}
+
+{{define "single"}}<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="UTF-8"><style>body { margin: 0; }{{.Styles}}</style></head>
+<body><div id="preview" class="theme {{.Card.Theme}}" style="display: inline-block">{{template "card" .Card}}</div></body>
+</html>{{end}}
+
+{{define "gallery"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1.0">
+<title>Link previews for: {{.Title}}</title>
+<style>body { margin: 0; font-family: sans-serif; } h1 { font-size: 20px; margin: 20px; } h2 { font-size: 16px; margin: 0 0 12px; } .row { display: flex; flex-wrap: wrap; gap: 0; }{{.Styles}}</style>
+</head>
+<body>
+<h1>Link previews for: {{.Title}}</h1>
+{{range .Platforms}}<div class="row">{{range .}}<section class="theme {{.Theme}}"><h2>{{.Label}} ({{.Theme}})</h2>{{template "card" .}}</section>{{end}}</div>
+{{end}}</body>
+</html>{{end}}
+`
+
+var previewTmpl = template.Must(template.New("previews").Parse(previewTemplates))
+
+// previewImageSource returns the URL cards show the image from
+func previewImageSource(data OpenGraphData) template.URL {
+	// Sanitized URLs are http(s) or relative, so they are safe in src
+	return template.URL(sanitizeMetaURL(data.ImageURL))
+}
+
+// generatePreviewGallery renders a page with every platform's preview in
+// the light and dark themes
+func generatePreviewGallery(data OpenGraphData) (string, error) {
+	image := previewImageSource(data)
+
+	var rows [][]previewCard
+	for _, p := range previewPlatforms {
+		var row []previewCard
+		for _, theme := range previewThemes {
+			row = append(row, newPreviewCard(p, theme, data, image))
+		}
+		rows = append(rows, row)
+	}
+
+	var buf bytes.Buffer
+	if err := previewTmpl.ExecuteTemplate(&buf, "gallery", struct {
+		Title     string
+		Styles    template.CSS
+		Platforms [][]previewCard
+	}{data.Title, previewStyles, rows}); err != nil {
+		return "", fmt.Errorf("failed to render preview gallery: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// previewPageHTML renders one card on its own for a screenshot
+func previewPageHTML(card previewCard) (string, error) {
+	var buf bytes.Buffer
+	if err := previewTmpl.ExecuteTemplate(&buf, "single", struct {
+		Styles template.CSS
+		Card   previewCard
+	}{previewStyles, card}); err != nil {
+		return "", fmt.Errorf("failed to render %s preview: %w", card.Platform, err)
+	}
+	return buf.String(), nil
+}
+
+// previewKey names a preview image
+func previewKey(platform, theme string) string {
+	return platform + "_" + theme
+}
+
+// RenderPreviews screenshots every platform's preview in both themes as
+// PNG images keyed by platform_theme. The generated image is embedded so
+// the cards do not depend on it being published yet.
+func (g *Generator) RenderPreviews(ctx context.Context, data OpenGraphData, img []byte, imageType string) (map[string][]byte, error) {
+	data = data.sanitized()
+	image := previewImageSource(data)
+	if len(img) > 0 {
+		image = template.URL("data:" + imageType + ";base64," + base64.StdEncoding.EncodeToString(img))
+	}
+
+	lease, err := g.pool.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("no browser available: %w", err)
+	}
+	defer lease.Release()
+
+	// Only the embedded image may be loaded, so nothing leaves the browser
+	var intercept chromedp.Action = chromedp.Tasks{}
+	if g.policy != nil {
+		intercept = newRequestGuard(g.policy, g.logf).enable()
+	}
+
+	previews := make(map[string][]byte)
+	for _, p := range previewPlatforms {
+		for _, theme := range previewThemes {
+			page, err := previewPageHTML(newPreviewCard(p, theme, data, image))
+			if err != nil {
+				return nil, err
+			}
+
+			var shot []byte
+			if err := chromedp.Run(lease.Ctx,
+				intercept,
+				emulation.SetDeviceMetricsOverride(int64(p.Width+64), 900, 2, false),
+				loadHTMLContent(page),
+				waitForAssets(),
+				chromedp.ActionFunc(func(ctx context.Context) error {
+					box, err := locateElement(ctx, "#preview")
+					if err != nil {
+						return err
+					}
+					shot, err = screenshot(FormatPNG, 0).WithCaptureBeyondViewport(true).WithClip(box.viewport()).Do(ctx)
+					return err
+				}),
+			); err != nil {
+				return nil, fmt.Errorf("failed to render %s preview: %w", p.Name, err)
+			}
+			previews[previewKey(p.Name, theme)] = shot
+			intercept = chromedp.Tasks{} // Interception stays enabled for the tab
+		}
+	}
+	return previews, nil
+}
+
+// previewGalleryPath returns where the gallery page is stored next to the
+// meta tags page
+func previewGalleryPath(htmlPath string) string {
+	return strings.TrimSuffix(htmlPath, filepath.Ext(htmlPath)) + "_previews.html"
+}
+
+// previewImagePath returns where a preview image is stored
+func previewImagePath(htmlPath, key string) string {
+	return strings.TrimSuffix(htmlPath, filepath.Ext(htmlPath)) + "_preview_" + key + ".png"
+}
+
+// previewKeys lists every preview image key in gallery order
+func previewKeys() []string {
+	var keys []string
+	for _, p := range previewPlatforms {
+		for _, theme := range previewThemes {
+			keys = append(keys, previewKey(p.Name, theme))
+		}
+	}
+	return keys
+}
+
+// previewImageFiles lists the preview images stored for a generation,
+// keyed by platform_theme
+func previewImageFiles(htmlPath string) map[string]string {
+	files := make(map[string]string)
+	for _, key := range previewKeys() {
+		path := previewImagePath(htmlPath, key)
+		if _, err := os.Stat(path); err == nil {
+			files[key] = path
+		}
+	}
+	return files
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTruncateWords(t *testing.T) {
+	tests := []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"Short title", 70, "Short title"},
+		{"Launch  week:\n five new features", 70, "Launch week: five new features"},
+		{"Launch week: five new features", 20, "Launch week: five…"},
+		{"Supercalifragilistic", 10, "Supercali…"},
+		{"Anything", 0, ""},
+	}
+	for _, tt := range tests {
+		if got := truncateWords(tt.in, tt.n); got != tt.want {
+			t.Errorf("truncateWords(%q, %d) = %q, want %q", tt.in, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestPreviewGallery(t *testing.T) {
+	data := testOpenGraphData
+	data.PageURL = "https://www.example.com/p/1"
+	data.Description = strings.Repeat("word ", 90)
+
+	gallery, err := generatePreviewGallery(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range previewPlatforms {
+		for _, theme := range previewThemes {
+			if !strings.Contains(gallery, p.Label+" ("+theme+")") {
+				t.Errorf("gallery has no %s %s preview", p.Name, theme)
+			}
+		}
+	}
+	if !strings.Contains(gallery, "EXAMPLE.COM") || !strings.Contains(gallery, "From example.com") {
+		t.Error("gallery should show the domain the way each platform does")
+	}
+	if !strings.Contains(gallery, "aspect-ratio: 1.91") || strings.Contains(gallery, "<b>") {
+		t.Errorf("gallery should crop images and escape text:\n%s", gallery)
+	}
+	if strings.Contains(gallery, strings.TrimSpace(data.Description)) {
+		t.Error("long descriptions should be truncated")
+	}
+
+	data.TwitterCard = "summary"
+	data.ImageURL = "javascript:alert(1)"
+	gallery, err = generatePreviewGallery(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(gallery, "preview x summary") || strings.Contains(gallery, "javascript:") {
+		t.Error("summary cards should use the square layout without unsafe image URLs")
+	}
+}
+
+func TestGenerationOutputFiles(t *testing.T) {
+	dir := t.TempDir()
+	htmlPath := filepath.Join(dir, "abc_og_meta.html")
+
+	result := &Result{
+		MetaHTML: "<html></html>",
+		Outputs:  map[string]string{MetaFormatPage: "<html></html>", MetaFormatJSON: "{}"},
+		Gallery:  "<html></html>",
+		Previews: map[string][]byte{"x_dark": []byte("png")},
+	}
+	if err := result.WriteFiles("", htmlPath); err != nil {
+		t.Fatal(err)
+	}
+
+	files := generationOutputFiles(htmlPath)
+	want := []string{
+		htmlPath,
+		filepath.Join(dir, "abc_og_meta_previews.html"),
+		filepath.Join(dir, "abc_og_meta_preview_x_dark.png"),
+	}
+	for _, path := range want {
+		if !containsFold(files, path) {
+			t.Errorf("%s is not listed in %v", path, files)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s was not written: %v", path, err)
+		}
+	}
+	if containsFold(files, filepath.Join(dir, "abc_og_meta_preview_x_light.png")) {
+		t.Error("previews that were not rendered should not be listed")
+	}
+}
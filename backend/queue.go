@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrQueueFull is returned when the queue has no room for another job
+var ErrQueueFull = errors.New("generation queue is full")
+
+// ErrQueueStopped is returned when submitting to a stopped queue
+var ErrQueueStopped = errors.New("generation queue is stopped")
+
+// Initial guess for how long a job takes, used until real jobs have finished
+const defaultJobDuration = 10 * time.Second
+
+// Job is a generation waiting for or being processed by a queue worker
+type Job struct {
+	ID         string
+	Params     GenerationParameters
+	ImagePath  string
+	HTMLPath   string
+	EnqueuedAt time.Time
+
+	// Task, when set, runs instead of the queue's handler, so other browser
+	// work such as loading a page to validate shares the workers
+	Task func(ctx context.Context) (*Result, error)
+
+	mu         sync.Mutex
+	startedAt  time.Time
+	finishedAt time.Time
+	result     *Result
+	err        error
+	done       chan struct{}
+}
+
+// NewJob creates a job for the given generation
+func NewJob(id string, params GenerationParameters, imagePath, htmlPath string) *Job {
+	return &Job{
+		ID:        id,
+		Params:    params,
+		ImagePath: imagePath,
+		HTMLPath:  htmlPath,
+		done:      make(chan struct{}),
+	}
+}
+
+// Done is closed once the job has finished, successfully or not
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Result returns the outcome of a finished job
+func (j *Job) Result() (*Result, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.result, j.err
+}
+
+// fail finishes a job that never reached a worker
+func (j *Job) fail(err error) {
+	j.mu.Lock()
+	j.err = err
+	j.mu.Unlock()
+	close(j.done)
+}
+
+// JobHandler processes a single job. The context carries the job timeout.
+type JobHandler func(ctx context.Context, job *Job) (*Result, error)
+
+// JobStatus describes where a job currently is in the queue
+type JobStatus struct {
+	State                string  `json:"state"`              // queued or running
+	Position             int     `json:"position,omitempty"` // 1-based position among queued jobs
+	WaitSeconds          float64 `json:"wait_seconds"`       // Time spent waiting so far
+	EstimatedWaitSeconds float64 `json:"estimated_wait_seconds,omitempty"`
+}
+
+// QueueStats reports the state of a JobQueue
+type QueueStats struct {
+	Workers              int     `json:"workers"`
+	Capacity             int     `json:"capacity"`
+	Queued               int     `json:"queued"`
+	Running              int     `json:"running"`
+	Completed            int64   `json:"completed"`
+	Failed               int64   `json:"failed"`
+	Rejected             int64   `json:"rejected"`
+	AverageDurationSecs  float64 `json:"average_duration_seconds"`
+	EstimatedWaitSeconds float64 `json:"estimated_wait_seconds"`
+}
+
+// JobQueue runs jobs on a fixed number of workers and holds at most
+// depth jobs waiting for a worker
+type JobQueue struct {
+	handler JobHandler
+	timeout time.Duration
+	workers int
+	depth   int
+	jobs    chan *Job
+
+	mu          sync.Mutex
+	pending     []*Job
+	running     map[string]*Job
+	avgDuration time.Duration
+	completed   int64
+	failed      int64
+	rejected    int64
+	stopped     bool
+
+	wg sync.WaitGroup
+}
+
+// NewJobQueue creates a queue. Each job gets timeout to run; call Start
+// to launch the workers.
+func NewJobQueue(workers, depth int, timeout time.Duration, handler JobHandler) *JobQueue {
+	if workers <= 0 {
+		workers = 1
+	}
+	if depth <= 0 {
+		depth = 1
+	}
+
+	return &JobQueue{
+		handler:     handler,
+		timeout:     timeout,
+		workers:     workers,
+		depth:       depth,
+		jobs:        make(chan *Job, depth),
+		running:     make(map[string]*Job),
+		avgDuration: defaultJobDuration,
+	}
+}
+
+// Start launches the worker goroutines
+func (q *JobQueue) Start() {
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+}
+
+// Stop stops accepting jobs and waits for queued and running jobs to finish
+func (q *JobQueue) Stop() {
+	q.mu.Lock()
+	if q.stopped {
+		q.mu.Unlock()
+		return
+	}
+	q.stopped = true
+	close(q.jobs)
+	q.mu.Unlock()
+
+	q.wg.Wait()
+}
+
+// Submit adds a job to the queue, failing with ErrQueueFull when the
+// queue is already at capacity
+func (q *JobQueue) Submit(job *Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.stopped {
+		return ErrQueueStopped
+	}
+	if len(q.pending) >= q.depth {
+		q.rejected++
+		return ErrQueueFull
+	}
+
+	job.EnqueuedAt = time.Now()
+	q.pending = append(q.pending, job)
+
+	// Never blocks: the channel is as large as the pending limit
+	q.jobs <- job
+	return nil
+}
+
+// Status reports the queue state of a job, or false once it has finished
+// or if the queue never saw it
+func (q *JobQueue) Status(id string) (JobStatus, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if job, ok := q.running[id]; ok {
+		job.mu.Lock()
+		waited := job.startedAt.Sub(job.EnqueuedAt)
+		job.mu.Unlock()
+		return JobStatus{State: "running", WaitSeconds: waited.Seconds()}, true
+	}
+
+	for i, job := range q.pending {
+		if job.ID == id {
+			return JobStatus{
+				State:                "queued",
+				Position:             i + 1,
+				WaitSeconds:          time.Since(job.EnqueuedAt).Seconds(),
+				EstimatedWaitSeconds: q.estimateWaitLocked(i).Seconds(),
+			}, true
+		}
+	}
+
+	return JobStatus{}, false
+}
+
+// RetryAfter estimates how long until the queue has room again
+func (q *JobQueue) RetryAfter() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// A slot frees up once a worker picks up the job at the head of the queue
+	wait := q.estimateWaitLocked(0)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait
+}
+
+// Stats returns a snapshot of the queue counters
+func (q *JobQueue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return QueueStats{
+		Workers:              q.workers,
+		Capacity:             q.depth,
+		Queued:               len(q.pending),
+		Running:              len(q.running),
+		Completed:            q.completed,
+		Failed:               q.failed,
+		Rejected:             q.rejected,
+		AverageDurationSecs:  q.avgDuration.Seconds(),
+		EstimatedWaitSeconds: q.estimateWaitLocked(len(q.pending)).Seconds(),
+	}
+}
+
+// estimateWaitLocked estimates how long a job with index position in the
+// pending list waits for a worker. Callers must hold q.mu.
+func (q *JobQueue) estimateWaitLocked(position int) time.Duration {
+	// Jobs that have to free a worker before this one can start
+	ahead := len(q.running) + position
+	if ahead < q.workers {
+		return 0
+	}
+	rounds := (ahead-q.workers)/q.workers + 1
+	return time.Duration(rounds) * q.avgDuration
+}
+
+// worker processes jobs until the queue is stopped
+func (q *JobQueue) worker() {
+	defer q.wg.Done()
+
+	for job := range q.jobs {
+		q.markRunning(job)
+
+		ctx, cancel := context.WithTimeout(context.Background(), q.timeout)
+		result, err := q.runJob(ctx, job)
+		cancel()
+
+		q.markFinished(job, result, err)
+	}
+}
+
+// runJob calls the handler, turning a panic into an error
+func (q *JobQueue) runJob(ctx context.Context, job *Job) (result *Result, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("generator panicked: %v", r)
+			CaptureMessage("Generation job panicked")
+		}
+	}()
+
+	if job.Task != nil {
+		return job.Task(ctx)
+	}
+	return q.handler(ctx, job)
+}
+
+// markRunning moves a job from the pending list to the running set
+func (q *JobQueue) markRunning(job *Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, pending := range q.pending {
+		if pending == job {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			break
+		}
+	}
+	q.running[job.ID] = job
+
+	job.mu.Lock()
+	job.startedAt = time.Now()
+	job.mu.Unlock()
+}
+
+// markFinished records the job outcome and wakes up anyone waiting on it
+func (q *JobQueue) markFinished(job *Job, result *Result, err error) {
+	job.mu.Lock()
+	job.finishedAt = time.Now()
+	job.result = result
+	job.err = err
+	duration := job.finishedAt.Sub(job.startedAt)
+	job.mu.Unlock()
+
+	q.mu.Lock()
+	delete(q.running, job.ID)
+	if err != nil {
+		q.failed++
+	} else {
+		q.completed++
+	}
+	// Exponentially weighted moving average of job durations
+	q.avgDuration = (q.avgDuration*4 + duration) / 5
+	q.mu.Unlock()
+
+	close(job.done)
+}
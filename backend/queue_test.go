@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestJobQueueRejectsWhenFull tests that the queue enforces its depth
+func TestJobQueueRejectsWhenFull(t *testing.T) {
+	release := make(chan struct{})
+	handler := func(ctx context.Context, job *Job) (*Result, error) {
+		<-release
+		return &Result{}, nil
+	}
+
+	queue := NewJobQueue(1, 2, time.Minute, handler)
+	queue.Start()
+	defer queue.Stop()
+	defer close(release)
+
+	// The first job occupies the worker, the next two fill the queue
+	first := NewJob("job-1", GenerationParameters{}, "", "")
+	if err := queue.Submit(first); err != nil {
+		t.Fatalf("Submit returned error: %v", err)
+	}
+	waitForState(t, queue, "job-1", "running")
+
+	for i := 2; i <= 3; i++ {
+		if err := queue.Submit(NewJob(fmt.Sprintf("job-%d", i), GenerationParameters{}, "", "")); err != nil {
+			t.Fatalf("Submit of job-%d returned error: %v", i, err)
+		}
+	}
+
+	if err := queue.Submit(NewJob("job-4", GenerationParameters{}, "", "")); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Expected ErrQueueFull, got %v", err)
+	}
+
+	status, ok := queue.Status("job-3")
+	if !ok || status.State != "queued" || status.Position != 2 {
+		t.Errorf("Expected job-3 queued at position 2, got %+v (found=%v)", status, ok)
+	}
+	if status.EstimatedWaitSeconds <= 0 {
+		t.Errorf("Expected a positive wait estimate, got %v", status.EstimatedWaitSeconds)
+	}
+	if queue.RetryAfter() < time.Second {
+		t.Errorf("Expected Retry-After of at least a second, got %v", queue.RetryAfter())
+	}
+
+	stats := queue.Stats()
+	if stats.Queued != 2 || stats.Running != 1 || stats.Rejected != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+// TestJobQueueResults tests that results and errors reach the submitter
+func TestJobQueueResults(t *testing.T) {
+	handler := func(ctx context.Context, job *Job) (*Result, error) {
+		if job.ID == "bad" {
+			return nil, errors.New("render failed")
+		}
+		if job.ID == "panic" {
+			panic("boom")
+		}
+		return &Result{MetaHTML: job.ID}, nil
+	}
+
+	queue := NewJobQueue(2, 5, time.Minute, handler)
+	queue.Start()
+	defer queue.Stop()
+
+	good := NewJob("good", GenerationParameters{}, "", "")
+	bad := NewJob("bad", GenerationParameters{}, "", "")
+	panicking := NewJob("panic", GenerationParameters{}, "", "")
+	task := NewJob("task", GenerationParameters{}, "", "")
+	task.Task = func(ctx context.Context) (*Result, error) {
+		return &Result{MetaHTML: "from task"}, nil
+	}
+	for _, job := range []*Job{good, bad, panicking, task} {
+		if err := queue.Submit(job); err != nil {
+			t.Fatalf("Submit returned error: %v", err)
+		}
+	}
+
+	for _, job := range []*Job{good, bad, panicking, task} {
+		select {
+		case <-job.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Job %s did not finish", job.ID)
+		}
+	}
+
+	if result, err := good.Result(); err != nil || result.MetaHTML != "good" {
+		t.Errorf("Unexpected result for good job: %v, %v", result, err)
+	}
+	if _, err := bad.Result(); err == nil {
+		t.Errorf("Expected an error for bad job")
+	}
+	if _, err := panicking.Result(); err == nil {
+		t.Errorf("Expected a panic to be turned into an error")
+	}
+	if result, err := task.Result(); err != nil || result.MetaHTML != "from task" {
+		t.Errorf("Expected the job's own task to run, got %v, %v", result, err)
+	}
+	if _, ok := queue.Status("good"); ok {
+		t.Errorf("Finished jobs should no longer have a queue status")
+	}
+}
+
+// waitForState polls until a job reaches the given queue state
+func waitForState(t *testing.T, queue *JobQueue, id, state string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if status, ok := queue.Status(id); ok && status.State == state {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Job %s never reached state %s", id, state)
+}
@@ -1,171 +1,63 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
+	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
-	"text/template"
 	"time"
 
-	"github.com/chromedp/chromedp"
 	"github.com/getsentry/sentry-go"
 )
 
 // Database instance
 var serverDB *Database
 
-// OpenGraphData represents the data needed for Open Graph meta tags
-type OpenGraphData struct {
-	Title       string
-	Description string
-	ImageURL    string
-	PageURL     string
-	Type        string
-	SiteName    string
-	ImageWidth  int
-	ImageHeight int
-	TwitterCard string
-	LocalImage  bool // If true, ImageURL is a local path
-}
-
 // Default values
 const (
 	defaultImageWidth  = 1200
 	defaultImageHeight = 630
 	defaultType        = "website"
 	defaultTwitterCard = "summary_large_image"
+	defaultQuality     = 90
+	defaultWaitTime    = 8000
+	defaultSelector    = "body"
 )
 
-// generateMetaTags creates HTML with Open Graph meta tags
-func generateMetaTags(data OpenGraphData) string {
-	metaTemplate := `<!DOCTYPE html>
-<html lang="en">
-<head>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>{{.Title}}</title>
-
-    <!-- Open Graph / Facebook -->
-    <meta property="og:type" content="{{.Type}}">
-    <meta property="og:url" content="{{.PageURL}}">
-    <meta property="og:title" content="{{.Title}}">
-    <meta property="og:description" content="{{.Description}}">
-    <meta property="og:image" content="{{.ImageURL}}">
-    {{if .SiteName}}<meta property="og:site_name" content="{{.SiteName}}">{{end}}
-    <meta property="og:image:width" content="{{.ImageWidth}}">
-    <meta property="og:image:height" content="{{.ImageHeight}}">
-
-    <!-- Twitter -->
-    <meta name="twitter:card" content="{{.TwitterCard}}">
-    <meta name="twitter:url" content="{{.PageURL}}">
-    <meta name="twitter:title" content="{{.Title}}">
-    <meta name="twitter:description" content="{{.Description}}">
-    <meta name="twitter:image" content="{{.ImageURL}}">
-
-    <!-- LinkedIn -->
-    <meta name="linkedin:title" content="{{.Title}}">
-    <meta name="linkedin:description" content="{{.Description}}">
-    <meta name="linkedin:image" content="{{.ImageURL}}">
-
-    <!-- Additional helpful meta tags -->
-    <meta name="description" content="{{.Description}}">
-</head>
-<body>
-    <h1>Open Graph Preview for: {{.Title}}</h1>
-    <p>This page contains the Open Graph meta tags for your content.</p>
-
-    <div style="margin: 20px 0;">
-        <h2>Preview:</h2>
-        <div style="border: 1px solid #ccc; border-radius: 8px; overflow: hidden; max-width: 600px;">
-            <img src="{{.ImageURL}}" style="width: 100%; height: auto;" alt="Open Graph preview image">
-            <div style="padding: 15px;">
-                <h3 style="margin: 0 0 10px; font-size: 18px;">{{.Title}}</h3>
-                <p style="margin: 0; color: #666; font-size: 14px;">{{.Description}}</p>
-                <p style="margin: 5px 0 0; color: #999; font-size: 12px;">{{.PageURL}}</p>
-            </div>
-        </div>
-    </div>
-
-    <div style="margin: 30px 0;">
-        <h2>HTML Code:</h2>
-        <pre style="background: #f4f4f4; padding: 15px; border-radius: 5px; overflow: auto;"><code>
-&lt;!-- Open Graph / Facebook --&gt;
-&lt;meta property="og:type" content="{{.Type}}"&gt;
-&lt;meta property="og:url" content="{{.PageURL}}"&gt;
-&lt;meta property="og:title" content="{{.Title}}"&gt;
-&lt;meta property="og:description" content="{{.Description}}"&gt;
-&lt;meta property="og:image" content="{{.ImageURL}}"&gt;
-{{if .SiteName}}&lt;meta property="og:site_name" content="{{.SiteName}}"&gt;{{end}}
-&lt;meta property="og:image:width" content="{{.ImageWidth}}"&gt;
-&lt;meta property="og:image:height" content="{{.ImageHeight}}"&gt;
-
-&lt;!-- Twitter --&gt;
-&lt;meta name="twitter:card" content="{{.TwitterCard}}"&gt;
-&lt;meta name="twitter:url" content="{{.PageURL}}"&gt;
-&lt;meta name="twitter:title" content="{{.Title}}"&gt;
-&lt;meta name="twitter:description" content="{{.Description}}"&gt;
-&lt;meta name="twitter:image" content="{{.ImageURL}}"&gt;
-
-&lt;!-- LinkedIn --&gt;
-&lt;meta name="linkedin:title" content="{{.Title}}"&gt;
-&lt;meta name="linkedin:description" content="{{.Description}}"&gt;
-&lt;meta name="linkedin:image" content="{{.ImageURL}}"&gt;
-        </code></pre>
-    </div>
-</body>
-</html>`
-
-	tmpl, err := template.New("metatags").Parse(metaTemplate)
+// startLocalServer serves the meta tags page at / and the files in the
+// image's directory next to it. It returns the server and its URL.
+func startLocalServer(htmlContent string, imagePath string, port string) (*http.Server, string, error) {
+	listener, err := net.Listen("tcp", ":"+port)
 	if err != nil {
-		log.Fatalf("Error parsing template: %v", err)
-	}
-
-	var buf bytes.Buffer
-	if err := tmpl.Execute(&buf, data); err != nil {
-		log.Fatalf("Error executing template: %v", err)
+		return nil, "", fmt.Errorf("failed to start preview server: %w", err)
 	}
 
-	return buf.String()
-}
-
-// startLocalServer starts a local HTTP server to serve the HTML and image
-func startLocalServer(htmlContent string, imagePath string, port string) string {
-	serverURL := fmt.Sprintf("http://localhost:%s", port)
-
-	// Create a file server handler
-	fs := http.FileServer(http.Dir("."))
-
-	// Define handlers
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	files := http.FileServer(http.Dir(filepath.Dir(imagePath)))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/" {
 			w.Header().Set("Content-Type", "text/html")
 			w.Write([]byte(htmlContent))
 			return
 		}
 		// Serve other requests through the file server
-		fs.ServeHTTP(w, r)
+		files.ServeHTTP(w, r)
 	})
 
-	// Start the server in a goroutine
+	server := &http.Server{Handler: mux}
 	go func() {
-		fmt.Printf("Starting local server at %s\n", serverURL)
-		if err := http.ListenAndServe(":"+port, nil); err != nil {
-			log.Fatalf("Error starting server: %v", err)
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Preview server stopped: %v", err)
 		}
 	}()
-
-	// Wait a moment for the server to start
-	time.Sleep(500 * time.Millisecond)
-
-	return serverURL
+	return server, fmt.Sprintf("http://localhost:%s", port), nil
 }
 
 // startCleanupScheduler initiates a goroutine that periodically runs the database cleanup job
@@ -179,7 +71,7 @@ func startCleanupScheduler(db *Database, interval time.Duration) {
 
 	go func() {
 		// Run immediately on startup
-		if err := db.RunCleanup(); err != nil {
+		if _, err := db.RunCleanup(); err != nil {
 			log.Printf("Error during initial cleanup: %v", err)
 		} else {
 			log.Printf("Initial cleanup completed successfully")
@@ -193,7 +85,7 @@ func startCleanupScheduler(db *Database, interval time.Duration) {
 			select {
 			case <-ticker.C:
 				log.Printf("Running scheduled cleanup...")
-				if err := db.RunCleanup(); err != nil {
+				if _, err := db.RunCleanup(); err != nil {
 					log.Printf("Error during scheduled cleanup: %v", err)
 				} else {
 					log.Printf("Scheduled cleanup completed successfully")
@@ -233,471 +125,340 @@ func initService() {
 	startCleanupScheduler(serverDB, 1*time.Hour)
 }
 
-// ServerMain is the entry point for the OG generator functionality
-func ServerMain() {
-	// First check if API service mode is active
-	isAPIService := false
-	// Check command line args for service flag
-	for _, arg := range os.Args {
-		if arg == "-api-service" || arg == "-api-service=true" {
-			isAPIService = true
-			break
-		}
-	}
-	// Also check environment variable
-	if os.Getenv("OG_API_SERVICE") == "true" {
-		isAPIService = true
-	}
-
-	// Create a new FlagSet and define all the flags
-	fs := flag.NewFlagSet("og-generator", flag.ContinueOnError)
-	fs.SetOutput(ioutil.Discard) // Suppress error output
+// cliGeneration is a generation requested on the command line
+type cliGeneration struct {
+	Params    GenerationParameters
+	ImagePath string // Absolute path the image is written to
+	HTMLPath  string // Absolute path the meta tags page is written to
+	Timeout   time.Duration
+}
 
-	// Define all flags
+// generateFlags defines the flags of generate and preview on fs. The
+// returned function builds the generation once fs is parsed; preview
+// points og:image at the local preview server.
+func generateFlags(fs *flag.FlagSet) func(preview bool) (cliGeneration, error) {
 	webpageURL := fs.String("url", "", "Webpage URL to capture")
 	outputPath := fs.String("output", "outputs/og_image.png", "Output file path for the screenshot")
 	outputHTML := fs.String("html", "outputs/og_meta.html", "Output file for HTML with meta tags")
-	quality := fs.Int("quality", 90, "Screenshot quality (0-100)")
-	waitTime := fs.Int("wait", 8000, "Wait time in milliseconds before taking screenshot")
-	selector := fs.String("selector", "body", "CSS selector to wait for before capturing")
+	quality := fs.Int("quality", defaultQuality, "Screenshot quality for jpeg and webp (0-100)")
+	format := fs.String("format", "", "Image format: png, jpeg or webp (default png at quality 100, jpeg otherwise)")
+	waitTime := fs.Int("wait", defaultWaitTime, "Wait time in milliseconds before taking screenshot")
+	selector := fs.String("selector", defaultSelector, "CSS selector to wait for before capturing")
+	timeout := fs.Duration("timeout", 45*time.Second, "Time allowed for the whole generation")
 	debug := fs.Bool("debug", false, "Enable debug mode with additional logging")
 	verbose := fs.Bool("verbose", false, "Enable verbose logging")
 	title := fs.String("title", "", "Title for Open Graph meta tags")
 	description := fs.String("description", "", "Description for Open Graph meta tags")
-	ogType := fs.String("type", defaultType, "Type for Open Graph meta tags")
+	ogType := fs.String("type", "", "Type for Open Graph meta tags (default website, or the page's with -enrich)")
 	siteName := fs.String("site", "", "Site name for Open Graph meta tags")
 	targetURL := fs.String("target-url", "", "Target URL for the content (where it will be hosted)")
 	imgWidth := fs.Int("width", defaultImageWidth, "Width of the Open Graph image")
 	imgHeight := fs.Int("height", defaultImageHeight, "Height of the Open Graph image")
 	twitterCard := fs.String("twitter-card", defaultTwitterCard, "Twitter card type")
-	preview := fs.Bool("preview", false, "Start a local server to preview the Open Graph implementation")
-	port := fs.String("port", "8080", "Port for the preview server")
-	isApiService := fs.Bool("api-service", isAPIService, "Set to true when running as part of the API service")
-
-	// Parse the command line arguments
-	_ = fs.Parse(os.Args[1:])
-
-	if *verbose {
-		log.Printf("Command-line arguments: %v", os.Args)
-		log.Printf("Output paths: image=%s, html=%s", *outputPath, *outputHTML)
-		log.Printf("Key parameters: url=%s, title=%s, api-service=%v", *webpageURL, *title, *isApiService)
-	}
-
-	// Check for required inputs - but don't exit, just log the error
-	if *webpageURL == "" && *title == "" {
-		log.Printf("Warning: Neither a webpage URL (-url) nor a title (-title) was provided for Open Graph content.")
-		// Use defaults instead of exiting
-		*title = "Generated Open Graph Content"
-	}
-
-	// Create absolute path for output files
-	absOutputPath, err := filepath.Abs(*outputPath)
-	if err != nil {
-		log.Printf("Error creating absolute path: %v", err)
-		return
-	}
-
-	absHTMLPath, err := filepath.Abs(*outputHTML)
-	if err != nil {
-		log.Printf("Error creating absolute path: %v", err)
-		return
-	}
-
-	// Ensure parent directory exists for each output file
-	outputDir := filepath.Dir(absOutputPath)
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		log.Printf("Error creating output directory for image: %v", err)
-		return
-	}
-
-	htmlDir := filepath.Dir(absHTMLPath)
-	if htmlDir != outputDir {
-		if err := os.MkdirAll(htmlDir, 0755); err != nil {
-			log.Printf("Error creating output directory for HTML: %v", err)
-			return
+	scale := fs.Float64("scale", 1, "Device scale factor, 2 for retina output")
+	captureMode := fs.String("capture", CaptureModeViewport, "Capture mode: viewport, fullpage or element")
+	captureSelector := fs.String("capture-selector", "", "CSS selector of the element to screenshot, scaled into the image size")
+	capturePadding := fs.Int("capture-padding", 0, "Padding in pixels around the capture-selector element")
+	captureBackground := fs.String("capture-background", defaultCaptureBackground, "Background fill around the capture-selector element")
+	fit := fs.String("fit", "", "Resize the capture to the image size: cover (crop) or contain (letterbox)")
+	background := fs.String("background", "", "Letterbox fill, also used behind rounded corners in jpeg output")
+	cornerRadius := fs.Int("corner-radius", 0, "Round the image corners by this many pixels")
+	borderWidth := fs.Int("border-width", 0, "Border width in pixels")
+	borderColor := fs.String("border-color", "", "Border color (default #000000)")
+	watermarkURL := fs.String("watermark-url", "", "http(s) or data: URL of a logo to overlay")
+	watermarkPosition := fs.String("watermark-position", PositionBottomRight, "Logo position: top-left, top-right, bottom-left, bottom-right or center")
+	watermarkSize := fs.Float64("watermark-size", 0, "Logo width as a fraction of the image width (default 0.15)")
+	watermarkOpacity := fs.Float64("watermark-opacity", 0, "Logo opacity from 0 to 1 (default 1)")
+	optimize := fs.Bool("optimize", false, "Losslessly optimize png output")
+	cardTemplate := fs.String("template", defaultCardTemplate, "Card template rendered when no -url is given")
+	logoURL := fs.String("logo", "", "Logo URL shown on the card template")
+	backgroundColor := fs.String("background-color", "", "Card background color")
+	textColor := fs.String("text-color", "", "Card text color")
+	accentColor := fs.String("accent-color", "", "Card accent color")
+	titleMinFontSize := fs.Int("title-min-font-size", 0, "Smallest size the card title may shrink to, 0 for the template's")
+	titleMaxFontSize := fs.Int("title-max-font-size", 0, "Largest size for the card title, 0 for the template's")
+	platformPreviews := fs.Bool("platform-previews", false, "Render each platform's link preview as PNG images")
+	enrich := fs.Bool("enrich", false, "Fill every unset tag from the page's own metadata")
+
+	return func(preview bool) (cliGeneration, error) {
+		imageFormat, err := resolveImageFormat(*format, *quality)
+		if err != nil {
+			return cliGeneration{}, &usageError{err.Error()}
 		}
-	}
-
-	// Log the paths we're using
-	log.Printf("Using output paths: Image=%s, HTML=%s", absOutputPath, absHTMLPath)
 
-	// Initialize the database
-	serverDB, err := InitDB()
-	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
-	}
-	// Don't close the database connection here as we need it for ongoing operations
-	// and the goroutines that run concurrently for image generation
-	// defer serverDB.CloseDB()
-
-	// Start the cleanup scheduler to run every hour
-	startCleanupScheduler(serverDB, 1*time.Hour)
-
-	// Generate image if a URL is provided
-	if *webpageURL != "" {
-		// Fix common URL issues
-		fixedURL := *webpageURL
-		// Handle double protocol issue (like https://www://example.com)
-		if strings.Contains(fixedURL, "://") && strings.Count(fixedURL, "://") > 1 {
-			parts := strings.SplitN(fixedURL, "://", 2)
-			if len(parts) >= 2 {
-				secondPart := parts[1]
-				if strings.HasPrefix(secondPart, "www://") {
-					secondPart = strings.Replace(secondPart, "www://", "www.", 1)
-				}
-				fixedURL = parts[0] + "://" + secondPart
+		// Give the default output file the extension of the chosen format
+		outputSet := false
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name == "output" {
+				outputSet = true
 			}
+		})
+		if !outputSet {
+			*outputPath = "outputs/og_image" + imageExtension(imageFormat)
 		}
 
-		// Add http:// prefix if no protocol is present
-		if !strings.Contains(fixedURL, "://") {
-			fixedURL = "http://" + fixedURL
-			if *verbose {
-				log.Printf("Added http:// prefix to URL: %s", fixedURL)
-			}
+		if *verbose {
+			log.Printf("Output paths: image=%s, html=%s", *outputPath, *outputHTML)
+			log.Printf("Key parameters: url=%s, title=%s", *webpageURL, *title)
 		}
 
-		// Verify URL is valid
-		_, err := url.Parse(fixedURL)
-		if err != nil {
-			log.Printf("Invalid URL: %s\nError: %v\n", fixedURL, err)
-			// Return early instead of exiting
-			return
+		// Without a page or a title there is nothing to describe, so the
+		// card gets a placeholder title
+		if *webpageURL == "" && *title == "" {
+			log.Printf("Warning: Neither a webpage URL (-url) nor a title (-title) was provided for Open Graph content.")
+			*title = "Generated Open Graph Content"
 		}
 
-		if *verbose {
-			fmt.Printf("Using URL: %s\n", fixedURL)
+		gen := cliGeneration{Timeout: *timeout}
+		if gen.ImagePath, err = filepath.Abs(*outputPath); err != nil {
+			return cliGeneration{}, err
 		}
-
-		// Create a Chrome context with options for better rendering
-		opts := append(chromedp.DefaultExecAllocatorOptions[:],
-			chromedp.Flag("disable-web-security", true),
-			chromedp.Flag("disable-background-networking", false),
-			chromedp.Flag("enable-features", "NetworkService,NetworkServiceInProcess"),
-			chromedp.Flag("disable-background-timer-throttling", true),
-			chromedp.Flag("disable-backgrounding-occluded-windows", true),
-			chromedp.Flag("disable-breakpad", true),
-			chromedp.Flag("disable-client-side-phishing-detection", true),
-			chromedp.Flag("disable-default-apps", true),
-			chromedp.Flag("disable-dev-shm-usage", true),
-			chromedp.Flag("disable-extensions", true),
-			chromedp.Flag("disable-features", "site-per-process,TranslateUI,BlinkGenPropertyTrees"),
-			chromedp.Flag("disable-hang-monitor", true),
-			chromedp.Flag("disable-ipc-flooding-protection", true),
-			chromedp.Flag("disable-popup-blocking", true),
-			chromedp.Flag("disable-prompt-on-repost", true),
-			chromedp.Flag("disable-renderer-backgrounding", true),
-			chromedp.Flag("disable-sync", true),
-			chromedp.Flag("force-color-profile", "srgb"),
-			chromedp.Flag("metrics-recording-only", true),
-			chromedp.Flag("safebrowsing-disable-auto-update", true),
-			chromedp.Flag("enable-automation", true),
-			chromedp.Flag("password-store", "basic"),
-			chromedp.Flag("use-mock-keychain", true),
-			// Additional rendering optimization flags
-			chromedp.Flag("disable-accelerated-2d-canvas", false),
-			chromedp.Flag("enable-gpu-rasterization", true),
-			chromedp.Flag("disable-gpu-vsync", true),
-			// Enhanced SSL error handling
-			chromedp.Flag("ignore-certificate-errors", true),
-			chromedp.Flag("allow-insecure-localhost", true),
-			chromedp.Flag("allow-running-insecure-content", true),
-			chromedp.UserAgent("Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.110 Safari/537.36"),
-		)
-
-		allocCtx, cancel := chromedp.NewExecAllocator(context.Background(), opts...)
-		defer cancel()
-
-		// Set up logging options
-		logOpts := []chromedp.ContextOption{chromedp.WithLogf(log.Printf)}
-		if *verbose {
-			// Add more verbose logging if requested
-			logOpts = append(logOpts, chromedp.WithDebugf(log.Printf))
+		if gen.HTMLPath, err = filepath.Abs(*outputHTML); err != nil {
+			return cliGeneration{}, err
 		}
 
-		// Create a Chrome context
-		ctx, cancel := chromedp.NewContext(allocCtx, logOpts...)
-		defer cancel()
-
-		// Set a generous timeout
-		ctx, cancel = context.WithTimeout(ctx, 45*time.Second)
-		defer cancel()
-
-		// Capture screenshot
-		var buf []byte
-		var htmlContent string
-
-		fmt.Printf("Navigating to %s and waiting for content to load...\n", fixedURL)
-
-		if err := chromedp.Run(ctx,
-			// Navigate to the URL
-			chromedp.Navigate(fixedURL),
-
-			// Wait for the specified selector to be visible
-			chromedp.WaitVisible(*selector, chromedp.ByQuery),
-
-			// Wait for document to be ready
-			chromedp.ActionFunc(func(ctx context.Context) error {
-				err := chromedp.Evaluate(`
-					new Promise((resolve) => {
-						if (document.readyState === 'complete') {
-							resolve();
-						} else {
-							window.addEventListener('load', resolve);
-						}
-					})
-				`, nil).Do(ctx)
-				return err
-			}),
-
-			// Ensure text elements are visible by forcing display properties
-			chromedp.ActionFunc(func(ctx context.Context) error {
-				script := `
-					new Promise((resolve) => {
-						// Force all elements to be visible
-						const textElements = document.querySelectorAll('p, h1, h2, h3, h4, h5, h6, span, div, a, button, input, textarea, label');
-
-						textElements.forEach(el => {
-							// Check if element or its ancestors might have text content
-							if (el.textContent && el.textContent.trim() !== '') {
-								// Check computed style
-								const style = window.getComputedStyle(el);
-								if (style.display === 'none') {
-									console.log('Forcing display for element:', el);
-									el.style.setProperty('display', 'block', 'important');
-								}
-								if (style.visibility === 'hidden') {
-									console.log('Forcing visibility for element:', el);
-									el.style.setProperty('visibility', 'visible', 'important');
-								}
-								if (parseFloat(style.opacity) === 0) {
-									console.log('Forcing opacity for element:', el);
-									el.style.setProperty('opacity', '1', 'important');
-								}
-							}
-						});
-
-						// Force all potential text-containing elements to render
-						document.querySelectorAll('[style*="display:none"], [style*="display: none"]').forEach(el => {
-							if (el.textContent && el.textContent.trim() !== '') {
-								el.style.setProperty('display', 'block', 'important');
-							}
-						});
-
-						// Allow a bit of time for changes to take effect
-						setTimeout(resolve, 500);
-					})
-				`
-				return chromedp.Evaluate(script, nil).Do(ctx)
-			}),
-
-			// Simulate user scrolling to trigger lazy-loaded content
-			chromedp.ActionFunc(func(ctx context.Context) error {
-				script := `
-					new Promise((resolve) => {
-						// Simulate scrolling to trigger any lazy-loaded content
-						const scrollHeight = Math.max(
-							document.body.scrollHeight, document.documentElement.scrollHeight,
-							document.body.offsetHeight, document.documentElement.offsetHeight,
-							document.body.clientHeight, document.documentElement.clientHeight
-						);
-
-						// Scroll in increments to trigger events
-						const increment = Math.max(window.innerHeight / 2, 200);
-						let currentScroll = 0;
-
-						const scrollInterval = setInterval(() => {
-							window.scrollTo(0, currentScroll);
-							currentScroll += increment;
-
-							if (currentScroll >= scrollHeight) {
-								clearInterval(scrollInterval);
-								// Scroll back to top
-								window.scrollTo(0, 0);
-								resolve();
-							}
-						}, 100);
-					})
-				`
-				return chromedp.Evaluate(script, nil).Do(ctx)
-			}),
-
-			// Simulate hovering on elements to trigger any hover effects
-			chromedp.ActionFunc(func(ctx context.Context) error {
-				script := `
-					new Promise((resolve) => {
-						// Find all interactive elements
-						const elements = document.querySelectorAll('a, button, [role="button"], [tabindex]');
-						elements.forEach(el => {
-							// Dispatch mouseenter and mouseover events
-							el.dispatchEvent(new MouseEvent('mouseenter', {
-								view: window,
-								bubbles: true,
-								cancelable: true
-							}));
-						});
-						resolve();
-					})
-				`
-				return chromedp.Evaluate(script, nil).Do(ctx)
-			}),
-
-			// Additional wait time to ensure all content is fully loaded
-			chromedp.Sleep(time.Duration(*waitTime)*time.Millisecond),
-
-			// Get the HTML content for debugging
-			chromedp.OuterHTML("html", &htmlContent, chromedp.ByQuery),
-
-			// Take the screenshot
-			chromedp.FullScreenshot(&buf, int(*quality)),
-		); err != nil {
-			if strings.Contains(err.Error(), "ERR_SSL_PROTOCOL_ERROR") || strings.Contains(err.Error(), "ERR_CERT") {
-				log.Fatalf("SSL Certificate Error accessing %s: %v\nTry checking if the domain name is correct or if the site has valid SSL.", fixedURL, err)
-			} else {
-				log.Fatalf("Error executing chromedp: %v", err)
+		// Determine where the image will be reachable from
+		imageURL := ""
+		if preview {
+			// The preview server serves the image's directory
+			imageURL = "/" + filepath.Base(gen.ImagePath)
+		} else {
+			imageURL = firstNonEmpty(*targetURL, *webpageURL, "https://example.com/")
+			if !strings.HasSuffix(imageURL, "/") {
+				imageURL += "/"
 			}
+			imageURL += filepath.Base(gen.ImagePath)
 		}
 
-		// Save screenshot to file
-		if err := ioutil.WriteFile(absOutputPath, buf, 0644); err != nil {
-			log.Fatal(err)
+		gen.Params = GenerationParameters{
+			WebpageURL:  *webpageURL,
+			Title:       *title,
+			Description: *description,
+			OgType:      *ogType,
+			SiteName:    *siteName,
+			TargetURL:   *targetURL,
+			TwitterCard: *twitterCard,
+			ImageWidth:  *imgWidth,
+			ImageHeight: *imgHeight,
+			Quality:     *quality,
+			WaitTime:    *waitTime,
+			Selector:    *selector,
+			ImageURL:    imageURL,
+			Debug:       *debug,
+			Verbose:     *verbose,
+
+			DeviceScaleFactor: *scale,
+			CaptureMode:       *captureMode,
+			Format:            imageFormat,
+
+			CaptureSelector:   *captureSelector,
+			CapturePadding:    *capturePadding,
+			CaptureBackground: *captureBackground,
+
+			Template:        *cardTemplate,
+			LogoURL:         *logoURL,
+			BackgroundColor: *backgroundColor,
+			TextColor:       *textColor,
+			AccentColor:     *accentColor,
+
+			TitleMinFontSize: *titleMinFontSize,
+			TitleMaxFontSize: *titleMaxFontSize,
+
+			Previews: *platformPreviews,
+			Enrich:   *enrich,
 		}
 
-		// In debug mode, save the HTML content for inspection
-		if *debug {
-			debugFile := absOutputPath + ".html"
-			if err := ioutil.WriteFile(debugFile, []byte(htmlContent), 0644); err != nil {
-				log.Printf("Warning: Failed to save debug HTML: %v", err)
-			} else {
-				fmt.Printf("Debug HTML saved to %s\n", debugFile)
-			}
+		processing := ImageProcessing{
+			Fit:               *fit,
+			Background:        *background,
+			CornerRadius:      *cornerRadius,
+			BorderWidth:       *borderWidth,
+			BorderColor:       *borderColor,
+			WatermarkURL:      *watermarkURL,
+			WatermarkPosition: *watermarkPosition,
+			WatermarkSize:     *watermarkSize,
+			WatermarkOpacity:  *watermarkOpacity,
+			Optimize:          *optimize,
 		}
-
-		fmt.Printf("Screenshot saved to %s\n", absOutputPath)
-
-		// Try to extract title and description from the page if not provided
-		if *title == "" {
-			var extractedTitle string
-			if err := chromedp.Run(ctx, chromedp.EvaluateAsDevTools(`document.querySelector('title').innerText`, &extractedTitle)); err == nil && extractedTitle != "" {
-				*title = extractedTitle
-				fmt.Printf("Extracted title from page: %s\n", *title)
-			}
+		if processing != (ImageProcessing{WatermarkPosition: PositionBottomRight}) {
+			gen.Params.Processing = &processing
 		}
+		return gen, nil
+	}
+}
 
-		if *description == "" {
-			var extractedDesc string
-			if err := chromedp.Run(ctx, chromedp.EvaluateAsDevTools(`document.querySelector('meta[name="description"]')?.content || document.querySelector('meta[property="og:description"]')?.content || ""`, &extractedDesc)); err == nil && extractedDesc != "" {
-				*description = extractedDesc
-				fmt.Printf("Extracted description from page: %s\n", *description)
-			}
-		}
+// newCLIGenerator creates a generator for a command, with a browser pool
+// of the given size and the fonts in $FONTS_DIR. Close the pool when done.
+func newCLIGenerator(size int) (*Generator, *BrowserPool) {
+	pool := NewBrowserPool(BrowserPoolOptions{Size: size, ChromePath: os.Getenv("CHROME_PATH")})
+	generator := NewGenerator(pool)
+	if registry, err := NewFontRegistry(os.Getenv("FONTS_DIR")); err != nil {
+		log.Printf("Warning: Failed to load fonts: %v", err)
+	} else {
+		generator.SetFontRegistry(registry)
+	}
+	return generator, pool
+}
 
-		if *siteName == "" {
-			var extractedSiteName string
-			if err := chromedp.Run(ctx, chromedp.EvaluateAsDevTools(`document.querySelector('meta[property="og:site_name"]')?.content || document.domain || ""`, &extractedSiteName)); err == nil && extractedSiteName != "" {
-				*siteName = extractedSiteName
-				fmt.Printf("Extracted site name from page: %s\n", *siteName)
-			}
+// generateFiles runs a command-line generation in its own browser and
+// writes the files
+func generateFiles(gen cliGeneration) (*Result, error) {
+	for _, dir := range []string{filepath.Dir(gen.ImagePath), filepath.Dir(gen.HTMLPath)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create output directory: %w", err)
 		}
 	}
+	log.Printf("Using output paths: Image=%s, HTML=%s", gen.ImagePath, gen.HTMLPath)
+
+	ctx, cancel := context.WithTimeout(context.Background(), gen.Timeout)
+	defer cancel()
 
-	// Use default values if fields are still empty
-	if *title == "" {
-		*title = "Open Graph Generated Content"
+	generator, pool := newCLIGenerator(1)
+	result, err := generator.Generate(ctx, gen.Params)
+	pool.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error generating Open Graph assets: %w", err)
 	}
 
-	if *description == "" {
-		*description = "Content shared with Open Graph meta tags"
+	if err := result.WriteFiles(gen.ImagePath, gen.HTMLPath); err != nil {
+		return nil, err
 	}
 
-	// Determine the target URL
-	pageURL := *targetURL
-	if pageURL == "" {
-		if *webpageURL != "" {
-			pageURL = *webpageURL
-		} else {
-			// Use a placeholder if no URL is provided
-			pageURL = "https://example.com/"
+	if gen.Params.Verbose {
+		names := make([]string, 0, len(result.Fields))
+		for name := range result.Fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			log.Printf("Metadata %s from %s: %v", name, result.Fields[name].Source, result.Fields[name].Value)
 		}
 	}
+	return result, nil
+}
 
-	// Determine image URL - check that the image file exists first
-	imageURL := ""
-	_, err = os.Stat(absOutputPath)
-	imageExists := !os.IsNotExist(err)
+// generateSummary is what generate and preview report
+type generateSummary struct {
+	Image      string                   `json:"image,omitempty"` // Empty when no image was produced
+	HTML       string                   `json:"html"`
+	Outputs    map[string]string        `json:"outputs"`
+	Gallery    string                   `json:"gallery"`
+	Previews   map[string]string        `json:"previews,omitempty"`
+	PreviewURL string                   `json:"preview_url,omitempty"` // The local preview server
+	Metadata   map[string]MetadataField `json:"metadata,omitempty"`
+	TextFit    []TextFit                `json:"text_fit,omitempty"`
+	Blocked    []BlockedRequest         `json:"blocked_requests,omitempty"`
+}
 
-	if imageExists {
-		if *verbose {
-			log.Printf("Image file exists at: %s", absOutputPath)
-		}
-	} else {
-		if *verbose {
-			log.Printf("Image file does not exist at: %s", absOutputPath)
+// newGenerateSummary lists the files a generation wrote
+func newGenerateSummary(gen cliGeneration, result *Result) generateSummary {
+	summary := generateSummary{
+		HTML:     gen.HTMLPath,
+		Outputs:  make(map[string]string),
+		Gallery:  previewGalleryPath(gen.HTMLPath),
+		Metadata: result.Fields,
+		TextFit:  result.TextFit,
+		Blocked:  result.Blocked,
+	}
+	if len(result.Image) > 0 {
+		summary.Image = gen.ImagePath
+	}
+	for _, format := range MetaFormats() {
+		summary.Outputs[format] = metaOutputPath(gen.HTMLPath, format)
+	}
+	for key := range result.Previews {
+		if summary.Previews == nil {
+			summary.Previews = make(map[string]string)
 		}
-		fmt.Println("Warning: No image was generated. Using a placeholder in the meta tags.")
+		summary.Previews[key] = previewImagePath(gen.HTMLPath, key)
 	}
+	return summary
+}
 
-	if *preview {
-		// For preview, use relative path to the image
-		imageURL = "/" + filepath.Base(absOutputPath)
-	} else if *isApiService {
-		// When running as part of the API service, just use the filename
-		// The service will handle constructing the full URL
-		imageURL = "/" + filepath.Base(absOutputPath)
+// print writes the summary as text
+func (s generateSummary) print(w io.Writer) {
+	if s.Image != "" {
+		fmt.Fprintf(w, "Screenshot saved to %s\n", s.Image)
 	} else {
-		// For production use the full URL
-		imageURL = pageURL
-		if !strings.HasSuffix(imageURL, "/") {
-			imageURL += "/"
+		fmt.Fprintln(w, "Warning: No image was generated. Using a placeholder in the meta tags.")
+	}
+	fmt.Fprintf(w, "HTML with Open Graph meta tags saved to %s\n", s.HTML)
+	for _, format := range MetaFormats() {
+		if format != MetaFormatPage {
+			fmt.Fprintf(w, "  %s: %s\n", format, s.Outputs[format])
 		}
-		imageURL += filepath.Base(absOutputPath)
 	}
-
-	// If we don't have an image, use a placeholder
-	if !imageExists && *webpageURL == "" {
-		fmt.Println("Warning: No image was generated. Using a placeholder in the meta tags.")
-		// Set a placeholder URL for the image
-		imageURL = "https://via.placeholder.com/1200x630?text=" + url.QueryEscape(*title)
+	fmt.Fprintf(w, "Link preview gallery saved to %s\n", s.Gallery)
+	for _, key := range previewKeys() {
+		if path, ok := s.Previews[key]; ok {
+			fmt.Fprintf(w, "  %s: %s\n", key, path)
+		}
 	}
-
-	// Create the Open Graph data
-	ogData := OpenGraphData{
-		Title:       *title,
-		Description: *description,
-		ImageURL:    imageURL,
-		PageURL:     pageURL,
-		Type:        *ogType,
-		SiteName:    *siteName,
-		ImageWidth:  *imgWidth,
-		ImageHeight: *imgHeight,
-		TwitterCard: *twitterCard,
-		LocalImage:  *preview,
+	for _, fit := range s.TextFit {
+		if fit.Strategy != FitNone {
+			fmt.Fprintf(w, "Card %s text fitted with %s at %.1fpx\n", fit.Element, fit.Strategy, fit.FontSize)
+		}
+	}
+	if s.PreviewURL != "" {
+		fmt.Fprintf(w, "Preview available at: %s\n", s.PreviewURL)
+		fmt.Fprintln(w, "Press Ctrl+C to stop the server.")
 	}
+}
 
-	htmlOutput := generateMetaTags(ogData)
+// runGenerate captures a page or renders a card and writes the image, the
+// meta outputs and the preview gallery
+func runGenerate(c *cli, args []string) error {
+	fs := c.flagSet("generate", "")
+	build := generateFlags(fs)
+	if _, err := c.parse(fs, args, 0); err != nil {
+		return err
+	}
+	gen, err := build(false)
+	if err != nil {
+		return err
+	}
 
-	// Save HTML to file, using the absolute path to ensure it's saved to the correct location
-	if err := ioutil.WriteFile(absHTMLPath, []byte(htmlOutput), 0644); err != nil {
-		log.Fatal(err)
+	result, err := generateFiles(gen)
+	if err != nil {
+		return err
 	}
+	summary := newGenerateSummary(gen, result)
+	c.result(summary, summary.print)
+	return nil
+}
 
-	fmt.Printf("HTML with Open Graph meta tags saved to %s\n", absHTMLPath)
+// runPreview generates like generate, then serves the meta tags page and
+// the image locally until interrupted
+func runPreview(c *cli, args []string) error {
+	fs := c.flagSet("preview", "")
+	build := generateFlags(fs)
+	port := fs.String("port", "8080", "Port for the preview server")
+	if _, err := c.parse(fs, args, 0); err != nil {
+		return err
+	}
+	gen, err := build(true)
+	if err != nil {
+		return err
+	}
 
-	if *verbose {
-		log.Printf("Files generated - Image: %s, HTML: %s", absOutputPath, absHTMLPath)
+	result, err := generateFiles(gen)
+	if err != nil {
+		return err
+	}
+	server, serverURL, err := startLocalServer(result.MetaHTML, gen.ImagePath, *port)
+	if err != nil {
+		return err
 	}
 
-	// If preview mode is enabled, start a local server
-	if *preview {
-		serverURL := startLocalServer(htmlOutput, absOutputPath, *port)
-		fmt.Printf("Preview available at: %s\n", serverURL)
-		fmt.Printf("Press Ctrl+C to stop the server.\n")
+	summary := newGenerateSummary(gen, result)
+	summary.PreviewURL = serverURL
+	c.result(summary, summary.print)
 
-		// Keep the program running until it's terminated
-		select {}
-	}
+	ctx, stop := interruptContext()
+	defer stop()
+	<-ctx.Done()
 
-	if *verbose && *isApiService {
-		log.Printf("ServerMain completed successfully. Returning to API service.")
-	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
 }
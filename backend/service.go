@@ -2,10 +2,13 @@ package main
 
 import (
 	"archive/zip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"math/rand"
 	"net/http"
 	"net/url"
@@ -21,34 +24,62 @@ import (
 
 // APIResponse represents the structure of the API response
 type APIResponse struct {
-	Success     bool   `json:"success"`
-	Message     string `json:"message"`
-	ImageURL    string `json:"image_url,omitempty"`
-	MetaTagsURL string `json:"meta_tags_url,omitempty"`
-	PreviewURL  string `json:"preview_url,omitempty"`
-	ZipURL      string `json:"zip_url,omitempty"`      // URL to download files as zip
-	HtmlContent string `json:"html_content,omitempty"` // HTML content for direct display
-	ID          string `json:"id,omitempty"`
+	Success     bool              `json:"success"`
+	Message     string            `json:"message"`
+	ImageURL    string            `json:"image_url,omitempty"`
+	MetaTagsURL string            `json:"meta_tags_url,omitempty"`
+	PreviewURL  string            `json:"preview_url,omitempty"`  // Gallery of each platform's link preview
+	ZipURL      string            `json:"zip_url,omitempty"`      // URL to download files as zip
+	HtmlContent string            `json:"html_content,omitempty"` // HTML content for direct display
+	ID          string            `json:"id,omitempty"`
+	Status      string            `json:"status,omitempty"`           // Generation status: pending, rendering, completed, failed
+	StatusURL   string            `json:"status_url,omitempty"`       // URL to poll for asynchronous generations
+	Queue       *JobStatus        `json:"queue,omitempty"`            // Queue position while the generation waits
+	TextFit     []TextFit         `json:"text_fit,omitempty"`         // How card text was fitted, for template generations
+	Blocked     []BlockedRequest  `json:"blocked_requests,omitempty"` // Requests the network policy refused
+	Outputs     map[string]string `json:"outputs,omitempty"`          // Download URL of each meta output format
+	MetaOutput  string            `json:"meta_output,omitempty"`      // The output picked with meta_format
+
+	PreviewImages map[string]string        `json:"preview_images,omitempty"` // Preview image URLs keyed by platform_theme
+	Metadata      map[string]MetadataField `json:"metadata,omitempty"`       // Merged tag values and their sources
+	Extracted     *PageMetadata            `json:"extracted,omitempty"`      // Metadata read from the captured page
 }
 
 // Config holds the service configuration
 type Config struct {
-	Port         string
-	BaseURL      string
-	OutputDir    string
-	EnableCORS   bool
-	MaxQueueSize int
-	ChromePath   string
+	Port            string
+	BaseURL         string
+	OutputDir       string
+	FontsDir        string
+	EnableCORS      bool
+	MaxQueueSize    int
+	ChromePath      string
+	BrowserPoolSize int
+	BrowserMaxUses  int
+	QueueWorkers    int
+
+	// Network policy for renders; the CIDRs add to the built-in private ranges
+	AllowedSchemes []string
+	AllowCIDRs     []string
+	DenyCIDRs      []string
+
+	// API clients that may register webhook callbacks
+	WebhookClients []WebhookClient
 }
 
 // Default configuration
 var config = Config{
-	Port:         "8888",
-	BaseURL:      "http://localhost:8888",
-	OutputDir:    "outputs",
-	EnableCORS:   true,
-	MaxQueueSize: 10,
-	ChromePath:   "", // Will use system default if empty
+	Port:            "8888",
+	BaseURL:         "http://localhost:8888",
+	OutputDir:       "outputs",
+	FontsDir:        "data/fonts",
+	EnableCORS:      true,
+	MaxQueueSize:    10,
+	ChromePath:      "", // Will use system default if empty
+	BrowserPoolSize: 2,
+	BrowserMaxUses:  50,
+	QueueWorkers:    2,
+	AllowedSchemes:  []string{"http", "https"},
 }
 
 // Global variable to track if Sentry is initialized
@@ -57,15 +88,25 @@ var sentryInitialized bool
 // Add package-level db variable
 var db *Database
 
-// GenerateRequest represents a request to generate Open Graph assets
-type GenerateRequest struct {
-	URL          string            `json:"url"`
-	Title        string            `json:"title,omitempty"`
-	Description  string            `json:"description,omitempty"`
-	ImageWidth   int               `json:"image_width,omitempty"`
-	ImageHeight  int               `json:"image_height,omitempty"`
-	CustomParams map[string]string `json:"custom_params,omitempty"`
-}
+// generator renders Open Graph assets for the API handlers. ServiceMain
+// replaces it with one backed by the configured browser pool.
+var generator = NewGenerator(NewBrowserPool(BrowserPoolOptions{}))
+
+// fonts holds the bundled and uploaded fonts card templates can use
+var fonts *FontRegistry
+
+// jobQueue bounds how many generations run and wait at once
+var jobQueue *JobQueue
+
+// generationTimeout limits how long a single generation may render
+const generationTimeout = 30 * time.Second
+
+// shutdownTimeout limits how long in-flight requests get to finish when the
+// service is stopped
+const shutdownTimeout = 30 * time.Second
+
+// ErrGenerationTimeout is returned when a generation exceeds generationTimeout
+var ErrGenerationTimeout = errors.New("generation timed out")
 
 // loadConfig loads configuration from environment variables
 func loadConfig() {
@@ -85,6 +126,11 @@ func loadConfig() {
 		log.Printf("Using OUTPUT_DIR from environment: %s", outputDir)
 	}
 
+	if fontsDir := os.Getenv("FONTS_DIR"); fontsDir != "" {
+		config.FontsDir = fontsDir
+		log.Printf("Using FONTS_DIR from environment: %s", fontsDir)
+	}
+
 	if enableCORS := os.Getenv("ENABLE_CORS"); enableCORS != "" {
 		config.EnableCORS = enableCORS == "true" || enableCORS == "1" || enableCORS == "yes"
 		log.Printf("CORS %s based on environment setting", map[bool]string{true: "enabled", false: "disabled"}[config.EnableCORS])
@@ -104,6 +150,57 @@ func loadConfig() {
 		log.Printf("Using custom Chrome path from environment: %s", chromePath)
 	}
 
+	if poolSize := os.Getenv("BROWSER_POOL_SIZE"); poolSize != "" {
+		if val, err := strconv.Atoi(poolSize); err == nil && val > 0 {
+			config.BrowserPoolSize = val
+			log.Printf("Using BROWSER_POOL_SIZE from environment: %d", val)
+		} else {
+			log.Printf("Invalid BROWSER_POOL_SIZE value: %s, using default: %d", poolSize, config.BrowserPoolSize)
+		}
+	}
+
+	if maxUses := os.Getenv("BROWSER_MAX_USES"); maxUses != "" {
+		if val, err := strconv.Atoi(maxUses); err == nil && val >= 0 {
+			config.BrowserMaxUses = val
+			log.Printf("Using BROWSER_MAX_USES from environment: %d", val)
+		} else {
+			log.Printf("Invalid BROWSER_MAX_USES value: %s, using default: %d", maxUses, config.BrowserMaxUses)
+		}
+	}
+
+	if workers := os.Getenv("QUEUE_WORKERS"); workers != "" {
+		if val, err := strconv.Atoi(workers); err == nil && val > 0 {
+			config.QueueWorkers = val
+			log.Printf("Using QUEUE_WORKERS from environment: %d", val)
+		} else {
+			log.Printf("Invalid QUEUE_WORKERS value: %s, using default: %d", workers, config.QueueWorkers)
+		}
+	}
+
+	if schemes := splitList(os.Getenv("NETWORK_ALLOWED_SCHEMES")); len(schemes) > 0 {
+		config.AllowedSchemes = schemes
+		log.Printf("Using NETWORK_ALLOWED_SCHEMES from environment: %s", strings.Join(schemes, ", "))
+	}
+
+	if allow := splitList(os.Getenv("NETWORK_ALLOW_CIDRS")); len(allow) > 0 {
+		config.AllowCIDRs = allow
+		log.Printf("Using NETWORK_ALLOW_CIDRS from environment: %s", strings.Join(allow, ", "))
+	}
+
+	if deny := splitList(os.Getenv("NETWORK_DENY_CIDRS")); len(deny) > 0 {
+		config.DenyCIDRs = deny
+		log.Printf("Using NETWORK_DENY_CIDRS from environment: %s", strings.Join(deny, ", "))
+	}
+
+	if value := os.Getenv("WEBHOOK_CLIENTS"); value != "" {
+		if clients, err := parseWebhookClients(value); err != nil {
+			log.Printf("Invalid WEBHOOK_CLIENTS value, webhooks are disabled: %v", err)
+		} else {
+			config.WebhookClients = clients
+			log.Printf("Using %d webhook clients from WEBHOOK_CLIENTS", len(clients))
+		}
+	}
+
 	// Set logging level based on environment
 	if logLevel := os.Getenv("LOG_LEVEL"); logLevel != "" {
 		switch strings.ToLower(logLevel) {
@@ -120,8 +217,8 @@ func loadConfig() {
 		}
 	}
 
-	log.Printf("Configuration loaded: Port=%s, BaseURL=%s, OutputDir=%s, EnableCORS=%v, MaxQueueSize=%d",
-		config.Port, config.BaseURL, config.OutputDir, config.EnableCORS, config.MaxQueueSize)
+	log.Printf("Configuration loaded: Port=%s, BaseURL=%s, OutputDir=%s, EnableCORS=%v, MaxQueueSize=%d, QueueWorkers=%d",
+		config.Port, config.BaseURL, config.OutputDir, config.EnableCORS, config.MaxQueueSize, config.QueueWorkers)
 
 	// Make sure base URL doesn't end with a slash
 	config.BaseURL = strings.TrimSuffix(config.BaseURL, "/")
@@ -135,11 +232,10 @@ func loadConfig() {
 	}
 }
 
-// ServiceMain is the entry point for the API service
-func ServiceMain() {
-	// Set environment variable to indicate we're running in API service mode
-	os.Setenv("OG_API_SERVICE", "true")
-
+// ServiceMain runs the API service until it is interrupted or terminated,
+// then lets in-flight requests and queued generations finish and stops the
+// webhook dispatcher. It returns early when the service cannot start.
+func ServiceMain() error {
 	// Load configuration from environment variables
 	loadConfig()
 
@@ -151,7 +247,7 @@ func ServiceMain() {
 
 	// Ensure output directory exists
 	if err := os.MkdirAll(config.OutputDir, 0755); err != nil {
-		log.Fatalf("Failed to create output directory: %v", err)
+		return fmt.Errorf("failed to create output directory: %w", err)
 	}
 
 	// Initialize the database - global variable that will be reused
@@ -169,6 +265,56 @@ func ServiceMain() {
 		StartCleanupTask(db)
 	}
 
+	// Keep renders away from internal addresses, except for the font files
+	// the card templates load from this service
+	policy, err := NewNetworkPolicy(config.AllowedSchemes, config.AllowCIDRs, config.DenyCIDRs)
+	if err != nil {
+		return fmt.Errorf("invalid network policy: %w", err)
+	}
+	policy.AllowPrefix("http://127.0.0.1:" + config.Port + "/fonts/")
+	proxy, err := policy.StartProxy()
+	if err != nil {
+		return err
+	}
+
+	// Keep warm browsers around for rendering, connecting through the
+	// policy's proxy
+	generator = NewGenerator(NewBrowserPool(BrowserPoolOptions{
+		Size:       config.BrowserPoolSize,
+		MaxUses:    config.BrowserMaxUses,
+		ChromePath: config.ChromePath,
+		Proxy:      proxy,
+	}))
+	if db != nil {
+		generator.SetTemplateStore(db)
+	}
+
+	// Chrome fetches card fonts from this service, so the rules point at it
+	// directly rather than at a public BASE_URL
+	fonts, err = NewFontRegistry(config.FontsDir)
+	if err != nil {
+		log.Printf("Warning: Failed to load uploaded fonts: %v", err)
+		if fonts, err = NewFontRegistry(""); err != nil {
+			return fmt.Errorf("failed to load bundled fonts: %w", err)
+		}
+	}
+	fonts.SetBaseURL("http://127.0.0.1:" + config.Port)
+	generator.SetFontRegistry(fonts)
+
+	generator.SetNetworkPolicy(policy)
+	go generator.Pool().Warm()
+
+	// Start the workers that process generation jobs
+	jobQueue = NewJobQueue(config.QueueWorkers, config.MaxQueueSize, generationTimeout, processGenerationJob)
+	jobQueue.Start()
+
+	// Webhooks are sent under the same network policy as renders, so a
+	// callback URL cannot reach internal addresses
+	if db != nil && len(config.WebhookClients) > 0 {
+		webhooks = NewWebhookDispatcher(db, policy.HTTPClient(webhookTimeout))
+		webhooks.Start()
+	}
+
 	// Global CORS middleware applied to all requests
 	globalCorsMiddleware := func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -182,7 +328,7 @@ func ServiceMain() {
 			// Always apply CORS headers to all responses
 			w.Header().Set("Access-Control-Allow-Origin", "*")
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Accept, Authorization, X-Requested-With")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Accept, Authorization, X-Requested-With, X-API-Key")
 			w.Header().Set("Access-Control-Max-Age", "3600")
 
 			// Handle preflight OPTIONS requests immediately
@@ -201,8 +347,20 @@ func ServiceMain() {
 
 	// Register individual API handlers
 	mux.HandleFunc("/api/generate", handleGenerateRequest)
+	mux.HandleFunc("/api/validate", handleValidateRequest)
+	mux.HandleFunc("/api/batch", handleBatchRequest)
+	mux.HandleFunc("/api/batch/", handleBatchStatusRequest)
+	mux.HandleFunc("/api/webhooks/deliveries", handleWebhookDeliveriesRequest)
+	mux.HandleFunc("/api/webhooks/deliveries/", handleWebhookDeliveryRequest)
 	mux.HandleFunc("/api/health", handleHealthCheck)
+	mux.HandleFunc("/api/stats", handleStatsRequest)
+	mux.HandleFunc("/api/templates", adminOnlyMethods(handleTemplatesRequest, http.MethodPost))
+	mux.HandleFunc("/api/templates/", adminOnlyMethods(handleTemplateRequest, http.MethodPost, http.MethodDelete))
 	mux.HandleFunc("/api/download-zip", handleZipDownload)
+	mux.HandleFunc("/api/fonts", adminOnlyMethods(handleFontsRequest, http.MethodPost))
+	mux.HandleFunc("/api/fonts/", adminOnlyMethods(handleFontRequest, http.MethodDelete))
+	mux.HandleFunc("/fonts/", handleFontFileRequest)
+	mux.HandleFunc("/fonts.css", handleFontCSSRequest)
 
 	// Add new API endpoints for history
 	mux.HandleFunc("/api/history", handleHistoryRequest)
@@ -232,13 +390,9 @@ func ServiceMain() {
 		}
 
 		// Determine content type
-		contentType := "application/octet-stream"
-		if strings.HasSuffix(filePath, ".html") {
-			contentType = "text/html"
-		} else if strings.HasSuffix(filePath, ".png") {
-			contentType = "image/png"
-		} else if strings.HasSuffix(filePath, ".jpg") || strings.HasSuffix(filePath, ".jpeg") {
-			contentType = "image/jpeg"
+		contentType := contentTypeForFile(filePath)
+		if contentType == "" {
+			contentType = "application/octet-stream"
 		}
 
 		// Set content type and serve the file
@@ -262,7 +416,31 @@ func ServiceMain() {
 	log.Printf("Files will be served from %s/files/{filename}", config.BaseURL)
 	log.Printf("CORS Enabled: Applying to all requests")
 	log.Printf("Sentry Error Tracking: Enabled")
-	log.Fatal(http.ListenAndServe(":"+config.Port, handler))
+
+	server := &http.Server{Addr: ":" + config.Port, Handler: handler}
+	ctx, stop := interruptContext()
+	defer stop()
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.ListenAndServe() }()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	// Stop taking requests, drain the queue, then stop delivering the
+	// webhooks the last generations queued; undelivered ones stay in the log
+	log.Printf("Shutting down...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = server.Shutdown(shutdownCtx)
+	jobQueue.Stop()
+	if webhooks != nil {
+		webhooks.Stop()
+	}
+	generator.Pool().Close()
+	return err
 }
 
 // handleHealthCheck responds to health check requests
@@ -275,6 +453,26 @@ func handleHealthCheck(w http.ResponseWriter, r *http.Request) {
 	sendJSONResponse(w, response)
 }
 
+// handleStatsRequest reports runtime statistics for the rendering subsystems
+func handleStatsRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := map[string]interface{}{
+		"browser_pool": generator.Pool().Stats(),
+	}
+	if jobQueue != nil {
+		stats["queue"] = jobQueue.Stats()
+	}
+
+	sendJSONResponse(w, map[string]interface{}{
+		"success": true,
+		"data":    stats,
+	})
+}
+
 // handleZipDownload creates a zip file with the specified files and serves it for download
 func handleZipDownload(w http.ResponseWriter, r *http.Request) {
 	// Get the filenames from the query parameters
@@ -352,28 +550,72 @@ func handleGenerateRequest(w http.ResponseWriter, r *http.Request) {
 	// Log the incoming request
 	log.Printf("Received generate request from %s", r.RemoteAddr)
 
-	// Parse the multipart form with a reasonable max memory
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		// If not multipart, try to parse as regular form
-		if err = r.ParseForm(); err != nil {
-			log.Printf("Error parsing form: %v", err)
-			sendErrorResponse(w, "Failed to parse form data", http.StatusBadRequest)
+	if jobQueue == nil {
+		sendErrorResponse(w, "Generation queue is not running", http.StatusServiceUnavailable)
+		return
+	}
+
+	// JSON bodies are decoded strictly; forms keep their lenient mapping
+	var params GenerationParameters
+	async := isAsyncRequest(r)
+	if isJSONRequest(r) {
+		req, err := decodeGenerateRequest(r.Body)
+		if err != nil {
+			log.Printf("Rejecting generate request: %v", err)
+			sendValidationError(w, err)
+			return
+		}
+		params = req.Parameters()
+		async = async || req.Async
+	} else {
+		// Parse the multipart form with a reasonable max memory
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			// If not multipart, try to parse as regular form
+			if err = r.ParseForm(); err != nil {
+				log.Printf("Error parsing form: %v", err)
+				sendErrorResponse(w, "Failed to parse form data", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Log the form data received
+		log.Printf("Form data received:")
+		for key, values := range r.Form {
+			log.Printf("  %s: %v", key, values)
+		}
+
+		if err := validateForm(r.Form); err != nil {
+			log.Printf("Rejecting generate request: %v", err)
+			sendValidationError(w, err)
 			return
 		}
+
+		// Map the submitted form onto generation parameters
+		params = parametersFromForm(r.Form)
 	}
 
-	// Log the form data received
-	log.Printf("Form data received:")
-	for key, values := range r.Form {
-		log.Printf("  %s: %v", key, values)
+	// Clients that leave a callback URL are notified instead of waiting
+	client, err := callbackClient(r, params.CallbackURL)
+	if err != nil {
+		log.Printf("Rejecting generate request: %v", err)
+		sendValidationError(w, err)
+		return
 	}
+	async = async || client != nil
 
 	// Generate a unique ID for this request
 	requestID := generateRequestID()
 
-	// Prepare the output paths
-	imgOutputPath := filepath.Join(config.OutputDir, requestID+"_og_image.png")
-	htmlOutputPath := filepath.Join(config.OutputDir, requestID+"_og_meta.html")
+	// The format decides the file extension, so it is checked up front
+	generation, err := newGeneration(requestID, &params, r)
+	if err != nil {
+		sendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	imgOutputPath, htmlOutputPath := generation.ImagePath, generation.HTMLPath
+	if client != nil {
+		generation.WebhookClient = client.Name
+	}
 
 	// Make sure the output directory exists
 	if err := os.MkdirAll(config.OutputDir, 0755); err != nil {
@@ -382,21 +624,6 @@ func handleGenerateRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create generation record in database with initial pending status
-	generation := &Generation{
-		ID:          requestID,
-		Title:       r.FormValue("title"),
-		Description: r.FormValue("description"),
-		TargetURL:   r.FormValue("target_url"),
-		ImagePath:   imgOutputPath,
-		HTMLPath:    htmlOutputPath,
-		CreatedAt:   time.Now(),
-		ClientIP:    r.RemoteAddr,
-		UserAgent:   r.UserAgent(),
-		Parameters:  parametersToJSON(r.Form),
-		Status:      "pending",
-	}
-
 	// Save initial generation record
 	if err := db.SaveGeneration(generation); err != nil {
 		log.Printf("Error saving generation record: %v", err)
@@ -407,158 +634,61 @@ func handleGenerateRequest(w http.ResponseWriter, r *http.Request) {
 		// Continue anyway, as this is just for tracking
 	}
 
-	// Instead of executing a separate binary, set up a context for direct generation
-	// Save original args and restore them after
-	originalArgs := os.Args
-	defer func() { os.Args = originalArgs }()
-
-	// Build args array for flag parsing
-	args := []string{"og-generator"}
-
-	// Always set the API service flag
-	args = append(args, "-api-service=true")
-
-	// Set environment variable for API service mode
-	os.Setenv("OG_API_SERVICE", "true")
-
-	// Add all the form parameters as command-line args
-	for key, values := range r.Form {
-		if len(values) > 0 && values[0] != "" {
-			// Map form fields to command line arguments
-			cmdFlag := key
-			cmdValue := values[0]
-
-			// Special case mappings if needed
-			if key == "targetUrl" {
-				cmdFlag = "target-url"
-			} else if key == "twitterCard" {
-				cmdFlag = "twitter-card"
-			} else if key == "url" {
-				cmdFlag = "url"
-				log.Printf("Found URL parameter: %s", cmdValue)
-			} else if key == "title" {
-				cmdFlag = "title"
-				log.Printf("Found title parameter: %s", cmdValue)
-			}
-
-			// Handle boolean flags (checkboxes)
-			if key == "debug" || key == "verbose" {
-				if cmdValue == "true" || cmdValue == "on" || cmdValue == "1" {
-					args = append(args, "-"+cmdFlag)
-					continue
-				}
-			}
-
-			args = append(args, "-"+cmdFlag+"="+cmdValue)
-		}
+	// Hand the generation to the queue workers
+	job := NewJob(requestID, params, imgOutputPath, htmlOutputPath)
+	if err := jobQueue.Submit(job); err != nil {
+		log.Printf("Rejecting generation %s: %v", requestID, err)
+		recordGenerationStatus(requestID, "failed", err.Error())
+		sendQueueError(w, err)
+		return
 	}
 
-	// Add output paths
-	args = append(args, "-output="+imgOutputPath)
-	args = append(args, "-html="+htmlOutputPath)
-
-	// Log what we're doing
-	log.Printf("Generating with args: %s", strings.Join(args, " "))
-
-	// Set args for flag parsing
-	os.Args = args
-
-	// Create a channel to capture errors from ServerMain
-	errChan := make(chan error, 1)
-
-	// Run ServerMain in a goroutine so we can capture if it exits
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				errChan <- fmt.Errorf("generator panicked: %v", r)
-			} else {
-				// Signal completion
-				errChan <- nil
-			}
-		}()
+	// In async mode hand back the ID right away; clients poll for the status
+	if async {
+		response := APIResponse{
+			Success:   true,
+			Message:   "Generation queued. Poll the status URL until it completes.",
+			ID:        requestID,
+			Status:    "pending",
+			StatusURL: fmt.Sprintf("%s/api/generation/%s", config.BaseURL, requestID),
+		}
+		if status, ok := jobQueue.Status(requestID); ok {
+			response.Queue = &status
+		}
 
-		// Call ServerMain directly
-		ServerMain()
-	}()
+		w.Header().Set("Location", response.StatusURL)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
 
-	// Wait for generation to complete or time out
+	// Wait for a worker to finish the job. If the client goes away the job
+	// still runs to completion and its outcome is recorded.
 	select {
-	case err := <-errChan:
-		if err != nil {
-			log.Printf("Error during generation: %v", err)
-
-			// Report error to Sentry with context
-			sentry.WithScope(func(scope *sentry.Scope) {
-				scope.SetTag("request_type", "generation")
-				scope.SetExtra("request_ip", r.RemoteAddr)
-				scope.SetExtra("user_agent", r.UserAgent())
-
-				// Add form data as context (filtering sensitive information)
-				formData := make(map[string]string)
-				for key, values := range r.Form {
-					if len(values) > 0 {
-						// Don't include large or sensitive values
-						if key != "image" && key != "password" && len(values[0]) < 1000 {
-							formData[key] = values[0]
-						}
-					}
-				}
-				// Convert to map[string]interface{} for Sentry context
-				formDataContext := make(map[string]interface{})
-				for k, v := range formData {
-					formDataContext[k] = v
-				}
-				scope.SetContext("form_data", formDataContext)
-
-				// Capture the exception
-				CaptureException(err)
-			})
-
-			// Save error to database if database is available
-			db, dbErr := InitDB()
-			if dbErr == nil {
-				// Try to extract request ID from args
-				requestID := ""
-				for _, arg := range args {
-					if strings.HasPrefix(arg, "-output=") {
-						// Extract ID from output path
-						outputPath := strings.TrimPrefix(arg, "-output=")
-						requestID = strings.TrimSuffix(filepath.Base(outputPath), "_og_image.png")
-						break
-					}
-				}
-
-				if requestID != "" {
-					// Set error message and status
-					db.SetErrorMessage(requestID, err.Error())
-				}
-			}
-
-			sendErrorResponse(w, fmt.Sprintf("Failed to generate Open Graph assets: %v", err), http.StatusInternalServerError)
-			return
-		}
-	case <-time.After(30 * time.Second):
-		log.Printf("Generation timed out after 30 seconds")
-
-		// Report timeout to Sentry
-		sentry.WithScope(func(scope *sentry.Scope) {
-			scope.SetTag("error_type", "timeout")
-			scope.SetTag("request_type", "generation")
-			scope.SetExtra("timeout_duration", "30s")
-			CaptureMessage("Generation request timed out")
-		})
+	case <-job.Done():
+	case <-r.Context().Done():
+		log.Printf("Client disconnected while waiting for generation %s", requestID)
+		return
+	}
 
+	result, err := job.Result()
+	var blocked *BlockedError
+	if errors.Is(err, ErrGenerationTimeout) {
 		sendErrorResponse(w, "Generation timed out", http.StatusRequestTimeout)
 		return
+	} else if errors.As(err, &blocked) {
+		sendErrorResponse(w, blocked.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		sendErrorResponse(w, fmt.Sprintf("Failed to generate Open Graph assets: %v", err), http.StatusInternalServerError)
+		return
 	}
 
 	// Construct the response URLs
 	imageURL := fmt.Sprintf("%s/files/%s", config.BaseURL, filepath.Base(imgOutputPath))
 	metaTagsURL := fmt.Sprintf("%s/files/%s", config.BaseURL, filepath.Base(htmlOutputPath))
-	zipURL := fmt.Sprintf("%s/api/download-zip?file=%s&file=%s",
-		config.BaseURL,
-		filepath.Base(imgOutputPath),
-		filepath.Base(htmlOutputPath))
+	zipURL := zipDownloadURL(generationFiles(imgOutputPath, htmlOutputPath))
 
 	// Check if image was actually generated
 	if _, err := os.Stat(imgOutputPath); os.IsNotExist(err) {
@@ -582,30 +712,6 @@ func handleGenerateRequest(w http.ResponseWriter, r *http.Request) {
 	// Determine if generation was successful
 	generationSuccess := imageURL != "" || metaTagsURL != ""
 
-	// Update the generation status in the database
-	if generationSuccess {
-		// Update generation status to completed
-		if err := db.UpdateGenerationStatus(requestID, "completed", ""); err != nil {
-			log.Printf("Error updating generation status: %v", err)
-			captureError(err, map[string]interface{}{
-				"operation": "update_generation_status",
-				"requestID": requestID,
-				"status":    "completed",
-			})
-		}
-	} else {
-		// Update generation status to failed
-		errorMsg := "Failed to generate Open Graph assets"
-		if err := db.UpdateGenerationStatus(requestID, "failed", errorMsg); err != nil {
-			log.Printf("Error updating generation status: %v", err)
-			captureError(err, map[string]interface{}{
-				"operation": "update_generation_status",
-				"requestID": requestID,
-				"status":    "failed",
-			})
-		}
-	}
-
 	// Send the successful response
 	response := APIResponse{
 		Success:     generationSuccess,
@@ -615,6 +721,18 @@ func handleGenerateRequest(w http.ResponseWriter, r *http.Request) {
 		ZipURL:      zipURL,
 		HtmlContent: htmlContent,
 		ID:          requestID, // Include the ID in the response
+		Status:      "completed",
+		TextFit:     result.TextFit,
+		Blocked:     result.Blocked,
+		Outputs:     metaOutputURLs(htmlOutputPath),
+		PreviewURL:  fileURL(previewGalleryPath(htmlOutputPath)),
+
+		PreviewImages: previewImageURLs(htmlOutputPath),
+		Metadata:      result.Fields,
+		Extracted:     result.Extracted,
+	}
+	if params.MetaFormat != "" {
+		response.MetaOutput = result.Outputs[params.MetaFormat]
 	}
 
 	// Add more information to the message if the files were generated
@@ -632,25 +750,285 @@ func handleGenerateRequest(w http.ResponseWriter, r *http.Request) {
 	sendJSONResponse(w, response)
 }
 
-// parametersToJSON converts form values to a JSON string
-func parametersToJSON(form url.Values) string {
-	params := make(map[string]interface{})
+// newGeneration resolves the image format and output paths of a
+// generation and returns its pending record. The parameters are updated
+// with the resolved format and image URL.
+func newGeneration(id string, params *GenerationParameters, r *http.Request) (*Generation, error) {
+	imageFormat, err := resolveImageFormat(params.Format, params.Quality)
+	if err != nil {
+		return nil, err
+	}
+	params.Format = imageFormat
+
+	imgOutputPath := filepath.Join(config.OutputDir, id+"_og_image"+imageExtension(imageFormat))
+	htmlOutputPath := filepath.Join(config.OutputDir, id+"_og_meta.html")
+	params.ImageURL = fileURL(imgOutputPath)
 
-	for key, values := range form {
-		if len(values) == 1 {
-			params[key] = values[0]
-		} else if len(values) > 1 {
-			params[key] = values
+	paramsJSON, err := SerializeParameters(params)
+	if err != nil {
+		log.Printf("Error serializing generation parameters: %v", err)
+		paramsJSON = "{}"
+	}
+
+	return &Generation{
+		ID:          id,
+		Title:       params.Title,
+		Description: params.Description,
+		TargetURL:   params.TargetURL,
+		ImagePath:   imgOutputPath,
+		HTMLPath:    htmlOutputPath,
+		CreatedAt:   time.Now(),
+		ClientIP:    r.RemoteAddr,
+		UserAgent:   r.UserAgent(),
+		Parameters:  paramsJSON,
+		Status:      "pending",
+	}, nil
+}
+
+// processGenerationJob renders a queued generation, writes its files and
+// records each stage of its progress in the database
+func processGenerationJob(ctx context.Context, job *Job) (*Result, error) {
+	defer notifyGeneration(job.ID)
+	recordGenerationStatus(job.ID, "rendering", "")
+
+	result, err := generator.Generate(ctx, job.Params)
+	if err == nil {
+		err = result.WriteFiles(job.ImagePath, job.HTMLPath)
+	}
+
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		log.Printf("Generation %s timed out after %v", job.ID, generationTimeout)
+
+		// Report timeout to Sentry
+		sentry.WithScope(func(scope *sentry.Scope) {
+			scope.SetTag("error_type", "timeout")
+			scope.SetTag("request_type", "generation")
+			scope.SetExtra("generation_id", job.ID)
+			scope.SetExtra("timeout_duration", generationTimeout.String())
+			CaptureMessage("Generation request timed out")
+		})
+
+		recordGenerationFailure(job.ID, ErrGenerationTimeout)
+		return nil, ErrGenerationTimeout
+	} else if err != nil {
+		log.Printf("Error during generation %s: %v", job.ID, err)
+
+		// Report error to Sentry with the generation parameters as context
+		sentry.WithScope(func(scope *sentry.Scope) {
+			scope.SetTag("request_type", "generation")
+			scope.SetExtra("generation_id", job.ID)
+			scope.SetContext("parameters", map[string]interface{}{
+				"url":    job.Params.WebpageURL,
+				"title":  job.Params.Title,
+				"width":  job.Params.ImageWidth,
+				"height": job.Params.ImageHeight,
+			})
+			CaptureException(err)
+		})
+
+		recordGenerationFailure(job.ID, err)
+		return nil, err
+	}
+
+	// Details are stored before the status, so a client that sees the
+	// generation completed also sees them
+	if len(result.Blocked) > 0 && db != nil {
+		if err := db.SetBlockedRequests(job.ID, result.Blocked); err != nil {
+			log.Printf("Error recording blocked requests: %v", err)
+		}
+	}
+	if len(result.TextFit) > 0 && db != nil {
+		if err := db.SetTextFit(job.ID, result.TextFit); err != nil {
+			log.Printf("Error recording text fit: %v", err)
+		}
+	}
+	if (len(result.Fields) > 0 || result.Extracted != nil) && db != nil {
+		if err := db.SetMetadata(job.ID, result.Fields, result.Extracted); err != nil {
+			log.Printf("Error recording metadata: %v", err)
 		}
 	}
+	recordGenerationStatus(job.ID, "completed", "")
+	return result, nil
+}
 
-	jsonData, err := json.Marshal(params)
-	if err != nil {
-		log.Printf("Error marshaling parameters to JSON: %v", err)
-		return "{}"
+// recordGenerationFailure marks a generation as failed along with the
+// reason, so refused URLs can be told apart from rendering errors
+func recordGenerationFailure(id string, err error) {
+	recordGenerationStatus(id, "failed", err.Error())
+	if db == nil {
+		return
 	}
 
-	return string(jsonData)
+	if err := db.SetFailureReason(id, failureReason(err)); err != nil {
+		log.Printf("Error recording failure reason: %v", err)
+	}
+	var blocked *BlockedError
+	if errors.As(err, &blocked) {
+		if err := db.SetBlockedRequests(id, []BlockedRequest{blocked.BlockedRequest}); err != nil {
+			log.Printf("Error recording blocked requests: %v", err)
+		}
+	}
+}
+
+// recordGenerationStatus moves a generation to a new status, logging rather
+// than failing when the database is unavailable
+func recordGenerationStatus(id, status, errorMessage string) {
+	if db == nil {
+		return
+	}
+
+	if err := db.UpdateGenerationStatus(id, status, errorMessage); err != nil {
+		log.Printf("Error updating generation status: %v", err)
+		captureError(err, map[string]interface{}{
+			"operation": "update_generation_status",
+			"requestID": id,
+			"status":    status,
+		})
+	}
+}
+
+// isAsyncRequest reports whether the client asked for an asynchronous
+// generation, either through the form or the query string
+func isAsyncRequest(r *http.Request) bool {
+	switch strings.ToLower(r.FormValue("async")) {
+	case "true", "on", "1", "yes":
+		return true
+	}
+	return false
+}
+
+// parametersFromForm maps submitted form fields onto generation parameters.
+// Both the CLI flag names and their camelCase/snake_case variants are accepted.
+func parametersFromForm(form url.Values) GenerationParameters {
+	get := func(keys ...string) string {
+		for _, key := range keys {
+			if v := strings.TrimSpace(form.Get(key)); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	getInt := func(keys ...string) int {
+		v, err := strconv.Atoi(get(keys...))
+		if err != nil {
+			return 0
+		}
+		return v
+	}
+	getBool := func(key string) bool {
+		v := get(key)
+		return v == "true" || v == "on" || v == "1"
+	}
+	getFloat := func(keys ...string) float64 {
+		v, err := strconv.ParseFloat(get(keys...), 64)
+		if err != nil {
+			return 0
+		}
+		return v
+	}
+	// Lists arrive comma separated
+	getList := func(keys ...string) []string {
+		return splitList(get(keys...))
+	}
+
+	processing := &ImageProcessing{
+		Fit:               get("fit"),
+		Background:        get("background"),
+		CornerRadius:      getInt("corner-radius", "corner_radius", "cornerRadius"),
+		BorderWidth:       getInt("border-width", "border_width", "borderWidth"),
+		BorderColor:       get("border-color", "border_color", "borderColor"),
+		WatermarkURL:      get("watermark-url", "watermark_url", "watermarkUrl"),
+		WatermarkPosition: get("watermark-position", "watermark_position", "watermarkPosition"),
+		WatermarkSize:     getFloat("watermark-size", "watermark_size", "watermarkSize"),
+		WatermarkOpacity:  getFloat("watermark-opacity", "watermark_opacity", "watermarkOpacity"),
+		WatermarkMargin:   getInt("watermark-margin", "watermark_margin", "watermarkMargin"),
+		Optimize:          getBool("optimize"),
+	}
+	if *processing == (ImageProcessing{}) {
+		processing = nil
+	}
+
+	// Invalid JSON is rejected by the handlers before they get here
+	customParams, _ := parseCustomParams(get("custom_params", "customParams"))
+
+	return GenerationParameters{
+		WebpageURL:  get("url"),
+		Title:       get("title"),
+		Description: get("description"),
+		OgType:      get("type"),
+		SiteName:    get("site"),
+		TargetURL:   get("target-url", "targetUrl", "target_url"),
+		TwitterCard: get("twitter-card", "twitterCard", "twitter_card"),
+		ImageWidth:  getInt("width"),
+		ImageHeight: getInt("height"),
+		Quality:     getInt("quality"),
+		WaitTime:    getInt("wait"),
+		Selector:    get("selector"),
+		Debug:       getBool("debug"),
+		Verbose:     getBool("verbose"),
+		CallbackURL: get("callback_url", "callbackUrl"),
+
+		DeviceScaleFactor: getFloat("scale", "device_scale_factor", "deviceScaleFactor"),
+		CaptureMode:       get("capture", "capture_mode", "captureMode"),
+		Format:            get("format"),
+
+		CaptureSelector:   get("capture-selector", "capture_selector", "captureSelector"),
+		CapturePadding:    getInt("capture-padding", "capture_padding", "capturePadding"),
+		CaptureBackground: get("capture-background", "capture_background", "captureBackground"),
+
+		Processing: processing,
+
+		Template:        get("template"),
+		LogoURL:         get("logo", "logo-url", "logo_url", "logoUrl"),
+		BackgroundColor: get("background-color", "background_color", "backgroundColor"),
+		TextColor:       get("text-color", "text_color", "textColor"),
+		AccentColor:     get("accent-color", "accent_color", "accentColor"),
+		TemplateVersion: getInt("template-version", "template_version", "templateVersion"),
+		CustomParams:    customParams,
+
+		TitleMinFontSize: getInt("title-min-font-size", "title_min_font_size", "titleMinFontSize"),
+		TitleMaxFontSize: getInt("title-max-font-size", "title_max_font_size", "titleMaxFontSize"),
+
+		MetaFormat: get("meta-format", "meta_format", "metaFormat"),
+		Previews:   getBool("previews"),
+		Enrich:     getBool("enrich"),
+
+		Locale:               get("locale"),
+		LocaleAlternates:     getList("locale-alternates", "locale_alternates", "localeAlternates"),
+		ImageAlt:             get("image-alt", "image_alt", "imageAlt"),
+		Images:               getList("images"),
+		VideoURL:             get("video-url", "video_url", "videoUrl"),
+		VideoType:            get("video-type", "video_type", "videoType"),
+		VideoWidth:           getInt("video-width", "video_width", "videoWidth"),
+		VideoHeight:          getInt("video-height", "video_height", "videoHeight"),
+		AudioURL:             get("audio-url", "audio_url", "audioUrl"),
+		AudioType:            get("audio-type", "audio_type", "audioType"),
+		ArticlePublishedTime: get("article-published-time", "article_published_time", "articlePublishedTime"),
+		ArticleModifiedTime:  get("article-modified-time", "article_modified_time", "articleModifiedTime"),
+		ArticleAuthors:       getList("article-authors", "article_authors", "articleAuthors"),
+		ArticleSection:       get("article-section", "article_section", "articleSection"),
+		ArticleTags:          getList("article-tags", "article_tags", "articleTags"),
+		ProductPriceAmount:   get("product-price-amount", "product_price_amount", "productPriceAmount"),
+		ProductPriceCurrency: get("product-price-currency", "product_price_currency", "productPriceCurrency"),
+		ProfileFirstName:     get("profile-first-name", "profile_first_name", "profileFirstName"),
+		ProfileLastName:      get("profile-last-name", "profile_last_name", "profileLastName"),
+		ProfileUsername:      get("profile-username", "profile_username", "profileUsername"),
+		ProfileGender:        get("profile-gender", "profile_gender", "profileGender"),
+		TwitterSite:          get("twitter-site", "twitter_site", "twitterSite"),
+		TwitterCreator:       get("twitter-creator", "twitter_creator", "twitterCreator"),
+	}
+}
+
+// sendQueueError answers a request the job queue refused, telling clients
+// when to retry if it was full
+func sendQueueError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrQueueFull) {
+		retryAfter := int(math.Ceil(jobQueue.RetryAfter().Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		sendErrorResponse(w, "Too many generations in progress, please retry later", http.StatusTooManyRequests)
+		return
+	}
+	sendErrorResponse(w, "Generation queue is not running", http.StatusServiceUnavailable)
 }
 
 // sendJSONResponse sends a structured JSON response
@@ -788,24 +1166,30 @@ func handleGetGenerationRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Construct the response URLs
-	imageURL := fmt.Sprintf("%s/files/%s", config.BaseURL, filepath.Base(generation.ImagePath))
-	metaTagsURL := fmt.Sprintf("%s/files/%s", config.BaseURL, filepath.Base(generation.HTMLPath))
-	zipURL := fmt.Sprintf("%s/api/download-zip?file=%s&file=%s",
-		config.BaseURL,
-		filepath.Base(generation.ImagePath),
-		filepath.Base(generation.HTMLPath))
-
-	// Send the response
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	response := map[string]interface{}{
 		"success":    true,
 		"message":    "Generation retrieved successfully",
 		"generation": generation,
-		"image_url":  imageURL,
-		"meta_url":   metaTagsURL,
-		"zip_url":    zipURL,
-	})
+		"status":     generation.Status,
+	}
+
+	// Asset URLs only exist once rendering has succeeded
+	if generation.Status == "completed" {
+		for key, value := range generationAssetURLs(generation) {
+			response[key] = value
+		}
+	}
+
+	// Report queue position and wait time while the job has not finished
+	if jobQueue != nil {
+		if status, ok := jobQueue.Status(generationID); ok {
+			response["queue"] = status
+		}
+	}
+
+	// Send the response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
 // handleDownloadCompleteRequest marks a generation as downloaded
@@ -1003,6 +1387,21 @@ func verifyAdminToken(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// adminOnlyMethods requires the admin token for the given methods, such as
+// the ones that change what every render shares, and leaves the rest open
+func adminOnlyMethods(next http.HandlerFunc, methods ...string) http.HandlerFunc {
+	guarded := verifyAdminToken(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, method := range methods {
+			if r.Method == method {
+				guarded(w, r)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
 // StartAPIService starts the API service on the specified port
 func StartAPIService(port string) {
 	log.Printf("Starting API service on port %s", port)
@@ -1029,6 +1428,11 @@ func StartAPIService(port string) {
 
 	// API endpoints
 	mux.HandleFunc("/api/generate", handleGenerateRequest)
+	mux.HandleFunc("/api/validate", handleValidateRequest)
+	mux.HandleFunc("/api/batch", handleBatchRequest)
+	mux.HandleFunc("/api/batch/", handleBatchStatusRequest)
+	mux.HandleFunc("/api/webhooks/deliveries", handleWebhookDeliveriesRequest)
+	mux.HandleFunc("/api/webhooks/deliveries/", handleWebhookDeliveryRequest)
 	mux.HandleFunc("/api/get/", handleGetGenerationRequest)
 	mux.HandleFunc("/api/download/", handleDownloadRequest)
 	mux.HandleFunc("/api/health", handleHealthCheck)
@@ -1045,7 +1449,7 @@ func StartAPIService(port string) {
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"}, // Allowing all origins for now
 		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type", "Accept", "Authorization"},
+		AllowedHeaders:   []string{"Content-Type", "Accept", "Authorization", "X-API-Key"},
 		AllowCredentials: true,
 	})
 
@@ -1123,44 +1527,60 @@ func setupStaticFileServing(mux *http.ServeMux) {
 	mux.Handle("/outputs/", http.StripPrefix("/outputs/", outputFileServer))
 }
 
-// buildGeneratorArgs builds the arguments for the generator command
-func buildGeneratorArgs(req GenerateRequest, imgPath, htmlPath string) []string {
-	args := []string{}
-
-	// Add required parameters
-	if req.URL != "" {
-		args = append(args, fmt.Sprintf("-url=%s", req.URL))
+// generationFiles lists the files a generation writes: the image and every
+// meta output
+func generationFiles(imagePath, htmlPath string) []string {
+	files := []string{filepath.Base(imagePath)}
+	for _, path := range generationOutputFiles(htmlPath) {
+		files = append(files, filepath.Base(path))
 	}
+	return files
+}
 
-	// Add output path
-	args = append(args, fmt.Sprintf("-output=%s", imgPath))
-
-	// Add HTML output path
-	args = append(args, fmt.Sprintf("-html=%s", htmlPath))
-
-	// Add optional parameters if provided
-	if req.Title != "" {
-		args = append(args, fmt.Sprintf("-title=%s", req.Title))
+// generationOutputFiles lists the files written next to the meta tags
+// page: the page itself, the other meta outputs and the previews
+func generationOutputFiles(htmlPath string) []string {
+	var files []string
+	for _, format := range MetaFormats() {
+		files = append(files, metaOutputPath(htmlPath, format))
 	}
+	files = append(files, previewGalleryPath(htmlPath))
 
-	if req.Description != "" {
-		args = append(args, fmt.Sprintf("-description=%s", req.Description))
+	previews := previewImageFiles(htmlPath)
+	for _, key := range previewKeys() {
+		if path, ok := previews[key]; ok {
+			files = append(files, path)
+		}
 	}
+	return files
+}
 
-	if req.ImageWidth > 0 {
-		args = append(args, fmt.Sprintf("-width=%d", req.ImageWidth))
-	}
+// zipDownloadURL returns the URL of a zip bundle of output files
+func zipDownloadURL(files []string) string {
+	return config.BaseURL + "/api/download-zip?" + url.Values{"file": files}.Encode()
+}
 
-	if req.ImageHeight > 0 {
-		args = append(args, fmt.Sprintf("-height=%d", req.ImageHeight))
-	}
+// fileURL returns the URL an output file is served from
+func fileURL(path string) string {
+	return fmt.Sprintf("%s/files/%s", config.BaseURL, filepath.Base(path))
+}
 
-	// Add any custom parameters from the request
-	for key, value := range req.CustomParams {
-		args = append(args, fmt.Sprintf("-%s=%s", key, value))
+// metaOutputURLs maps each meta output format to its download URL
+func metaOutputURLs(htmlPath string) map[string]string {
+	urls := make(map[string]string, len(metaOutputs))
+	for _, format := range MetaFormats() {
+		urls[format] = fileURL(metaOutputPath(htmlPath, format))
 	}
+	return urls
+}
 
-	return args
+// previewImageURLs maps each stored preview image to its URL
+func previewImageURLs(htmlPath string) map[string]string {
+	urls := make(map[string]string)
+	for key, path := range previewImageFiles(htmlPath) {
+		urls[key] = fileURL(path)
+	}
+	return urls
 }
 
 // getOutputDir returns the configured output directory
@@ -1181,10 +1601,9 @@ func StartCleanupTask(db *Database) {
 		// Run cleanup on the ticker interval
 		for range ticker.C {
 			log.Printf("Running scheduled cleanup")
-			if err := db.RunCleanup(); err != nil {
+			if _, err := db.RunCleanup(); err != nil {
 				log.Printf("Error running scheduled cleanup: %v", err)
 			}
 		}
 	}()
 }
-
@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 // TestLoadConfig tests the configuration loading from environment variables
@@ -80,58 +81,37 @@ func TestGenerateRequestID(t *testing.T) {
 	}
 }
 
-// TestBuildGeneratorArgs tests argument construction from requests
-func TestBuildGeneratorArgs(t *testing.T) {
-	// Create a mock request
+// TestParametersFromForm tests mapping form fields onto generation parameters
+func TestParametersFromForm(t *testing.T) {
 	form := url.Values{}
-	form.Add("url", "https://example.com")
-	form.Add("title", "Test Title")
-	form.Add("description", "Test Description")
-	form.Add("debug", "true")
-	
-	testReq := httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(form.Encode()))
-	testReq.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	testReq.Form = form
-	
-	// Convert to GenerateRequest
-	generateReq := GenerateRequest{
-		URL:         "https://example.com",
-		Title:       "Test Title",
-		Description: "Test Description",
-		CustomParams: map[string]string{
-			"debug": "true",
-		},
-	}
-	
-	// Set output paths
-	imgPath := "/tmp/test_image.png"
-	htmlPath := "/tmp/test_meta.html"
-	
-	// Call the function
-	args := buildGeneratorArgs(generateReq, imgPath, htmlPath)
-	
-	// Check expected arguments are present
-	expectedArgs := []string{
-		"-url=https://example.com",
-		"-title=Test Title", 
-		"-description=Test Description",
-		"-debug=true",
-		"-output=" + imgPath,
-		"-html=" + htmlPath,
-	}
-	
-	// Check each expected arg is in the result
-	for _, expected := range expectedArgs {
-		found := false
-		for _, arg := range args {
-			if arg == expected {
-				found = true
-				break
-			}
-		}
-		if !found {
-			t.Errorf("Expected argument %s not found in result: %v", expected, args)
-		}
+	form.Set("url", "https://example.com")
+	form.Set("title", "Test Title")
+	form.Set("targetUrl", "https://example.com/post")
+	form.Set("twitter-card", "summary")
+	form.Set("width", "800")
+	form.Set("quality", "not-a-number")
+	form.Set("debug", "on")
+	form.Set("output", "/etc/passwd")
+
+	params := parametersFromForm(form)
+
+	if params.WebpageURL != "https://example.com" {
+		t.Errorf("Expected WebpageURL https://example.com, got %s", params.WebpageURL)
+	}
+	if params.TargetURL != "https://example.com/post" {
+		t.Errorf("Expected TargetURL from targetUrl, got %s", params.TargetURL)
+	}
+	if params.TwitterCard != "summary" {
+		t.Errorf("Expected TwitterCard summary, got %s", params.TwitterCard)
+	}
+	if params.ImageWidth != 800 {
+		t.Errorf("Expected ImageWidth 800, got %d", params.ImageWidth)
+	}
+	if params.Quality != 0 {
+		t.Errorf("Expected invalid quality to be ignored, got %d", params.Quality)
+	}
+	if !params.Debug {
+		t.Errorf("Expected Debug to be true")
 	}
 }
 
@@ -161,6 +141,29 @@ func TestHealthEndpoint(t *testing.T) {
 	}
 }
 
+// TestGenerationAssetURLs tests that only completed generations link to their files
+func TestGenerationAssetURLs(t *testing.T) {
+	savedDB := dbInstance
+	defer func() { dbInstance = savedDB }()
+	dbInstance = newTestDatabase(t)
+
+	for _, status := range []string{"completed", "failed"} {
+		gen := &Generation{ID: "assets-" + status, Status: status, ImagePath: "outputs/a.png", HTMLPath: "outputs/a.html", CreatedAt: time.Now()}
+		if err := dbInstance.SaveGeneration(gen); err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		handleGetGenerationRequest(w, httptest.NewRequest(http.MethodGet, "/api/generation/"+gen.ID, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", status, w.Code, w.Body.String())
+		}
+		if got := strings.Contains(w.Body.String(), `"image_url"`); got != (status == "completed") {
+			t.Errorf("%s generation: image_url present = %v: %s", status, got, w.Body.String())
+		}
+	}
+}
+
 // TestCORSHeaders tests that CORS headers are set correctly
 func TestCORSHeaders(t *testing.T) {
 	// Enable CORS for this test
@@ -235,4 +238,4 @@ func mockExecCommand(shouldErr bool) func(name string, arg ...string) *exec.Cmd
 	}
 }
 
-// Note: Integration tests would be implemented in a separate file 
\ No newline at end of file
+// Note: Integration tests would be implemented in a separate file 
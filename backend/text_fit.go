@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/chromedp/chromedp"
+)
+
+// Strategies the text fitter can apply to an element
+const (
+	FitNone     = "none"     // The text fit at the largest size
+	FitShrink   = "shrink"   // The font size was reduced until the text fit
+	FitTruncate = "truncate" // Even the smallest size overflowed, so the text was cut with an ellipsis
+)
+
+// Largest font size a fit range may ask for, in CSS pixels
+const maxFitFontSize = 400
+
+// TextFit reports how the text of one data-fit element was fitted
+type TextFit struct {
+	Element  string  `json:"element"` // Value of the element's data-fit attribute
+	Strategy string  `json:"strategy"`
+	FontSize float64 `json:"font_size"`      // Final size in CSS pixels
+	Text     string  `json:"text,omitempty"` // Text shown after truncation
+}
+
+// decodeTextFit reads the text fit stored with a generation, returning nil
+// when there is none
+func decodeTextFit(data string) []TextFit {
+	if data == "" {
+		return nil
+	}
+	var fits []TextFit
+	if err := json.Unmarshal([]byte(data), &fits); err != nil {
+		log.Printf("Error decoding stored text fit: %v", err)
+		return nil
+	}
+	return fits
+}
+
+// fitRange overrides the font size range of one data-fit element
+type fitRange struct {
+	Min float64 `json:"min,omitempty"`
+	Max float64 `json:"max,omitempty"`
+}
+
+// fitTextScript fits every element marked with data-fit to its box. The
+// box is the element's own size, so templates bound it with max-height and
+// overflow: hidden. The font size is searched between data-fit-min and
+// data-fit-max; if the text overflows at the minimum, words are dropped from
+// the end and an ellipsis added until it fits.
+const fitTextScript = `(function(ranges) {
+	const fits = el => el.scrollHeight <= el.clientHeight + 1 && el.scrollWidth <= el.clientWidth + 1;
+	const round = n => Math.round(n * 10) / 10;
+	return Array.from(document.querySelectorAll('[data-fit]'), el => {
+		const name = el.dataset.fit;
+		const range = ranges[name] || {};
+		const max = range.max || parseFloat(el.dataset.fitMax) || parseFloat(getComputedStyle(el).fontSize);
+		const min = Math.min(range.min || parseFloat(el.dataset.fitMin) || max, max);
+
+		el.style.fontSize = max + 'px';
+		if (fits(el)) {
+			return {element: name, strategy: 'none', font_size: round(max)};
+		}
+
+		el.style.fontSize = min + 'px';
+		if (fits(el)) {
+			let lo = min, hi = max;
+			while (hi - lo > 0.5) {
+				const mid = (lo + hi) / 2;
+				el.style.fontSize = mid + 'px';
+				if (fits(el)) { lo = mid; } else { hi = mid; }
+			}
+			el.style.fontSize = lo + 'px';
+			return {element: name, strategy: 'shrink', font_size: round(lo)};
+		}
+
+		// Keep as many whole words as fit, then cut a single long word
+		const words = el.textContent.trim().split(/\s+/);
+		const show = text => { el.textContent = text.replace(/[\s.,;:!?–—-]+$/, '') + '…'; };
+		let lo = 0, hi = words.length - 1;
+		while (lo < hi) {
+			const mid = Math.ceil((lo + hi) / 2);
+			show(words.slice(0, mid).join(' '));
+			if (fits(el)) { lo = mid; } else { hi = mid - 1; }
+		}
+		if (lo > 0) {
+			show(words.slice(0, lo).join(' '));
+		} else {
+			let chars = Array.from(words[0] || '');
+			do {
+				chars.pop();
+				show(chars.join(''));
+			} while (chars.length > 1 && !fits(el));
+		}
+		return {element: name, strategy: 'truncate', font_size: round(min), text: el.textContent};
+	});
+})(%s)`
+
+// titleFitRange collects the title size range sent with a generation
+func titleFitRange(params GenerationParameters) (map[string]fitRange, error) {
+	minSize, maxSize := params.TitleMinFontSize, params.TitleMaxFontSize
+	if minSize < 0 || maxSize < 0 || minSize > maxFitFontSize || maxSize > maxFitFontSize {
+		return nil, fmt.Errorf("title font sizes must be between 1 and %d", maxFitFontSize)
+	}
+	if minSize > 0 && maxSize > 0 && minSize > maxSize {
+		return nil, fmt.Errorf("title minimum font size %d is larger than the maximum %d", minSize, maxSize)
+	}
+
+	ranges := map[string]fitRange{}
+	if minSize > 0 || maxSize > 0 {
+		ranges["title"] = fitRange{Min: float64(minSize), Max: float64(maxSize)}
+	}
+	return ranges, nil
+}
+
+// fitText runs the fitter over the loaded card and stores what it did
+func fitText(ranges map[string]fitRange, fits *[]TextFit) chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		arg, err := json.Marshal(ranges)
+		if err != nil {
+			return err
+		}
+		if err := chromedp.Evaluate(fmt.Sprintf(fitTextScript, arg), fits).Do(ctx); err != nil {
+			return fmt.Errorf("failed to fit text: %w", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTitleFitRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max int
+		want     fitRange
+		wantErr  bool
+	}{
+		{"template defaults", 0, 0, fitRange{}, false},
+		{"both", 32, 80, fitRange{Min: 32, Max: 80}, false},
+		{"only max", 0, 50, fitRange{Max: 50}, false},
+		{"min above max", 80, 32, fitRange{}, true},
+		{"negative", -1, 0, fitRange{}, true},
+		{"too large", 0, maxFitFontSize + 1, fitRange{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges, err := titleFitRange(GenerationParameters{TitleMinFontSize: tt.min, TitleMaxFontSize: tt.max})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("titleFitRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && ranges["title"] != tt.want {
+				t.Errorf("titleFitRange() = %+v, want %+v", ranges["title"], tt.want)
+			}
+		})
+	}
+}
+
+func TestBuiltinTemplatesFitTitle(t *testing.T) {
+	templates, err := ListCardTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tmpl := range templates {
+		html, err := renderCardTemplate(tmpl.Name, CardData{Title: "T", Description: "D", Width: 1200, Height: 630})
+		if err != nil {
+			t.Fatalf("%s: %v", tmpl.Name, err)
+		}
+		for _, want := range []string{`data-fit="title"`, `data-fit="description"`, "max-height"} {
+			if !strings.Contains(html, want) {
+				t.Errorf("%s is missing %s", tmpl.Name, want)
+			}
+		}
+	}
+}
+
+// TestTextFitStored checks that the text fit of a queued generation is
+// reported by the status endpoint and with its batch
+func TestTextFitStored(t *testing.T) {
+	savedDB := dbInstance
+	defer func() { dbInstance = savedDB }()
+	dbInstance = newTestDatabase(t)
+
+	now := time.Now()
+	if err := dbInstance.SaveBatch(&Batch{ID: "fit-batch", Status: "running", Total: 1, CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	gen := &Generation{ID: "fit-test", Status: "completed", ImagePath: "outputs/a.png", HTMLPath: "outputs/a.html", CreatedAt: now, BatchID: "fit-batch"}
+	if err := dbInstance.SaveGeneration(gen); err != nil {
+		t.Fatal(err)
+	}
+	fits := []TextFit{{Element: "title", Strategy: FitShrink, FontSize: 52.5}}
+	if err := dbInstance.SetTextFit(gen.ID, fits); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	handleGetGenerationRequest(w, httptest.NewRequest(http.MethodGet, "/api/generation/"+gen.ID, nil))
+	var response struct {
+		TextFit []TextFit `json:"text_fit"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(response.TextFit, fits) {
+		t.Errorf("status text_fit = %+v, want %+v", response.TextFit, fits)
+	}
+
+	batch, err := dbInstance.GetBatch("fit-batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Items) != 1 || !reflect.DeepEqual(batch.Items[0].TextFit, fits) {
+		t.Errorf("batch items = %+v, want the stored text fit", batch.Items)
+	}
+}
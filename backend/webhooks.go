@@ -0,0 +1,524 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Events a webhook is sent for
+const (
+	WebhookGenerationCompleted = "generation.completed"
+	WebhookGenerationFailed    = "generation.failed"
+	WebhookBatchCompleted      = "batch.completed"
+)
+
+const (
+	webhookTimeout      = 10 * time.Second
+	webhookPollInterval = 5 * time.Second
+	webhookBatchSize    = 20 // Deliveries attempted per poll
+	webhookMaxAttempts  = 8
+	webhookBaseBackoff  = 30 * time.Second // Wait after the first failed attempt, doubled after each one
+	webhookMaxBackoff   = time.Hour
+	webhookRetention    = 7 * 24 * time.Hour // Finished deliveries are kept this long
+	webhookUserAgent    = "ogdrip-webhooks/1.0 (+https://og-drip.com)"
+)
+
+// WebhookClient is an API client allowed to register callback URLs. Its
+// secret signs the webhooks it receives.
+type WebhookClient struct {
+	Name   string
+	APIKey string
+	Secret string
+}
+
+// parseWebhookClients reads WEBHOOK_CLIENTS, a comma-separated list of
+// name:api_key:secret entries
+func parseWebhookClients(value string) ([]WebhookClient, error) {
+	var clients []WebhookClient
+	seen := make(map[string]bool)
+	for _, entry := range splitList(value) {
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("webhook client %q is not name:api_key:secret", parts[0])
+		}
+		if seen[parts[0]] {
+			return nil, fmt.Errorf("webhook client %q is listed twice", parts[0])
+		}
+		seen[parts[0]] = true
+		clients = append(clients, WebhookClient{Name: parts[0], APIKey: parts[1], Secret: parts[2]})
+	}
+	return clients, nil
+}
+
+// requestWebhookClient returns the client whose key is in the request's
+// X-API-Key header, or nil
+func requestWebhookClient(r *http.Request) *WebhookClient {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return nil
+	}
+	for i := range config.WebhookClients {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(config.WebhookClients[i].APIKey)) == 1 {
+			return &config.WebhookClients[i]
+		}
+	}
+	return nil
+}
+
+// webhookClientByName returns a configured client, or nil
+func webhookClientByName(name string) *WebhookClient {
+	for i := range config.WebhookClients {
+		if config.WebhookClients[i].Name == name {
+			return &config.WebhookClients[i]
+		}
+	}
+	return nil
+}
+
+// callbackClient returns the client a callback URL is registered for. A
+// callback needs webhooks to be enabled and a valid X-API-Key, since the
+// client's secret signs what is sent to it.
+func callbackClient(r *http.Request, callbackURL string) (*WebhookClient, error) {
+	if callbackURL == "" {
+		return nil, nil
+	}
+	if webhooks == nil {
+		return nil, &ValidationError{Fields: []FieldError{{Field: "callback_url", Message: "webhooks are not enabled on this server"}}}
+	}
+	client := requestWebhookClient(r)
+	if client == nil {
+		return nil, &ValidationError{Fields: []FieldError{{Field: "callback_url", Message: "requires a valid X-API-Key header"}}}
+	}
+	return client, nil
+}
+
+// signWebhook signs a webhook body sent at the given time. The signature
+// covers "<unix time>.<body>" so receivers can reject replayed requests.
+func signWebhook(secret string, sentAt time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(sentAt.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff is the wait before retrying a delivery that has failed
+// the given number of times
+func webhookBackoff(attempts int) time.Duration {
+	wait := webhookBaseBackoff
+	for i := 1; i < attempts && wait < webhookMaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, webhookMaxBackoff)
+}
+
+// WebhookPayload is the JSON body of a webhook
+type WebhookPayload struct {
+	ID        string      `json:"id"` // Shared by every delivery of the event
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// WebhookDelivery is one webhook and its delivery attempts
+type WebhookDelivery struct {
+	ID            string          `json:"id"`
+	Client        string          `json:"-"`
+	Event         string          `json:"event"`
+	SubjectID     string          `json:"subject_id"` // Generation or batch the event is about
+	URL           string          `json:"url"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"` // pending, delivered or failed
+	Attempts      int             `json:"attempts"`
+	ResponseCode  int             `json:"response_code,omitempty"` // Status of the last response
+	LastError     string          `json:"last_error,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+	NextAttemptAt *time.Time      `json:"next_attempt_at,omitempty"`
+	DeliveredAt   *time.Time      `json:"delivered_at,omitempty"`
+}
+
+// WebhookDispatcher delivers webhooks from the delivery log, retrying
+// failed deliveries with exponential backoff
+type WebhookDispatcher struct {
+	db     *Database
+	client *http.Client
+	wake   chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// webhooks sends the service's webhooks. It is nil when no webhook
+// clients are configured or the database is unavailable.
+var webhooks *WebhookDispatcher
+
+// NewWebhookDispatcher creates a dispatcher that sends webhooks with
+// client. Redirects are not followed, so a callback cannot bounce a
+// signed payload elsewhere.
+func NewWebhookDispatcher(db *Database, client *http.Client) *WebhookDispatcher {
+	c := *client
+	c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &WebhookDispatcher{
+		db:     db,
+		client: &c,
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start begins delivering webhooks in the background
+func (d *WebhookDispatcher) Start() {
+	go d.run()
+}
+
+// Stop waits for the delivery in progress, then stops the dispatcher.
+// Pending deliveries stay in the log for the next start.
+func (d *WebhookDispatcher) Stop() {
+	close(d.stop)
+	<-d.done
+}
+
+// run delivers due webhooks whenever one is queued and on every poll
+func (d *WebhookDispatcher) run() {
+	defer close(d.done)
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+		d.deliverDue(time.Now().UTC())
+	}
+}
+
+// notify wakes the dispatcher to send a new delivery right away
+func (d *WebhookDispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Enqueue records a webhook for a client and schedules its delivery
+func (d *WebhookDispatcher) Enqueue(client, event, subjectID, url string, data interface{}) (*WebhookDelivery, error) {
+	now := time.Now().UTC()
+	id := generateRequestID()
+	payload, err := json.Marshal(WebhookPayload{ID: id, Event: event, CreatedAt: now, Data: data})
+	if err != nil {
+		return nil, err
+	}
+
+	delivery := &WebhookDelivery{
+		ID:            id,
+		Client:        client,
+		Event:         event,
+		SubjectID:     subjectID,
+		URL:           url,
+		Payload:       payload,
+		Status:        "pending",
+		CreatedAt:     now,
+		NextAttemptAt: &now,
+	}
+	if err := d.db.SaveWebhookDelivery(delivery); err != nil {
+		return nil, err
+	}
+	d.notify()
+	return delivery, nil
+}
+
+// Redeliver sends a delivery's payload again as a new delivery, leaving
+// the original in the log. The payload keeps its event ID so receivers
+// can tell it is a repeat.
+func (d *WebhookDispatcher) Redeliver(original *WebhookDelivery) (*WebhookDelivery, error) {
+	now := time.Now().UTC()
+	delivery := &WebhookDelivery{
+		ID:            generateRequestID(),
+		Client:        original.Client,
+		Event:         original.Event,
+		SubjectID:     original.SubjectID,
+		URL:           original.URL,
+		Payload:       original.Payload,
+		Status:        "pending",
+		CreatedAt:     now,
+		NextAttemptAt: &now,
+	}
+	if err := d.db.SaveWebhookDelivery(delivery); err != nil {
+		return nil, err
+	}
+	d.notify()
+	return delivery, nil
+}
+
+// deliverDue attempts every pending delivery that is due at now
+func (d *WebhookDispatcher) deliverDue(now time.Time) {
+	deliveries, err := d.db.DueWebhookDeliveries(now, webhookBatchSize)
+	if err != nil {
+		log.Printf("Error loading due webhook deliveries: %v", err)
+		return
+	}
+	for _, delivery := range deliveries {
+		d.attempt(delivery, now)
+		if err := d.db.UpdateWebhookDelivery(delivery); err != nil {
+			log.Printf("Error recording webhook delivery %s: %v", delivery.ID, err)
+		}
+	}
+}
+
+// attempt sends a delivery once, then marks it delivered, schedules a
+// retry or gives up
+func (d *WebhookDispatcher) attempt(delivery *WebhookDelivery, now time.Time) {
+	delivery.Attempts++
+	delivery.ResponseCode = 0
+
+	err := d.send(delivery, now)
+	if err == nil {
+		delivery.Status = "delivered"
+		delivery.LastError = ""
+		delivery.DeliveredAt = &now
+		delivery.NextAttemptAt = nil
+		log.Printf("Delivered webhook %s (%s) to %s", delivery.ID, delivery.Event, delivery.URL)
+		return
+	}
+
+	delivery.LastError = err.Error()
+	if delivery.Attempts >= webhookMaxAttempts || errors.Is(err, errUnknownWebhookClient) {
+		delivery.Status = "failed"
+		delivery.NextAttemptAt = nil
+		log.Printf("Giving up on webhook %s after %d attempts: %v", delivery.ID, delivery.Attempts, err)
+		return
+	}
+	next := now.Add(webhookBackoff(delivery.Attempts))
+	delivery.NextAttemptAt = &next
+	log.Printf("Webhook %s failed (attempt %d), retrying at %s: %v", delivery.ID, delivery.Attempts, next.Format(time.RFC3339), err)
+}
+
+// errUnknownWebhookClient fails deliveries whose client has been removed
+// from the configuration, as there is no secret left to sign them with
+var errUnknownWebhookClient = errors.New("webhook client is no longer configured")
+
+// send POSTs a signed delivery, succeeding on any 2xx response
+func (d *WebhookDispatcher) send(delivery *WebhookDelivery, now time.Time) error {
+	client := webhookClientByName(delivery.Client)
+	if client == nil {
+		return errUnknownWebhookClient
+	}
+
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, strings.NewReader(string(delivery.Payload)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", webhookUserAgent)
+	req.Header.Set("X-OGDrip-Event", delivery.Event)
+	req.Header.Set("X-OGDrip-Delivery", delivery.ID)
+	req.Header.Set("X-OGDrip-Signature", signWebhook(client.Secret, now, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	delivery.ResponseCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %s", resp.Status)
+	}
+	return nil
+}
+
+// generationAssetURLs lists the download URLs of a finished generation,
+// along with how its card text was fitted and its merged metadata
+func generationAssetURLs(generation *Generation) map[string]interface{} {
+	urls := map[string]interface{}{
+		"image_url":   fileURL(generation.ImagePath),
+		"meta_url":    fileURL(generation.HTMLPath),
+		"zip_url":     zipDownloadURL(generationFiles(generation.ImagePath, generation.HTMLPath)),
+		"outputs":     metaOutputURLs(generation.HTMLPath),
+		"preview_url": fileURL(previewGalleryPath(generation.HTMLPath)),
+	}
+	if previews := previewImageURLs(generation.HTMLPath); len(previews) > 0 {
+		urls["preview_images"] = previews
+	}
+	if fits := decodeTextFit(generation.TextFit); len(fits) > 0 {
+		urls["text_fit"] = fits
+	}
+	stored := decodeMetadata(generation.Metadata)
+	if len(stored.Fields) > 0 {
+		urls["metadata"] = stored.Fields
+	}
+	if stored.Extracted != nil {
+		urls["extracted"] = stored.Extracted
+	}
+	return urls
+}
+
+// notifyGeneration queues the webhook of a finished generation that was
+// requested with a callback URL. Batch items are reported by their batch.
+func notifyGeneration(id string) {
+	if webhooks == nil || db == nil {
+		return
+	}
+	generation, err := db.GetGeneration(id)
+	if err != nil {
+		log.Printf("Error loading generation %s for its webhook: %v", id, err)
+		return
+	}
+	if generation.WebhookClient == "" || generation.BatchID != "" {
+		return
+	}
+	var params GenerationParameters
+	if err := json.Unmarshal([]byte(generation.Parameters), &params); err != nil || params.CallbackURL == "" {
+		return
+	}
+
+	event := WebhookGenerationCompleted
+	data := map[string]interface{}{"generation": generation}
+	if generation.Status == "completed" {
+		for key, value := range generationAssetURLs(generation) {
+			data[key] = value
+		}
+	} else {
+		event = WebhookGenerationFailed
+	}
+	if _, err := webhooks.Enqueue(generation.WebhookClient, event, id, params.CallbackURL, data); err != nil {
+		log.Printf("Error queueing webhook for generation %s: %v", id, err)
+	}
+}
+
+// notifyBatch queues the webhook of a finished batch that was submitted
+// with a callback URL
+func notifyBatch(batch *Batch) {
+	if webhooks == nil || batch.CallbackURL == "" {
+		return
+	}
+	batch.setURLs()
+	if _, err := webhooks.Enqueue(batch.WebhookClient, WebhookBatchCompleted, batch.ID, batch.CallbackURL, batch); err != nil {
+		log.Printf("Error queueing webhook for batch %s: %v", batch.ID, err)
+	}
+}
+
+// webhookRequestClient authenticates a request to the delivery log
+// endpoints, writing an error response when that fails
+func webhookRequestClient(w http.ResponseWriter, r *http.Request) *WebhookClient {
+	if webhooks == nil {
+		sendErrorResponse(w, "Webhooks are not enabled on this server", http.StatusServiceUnavailable)
+		return nil
+	}
+	client := requestWebhookClient(r)
+	if client == nil {
+		sendErrorResponse(w, "A valid X-API-Key header is required", http.StatusUnauthorized)
+		return nil
+	}
+	return client
+}
+
+// handleWebhookDeliveriesRequest lists the caller's webhook deliveries,
+// newest first
+func handleWebhookDeliveriesRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	client := webhookRequestClient(w, r)
+	if client == nil {
+		return
+	}
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	offset = max(offset, 0)
+
+	deliveries, err := webhooks.db.ListWebhookDeliveries(client.Name, limit, offset)
+	if err != nil {
+		log.Printf("Error listing webhook deliveries: %v", err)
+		sendErrorResponse(w, "Failed to list webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []*WebhookDelivery{}
+	}
+
+	sendJSONResponse(w, map[string]interface{}{
+		"success": true,
+		"data":    deliveries,
+		"pagination": map[string]interface{}{
+			"limit":  limit,
+			"offset": offset,
+		},
+	})
+}
+
+// handleWebhookDeliveryRequest returns one of the caller's deliveries, or
+// redelivers it on POST /api/webhooks/deliveries/{id}/redeliver
+func handleWebhookDeliveryRequest(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/webhooks/deliveries/")
+	id, redeliver := strings.CutSuffix(path, "/redeliver")
+	switch {
+	case id == "" || strings.Contains(id, "/"):
+		sendErrorResponse(w, "Delivery ID is required", http.StatusBadRequest)
+		return
+	case redeliver && r.Method != http.MethodPost, !redeliver && r.Method != http.MethodGet:
+		sendErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	client := webhookRequestClient(w, r)
+	if client == nil {
+		return
+	}
+
+	// Other clients' deliveries are reported as missing
+	delivery, err := webhooks.db.GetWebhookDelivery(id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && delivery.Client != client.Name) {
+		sendErrorResponse(w, "Delivery not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error retrieving webhook delivery %s: %v", id, err)
+		sendErrorResponse(w, "Failed to retrieve webhook delivery", http.StatusInternalServerError)
+		return
+	}
+
+	if !redeliver {
+		sendJSONResponse(w, map[string]interface{}{
+			"success": true,
+			"data":    delivery,
+		})
+		return
+	}
+
+	redelivery, err := webhooks.Redeliver(delivery)
+	if err != nil {
+		log.Printf("Error redelivering webhook %s: %v", id, err)
+		sendErrorResponse(w, "Failed to redeliver webhook", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/api/webhooks/deliveries/%s", config.BaseURL, redelivery.ID))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"data":    redelivery,
+	})
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useWebhookClients configures webhook clients for the rest of a test
+func useWebhookClients(t *testing.T, clients ...WebhookClient) {
+	saved := config.WebhookClients
+	t.Cleanup(func() { config.WebhookClients = saved })
+	config.WebhookClients = clients
+}
+
+func TestParseWebhookClients(t *testing.T) {
+	clients, err := parseWebhookClients("shop:key-1:secret:with:colons, blog:key-2:s2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 2 || clients[0].Secret != "secret:with:colons" || clients[1].Name != "blog" {
+		t.Errorf("clients = %+v", clients)
+	}
+	for _, value := range []string{"shop:key", "shop::secret", "a:k1:s1,a:k2:s2"} {
+		if _, err := parseWebhookClients(value); err == nil {
+			t.Errorf("%q should be rejected", value)
+		}
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	body := []byte(`{"event":"generation.completed"}`)
+	signature := signWebhook("secret", time.Unix(1700000000, 0), body)
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1700000000." + string(body)))
+	if want := "t=1700000000,v1=" + hex.EncodeToString(mac.Sum(nil)); signature != want {
+		t.Errorf("signature = %q, want %q", signature, want)
+	}
+
+	backoffs := map[int]time.Duration{1: 30 * time.Second, 2: time.Minute, 4: 4 * time.Minute, 7: 32 * time.Minute, 8: time.Hour, 50: time.Hour}
+	for attempts, want := range backoffs {
+		if got := webhookBackoff(attempts); got != want {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestWebhookDispatcher(t *testing.T) {
+	useWebhookClients(t, WebhookClient{Name: "shop", APIKey: "key", Secret: "secret"})
+
+	var mu sync.Mutex
+	var requests []*http.Request
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r)
+		bodies = append(bodies, string(body))
+		switch {
+		case r.URL.Path == "/moved":
+			http.Redirect(w, r, "/hook", http.StatusFound)
+		case len(requests) == 1:
+			http.Error(w, "try again", http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	sent := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(requests)
+	}
+
+	database := newTestDatabase(t)
+	dispatcher := NewWebhookDispatcher(database, server.Client())
+
+	delivery, err := dispatcher.Enqueue("shop", WebhookGenerationCompleted, "gen1", server.URL+"/hook", map[string]string{"id": "gen1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	dispatcher.deliverDue(now)
+	stored, err := database.GetWebhookDelivery(delivery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != "pending" || stored.Attempts != 1 || stored.ResponseCode != 500 || stored.NextAttemptAt == nil {
+		t.Fatalf("after a failed attempt: %+v", stored)
+	}
+	if wait := stored.NextAttemptAt.Sub(now); wait < 29*time.Second || wait > 31*time.Second {
+		t.Errorf("retry scheduled %v later, want 30s", wait)
+	}
+
+	// Nothing is sent again until the retry is due
+	dispatcher.deliverDue(now.Add(time.Second))
+	dispatcher.deliverDue(now.Add(31 * time.Second))
+	if stored, _ = database.GetWebhookDelivery(delivery.ID); stored.Status != "delivered" || stored.Attempts != 2 || stored.DeliveredAt == nil {
+		t.Errorf("after the retry: %+v", stored)
+	}
+	if sent() != 2 {
+		t.Fatalf("%d requests sent, want 2", sent())
+	}
+
+	mu.Lock()
+	r, body := requests[1], bodies[1]
+	mu.Unlock()
+	if r.Header.Get("X-OGDrip-Event") != WebhookGenerationCompleted || r.Header.Get("X-OGDrip-Delivery") != delivery.ID {
+		t.Errorf("headers = %v", r.Header)
+	}
+	if want := signWebhook("secret", now.Add(31*time.Second), []byte(body)); r.Header.Get("X-OGDrip-Signature") != want {
+		t.Errorf("signature = %q, want %q", r.Header.Get("X-OGDrip-Signature"), want)
+	}
+	var payload WebhookPayload
+	if err := json.Unmarshal([]byte(body), &payload); err != nil || payload.ID != delivery.ID || payload.Event != WebhookGenerationCompleted {
+		t.Errorf("payload = %s (%v)", body, err)
+	}
+
+	// Redirects are failures rather than followed
+	moved, _ := dispatcher.Enqueue("shop", WebhookGenerationCompleted, "gen2", server.URL+"/moved", nil)
+	dispatcher.deliverDue(time.Now().UTC())
+	if stored, _ = database.GetWebhookDelivery(moved.ID); stored.Status != "pending" || stored.ResponseCode != http.StatusFound || sent() != 3 {
+		t.Errorf("redirected delivery = %+v after %d requests", stored, sent())
+	}
+
+	// Without its client there is no secret to sign with
+	orphan, _ := dispatcher.Enqueue("removed", WebhookGenerationFailed, "gen3", server.URL+"/hook", nil)
+	dispatcher.deliverDue(time.Now().UTC())
+	if stored, _ = database.GetWebhookDelivery(orphan.ID); stored.Status != "failed" || sent() != 3 {
+		t.Errorf("orphaned delivery = %+v", stored)
+	}
+}
+
+func TestWebhookDeliveryHandlers(t *testing.T) {
+	useWebhookClients(t,
+		WebhookClient{Name: "shop", APIKey: "shop-key", Secret: "s1"},
+		WebhookClient{Name: "blog", APIKey: "blog-key", Secret: "s2"},
+	)
+	savedDB, savedWebhooks := db, webhooks
+	defer func() { db, webhooks = savedDB, savedWebhooks }()
+	db = newTestDatabase(t)
+	webhooks = NewWebhookDispatcher(db, http.DefaultClient)
+
+	delivery, err := webhooks.Enqueue("shop", WebhookBatchCompleted, "batch1", "https://example.com/hook", map[string]string{"id": "batch1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(method, path, key string, handler http.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	if rec := call(http.MethodGet, "/api/webhooks/deliveries", "", handleWebhookDeliveriesRequest); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a key, got %d", rec.Code)
+	}
+	var list struct {
+		Data []WebhookDelivery `json:"data"`
+	}
+	rec := call(http.MethodGet, "/api/webhooks/deliveries", "blog-key", handleWebhookDeliveriesRequest)
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil || len(list.Data) != 0 {
+		t.Errorf("another client's deliveries were listed: %+v (%v)", list.Data, err)
+	}
+	rec = call(http.MethodGet, "/api/webhooks/deliveries", "shop-key", handleWebhookDeliveriesRequest)
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil || len(list.Data) != 1 || list.Data[0].ID != delivery.ID {
+		t.Errorf("deliveries = %+v (%v)", list.Data, err)
+	}
+
+	path := "/api/webhooks/deliveries/" + delivery.ID
+	if rec := call(http.MethodGet, path, "blog-key", handleWebhookDeliveryRequest); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for another client's delivery, got %d", rec.Code)
+	}
+	if rec := call(http.MethodGet, path, "shop-key", handleWebhookDeliveryRequest); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"subject_id":"batch1"`) {
+		t.Errorf("Expected the delivery, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = call(http.MethodPost, path+"/redeliver", "shop-key", handleWebhookDeliveryRequest)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var redelivery struct {
+		Data WebhookDelivery `json:"data"`
+	}
+	json.NewDecoder(rec.Body).Decode(&redelivery)
+	if redelivery.Data.ID == delivery.ID || redelivery.Data.Status != "pending" || string(redelivery.Data.Payload) != string(delivery.Payload) {
+		t.Errorf("redelivery = %+v, want a new delivery of the same payload", redelivery.Data)
+	}
+}
+
+func TestGenerateCallback(t *testing.T) {
+	useWebhookClients(t, WebhookClient{Name: "shop", APIKey: "shop-key", Secret: "s1"})
+	savedDB, savedQueue, savedWebhooks, savedDir := db, jobQueue, webhooks, config.OutputDir
+	defer func() { db, jobQueue, webhooks, config.OutputDir = savedDB, savedQueue, savedWebhooks, savedDir }()
+	db = newTestDatabase(t)
+	config.OutputDir = t.TempDir()
+	jobQueue = NewJobQueue(1, 10, time.Minute, func(ctx context.Context, job *Job) (*Result, error) {
+		defer notifyGeneration(job.ID)
+		fields := map[string]MetadataField{"title": {Value: job.Params.Title, Source: SourceUser}}
+		if err := db.SetMetadata(job.ID, fields, nil); err != nil {
+			t.Error(err)
+		}
+		recordGenerationStatus(job.ID, "completed", "")
+		return &Result{}, nil
+	})
+	jobQueue.Start()
+	defer jobQueue.Stop()
+
+	generate := func(key string) *httptest.ResponseRecorder {
+		body := `{"title": "Hello", "callback_url": "https://example.com/hook"}`
+		req := httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		handleGenerateRequest(rec, req)
+		return rec
+	}
+
+	webhooks = nil
+	if rec := generate("shop-key"); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "not enabled") {
+		t.Errorf("Expected callbacks to be refused while webhooks are off, got %d: %s", rec.Code, rec.Body.String())
+	}
+	webhooks = NewWebhookDispatcher(db, http.DefaultClient)
+	if rec := generate("wrong-key"); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "X-API-Key") {
+		t.Errorf("Expected an unknown key to be refused, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec := generate("shop-key")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected a callback request to be async, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var response APIResponse
+	json.NewDecoder(rec.Body).Decode(&response)
+
+	var deliveries []*WebhookDelivery
+	deadline := time.Now().Add(5 * time.Second)
+	for len(deliveries) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		deliveries, _ = db.ListWebhookDeliveries("shop", 10, 0)
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("%d webhooks queued, want 1", len(deliveries))
+	}
+	d := deliveries[0]
+	if d.Event != WebhookGenerationCompleted || d.SubjectID != response.ID || d.URL != "https://example.com/hook" {
+		t.Errorf("delivery = %+v", d)
+	}
+	if !strings.Contains(string(d.Payload), `"image_url"`) || !strings.Contains(string(d.Payload), `"status":"completed"`) {
+		t.Errorf("payload = %s, want the generation and its asset URLs", d.Payload)
+	}
+	if !strings.Contains(string(d.Payload), `"metadata":{"title":{"value":"Hello","source":"user"}}`) {
+		t.Errorf("payload = %s, want the merged metadata", d.Payload)
+	}
+
+	// The status endpoint reports the same metadata
+	savedInstance := dbInstance
+	defer func() { dbInstance = savedInstance }()
+	dbInstance = db
+	status := httptest.NewRecorder()
+	handleGetGenerationRequest(status, httptest.NewRequest(http.MethodGet, "/api/generation/"+response.ID, nil))
+	if !strings.Contains(status.Body.String(), `"metadata":{"title":{"value":"Hello","source":"user"}}`) {
+		t.Errorf("status = %s, want the merged metadata", status.Body.String())
+	}
+}